@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	stdLog "log"
+	"net/http"
+	"time"
+
+	"github.com/corestario/dwh/x/api"
+	dwh_common "github.com/corestario/dwh/x/common"
+	"github.com/gorilla/mux"
+	_ "github.com/lib/pq"
+)
+
+func main() {
+	cfg := dwh_common.ReadCommonConfig(dwh_common.DefaultConfigName, dwh_common.DefaultConfigPath)
+
+	db, err := dwh_common.GetDB(cfg)
+	if err != nil {
+		stdLog.Fatalf("failed to establish database connection: %v", err)
+	}
+	defer db.Close()
+
+	mongoClient, err := dwh_common.GetMongoClient(cfg)
+	if err != nil {
+		stdLog.Fatalf("failed to create MongoDB client: %v", err)
+	}
+	if err := mongoClient.Connect(context.Background()); err != nil {
+		stdLog.Fatalf("failed to connect to MongoDB: %v", err)
+	}
+	defer mongoClient.Disconnect(context.Background())
+	metadata := mongoClient.Database(cfg.MongoDatabase).Collection(cfg.MongoCollection)
+
+	router := mux.NewRouter()
+	api.NewAPI(db, metadata, cfg).Register(router)
+
+	srv := http.Server{
+		Handler:           router,
+		Addr:              cfg.APIAddr,
+		WriteTimeout:      15 * time.Second,
+		ReadTimeout:       15 * time.Second,
+		ReadHeaderTimeout: 5 * time.Second,
+		IdleTimeout:       30 * time.Second,
+	}
+	go func() {
+		stdLog.Println("listen and serve start")
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			stdLog.Fatalf("failed to serve API: %v", err)
+		}
+	}()
+
+	stdLog.Printf("stopping: %v", dwh_common.WaitInterrupted(context.Background()))
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		stdLog.Printf("failed to shut down API: %v", err)
+	}
+}
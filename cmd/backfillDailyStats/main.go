@@ -0,0 +1,125 @@
+// Command backfillDailyStats recomputes the marketplace_daily_stats table for the
+// whole indexed history: the sales statistics are taken from the sales table (or
+// replayed from the indexed messages for the days before it), and the rest is counted
+// from the indexed messages. Block times are queried from the node.
+// Every indexed chain is backfilled. The indexer should be stopped while the command
+// runs. It refuses to run if retention policies removed marketplace messages, since
+// the statistics of their heights would be lost.
+package main
+
+import (
+	"fmt"
+	stdLog "log"
+	"time"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/cosmos/modules/incubator/nft"
+	dwh_common "github.com/corestario/dwh/x/common"
+	"github.com/corestario/dwh/x/indexer/handlers"
+	"github.com/corestario/dwh/x/partitions"
+	mptypes "github.com/corestario/marketplace/x/marketplace/types"
+	"github.com/jinzhu/gorm"
+)
+
+func main() {
+	cfg := dwh_common.ReadCommonConfig(dwh_common.DefaultConfigName, dwh_common.DefaultConfigPath)
+
+	db, err := dwh_common.GetDB(cfg)
+	if err != nil {
+		stdLog.Fatalf("failed to establish database connection: %v", err)
+	}
+	defer db.Close()
+
+	removed, err := partitions.RemovedRanges(db, []string{mptypes.ModuleName, nft.ModuleName})
+	if err != nil {
+		stdLog.Fatalf("failed to check removed messages: %v", err)
+	}
+	if len(removed) > 0 {
+		stdLog.Fatalf("retention policies removed %s at heights %d-%d (and %d other ranges), their statistics can not be backfilled",
+			removed[0].Parent, removed[0].FromHeight, removed[0].ToHeight, len(removed)-1)
+	}
+
+	for _, chain := range cfg.IndexedChains() {
+		count, err := backfill(dwh_common.WithChainID(db, chain.ChainID), cfg.ForChain(chain))
+		if err != nil {
+			stdLog.Fatalf("failed to backfill daily stats of chain %s: %v", chain.ChainID, err)
+		}
+		stdLog.Printf("processed %d messages of chain %s", count, chain.ChainID)
+	}
+}
+
+// backfill recomputes the daily statistics of the chain that db is scoped to, and
+// returns the number of processed messages.
+func backfill(db *gorm.DB, cfg *dwh_common.DwhCommonServiceConfig) (int, error) {
+	cliCtx, _, err := handlers.GetEnv(cfg)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get env: %v", err)
+	}
+	node, err := cliCtx.GetNode()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get node: %v", err)
+	}
+
+	if err := handlers.ResetDailyStats(db); err != nil {
+		return 0, fmt.Errorf("failed to reset daily stats: %v", err)
+	}
+
+	rows, err := db.Raw(`
+		SELECT messages.signature, txes.height, txes.hash FROM messages
+		JOIN txes ON txes.id = messages.tx_id
+		WHERE messages.chain_id = ? AND NOT messages.failed AND messages.route IN (?) AND messages.deleted_at IS NULL
+		ORDER BY messages.id`,
+		dwh_common.ChainID(db), []string{mptypes.ModuleName, nft.ModuleName},
+	).Rows()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get messages: %v", err)
+	}
+	defer rows.Close()
+
+	var (
+		count         int
+		lastHeight    int64
+		lastBlockTime time.Time
+		sales         = handlers.NewSalesReplay()
+	)
+	for rows.Next() {
+		var (
+			signBytes []byte
+			info      handlers.MsgInfo
+			msg       sdk.Msg
+		)
+		if err := rows.Scan(&signBytes, &info.Height, &info.TxHash); err != nil {
+			return count, fmt.Errorf("failed to scan message: %v", err)
+		}
+		if err := cliCtx.Codec.UnmarshalJSON(signBytes, &msg); err != nil {
+			stdLog.Printf("failed to decode message of tx %s: %v", info.TxHash, err)
+			continue
+		}
+		// Messages are ordered by height, so each block is only queried once.
+		if info.Height != lastHeight {
+			block, err := node.Block(&info.Height)
+			if err != nil {
+				return count, fmt.Errorf("failed to get block %d: %v", info.Height, err)
+			}
+			lastHeight, lastBlockTime = info.Height, block.Block.Header.Time
+		}
+		info.BlockTime = lastBlockTime
+
+		if err := sales.Add(db, info, msg); err != nil {
+			stdLog.Printf("failed to replay sales for message of tx %s: %v", info.TxHash, err)
+		}
+		if err := handlers.BackfillDailyStats(db, info, msg); err != nil {
+			stdLog.Printf("failed to backfill daily stats for message of tx %s: %v", info.TxHash, err)
+			continue
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return count, fmt.Errorf("failed to get messages: %v", err)
+	}
+	if err := sales.Save(db); err != nil {
+		return count, fmt.Errorf("failed to save replayed sales: %v", err)
+	}
+
+	return count, nil
+}
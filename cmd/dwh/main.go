@@ -0,0 +1,163 @@
+// Command dwh manages the DWH database:
+//
+//	dwh migrate up               applies all pending migrations
+//	dwh migrate down [-steps N] [-component C]
+//	                             reverts the last N applied migrations (1 by default; -1
+//	                             means all of them), only the ones of component C if set
+//	dwh migrate status           lists migrations and whether they were applied
+//	dwh indexes                  reports the indexes that known queries need but are
+//	                             missing, and exits with status 1 if there are any
+//	dwh partitions               lists the partitions of txes and messages
+//	dwh retention [-dry-run]     applies the retention policies to old partitions
+package main
+
+import (
+	"flag"
+	"fmt"
+	stdLog "log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	dwh_common "github.com/corestario/dwh/x/common"
+	"github.com/corestario/dwh/x/indexer"
+	"github.com/corestario/dwh/x/indexer/handlers"
+	"github.com/corestario/dwh/x/migrations"
+	"github.com/corestario/dwh/x/partitions"
+)
+
+const usage = `usage:
+	dwh migrate up
+	dwh migrate down [-steps N] [-component C]
+	dwh migrate status
+	dwh indexes
+	dwh partitions
+	dwh retention [-dry-run]`
+
+func main() {
+	if len(os.Args) < 2 {
+		stdLog.Fatal(usage)
+	}
+	command := os.Args[1]
+	if command == "migrate" {
+		if len(os.Args) < 3 {
+			stdLog.Fatal(usage)
+		}
+		command += " " + os.Args[2]
+	}
+
+	cfg := dwh_common.ReadCommonConfig(dwh_common.DefaultConfigName, dwh_common.DefaultConfigPath)
+	db, err := dwh_common.GetDB(cfg)
+	if err != nil {
+		stdLog.Fatalf("failed to establish database connection: %v", err)
+	}
+	defer db.Close()
+
+	// The same sources, in the same order, as the ones of the indexer (see
+	// Indexer.Migrations). Existing rows are assigned to the first chain.
+	chainID := cfg.IndexedChains()[0].ChainID
+	migrator, err := migrations.NewMigrator(db,
+		indexer.Migrations(chainID),
+		handlers.MarketplaceMigrations(cfg.PostgresSchema(handlers.MarketplaceMigrationsComponent), chainID),
+	)
+	if err != nil {
+		stdLog.Fatalf("failed to create migrator: %v", err)
+	}
+
+	switch command {
+	case "migrate up":
+		count, err := migrator.Up()
+		if err != nil {
+			stdLog.Fatalf("failed to migrate up: %v", err)
+		}
+		stdLog.Printf("applied %d migrations", count)
+	case "migrate down":
+		flags := flag.NewFlagSet("down", flag.ExitOnError)
+		steps := flags.Int("steps", 1, "number of migrations to revert, -1 for all")
+		component := flags.String("component", "", "revert only the migrations of this component (e.g., marketplace)")
+		if err := flags.Parse(os.Args[3:]); err != nil {
+			stdLog.Fatal(err)
+		}
+		count, err := migrator.Down(*component, *steps)
+		if err != nil {
+			stdLog.Fatalf("failed to migrate down: %v", err)
+		}
+		stdLog.Printf("reverted %d migrations", count)
+	case "migrate status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			stdLog.Fatalf("failed to get migrations status: %v", err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "COMPONENT\tVERSION\tNAME\tAPPLIED AT")
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.AppliedAt != nil {
+				appliedAt = status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", status.Component, status.Version, status.Name, appliedAt)
+		}
+		w.Flush()
+	case "indexes":
+		missing, err := migrator.MissingIndexes()
+		if err != nil {
+			stdLog.Fatalf("failed to check indexes: %v", err)
+		}
+		if len(missing) == 0 {
+			stdLog.Println("no missing indexes")
+			return
+		}
+		// Indexes are reported with statements that do not block the indexer; partitioned
+		// tables can only be indexed with a lock.
+		for _, index := range missing {
+			partitioned, err := partitions.IsPartitioned(db, index.Schema+"."+index.Table)
+			if err != nil {
+				stdLog.Fatalf("failed to check indexes: %v", err)
+			}
+			statement := index.ConcurrentStatement(index.Schema)
+			if partitioned {
+				statement = index.Statement(index.Schema)
+			}
+			fmt.Printf("-- %s: no index on %s.%s (%s)\n%s;\n",
+				index.Component, index.Schema, index.Table, strings.Join(index.Columns, ", "), statement)
+		}
+		os.Exit(1)
+	case "partitions":
+		list, err := partitions.NewManager(db, cfg.PartitioningCfg, cfg.IndexedChains()).List()
+		if err != nil {
+			stdLog.Fatalf("failed to list partitions: %v", err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TABLE\tPARTITION\tFROM HEIGHT\tTO HEIGHT\tEND TIME")
+		for _, partition := range list {
+			endTime := "open"
+			if partition.EndTime != nil {
+				endTime = partition.EndTime.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\n",
+				partition.Parent, partition.Name, partition.FromHeight, partition.ToHeight, endTime)
+		}
+		w.Flush()
+	case "retention":
+		flags := flag.NewFlagSet("retention", flag.ExitOnError)
+		dryRun := flags.Bool("dry-run", false, "only report the rows that would be removed")
+		if err := flags.Parse(os.Args[2:]); err != nil {
+			stdLog.Fatal(err)
+		}
+		removals, err := partitions.NewManager(db, cfg.PartitioningCfg, cfg.IndexedChains()).Retain(time.Now(), *dryRun)
+		for _, removal := range removals {
+			what := fmt.Sprintf("%d rows of", removal.Rows)
+			if removal.Whole {
+				what = "partition"
+			}
+			stdLog.Printf("%s %s %s (%s, route %q, status %q, older than %d days)", removal.Policy.Action, what,
+				removal.Partition.Name, removal.Policy.Table, removal.Policy.Route, removal.Policy.Status, removal.Policy.MaxAgeDays)
+		}
+		if err != nil {
+			stdLog.Fatalf("failed to apply retention policies: %v", err)
+		}
+	default:
+		stdLog.Fatal(usage)
+	}
+}
@@ -20,6 +20,7 @@ func main() {
 	router.HandleFunc(dwh_common.StoreImagePath, st.StoreHandler).Methods(http.MethodPost)
 	router.HandleFunc(dwh_common.LoadImagePath, st.LoadHandler).Methods(http.MethodGet)
 	router.HandleFunc(dwh_common.GetCheckSumPath, st.GetCheckSumHandler).Methods(http.MethodPost)
+	router.HandleFunc(dwh_common.ListImagesPath, st.ListHandler).Methods(http.MethodGet)
 
 	srv := http.Server{
 		Handler:           router,
@@ -6,8 +6,12 @@ import (
 	_ "net/http/pprof"
 
 	common "github.com/corestario/dwh/x/common"
+	"github.com/corestario/dwh/x/accountService"
 	"github.com/corestario/dwh/x/indexer"
 	"github.com/corestario/dwh/x/indexer/handlers"
+	"github.com/corestario/dwh/x/outbox"
+	"github.com/corestario/dwh/x/partitions"
+	"github.com/corestario/dwh/x/sinks"
 	_ "github.com/lib/pq"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
@@ -37,20 +41,55 @@ func main() {
 		}
 	}()
 
-	cliCtx, txDecoder, err := handlers.GetEnv(idxrCfg)
-	if err != nil {
-		log.Fatalf("failed to get env: %v", err)
-	}
-
-	idxr, err := indexer.NewIndexer(ctx, idxrCfg, cliCtx, txDecoder, db,
-		indexer.WithHandler(handlers.NewMarketplaceHandler(cliCtx)),
+	// Every chain has its own node, account service, sinks and their relays, outbox relay
+	// and cursor; partitions are shared.
+	var (
+		parts       = partitions.NewManager(db, idxrCfg.PartitioningCfg, idxrCfg.IndexedChains())
+		accountSvcs []*accountService.AccountService
+		relays      []sinks.Relays
+		outboxes    []*outbox.Outbox
+		indexers    []*indexer.Indexer
 	)
-	if err != nil {
-		log.Fatalf("failed to create new indexer: %v", err)
+	for _, chain := range idxrCfg.IndexedChains() {
+		chainCfg := idxrCfg.ForChain(chain)
+		cliCtx, txDecoder, err := handlers.GetEnv(chainCfg)
+		if err != nil {
+			log.Fatalf("failed to get env of chain %s: %v", chain.ChainID, err)
+		}
+
+		accounts, err := accountService.NewAccountService(cliCtx, common.WithChainID(db, chain.ChainID), chainCfg)
+		if err != nil {
+			log.Fatalf("failed to create account service of chain %s: %v", chain.ChainID, err)
+		}
+
+		sink := sinks.New(chainCfg)
+		sinkRelays, err := sinks.NewRelays(common.WithChainID(db, chain.ChainID), chainCfg)
+		if err != nil {
+			log.Fatalf("failed to create sinks of chain %s: %v", chain.ChainID, err)
+		}
+
+		uris := outbox.NewOutbox(common.WithChainID(db, chain.ChainID), chainCfg, chainCfg.UriQueueName, chainCfg.UriQueueMaxPriority)
+
+		idxr, err := indexer.NewIndexer(ctx, chainCfg, cliCtx, txDecoder, db,
+			indexer.WithHandler(handlers.NewMarketplaceHandler(cliCtx, accounts, chain.ChainID, sink, uris)),
+			indexer.WithPartitions(parts),
+		)
+		if err != nil {
+			log.Fatalf("failed to create new indexer of chain %s: %v", chain.ChainID, err)
+		}
+		accountSvcs, relays, outboxes, indexers = append(accountSvcs, accounts), append(relays, sinkRelays),
+			append(outboxes, uris), append(indexers, idxr)
 	}
-	if err := idxr.Setup(idxrCfg.ResetDatabase); err != nil {
+	// The migrations are the same for all chains, existing rows are assigned to the
+	// first one.
+	if err := indexers[0].Setup(idxrCfg.ResetDatabase); err != nil {
 		log.Fatalf("failed to setup Indexer: %v", err)
 	}
+	for i := range indexers {
+		accountSvcs[i].Start()
+		relays[i].Start()
+		outboxes[i].Start()
+	}
 
 	if viper.GetBool(common.PrometheusEnabledFlag) {
 		go func() {
@@ -64,14 +103,24 @@ func main() {
 	wg, ctx := errgroup.WithContext(ctx)
 	wg.Go(func() error {
 		err := common.WaitInterrupted(ctx)
-		idxr.Stop()
+		for i := range indexers {
+			indexers[i].Stop()
+			// After the indexer, so the users of the last block are refreshed.
+			accountSvcs[i].Stop()
+			// After the indexer, so the events and messages of the last block are relayed.
+			relays[i].Stop()
+			outboxes[i].Stop()
+		}
 		return err
 	})
-	wg.Go(func() error {
-		log.Info("starting indexer")
-		defer log.Info("stopping indexer")
-		return idxr.Start()
-	})
+	for i, idxr := range indexers {
+		chainID, idxr := idxrCfg.IndexedChains()[i].ChainID, idxr
+		wg.Go(func() error {
+			log.Infof("starting indexer of chain %s", chainID)
+			defer log.Infof("stopping indexer of chain %s", chainID)
+			return idxr.Start()
+		})
+	}
 
 	if err := wg.Wait(); err != nil {
 		log.Fatalf("indexer stopped: %v", err)
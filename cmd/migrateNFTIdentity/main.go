@@ -0,0 +1,54 @@
+// Command migrateNFTIdentity moves the data that was stored before NFTs were
+// identified by (denom, token ID): it sets the denom of token metadata documents in
+// MongoDB and renames stored images. Postgres tables are migrated by the indexer on
+// start. It must be run on the image storage host after the indexer has been migrated.
+package main
+
+import (
+	"context"
+	stdLog "log"
+
+	dwh_common "github.com/corestario/dwh/x/common"
+	"github.com/corestario/dwh/x/imgstorage"
+	"github.com/corestario/dwh/x/tokenMetadataService"
+)
+
+func main() {
+	cfg := dwh_common.ReadCommonConfig(dwh_common.DefaultConfigName, dwh_common.DefaultConfigPath)
+	ctx := context.Background()
+
+	db, err := dwh_common.GetDB(cfg)
+	if err != nil {
+		stdLog.Fatalf("failed to establish database connection: %v", err)
+	}
+	defer db.Close()
+
+	mongoClient, err := dwh_common.GetMongoClient(cfg)
+	if err != nil {
+		stdLog.Fatalf("failed to create mongo client: %v", err)
+	}
+	if err := mongoClient.Connect(ctx); err != nil {
+		stdLog.Fatalf("failed to connect to mongo: %v", err)
+	}
+	defer mongoClient.Disconnect(ctx)
+	collection := mongoClient.Database(cfg.MongoDatabase).Collection(cfg.MongoCollection)
+
+	st := imgstorage.NewImgStorage(cfg)
+
+	var tokens []dwh_common.NFT
+	if err := db.Find(&tokens).Error; err != nil {
+		stdLog.Fatalf("failed to get nfts: %v", err)
+	}
+	for _, token := range tokens {
+		if err := tokenMetadataService.MigrateDenom(ctx, collection, token.Denom, token.TokenID); err != nil {
+			stdLog.Printf("failed to migrate metadata of nft %s/%s: %v", token.Denom, token.TokenID, err)
+		}
+		// Images are stored under the owner they were published for, so images of tokens
+		// that changed owners since then are not found here; they are rebuilt by the next
+		// metadata refresh.
+		if err := st.MigrateKeys(token.OwnerAddress, token.Denom, token.TokenID); err != nil {
+			stdLog.Printf("failed to migrate images of nft %s/%s: %v", token.Denom, token.TokenID, err)
+		}
+	}
+	stdLog.Printf("migrated %d nfts", len(tokens))
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	stdLog "log"
+	"net/http"
+	"time"
+
+	dwh_common "github.com/corestario/dwh/x/common"
+	"github.com/corestario/dwh/x/webhooks"
+	"github.com/gorilla/mux"
+	_ "github.com/lib/pq"
+)
+
+func main() {
+	cfg := dwh_common.ReadCommonConfig(dwh_common.DefaultConfigName, dwh_common.DefaultConfigPath)
+
+	db, err := dwh_common.GetDB(cfg)
+	if err != nil {
+		stdLog.Fatalf("failed to establish database connection: %v", err)
+	}
+	defer db.Close()
+
+	dispatcher := webhooks.NewDispatcher(db, cfg.WebhooksCfg)
+	dispatcher.Start()
+
+	router := mux.NewRouter()
+	webhooks.NewAPI(db, cfg.WebhooksCfg).Register(router)
+
+	srv := http.Server{
+		Handler:           router,
+		Addr:              cfg.WebhooksAPIAddr,
+		WriteTimeout:      15 * time.Second,
+		ReadTimeout:       15 * time.Second,
+		ReadHeaderTimeout: 5 * time.Second,
+		IdleTimeout:       30 * time.Second,
+	}
+	go func() {
+		stdLog.Println("listen and serve start")
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			stdLog.Fatalf("failed to serve webhooks API: %v", err)
+		}
+	}()
+
+	stdLog.Printf("stopping: %v", dwh_common.WaitInterrupted(context.Background()))
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		stdLog.Printf("failed to shut down webhooks API: %v", err)
+	}
+	dispatcher.Stop()
+}
@@ -10,6 +10,8 @@ docker_metadata_worker_name=dwh_tmd_worker
 docker_img_storage_name=dwh_img_storage
 docker_mongo_daemon_name=dwh_mongo_daemon
 docker_indexer_name=dwh_indexer
+docker_webhooks_name=dwh_webhooks
+docker_api_name=dwh_api
 
 if [ $# -ne 1 ]; then
     echo "Illegal number of parameters: $#"
@@ -31,7 +33,7 @@ while test $# -gt 0; do
       echo "start                       start all stopped containers without recreation"
       echo "stop                        stop all running containers without data loss"
       echo "rebuild                     rebuild dwh images:
-                            imgstorage, imgworker, indexer, mongoDaemon, tokenMetadataWorker"
+                            imgstorage, imgworker, indexer, mongoDaemon, tokenMetadataWorker, webhooks, api"
       echo "rebuild-mp                  rebuild marketplace image"
       echo "rebuild-all                 rebuild all docker images, including marketplace
                             IMPORTANT: marketplace src MUST be in ./../marketplace"
@@ -95,6 +97,8 @@ while test $# -gt 0; do
       docker build -t $docker_metadata_worker_name --build-arg APPNAME=tokenMetadataWorker .
       docker build -t $docker_img_worker_name --build-arg	APPNAME=imgworker .
       docker build -t $docker_mongo_daemon_name --build-arg APPNAME=mongoDaemon .
+      docker build -t $docker_webhooks_name --build-arg APPNAME=webhooks .
+      docker build -t $docker_api_name --build-arg APPNAME=api .
 
       rm -rf $cur_path/vendor
       exit 0
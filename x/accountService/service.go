@@ -0,0 +1,300 @@
+package accountService
+
+import (
+	"context"
+	"fmt"
+	stdLog "log"
+	"sync"
+	"time"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/cosmos/cosmos-sdk/x/auth/exported"
+	authtypes "github.com/cosmos/cosmos-sdk/x/auth/types"
+	cliContext "github.com/corestario/cosmos-utils/client/context"
+	dwh_common "github.com/corestario/dwh/x/common"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/jinzhu/gorm"
+	cmn "github.com/tendermint/tendermint/libs/common"
+	rpcclient "github.com/tendermint/tendermint/rpc/client"
+	ctypes "github.com/tendermint/tendermint/rpc/core/types"
+)
+
+// maxRefreshAttempts is the number of refreshes a user is retried for while it is not
+// found (see requeue).
+const maxRefreshAttempts = 5
+
+// AccountService provides account data to the indexer without making it wait for node
+// queries: accounts are queried at a given height and cached, and the account data of
+// users (balance, account and sequence numbers) is refreshed in the background in
+// batches.
+type AccountService struct {
+	mu       sync.Mutex
+	cfg      *dwh_common.DwhCommonServiceConfig
+	db       *gorm.DB
+	node     abciQuerier
+	accounts *lru.Cache             // address -> cachedAccount
+	pending  map[string]pendingUser // Users to refresh by address.
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// abciQuerier is the part of the node client that accounts are queried with.
+type abciQuerier interface {
+	ABCIQueryWithOptions(path string, data cmn.HexBytes, opts rpcclient.ABCIQueryOptions) (*ctypes.ResultABCIQuery, error)
+}
+
+// cachedAccount is the latest known state of an account.
+type cachedAccount struct {
+	account exported.Account
+	height  int64 // Height the account was queried at.
+}
+
+func NewAccountService(cliCtx *cliContext.Context, db *gorm.DB, cfg *dwh_common.DwhCommonServiceConfig) (*AccountService, error) {
+	node, err := cliCtx.GetNode()
+	if err != nil {
+		return nil, fmt.Errorf("could not get node, error: %+v", err)
+	}
+	accounts, err := lru.New(cfg.AccountCacheSize)
+	if err != nil {
+		return nil, fmt.Errorf("could not create account cache, error: %+v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &AccountService{
+		cfg:      cfg,
+		db:       db,
+		node:     node,
+		accounts: accounts,
+		pending:  map[string]pendingUser{},
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// getAccount returns the account with the given address at the given height (0 means
+// the latest height), and the height it was queried at. Users are never updated with
+// older account data, so the cached account is returned if it was queried at the
+// given height or later.
+func (s *AccountService) getAccount(addr sdk.AccAddress, height int64) (exported.Account, int64, error) {
+	if height != 0 {
+		if cached, ok := s.accounts.Get(addr.String()); ok && cached.(cachedAccount).height >= height {
+			return cached.(cachedAccount).account, cached.(cachedAccount).height, nil
+		}
+	}
+	acc, queryHeight, err := authtypes.NewAccountRetriever(heightQuerier{s.node, height}).GetAccountWithHeight(addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	if cached, ok := s.accounts.Get(addr.String()); !ok || cached.(cachedAccount).height < queryHeight {
+		s.accounts.Add(addr.String(), cachedAccount{acc, queryHeight})
+	}
+
+	return acc, queryHeight, nil
+}
+
+// FindOrCreateUser returns the user with the given address, creating it if needed,
+// and schedules a refresh of its account data at the given height. It does not query
+// the node. The refresh may run before the transaction of db is committed; users that
+// are not found then are refreshed again later (see requeue).
+func (s *AccountService) FindOrCreateUser(db *gorm.DB, addr sdk.AccAddress, height int64) (*dwh_common.User, error) {
+	db = db.New()
+	user := &dwh_common.User{}
+	err := db.Where("address = ?", addr.String()).First(user).Error
+	if gorm.IsRecordNotFoundError(err) {
+		user = dwh_common.NewUser("", addr, nil, 0, 0, nil)
+		err = db.Create(user).Error
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find or create user %s: %v", addr, err)
+	}
+
+	s.mu.Lock()
+	if queued, ok := s.pending[user.Address]; !ok || height > queued.height {
+		s.pending[user.Address] = pendingUser{address: user.Address, height: height}
+	}
+	s.mu.Unlock()
+
+	return user, nil
+}
+
+// Start runs the refresher until Stop is called.
+func (s *AccountService) Start() {
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(time.Duration(s.cfg.AccountRefreshIntervalSeconds) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.ctx.Done():
+				s.refresh()
+				return
+			case <-ticker.C:
+				s.refresh()
+			}
+		}
+	}()
+}
+
+// Stop stops the refresher after refreshing the remaining users.
+func (s *AccountService) Stop() {
+	s.cancel()
+	<-s.done
+}
+
+// pendingUser is a user whose account data is to be refreshed at the given height.
+type pendingUser struct {
+	address  string
+	height   int64
+	attempts int // Refreshes that did not find the user.
+}
+
+// refresh updates the account data of the users that were touched since the last
+// refresh, in batches.
+func (s *AccountService) refresh() {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = map[string]pendingUser{}
+	s.mu.Unlock()
+
+	var batch []pendingUser
+	for _, user := range pending {
+		batch = append(batch, user)
+		if len(batch) == s.cfg.AccountRefreshBatchSize {
+			s.refreshBatch(batch)
+			batch = nil
+		}
+	}
+	if len(batch) > 0 {
+		s.refreshBatch(batch)
+	}
+}
+
+// refreshBatch queries the accounts of the users of the batch, then stores them, each
+// user in a transaction of its own.
+func (s *AccountService) refreshBatch(batch []pendingUser) {
+	accounts := make([]exported.Account, len(batch))
+	heights := make([]int64, len(batch))
+	for i, user := range batch {
+		addr, err := sdk.AccAddressFromBech32(user.address)
+		if err != nil {
+			stdLog.Printf("could not parse address %s, error: %+v", user.address, err)
+			continue
+		}
+		acc, height, err := s.getAccount(addr, user.height)
+		if err != nil && user.height != 0 {
+			// The node might not keep the state at this height anymore.
+			acc, height, err = s.getAccount(addr, 0)
+		}
+		if err != nil {
+			stdLog.Printf("could not get account %s, error: %+v", user.address, err)
+			continue
+		}
+		accounts[i], heights[i] = acc, height
+	}
+
+	for i, user := range batch {
+		if accounts[i] == nil {
+			continue
+		}
+		found, err := s.updateUser(user.address, accounts[i], heights[i])
+		if err != nil {
+			stdLog.Printf("could not update user %s, error: %+v", user.address, err)
+			continue
+		}
+		if !found {
+			s.requeue(user)
+		}
+	}
+}
+
+// updateUser stores the account data that was queried at the given height, unless the
+// user already has newer data, and reports whether the user was found.
+func (s *AccountService) updateUser(address string, acc exported.Account, height int64) (bool, error) {
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return false, fmt.Errorf("could not begin transaction: %v", tx.Error)
+	}
+	// Do not overwrite account data with older data.
+	updated := tx.Model(&dwh_common.User{}).
+		Where("address = ? AND (account_height IS NULL OR account_height <= ?)", address, height).
+		UpdateColumns(map[string]interface{}{
+			"balance":         acc.GetCoins().String(),
+			"account_number":  acc.GetAccountNumber(),
+			"sequence_number": acc.GetSequence(),
+			"account_height":  height,
+		})
+	if updated.Error != nil {
+		tx.Rollback()
+		return false, updated.Error
+	}
+	if updated.RowsAffected == 0 {
+		tx.Rollback()
+		// Either the user has newer data, or it is not committed (yet).
+		var count int
+		if err := s.db.New().Model(&dwh_common.User{}).Where("address = ?", address).Count(&count).Error; err != nil {
+			return false, err
+		}
+		return count > 0, nil
+	}
+	if err := s.recordUserVersion(tx, address); err != nil {
+		tx.Rollback()
+		return false, fmt.Errorf("could not record version: %v", err)
+	}
+
+	return true, tx.Commit().Error
+}
+
+// requeue schedules another refresh of a user that was not found, since the
+// transaction that created it may not have been committed yet. A user that is still
+// not found after maxRefreshAttempts refreshes was rolled back, and is dropped; it is
+// scheduled again if its message is indexed again.
+func (s *AccountService) requeue(user pendingUser) {
+	user.attempts++
+	if user.attempts >= maxRefreshAttempts {
+		stdLog.Printf("could not find user %s, giving up on its account data", user.address)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if queued, ok := s.pending[user.address]; !ok || queued.height < user.height {
+		s.pending[user.address] = user
+	}
+}
+
+// recordUserVersion closes the current version of the user's account data and adds
+// a new one, valid from the height the account data was queried at.
+func (s *AccountService) recordUserVersion(tx *gorm.DB, address string) error {
+	var user dwh_common.User
+	if err := tx.New().Where("address = ?", address).First(&user).Error; err != nil {
+		return err
+	}
+	current := tx.New().Model(&dwh_common.UserVersion{}).Where("address = ? AND valid_to_height IS NULL", address)
+	if err := current.Where("valid_from_height >= ?", user.AccountHeight).Delete(&dwh_common.UserVersion{}).Error; err != nil {
+		return err
+	}
+	if err := current.UpdateColumn("valid_to_height", user.AccountHeight).Error; err != nil {
+		return err
+	}
+
+	return tx.New().Create(dwh_common.NewUserVersion(&user)).Error
+}
+
+// heightQuerier queries the node at the given height (0 means the latest height).
+type heightQuerier struct {
+	node   abciQuerier
+	height int64
+}
+
+func (q heightQuerier) QueryWithData(path string, data []byte) ([]byte, int64, error) {
+	result, err := q.node.ABCIQueryWithOptions(path, data, rpcclient.ABCIQueryOptions{Height: q.height})
+	if err != nil {
+		return nil, 0, err
+	}
+	if !result.Response.IsOK() {
+		return nil, 0, fmt.Errorf("query %s failed: %s", path, result.Response.Log)
+	}
+
+	return result.Response.Value, result.Response.Height, nil
+}
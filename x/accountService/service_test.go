@@ -0,0 +1,155 @@
+package accountService
+
+import (
+	"testing"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	authtypes "github.com/cosmos/cosmos-sdk/x/auth/types"
+	dwh_common "github.com/corestario/dwh/x/common"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/stretchr/testify/require"
+	abci "github.com/tendermint/tendermint/abci/types"
+	"github.com/tendermint/tendermint/crypto/ed25519"
+	cmn "github.com/tendermint/tendermint/libs/common"
+	rpcclient "github.com/tendermint/tendermint/rpc/client"
+	ctypes "github.com/tendermint/tendermint/rpc/core/types"
+)
+
+// fakeNode answers account queries with the given coins, at the queried height, or at
+// latest if the latest height is queried.
+type fakeNode struct {
+	t       *testing.T
+	addr    sdk.AccAddress
+	latest  int64
+	queries []int64 // Queried heights.
+}
+
+func (n *fakeNode) ABCIQueryWithOptions(path string, data cmn.HexBytes, opts rpcclient.ABCIQueryOptions) (*ctypes.ResultABCIQuery, error) {
+	n.queries = append(n.queries, opts.Height)
+	height := opts.Height
+	if height == 0 {
+		height = n.latest
+	}
+	acc := authtypes.NewBaseAccountWithAddress(n.addr)
+	require.NoError(n.t, acc.SetCoins(sdk.NewCoins(sdk.NewInt64Coin("token", height))))
+	value, err := authtypes.ModuleCdc.MarshalJSON(&acc)
+	require.NoError(n.t, err)
+
+	return &ctypes.ResultABCIQuery{Response: abci.ResponseQuery{Value: value, Height: height}}, nil
+}
+
+func newTestService(t *testing.T, node abciQuerier, cacheSize int) *AccountService {
+	accounts, err := lru.New(cacheSize)
+	require.NoError(t, err)
+
+	return &AccountService{node: node, accounts: accounts, pending: map[string]pendingUser{}}
+}
+
+func testAddress() sdk.AccAddress {
+	return sdk.AccAddress(ed25519.GenPrivKey().PubKey().Address())
+}
+
+func TestGetAccountCache(t *testing.T) {
+	addr, other := testAddress(), testAddress()
+	node := &fakeNode{t: t, addr: addr, latest: 20}
+	s := newTestService(t, node, 1)
+
+	acc, height, err := s.getAccount(addr, 10)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), height)
+	require.Equal(t, "10token", acc.GetCoins().String())
+
+	// Accounts queried at the given height or later are cached.
+	for _, h := range []int64{5, 10} {
+		_, height, err = s.getAccount(addr, h)
+		require.NoError(t, err)
+		require.Equal(t, int64(10), height)
+	}
+	require.Equal(t, []int64{10}, node.queries)
+
+	// Later heights are queried, and replace the cached account.
+	_, height, err = s.getAccount(addr, 15)
+	require.NoError(t, err)
+	require.Equal(t, int64(15), height)
+	_, height, err = s.getAccount(addr, 12)
+	require.NoError(t, err)
+	require.Equal(t, int64(15), height)
+	require.Equal(t, []int64{10, 15}, node.queries)
+
+	// The latest height is always queried.
+	_, height, err = s.getAccount(addr, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(20), height)
+	require.Equal(t, []int64{10, 15, 0}, node.queries)
+
+	// The least recently used account is evicted.
+	_, _, err = s.getAccount(other, 10)
+	require.NoError(t, err)
+	_, _, err = s.getAccount(addr, 20)
+	require.NoError(t, err)
+	require.Equal(t, []int64{10, 15, 0, 10, 20}, node.queries)
+}
+
+func TestUpdateUser(t *testing.T) {
+	cfg := dwh_common.DefaultDwhCommonServiceConfig()
+	db, err := dwh_common.GetDB(cfg)
+	if err != nil {
+		t.Errorf("failed to establish database connection: %v", err)
+		return
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("failed to close database connection: %v", err)
+		}
+	}()
+	require.NoError(t, db.AutoMigrate(&dwh_common.User{}, &dwh_common.UserVersion{}).Error)
+
+	addr, missing := testAddress(), testAddress()
+	clean := func() {
+		addresses := []string{addr.String(), missing.String()}
+		require.NoError(t, db.Unscoped().Where("address IN (?)", addresses).Delete(&dwh_common.User{}).Error)
+		require.NoError(t, db.Where("address IN (?)", addresses).Delete(&dwh_common.UserVersion{}).Error)
+	}
+	clean()
+	defer clean()
+
+	node := &fakeNode{t: t, addr: addr, latest: 20}
+	s := newTestService(t, node, 10)
+	s.cfg, s.db = cfg, db
+	_, err = s.FindOrCreateUser(db, addr, 10)
+	require.NoError(t, err)
+	_, err = s.FindOrCreateUser(db, addr, 5)
+	require.NoError(t, err)
+	require.Equal(t, pendingUser{address: addr.String(), height: 10}, s.pending[addr.String()])
+
+	user := func() *dwh_common.User {
+		var user dwh_common.User
+		require.NoError(t, db.Where("address = ?", addr.String()).First(&user).Error)
+		return &user
+	}
+	s.refresh()
+	require.Equal(t, int64(10), user().AccountHeight)
+	require.Equal(t, "10token", user().Balance)
+	require.Empty(t, s.pending)
+
+	// Older account data does not overwrite newer data.
+	acc, _, err := s.getAccount(addr, 0)
+	require.NoError(t, err)
+	found, err := s.updateUser(addr.String(), acc, 5)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, int64(10), user().AccountHeight)
+	require.Equal(t, "10token", user().Balance)
+	var versions int
+	require.NoError(t, db.Model(&dwh_common.UserVersion{}).Where("address = ?", addr.String()).Count(&versions).Error)
+	require.Equal(t, 1, versions)
+
+	// Users that are not found are refreshed again, up to maxRefreshAttempts times.
+	s.pending[missing.String()] = pendingUser{address: missing.String(), height: 10}
+	for attempts := 1; attempts < maxRefreshAttempts; attempts++ {
+		s.refresh()
+		require.Equal(t, pendingUser{address: missing.String(), height: 10, attempts: attempts}, s.pending[missing.String()])
+	}
+	s.refresh()
+	require.Empty(t, s.pending)
+}
@@ -0,0 +1,138 @@
+// Package api is a REST API that reads the tables of the indexer, so that simple
+// clients do not need Hasura and GraphQL: NFTs by owner, denom or status, token details
+// with offers and bids, user profiles, sales, collection statistics and search over token
+// metadata. Lists are sorted by a field of the rows and paginated with cursors; the API
+// is described by an OpenAPI spec served at SpecPath.
+//
+// Token details also include the metadata of the token, from the MongoDB collection of
+// the token metadata service, and the URLs of its images in the image storage.
+// Successful responses may be cached for the configured max age, errors are not cached,
+// and image URLs that include the checksum of the image are cached for good (see
+// common.ImmutableImageCacheControl).
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	common "github.com/corestario/dwh/x/common"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/prometheus/common/log"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Paths of the API.
+const (
+	SpecPath        = "/api/v1/openapi.json"
+	NFTsPath        = "/api/v1/nfts"
+	NFTPath         = "/api/v1/nfts/{denom}/{token_id}"
+	UserPath        = "/api/v1/users/{address}"
+	SalesPath       = "/api/v1/sales"
+	CollectionsPath = "/api/v1/collections"
+	CollectionPath  = "/api/v1/collections/{denom}"
+	SearchPath      = "/api/v1/search"
+)
+
+// API serves the read API. Every request can be limited to a chain with the
+// "chain_id" parameter; otherwise it sees the rows of all chains.
+type API struct {
+	db         *gorm.DB
+	metadata   *mongo.Collection // Token metadata documents.
+	cfg        common.APICfg
+	storageURL string // URL the image storage is reached at.
+	imagesURL  string // Public URL of the image storage.
+	client     *http.Client
+}
+
+func NewAPI(db *gorm.DB, metadata *mongo.Collection, cfg *common.DwhCommonServiceConfig) *API {
+	storageURL := fmt.Sprintf("%s:%d", cfg.StorageAddr, cfg.StoragePort)
+	imagesURL := cfg.APIImagesURL
+	if imagesURL == "" {
+		imagesURL = storageURL
+	}
+
+	return &API{
+		db:         db,
+		metadata:   metadata,
+		cfg:        cfg.APICfg,
+		storageURL: storageURL,
+		imagesURL:  imagesURL,
+		client:     &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Register adds the routes of the API to the router.
+func (a *API) Register(router *mux.Router) {
+	routes := router.NewRoute().Subrouter()
+	routes.Use(a.cacheControl)
+	routes.HandleFunc(SpecPath, serveSpec).Methods(http.MethodGet)
+	routes.HandleFunc(NFTsPath, a.listNFTs).Methods(http.MethodGet)
+	routes.HandleFunc(NFTPath, a.getNFT).Methods(http.MethodGet)
+	routes.HandleFunc(UserPath, a.getUser).Methods(http.MethodGet)
+	routes.HandleFunc(SalesPath, a.listSales).Methods(http.MethodGet)
+	routes.HandleFunc(CollectionsPath, a.listCollections).Methods(http.MethodGet)
+	routes.HandleFunc(CollectionPath, a.getCollection).Methods(http.MethodGet)
+	routes.HandleFunc(SearchPath, a.search).Methods(http.MethodGet)
+}
+
+// cacheControl lets responses be cached for the configured max age. Handlers override
+// it for responses that must not be cached (see writeError).
+func (a *API) cacheControl(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", a.cfg.APICacheMaxAgeSeconds))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// query returns a handle of the database for the request, scoped to its chain if any.
+func (a *API) query(r *http.Request) *gorm.DB {
+	return common.WithChainID(a.db.New(), r.FormValue("chain_id"))
+}
+
+// errAmbiguous is returned by first if rows of several chains match the request.
+var errAmbiguous = errors.New("several chains have a match, chain_id is required")
+
+// first gets the row that matches the query into out, like gorm's First. Denoms, token
+// IDs and addresses are only unique within a chain, so if the request is not scoped to
+// a chain and rows of several chains match, it returns errAmbiguous rather than an
+// arbitrary one of them.
+func (a *API) first(r *http.Request, out interface{}, query string, args ...interface{}) error {
+	db := a.query(r).Where(query, args...)
+	if r.FormValue("chain_id") == "" {
+		var count int
+		if err := db.Model(out).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 1 {
+			return errAmbiguous
+		}
+	}
+
+	return db.First(out).Error
+}
+
+// parseTime parses the time parameter, which is RFC 3339 or a date (e.g., 2020-05-01).
+func parseTime(value string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Errorf("failed to write response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, map[string]string{"error": msg})
+}
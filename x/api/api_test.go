@@ -0,0 +1,187 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	common "github.com/corestario/dwh/x/common"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSpec(t *testing.T) {
+	var doc struct {
+		Paths map[string]map[string]struct {
+			Parameters []struct {
+				Name   string `json:"name"`
+				Schema struct {
+					Enum []string `json:"enum"`
+				} `json:"schema"`
+			} `json:"parameters"`
+		} `json:"paths"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(spec), &doc))
+
+	// Every route is documented.
+	router := mux.NewRouter()
+	NewAPI(nil, nil, common.DefaultDwhCommonServiceConfig()).Register(router)
+	var paths []string
+	require.NoError(t, router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		// Subrouters have no path.
+		if path, err := route.GetPathTemplate(); err == nil {
+			paths = append(paths, path)
+		}
+		return nil
+	}))
+	var documented []string
+	for path := range doc.Paths {
+		documented = append(documented, path)
+	}
+	sort.Strings(paths)
+	sort.Strings(documented)
+	require.Equal(t, paths, documented)
+
+	// Sort fields are documented.
+	for path, sorts := range map[string]map[string]sortField{
+		NFTsPath:        nftSorts,
+		SalesPath:       saleSorts,
+		CollectionsPath: collectionSorts,
+	} {
+		var want []string
+		for name := range sorts {
+			want = append(want, name, "-"+name)
+		}
+		var got []string
+		for _, param := range doc.Paths[path]["get"].Parameters {
+			if param.Name == "sort" {
+				got = param.Schema.Enum
+			}
+		}
+		require.ElementsMatch(t, want, got, path)
+	}
+}
+
+func TestParsePage(t *testing.T) {
+	a := NewAPI(nil, nil, common.DefaultDwhCommonServiceConfig())
+
+	p, err := a.parsePage(httptest.NewRequest("GET", "/api/v1/sales", nil), saleSorts, "-time")
+	require.NoError(t, err)
+	require.Equal(t, "time", p.name)
+	require.True(t, p.desc)
+	require.Equal(t, 50, p.limit)
+	require.Nil(t, p.after)
+
+	next := cursor{Sort: "-time", Value: "2020-05-01T12:30:00Z", ID: 42}.encode()
+	p, err = a.parsePage(httptest.NewRequest("GET", "/api/v1/sales?limit=10&cursor="+next, nil), saleSorts, "-time")
+	require.NoError(t, err)
+	require.Equal(t, 10, p.limit)
+	require.Equal(t, &cursor{Sort: "-time", Value: "2020-05-01T12:30:00Z", ID: 42}, p.after)
+
+	for _, query := range []string{
+		"sort=price",
+		"limit=0",
+		"limit=501",
+		"cursor=invalid",
+		// The cursor of another order.
+		"sort=height&cursor=" + next,
+	} {
+		_, err := a.parsePage(httptest.NewRequest("GET", "/api/v1/sales?"+query, nil), saleSorts, "-time")
+		require.Error(t, err, query)
+	}
+}
+
+func TestDecodeMetadata(t *testing.T) {
+	updated := time.Date(2020, 5, 1, 12, 30, 0, 0, time.UTC)
+	raw, err := bson.Marshal(bson.D{
+		{Key: "_id", Value: primitive.NewObjectID()},
+		{Key: "name", Value: "Card"},
+		{Key: "attributes", Value: bson.A{bson.D{{Key: "trait_type", Value: "color"}, {Key: "value", Value: 1.5}}}},
+		{Key: "dwhData", Value: bson.D{{Key: "denom", Value: "cards"}, {Key: "lastUpdated", Value: updated}, {Key: "lastChecked", Value: updated}}},
+	})
+	require.NoError(t, err)
+
+	metadata, info, err := decodeMetadata(raw)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"name": "Card", "attributes": [{"trait_type": "color", "value": 1.5}]}`, string(metadata))
+	require.True(t, updated.Equal(info.DwhData.LastUpdated))
+}
+
+func TestAddImages(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, common.ListImagesPath, r.URL.Path)
+		require.Equal(t, "owner1", r.FormValue("owner"))
+		require.Equal(t, "1", r.FormValue("token_id"))
+		json.NewEncoder(w).Encode(common.ImageListResponse{Images: []common.StoredImage{
+			{MD5Sum: "abc"},
+			{Width: 200, Height: 150, MD5Sum: "def"},
+		}})
+	}))
+	defer server.Close()
+
+	cfg := common.DefaultDwhCommonServiceConfig()
+	a := NewAPI(nil, nil, cfg)
+	a.storageURL, a.imagesURL = server.URL, "https://img.example"
+	detail := &nftDetailView{nftView: nftView{Denom: "cards", TokenID: "1", Owner: "owner1"}}
+	require.NoError(t, a.addImages(detail))
+	require.Equal(t, []imageView{
+		{URL: "https://img.example/imgstore/load_img?denom=cards&height=0&img_type=1&owner=owner1&v=abc&width=0"},
+		{Width: 200, Height: 150, URL: "https://img.example/imgstore/load_img?denom=cards&height=150&img_type=1&owner=owner1&v=def&width=200"},
+	}, detail.Images)
+}
+
+func TestCacheControl(t *testing.T) {
+	router := mux.NewRouter()
+	NewAPI(nil, nil, common.DefaultDwhCommonServiceConfig()).Register(router)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", SpecPath, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "public, max-age=10", w.Header().Get("Cache-Control"))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", NFTsPath+"?sort=price", nil))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+}
+
+func TestSearchPipeline(t *testing.T) {
+	a := NewAPI(nil, nil, common.DefaultDwhCommonServiceConfig())
+	req, err := a.parseSearch(httptest.NewRequest("GET", "/api/v1/search?q=red+dragon&denom=cards&trait=color:red&trait=level:5&offset=20", nil))
+	require.NoError(t, err)
+	require.Equal(t, &searchRequest{
+		Text:   "red dragon",
+		Denom:  "cards",
+		Traits: []trait{{"color", "red"}, {"level", "5"}},
+		Offset: 20,
+		Limit:  50,
+	}, req)
+
+	pipeline := req.pipeline()
+	require.Equal(t, 3, len(pipeline))
+	require.Equal(t, bson.D{
+		{Key: "$text", Value: bson.M{"$search": "red dragon"}},
+		{Key: "dwhData.denom", Value: "cards"},
+		{Key: "attributes", Value: bson.M{"$all": bson.A{
+			bson.M{"$elemMatch": bson.M{"trait_type": "color", "value": bson.M{"$in": bson.A{"red"}}}},
+			bson.M{"$elemMatch": bson.M{"trait_type": "level", "value": bson.M{"$in": bson.A{"5", 5.0}}}},
+		}}},
+	}, pipeline[0][0].Value)
+	require.Equal(t, "$addFields", pipeline[1][0].Key)
+	require.Equal(t, "$facet", pipeline[2][0].Key)
+
+	// Without a text, the pipeline can not use the text score.
+	req, err = a.parseSearch(httptest.NewRequest("GET", "/api/v1/search?denom=cards", nil))
+	require.NoError(t, err)
+	require.Equal(t, 2, len(req.pipeline()))
+
+	for _, query := range []string{"trait=color", "trait=:red", "offset=-1", "offset=10001", "limit=0"} {
+		_, err := a.parseSearch(httptest.NewRequest("GET", "/api/v1/search?"+query, nil))
+		require.Error(t, err, query)
+	}
+}
@@ -0,0 +1,180 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	common "github.com/corestario/dwh/x/common"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/prometheus/common/log"
+)
+
+// maxDays is the max number of days of daily statistics returned by getCollection.
+const maxDays = 365
+
+// collectionSorts are the fields that collections can be sorted by; price statistics
+// are coins, which can not be sorted.
+var collectionSorts = map[string]sortField{
+	"denom": {"collections.denom", func(row interface{}) string {
+		return row.(*common.Collection).Denom
+	}},
+	"first_mint_height": {"collections.first_mint_height", func(row interface{}) string {
+		return strconv.FormatInt(row.(*common.Collection).FirstMintHeight, 10)
+	}},
+	"total_minted": {"collections.total_minted", func(row interface{}) string {
+		return strconv.FormatInt(row.(*common.Collection).TotalMinted, 10)
+	}},
+	"unique_holders": {"collections.unique_holders", func(row interface{}) string {
+		return strconv.FormatInt(row.(*common.Collection).UniqueHolders, 10)
+	}},
+	"on_market": {"collections.on_market", func(row interface{}) string {
+		return strconv.FormatInt(row.(*common.Collection).OnMarket, 10)
+	}},
+	"on_auction": {"collections.on_auction", func(row interface{}) string {
+		return strconv.FormatInt(row.(*common.Collection).OnAuction, 10)
+	}},
+}
+
+// listCollections returns the statistics of collections, optionally of a "creator".
+func (a *API) listCollections(w http.ResponseWriter, r *http.Request) {
+	p, err := a.parsePage(r, collectionSorts, "-total_minted")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	query := a.query(r)
+	if creator := r.FormValue("creator"); creator != "" {
+		query = query.Where("collections.creator = ?", creator)
+	}
+
+	var collections []common.Collection
+	out, err := p.find(query, &collections)
+	if err != nil {
+		log.Errorf("failed to get collections: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to get collections")
+		return
+	}
+	volumes, err := a.volumes24h(collections)
+	if err != nil {
+		log.Errorf("failed to get 24h volumes of collections: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to get collections")
+		return
+	}
+	views := make([]collectionView, 0, len(collections))
+	for i := range collections {
+		views = append(views, newCollectionView(&collections[i], volumes[collectionKey{collections[i].ChainID, collections[i].Denom}]))
+	}
+	out.Data = views
+
+	writeJSON(w, http.StatusOK, out)
+}
+
+// getCollection returns the statistics of a collection along with its daily statistics
+// of the last "days" (30 by default).
+func (a *API) getCollection(w http.ResponseWriter, r *http.Request) {
+	days := 30
+	if value := r.FormValue("days"); value != "" {
+		var err error
+		if days, err = strconv.Atoi(value); err != nil || days < 0 || days > maxDays {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("days must be from 0 to %d", maxDays))
+			return
+		}
+	}
+	denom := mux.Vars(r)["denom"]
+	var collection common.Collection
+	err := a.first(r, &collection, "denom = ?", denom)
+	if gorm.IsRecordNotFoundError(err) {
+		writeError(w, http.StatusNotFound, "collection not found")
+		return
+	}
+	if err == errAmbiguous {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		log.Errorf("failed to get collection %s: %v", denom, err)
+		writeError(w, http.StatusInternalServerError, "failed to get collection")
+		return
+	}
+
+	var stats []common.MarketplaceDailyStat
+	since := time.Now().UTC().AddDate(0, 0, -days).Format("2006-01-02")
+	if err := common.WithChainID(a.db.New(), collection.ChainID).
+		Where("collection = ? AND date > ?", denom, since).Order("date, denom").Find(&stats).Error; err != nil {
+		log.Errorf("failed to get daily statistics of collection %s: %v", denom, err)
+		writeError(w, http.StatusInternalServerError, "failed to get collection")
+		return
+	}
+	volumes, err := a.volumes24h([]common.Collection{collection})
+	if err != nil {
+		log.Errorf("failed to get 24h volume of collection %s: %v", denom, err)
+		writeError(w, http.StatusInternalServerError, "failed to get collection")
+		return
+	}
+	detail := collectionDetailView{
+		collectionView: newCollectionView(&collection, volumes[collectionKey{collection.ChainID, collection.Denom}]),
+		Daily:          make([]dailyStatView, 0, len(stats)),
+	}
+	for i := range stats {
+		detail.Daily = append(detail.Daily, newDailyStatView(&stats[i]))
+	}
+
+	writeJSON(w, http.StatusOK, detail)
+}
+
+// collectionKey identifies a collection across chains.
+type collectionKey struct {
+	chainID, denom string
+}
+
+// volumes24h returns the volumes of the sales of the last 24 hours of the given
+// collections, as coins strings. Collections that had no sales are not in the result.
+func (a *API) volumes24h(collections []common.Collection) (map[collectionKey]string, error) {
+	out := map[collectionKey]string{}
+	if len(collections) == 0 {
+		return out, nil
+	}
+	wanted := map[collectionKey]bool{}
+	denoms := make([]string, 0, len(collections))
+	for i := range collections {
+		wanted[collectionKey{collections[i].ChainID, collections[i].Denom}] = true
+		denoms = append(denoms, collections[i].Denom)
+	}
+	rows, err := a.db.New().Table(common.CollectionVolumes24hView).Select("chain_id, collection, denom, amount").
+		Where("collection IN (?)", denoms).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	volumes := map[collectionKey]sdk.Coins{}
+	for rows.Next() {
+		var (
+			key           collectionKey
+			denom, amount string
+		)
+		if err := rows.Scan(&key.chainID, &key.denom, &denom, &amount); err != nil {
+			return nil, err
+		}
+		if !wanted[key] {
+			continue
+		}
+		value, ok := sdk.NewIntFromString(amount)
+		if !ok {
+			return nil, fmt.Errorf("invalid amount %q of collection %s", amount, key.denom)
+		}
+		volumes[key] = volumes[key].Add(sdk.NewCoins(sdk.NewCoin(denom, value)))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for key, coins := range volumes {
+		out[key] = coins.String()
+	}
+
+	return out, nil
+}
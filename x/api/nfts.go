@@ -0,0 +1,139 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	common "github.com/corestario/dwh/x/common"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/prometheus/common/log"
+)
+
+// nftSorts are the fields that NFTs can be sorted by; "id" is the order of creation.
+var nftSorts = map[string]sortField{
+	"id": {"nfts.id", func(row interface{}) string {
+		return strconv.FormatUint(uint64(row.(*common.NFT).ID), 10)
+	}},
+	"updated_at": {"nfts.updated_at", func(row interface{}) string {
+		return row.(*common.NFT).UpdatedAt.Format(time.RFC3339Nano)
+	}},
+	"token_id": {"nfts.token_id", func(row interface{}) string {
+		return row.(*common.NFT).TokenID
+	}},
+	"time_to_sell": {"nfts.time_to_sell", func(row interface{}) string {
+		return row.(*common.NFT).TimeToSell.Format(time.RFC3339Nano)
+	}},
+}
+
+// listNFTs returns NFTs, optionally of an owner ("owner" parameter), of a denom
+// ("denom") and with a status ("status": default, on_market or on_auction).
+func (a *API) listNFTs(w http.ResponseWriter, r *http.Request) {
+	p, err := a.parsePage(r, nftSorts, "id")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	query := a.query(r)
+	if owner := r.FormValue("owner"); owner != "" {
+		query = query.Where("nfts.owner_address = ?", owner)
+	}
+	if denom := r.FormValue("denom"); denom != "" {
+		query = query.Where("nfts.denom = ?", denom)
+	}
+	if value := r.FormValue("status"); value != "" {
+		status, ok := nftStatuses[value]
+		if !ok {
+			writeError(w, http.StatusBadRequest, "status must be one of default, on_market, on_auction")
+			return
+		}
+		query = query.Where("nfts.status = ?", status)
+	}
+
+	var nfts []common.NFT
+	out, err := p.find(query, &nfts)
+	if err != nil {
+		log.Errorf("failed to get NFTs: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to get NFTs")
+		return
+	}
+	views := make([]nftView, 0, len(nfts))
+	for i := range nfts {
+		views = append(views, newNFTView(&nfts[i]))
+	}
+	out.Data = views
+
+	writeJSON(w, http.StatusOK, out)
+}
+
+// getNFT returns a token with its offers and bids, newest first, its metadata and its
+// images. If the metadata or the images can not be got, the token is returned without
+// them, and the response is not cached.
+func (a *API) getNFT(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var nft common.NFT
+	err := a.first(r, &nft, "denom = ? AND token_id = ?", vars["denom"], vars["token_id"])
+	if gorm.IsRecordNotFoundError(err) {
+		writeError(w, http.StatusNotFound, "NFT not found")
+		return
+	}
+	if err == errAmbiguous {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		log.Errorf("failed to get NFT %s/%s: %v", vars["denom"], vars["token_id"], err)
+		writeError(w, http.StatusInternalServerError, "failed to get NFT")
+		return
+	}
+	detail, err := a.nftDetail(&nft)
+	if err != nil {
+		log.Errorf("failed to get offers and bids of NFT %s/%s: %v", nft.Denom, nft.TokenID, err)
+		writeError(w, http.StatusInternalServerError, "failed to get NFT")
+		return
+	}
+	if err := a.addMetadata(r.Context(), detail); err != nil {
+		log.Errorf("failed to get metadata of NFT %s/%s: %v", nft.Denom, nft.TokenID, err)
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	if err := a.addImages(detail); err != nil {
+		log.Errorf("failed to get images of NFT %s/%s: %v", nft.Denom, nft.TokenID, err)
+		w.Header().Set("Cache-Control", "no-store")
+	}
+
+	writeJSON(w, http.StatusOK, detail)
+}
+
+// nftDetail returns the view of the token with its offers and bids.
+func (a *API) nftDetail(nft *common.NFT) (*nftDetailView, error) {
+	// Offers and bids are matched by denom and token ID, which are only unique within a
+	// chain.
+	query := common.WithChainID(a.db.New(), nft.ChainID).
+		Where("denom = ? AND token_id = ?", nft.Denom, nft.TokenID).Order("id DESC")
+	var (
+		offers []common.Offer
+		bids   []common.AuctionBid
+	)
+	if err := query.Find(&offers).Error; err != nil {
+		return nil, err
+	}
+	if err := query.Find(&bids).Error; err != nil {
+		return nil, err
+	}
+
+	detail := &nftDetailView{
+		nftView: newNFTView(nft),
+		Offers:  make([]offerView, 0, len(offers)),
+		Bids:    make([]bidView, 0, len(bids)),
+		Images:  []imageView{},
+	}
+	for i := range offers {
+		detail.Offers = append(detail.Offers, newOfferView(&offers[i]))
+	}
+	for i := range bids {
+		detail.Bids = append(detail.Bids, newBidView(&bids[i]))
+	}
+
+	return detail, nil
+}
@@ -0,0 +1,372 @@
+package api
+
+import (
+	"net/http"
+)
+
+// spec is the OpenAPI spec of the API.
+const spec = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "DWH read API",
+    "version": "1.0.0",
+    "description": "Read-only access to the NFTs, users, sales and collections indexed by DWH. Successful responses may be cached for a configured max age (Cache-Control), errors are not cached. Lists are sorted by the field given in 'sort' (prefixed with '-' for descending order) and paginated: the next page is requested with the 'next_cursor' of the previous one, along with the same 'sort'. The last page has no 'next_cursor'. Prices are coins strings (e.g., '10token')."
+  },
+  "paths": {
+    "/api/v1/nfts": {
+      "get": {
+        "summary": "List NFTs",
+        "parameters": [
+          {"$ref": "#/components/parameters/chain_id"},
+          {"name": "owner", "in": "query", "schema": {"type": "string"}, "description": "Address of the owner."},
+          {"name": "denom", "in": "query", "schema": {"type": "string"}},
+          {"name": "status", "in": "query", "schema": {"$ref": "#/components/schemas/NFTStatus"}},
+          {"name": "sort", "in": "query", "schema": {"type": "string", "default": "id", "enum": ["id", "-id", "updated_at", "-updated_at", "token_id", "-token_id", "time_to_sell", "-time_to_sell"]}, "description": "'id' is the order of creation."},
+          {"$ref": "#/components/parameters/cursor"},
+          {"$ref": "#/components/parameters/limit"}
+        ],
+        "responses": {
+          "200": {"description": "A page of NFTs.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/NFTPage"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"}
+        }
+      }
+    },
+    "/api/v1/nfts/{denom}/{token_id}": {
+      "get": {
+        "summary": "Get an NFT with its offers, bids, metadata and images",
+        "description": "If the metadata or the images can not be got, the NFT is returned without them and the response is not cached.",
+        "parameters": [
+          {"name": "denom", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"name": "token_id", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"$ref": "#/components/parameters/chain_id"}
+        ],
+        "responses": {
+          "200": {"description": "The NFT.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/NFTDetail"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/api/v1/users/{address}": {
+      "get": {
+        "summary": "Get the profile of a user",
+        "description": "NFTs of the user are listed by /api/v1/nfts?owner={address}, its deals by /api/v1/sales?address={address}.",
+        "parameters": [
+          {"name": "address", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"$ref": "#/components/parameters/chain_id"}
+        ],
+        "responses": {
+          "200": {"description": "The user.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/User"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/api/v1/sales": {
+      "get": {
+        "summary": "List sales",
+        "parameters": [
+          {"$ref": "#/components/parameters/chain_id"},
+          {"name": "denom", "in": "query", "schema": {"type": "string"}},
+          {"name": "token_id", "in": "query", "schema": {"type": "string"}},
+          {"name": "seller", "in": "query", "schema": {"type": "string"}},
+          {"name": "buyer", "in": "query", "schema": {"type": "string"}},
+          {"name": "address", "in": "query", "schema": {"type": "string"}, "description": "Either the seller or the buyer."},
+          {"name": "since", "in": "query", "schema": {"type": "string"}, "description": "Date or RFC 3339 time (inclusive)."},
+          {"name": "until", "in": "query", "schema": {"type": "string"}, "description": "Date or RFC 3339 time (exclusive)."},
+          {"name": "sort", "in": "query", "schema": {"type": "string", "default": "-time", "enum": ["id", "-id", "time", "-time", "height", "-height"]}},
+          {"$ref": "#/components/parameters/cursor"},
+          {"$ref": "#/components/parameters/limit"}
+        ],
+        "responses": {
+          "200": {"description": "A page of sales.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/SalePage"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"}
+        }
+      }
+    },
+    "/api/v1/collections": {
+      "get": {
+        "summary": "List collections",
+        "parameters": [
+          {"$ref": "#/components/parameters/chain_id"},
+          {"name": "creator", "in": "query", "schema": {"type": "string"}},
+          {"name": "sort", "in": "query", "schema": {"type": "string", "default": "-total_minted", "enum": ["denom", "-denom", "first_mint_height", "-first_mint_height", "total_minted", "-total_minted", "unique_holders", "-unique_holders", "on_market", "-on_market", "on_auction", "-on_auction"]}},
+          {"$ref": "#/components/parameters/cursor"},
+          {"$ref": "#/components/parameters/limit"}
+        ],
+        "responses": {
+          "200": {"description": "A page of collections.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CollectionPage"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"}
+        }
+      }
+    },
+    "/api/v1/collections/{denom}": {
+      "get": {
+        "summary": "Get the statistics of a collection",
+        "parameters": [
+          {"name": "denom", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"$ref": "#/components/parameters/chain_id"},
+          {"name": "days", "in": "query", "schema": {"type": "integer", "default": 30, "minimum": 0, "maximum": 365}, "description": "Number of days of daily statistics."}
+        ],
+        "responses": {
+          "200": {"description": "The collection.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CollectionDetail"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/api/v1/search": {
+      "get": {
+        "summary": "Search NFTs by their metadata",
+        "description": "Finds the NFTs whose metadata matches a text and traits. Results are ranked by relevance if there is a text, and by the last update of their metadata otherwise; they are paginated with offset and limit. Facets count the most frequent denoms and traits of all matching NFTs. Only NFTs whose metadata was fetched can be found.",
+        "parameters": [
+          {"name": "q", "in": "query", "schema": {"type": "string"}, "description": "Words to find in the name, description and attribute values; \"quoted phrases\" and -excluded words are supported."},
+          {"name": "denom", "in": "query", "schema": {"type": "string"}},
+          {"name": "trait", "in": "query", "schema": {"type": "array", "items": {"type": "string"}}, "style": "form", "explode": true, "description": "An attribute the NFT must have, as trait_type:value (e.g., color:red); may be repeated."},
+          {"name": "offset", "in": "query", "schema": {"type": "integer", "default": 0, "minimum": 0, "maximum": 10000}},
+          {"$ref": "#/components/parameters/limit"}
+        ],
+        "responses": {
+          "200": {"description": "The search results.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/SearchResults"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "503": {"description": "Metadata is not available.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+        }
+      }
+    },
+    "/api/v1/openapi.json": {
+      "get": {
+        "summary": "Get this spec",
+        "responses": {
+          "200": {"description": "The OpenAPI spec.", "content": {"application/json": {"schema": {"type": "object"}}}}
+        }
+      }
+    }
+  },
+  "components": {
+    "parameters": {
+      "chain_id": {"name": "chain_id", "in": "query", "schema": {"type": "string"}, "description": "Limits the results to a chain; all chains by default. Required to get a row whose key is used by several chains."},
+      "cursor": {"name": "cursor", "in": "query", "schema": {"type": "string"}, "description": "The next_cursor of the previous page."},
+      "limit": {"name": "limit", "in": "query", "schema": {"type": "integer", "minimum": 1}, "description": "Number of rows per page; the default and max are configured."}
+    },
+    "responses": {
+      "BadRequest": {"description": "Invalid parameters.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+      "NotFound": {"description": "Not found.", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+    },
+    "schemas": {
+      "Error": {
+        "type": "object",
+        "properties": {"error": {"type": "string"}}
+      },
+      "NFTStatus": {"type": "string", "enum": ["default", "on_market", "on_auction"]},
+      "NFT": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer"},
+          "chain_id": {"type": "string"},
+          "denom": {"type": "string"},
+          "token_id": {"type": "string"},
+          "owner": {"type": "string"},
+          "token_uri": {"type": "string"},
+          "status": {"$ref": "#/components/schemas/NFTStatus"},
+          "price": {"type": "string"},
+          "seller_beneficiary": {"type": "string"},
+          "buyout_price": {"type": "string"},
+          "opening_price": {"type": "string"},
+          "time_to_sell": {"type": "string", "format": "date-time", "description": "End of the auction; only set on auctions."},
+          "created_at": {"type": "string", "format": "date-time"},
+          "updated_at": {"type": "string", "format": "date-time"}
+        }
+      },
+      "Offer": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer"},
+          "offer_id": {"type": "string"},
+          "buyer": {"type": "string"},
+          "price": {"type": "string"},
+          "buyer_beneficiary": {"type": "string"},
+          "beneficiary_commission": {"type": "string"},
+          "created_at": {"type": "string", "format": "date-time"}
+        }
+      },
+      "Bid": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer"},
+          "bidder": {"type": "string"},
+          "price": {"type": "string"},
+          "bidder_beneficiary": {"type": "string"},
+          "beneficiary_commission": {"type": "string"},
+          "created_at": {"type": "string", "format": "date-time"}
+        }
+      },
+      "NFTDetail": {
+        "allOf": [
+          {"$ref": "#/components/schemas/NFT"},
+          {
+            "type": "object",
+            "properties": {
+              "offers": {"type": "array", "items": {"$ref": "#/components/schemas/Offer"}, "description": "Newest first."},
+              "bids": {"type": "array", "items": {"$ref": "#/components/schemas/Bid"}, "description": "Newest first."},
+              "metadata": {"type": "object", "nullable": true, "description": "The metadata document fetched from the token URI; null until it is fetched."},
+              "metadata_updated_at": {"type": "string", "format": "date-time", "description": "Last time the metadata changed."},
+              "metadata_checked_at": {"type": "string", "format": "date-time", "description": "Last time the metadata was fetched."},
+              "images": {"type": "array", "items": {"$ref": "#/components/schemas/Image"}}
+            }
+          }
+        ]
+      },
+      "Image": {
+        "type": "object",
+        "description": "A stored image of the NFT; the original image has zero width and height. The URL includes the checksum of the image, so it can be cached for good.",
+        "properties": {
+          "width": {"type": "integer"},
+          "height": {"type": "integer"},
+          "url": {"type": "string"}
+        }
+      },
+      "NFTPage": {
+        "type": "object",
+        "properties": {
+          "data": {"type": "array", "items": {"$ref": "#/components/schemas/NFT"}},
+          "next_cursor": {"type": "string"}
+        }
+      },
+      "User": {
+        "type": "object",
+        "properties": {
+          "chain_id": {"type": "string"},
+          "address": {"type": "string"},
+          "name": {"type": "string"},
+          "balance": {"type": "string"},
+          "account_number": {"type": "integer"},
+          "sequence_number": {"type": "integer"},
+          "account_height": {"type": "integer", "description": "Height the account data was queried at."},
+          "first_seen_at": {"type": "string", "format": "date-time"},
+          "nfts_owned": {"type": "integer"},
+          "nfts_on_market": {"type": "integer"},
+          "nfts_on_auction": {"type": "integer"},
+          "sales": {"type": "integer", "description": "Number of NFTs sold."},
+          "purchases": {"type": "integer", "description": "Number of NFTs bought."}
+        }
+      },
+      "Sale": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer"},
+          "chain_id": {"type": "string"},
+          "denom": {"type": "string"},
+          "token_id": {"type": "string"},
+          "seller": {"type": "string"},
+          "buyer": {"type": "string"},
+          "price": {"type": "string"},
+          "msg_type": {"type": "string"},
+          "height": {"type": "integer"},
+          "time": {"type": "string", "format": "date-time"},
+          "tx_hash": {"type": "string"}
+        }
+      },
+      "SalePage": {
+        "type": "object",
+        "properties": {
+          "data": {"type": "array", "items": {"$ref": "#/components/schemas/Sale"}},
+          "next_cursor": {"type": "string"}
+        }
+      },
+      "Collection": {
+        "type": "object",
+        "properties": {
+          "chain_id": {"type": "string"},
+          "denom": {"type": "string"},
+          "creator": {"type": "string"},
+          "first_mint_height": {"type": "integer"},
+          "total_minted": {"type": "integer"},
+          "burned": {"type": "integer"},
+          "unique_holders": {"type": "integer"},
+          "on_market": {"type": "integer"},
+          "on_auction": {"type": "integer"},
+          "floor_price": {"type": "string"},
+          "volume": {"type": "string", "description": "All-time volume."},
+          "volume_24h": {"type": "string", "description": "Volume of the last 24 hours."},
+          "updated_at": {"type": "string", "format": "date-time"}
+        }
+      },
+      "DailyStat": {
+        "type": "object",
+        "description": "Activity of a day (UTC) under a price denom; mints and burns are under an empty denom.",
+        "properties": {
+          "date": {"type": "string", "format": "date"},
+          "denom": {"type": "string"},
+          "sales_count": {"type": "integer"},
+          "volume": {"type": "string"},
+          "unique_buyers": {"type": "integer"},
+          "unique_sellers": {"type": "integer"},
+          "new_listings": {"type": "integer"},
+          "new_auctions": {"type": "integer"},
+          "bids_placed": {"type": "integer"},
+          "offers_made": {"type": "integer"},
+          "offers_accepted": {"type": "integer"},
+          "mints": {"type": "integer"},
+          "burns": {"type": "integer"}
+        }
+      },
+      "CollectionDetail": {
+        "allOf": [
+          {"$ref": "#/components/schemas/Collection"},
+          {
+            "type": "object",
+            "properties": {
+              "daily": {"type": "array", "items": {"$ref": "#/components/schemas/DailyStat"}, "description": "Oldest first."}
+            }
+          }
+        ]
+      },
+      "SearchResults": {
+        "type": "object",
+        "properties": {
+          "total": {"type": "integer", "description": "Number of matching NFTs."},
+          "results": {
+            "type": "array",
+            "items": {
+              "type": "object",
+              "properties": {
+                "denom": {"type": "string"},
+                "token_id": {"type": "string"},
+                "name": {"description": "As in the metadata."},
+                "description": {"description": "As in the metadata."},
+                "image": {"description": "As in the metadata."},
+                "score": {"type": "number", "description": "Relevance to the text."}
+              }
+            }
+          },
+          "facets": {
+            "type": "object",
+            "properties": {
+              "denoms": {
+                "type": "array",
+                "items": {"type": "object", "properties": {"denom": {"type": "string"}, "count": {"type": "integer"}}}
+              },
+              "traits": {
+                "type": "array",
+                "items": {"type": "object", "properties": {"trait_type": {"type": "string"}, "value": {}, "count": {"type": "integer"}}}
+              }
+            }
+          }
+        }
+      },
+      "CollectionPage": {
+        "type": "object",
+        "properties": {
+          "data": {"type": "array", "items": {"$ref": "#/components/schemas/Collection"}},
+          "next_cursor": {"type": "string"}
+        }
+      }
+    }
+  }
+}
+`
+
+func serveSpec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(spec))
+}
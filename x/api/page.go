@@ -0,0 +1,146 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// sortField is a field that a list can be sorted by. column is its SQL expression and
+// value returns its value in a row (a model), which the next page starts after.
+type sortField struct {
+	column string
+	value  func(row interface{}) string
+}
+
+// cursor points to the last row of a page: its value of the sort field and its ID,
+// which breaks ties. Cursors are opaque to clients.
+type cursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    uint   `json:"id"`
+}
+
+func (c cursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (*cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var c cursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// page is a request for a page of a list, from the parameters "sort" (a field, prefixed
+// with "-" for descending order), "cursor" (the next_cursor of the previous page) and
+// "limit".
+type page struct {
+	name  string
+	field sortField
+	desc  bool
+	after *cursor
+	limit int
+}
+
+// pageOf is a page of a list as returned by the API. NextCursor is empty on the last
+// page.
+type pageOf struct {
+	Data       interface{} `json:"data"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// parsePage returns the page requested by r, sorted by one of the fields (defaultSort
+// if none is given).
+func (a *API) parsePage(r *http.Request, fields map[string]sortField, defaultSort string) (*page, error) {
+	p := &page{limit: a.cfg.APIDefaultPageSize}
+	name := r.FormValue("sort")
+	if name == "" {
+		name = defaultSort
+	}
+	if strings.HasPrefix(name, "-") {
+		name, p.desc = name[1:], true
+	}
+	field, ok := fields[name]
+	if !ok {
+		var names []string
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("sort must be one of %s, optionally prefixed with -", strings.Join(names, ", "))
+	}
+	p.name, p.field = name, field
+	if value := r.FormValue("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > a.cfg.APIMaxPageSize {
+			return nil, fmt.Errorf("limit must be from 1 to %d", a.cfg.APIMaxPageSize)
+		}
+		p.limit = limit
+	}
+	if value := r.FormValue("cursor"); value != "" {
+		after, err := decodeCursor(value)
+		if err != nil || after.Sort != sortParam(p.name, p.desc) {
+			// Cursors are only valid with the order they were returned with.
+			return nil, fmt.Errorf("invalid cursor")
+		}
+		p.after = after
+	}
+
+	return p, nil
+}
+
+// find gets the rows of the page into rows, a pointer to a slice of models with IDs, and
+// returns the page.
+func (p *page) find(query *gorm.DB, rows interface{}) (*pageOf, error) {
+	order, cmp := "ASC", ">"
+	if p.desc {
+		order, cmp = "DESC", "<"
+	}
+	table := query.NewScope(rows).TableName()
+	if p.after != nil {
+		query = query.Where(fmt.Sprintf("(%s, %s.id) %s (?, ?)", p.field.column, table, cmp), p.after.Value, p.after.ID)
+	}
+	// One more row tells whether there is a next page.
+	if err := query.Order(fmt.Sprintf("%s %s, %s.id %s", p.field.column, order, table, order)).
+		Limit(p.limit + 1).Find(rows).Error; err != nil {
+		return nil, err
+	}
+
+	out := &pageOf{}
+	list := reflect.ValueOf(rows).Elem()
+	if list.Len() > p.limit {
+		last := list.Index(p.limit - 1)
+		out.NextCursor = cursor{
+			Sort:  sortParam(p.name, p.desc),
+			Value: p.field.value(last.Addr().Interface()),
+			ID:    uint(last.FieldByName("ID").Uint()),
+		}.encode()
+		list.Set(list.Slice(0, p.limit))
+	}
+
+	return out, nil
+}
+
+// sortParam returns the "sort" parameter of the order, as given by clients.
+func sortParam(name string, desc bool) string {
+	if desc {
+		return "-" + name
+	}
+
+	return name
+}
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	common "github.com/corestario/dwh/x/common"
+	"github.com/prometheus/common/log"
+)
+
+var saleSorts = map[string]sortField{
+	"id": {"sales.id", func(row interface{}) string {
+		return strconv.FormatUint(uint64(row.(*common.Sale).ID), 10)
+	}},
+	"time": {"sales.time", func(row interface{}) string {
+		return row.(*common.Sale).Time.Format(time.RFC3339Nano)
+	}},
+	"height": {"sales.height", func(row interface{}) string {
+		return strconv.FormatInt(row.(*common.Sale).Height, 10)
+	}},
+}
+
+// listSales returns the sales history, latest first by default. It can be filtered by
+// token ("denom" and "token_id" parameters), by "seller", "buyer" or either of them
+// ("address"), and by time ("since" inclusive, "until" exclusive).
+func (a *API) listSales(w http.ResponseWriter, r *http.Request) {
+	p, err := a.parsePage(r, saleSorts, "-time")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	query := a.query(r)
+	for _, column := range []string{"denom", "token_id", "seller", "buyer"} {
+		if value := r.FormValue(column); value != "" {
+			query = query.Where("sales."+column+" = ?", value)
+		}
+	}
+	if address := r.FormValue("address"); address != "" {
+		query = query.Where("sales.seller = ? OR sales.buyer = ?", address, address)
+	}
+	for param, cmp := range map[string]string{"since": ">=", "until": "<"} {
+		if value := r.FormValue(param); value != "" {
+			t, err := parseTime(value)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, param+" must be a date or an RFC 3339 time")
+				return
+			}
+			query = query.Where("sales.time "+cmp+" ?", t)
+		}
+	}
+
+	var sales []common.Sale
+	out, err := p.find(query, &sales)
+	if err != nil {
+		log.Errorf("failed to get sales: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to get sales")
+		return
+	}
+	views := make([]saleView, 0, len(sales))
+	for i := range sales {
+		views = append(views, newSaleView(&sales[i]))
+	}
+	out.Data = views
+
+	writeJSON(w, http.StatusOK, out)
+}
@@ -0,0 +1,230 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// maxSearchOffset is the max offset of search results: results are ranked, so deep
+	// pages are rarely useful and costly.
+	maxSearchOffset = 10000
+	// maxFacets is the max number of values of each facet.
+	maxFacets = 100
+	// searchTimeout is the max time of a search.
+	searchTimeout = 10 * time.Second
+)
+
+// searchRequest is a search over token metadata: Text matches the name, description and
+// attribute values (see TokenMetadataWorker for the text index), Denom the denom, and
+// every trait an attribute. All of them are optional.
+type searchRequest struct {
+	Text   string
+	Denom  string
+	Traits []trait
+	Offset int
+	Limit  int
+}
+
+type trait struct {
+	Type  string
+	Value string
+}
+
+type searchResult struct {
+	Denom       string      `json:"denom" bson:"denom"`
+	TokenID     string      `json:"token_id" bson:"token_id"`
+	Name        interface{} `json:"name" bson:"name"`
+	Description interface{} `json:"description" bson:"description"`
+	Image       interface{} `json:"image" bson:"image"`
+	Score       float64     `json:"score,omitempty" bson:"score"`
+}
+
+type denomFacet struct {
+	Denom string `json:"denom" bson:"_id"`
+	Count int64  `json:"count" bson:"count"`
+}
+
+type traitFacet struct {
+	TraitType interface{} `json:"trait_type" bson:"trait_type"`
+	Value     interface{} `json:"value" bson:"value"`
+	Count     int64       `json:"count" bson:"count"`
+}
+
+// searchView is a page of search results, with the number of matching tokens and the
+// facets of all of them: the most frequent denoms and traits (type and value).
+type searchView struct {
+	Total   int64          `json:"total"`
+	Results []searchResult `json:"results"`
+	Facets  struct {
+		Denoms []denomFacet `json:"denoms"`
+		Traits []traitFacet `json:"traits"`
+	} `json:"facets"`
+}
+
+// parseSearch returns the search of the request: "q" (text), "denom", "trait" (any
+// number of type:value pairs), "offset" and "limit".
+func (a *API) parseSearch(r *http.Request) (*searchRequest, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	req := &searchRequest{
+		Text:  strings.TrimSpace(r.FormValue("q")),
+		Denom: r.FormValue("denom"),
+		Limit: a.cfg.APIDefaultPageSize,
+	}
+	for _, value := range r.Form["trait"] {
+		parts := strings.SplitN(value, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("trait must be type:value")
+		}
+		req.Traits = append(req.Traits, trait{Type: parts[0], Value: parts[1]})
+	}
+	if value := r.FormValue("offset"); value != "" {
+		offset, err := strconv.Atoi(value)
+		if err != nil || offset < 0 || offset > maxSearchOffset {
+			return nil, fmt.Errorf("offset must be from 0 to %d", maxSearchOffset)
+		}
+		req.Offset = offset
+	}
+	if value := r.FormValue("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > a.cfg.APIMaxPageSize {
+			return nil, fmt.Errorf("limit must be from 1 to %d", a.cfg.APIMaxPageSize)
+		}
+		req.Limit = limit
+	}
+
+	return req, nil
+}
+
+// pipeline returns the aggregation of the search. Results are ranked by text score if
+// there is a text, and by the last update of their metadata otherwise.
+func (req *searchRequest) pipeline() mongo.Pipeline {
+	match := bson.D{}
+	if req.Text != "" {
+		// $text must be in the first stage.
+		match = append(match, bson.E{Key: "$text", Value: bson.M{"$search": req.Text}})
+	}
+	if req.Denom != "" {
+		match = append(match, bson.E{Key: "dwhData.denom", Value: req.Denom})
+	}
+	if len(req.Traits) != 0 {
+		var all bson.A
+		for _, trait := range req.Traits {
+			// Values of attributes may be numbers, values of parameters are strings.
+			values := bson.A{trait.Value}
+			if number, err := strconv.ParseFloat(trait.Value, 64); err == nil {
+				values = append(values, number)
+			}
+			all = append(all, bson.M{"$elemMatch": bson.M{"trait_type": trait.Type, "value": bson.M{"$in": values}}})
+		}
+		match = append(match, bson.E{Key: "attributes", Value: bson.M{"$all": all}})
+	}
+
+	sort := bson.D{{Key: "dwhData.lastUpdated", Value: -1}, {Key: "_id", Value: -1}}
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: match}}}
+	if req.Text != "" {
+		sort = bson.D{{Key: "score", Value: -1}, {Key: "_id", Value: -1}}
+		pipeline = append(pipeline, bson.D{{Key: "$addFields", Value: bson.M{"score": bson.M{"$meta": "textScore"}}}})
+	}
+
+	return append(pipeline, bson.D{{Key: "$facet", Value: bson.M{
+		"total": bson.A{bson.M{"$count": "count"}},
+		"results": bson.A{
+			bson.M{"$sort": sort},
+			bson.M{"$skip": req.Offset},
+			bson.M{"$limit": req.Limit},
+			bson.M{"$project": bson.M{
+				"_id":         0,
+				"denom":       "$dwhData.denom",
+				"token_id":    "$dwhData.tokenID",
+				"name":        1,
+				"description": 1,
+				"image":       1,
+				"score":       1,
+			}},
+		},
+		"denoms": bson.A{
+			bson.M{"$group": bson.M{"_id": "$dwhData.denom", "count": bson.M{"$sum": 1}}},
+			bson.M{"$sort": bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}},
+			bson.M{"$limit": maxFacets},
+		},
+		"traits": bson.A{
+			bson.M{"$unwind": "$attributes"},
+			bson.M{"$match": bson.M{"attributes.trait_type": bson.M{"$exists": true}}},
+			bson.M{"$group": bson.M{
+				"_id":   bson.M{"trait_type": "$attributes.trait_type", "value": "$attributes.value"},
+				"count": bson.M{"$sum": 1},
+			}},
+			bson.M{"$sort": bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}},
+			bson.M{"$limit": maxFacets},
+			bson.M{"$project": bson.M{"_id": 0, "trait_type": "$_id.trait_type", "value": "$_id.value", "count": 1}},
+		},
+	}}})
+}
+
+// search finds tokens by their metadata (see searchRequest). Only tokens whose metadata
+// was fetched can be found.
+func (a *API) search(w http.ResponseWriter, r *http.Request) {
+	if a.metadata == nil {
+		writeError(w, http.StatusServiceUnavailable, "search is not available")
+		return
+	}
+	req, err := a.parseSearch(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), searchTimeout)
+	defer cancel()
+	cur, err := a.metadata.Aggregate(ctx, req.pipeline())
+	if err != nil {
+		log.Errorf("failed to search metadata: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to search")
+		return
+	}
+	defer cur.Close(ctx)
+	var out struct {
+		Total   []struct{ Count int64 } `bson:"total"`
+		Results []searchResult          `bson:"results"`
+		Denoms  []denomFacet            `bson:"denoms"`
+		Traits  []traitFacet            `bson:"traits"`
+	}
+	if cur.Next(ctx) {
+		err = cur.Decode(&out)
+	} else {
+		err = cur.Err()
+	}
+	if err != nil {
+		log.Errorf("failed to decode search results: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to search")
+		return
+	}
+
+	view := searchView{Results: out.Results}
+	view.Facets.Denoms, view.Facets.Traits = out.Denoms, out.Traits
+	if len(out.Total) != 0 {
+		view.Total = out.Total[0].Count
+	}
+	if view.Results == nil {
+		view.Results = []searchResult{}
+	}
+	if view.Facets.Denoms == nil {
+		view.Facets.Denoms = []denomFacet{}
+	}
+	if view.Facets.Traits == nil {
+		view.Facets.Traits = []traitFacet{}
+	}
+
+	writeJSON(w, http.StatusOK, view)
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	common "github.com/corestario/dwh/x/common"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// metadataTimeout is the max time to get the metadata of a token.
+const metadataTimeout = 5 * time.Second
+
+// imageView is an image of a token in a resolution; the original image has zero width
+// and height. URLs include the checksum of the image, so they change with the image.
+type imageView struct {
+	Width  uint   `json:"width"`
+	Height uint   `json:"height"`
+	URL    string `json:"url"`
+}
+
+// metadataInfo is what the token metadata service adds to metadata documents.
+type metadataInfo struct {
+	DwhData struct {
+		LastUpdated time.Time `bson:"lastUpdated"`
+		LastChecked time.Time `bson:"lastChecked"`
+	} `bson:"dwhData"`
+}
+
+// addMetadata adds the metadata document of the token, if it was fetched, without the
+// fields of the token metadata service.
+func (a *API) addMetadata(ctx context.Context, detail *nftDetailView) error {
+	if a.metadata == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, metadataTimeout)
+	defer cancel()
+	raw, err := a.metadata.FindOne(ctx, bson.M{"dwhData.denom": detail.Denom, "dwhData.tokenID": detail.TokenID}).DecodeBytes()
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to find metadata: %v", err)
+	}
+	metadata, info, err := decodeMetadata(raw)
+	if err != nil {
+		return err
+	}
+	detail.Metadata = metadata
+	detail.MetadataUpdatedAt, detail.MetadataCheckedAt = &info.DwhData.LastUpdated, &info.DwhData.LastChecked
+
+	return nil
+}
+
+// decodeMetadata returns the metadata of a document as JSON, and the fields of the token
+// metadata service.
+func decodeMetadata(raw bson.Raw) (json.RawMessage, *metadataInfo, error) {
+	var (
+		doc  bson.D
+		info metadataInfo
+	)
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode metadata: %v", err)
+	}
+	if err := bson.Unmarshal(raw, &info); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode metadata: %v", err)
+	}
+	metadata := bson.D{}
+	for _, elem := range doc {
+		if elem.Key != "_id" && elem.Key != "dwhData" {
+			metadata = append(metadata, elem)
+		}
+	}
+	// Metadata was decoded from JSON (see TokenMetadataWorker), relaxed extended JSON
+	// gives it back as it was.
+	data, err := bson.MarshalExtJSON(metadata, false, false)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode metadata: %v", err)
+	}
+
+	return data, &info, nil
+}
+
+// addImages adds the URLs of the stored images of the token. Images are stored under the
+// owner of the token, so the images of a token that was just transferred are missing
+// until they are stored again.
+func (a *API) addImages(detail *nftDetailView) error {
+	query := url.Values{"owner": {detail.Owner}, "denom": {detail.Denom}, "token_id": {detail.TokenID}}
+	resp, err := a.client.Get(a.storageURL + common.ListImagesPath + "?" + query.Encode())
+	if err != nil {
+		return fmt.Errorf("failed to list images: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to list images: status %s", resp.Status)
+	}
+	var list common.ImageListResponse
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return fmt.Errorf("failed to decode images: %v", err)
+	}
+
+	for _, image := range list.Images {
+		// img_type is the token ID (see ImgStorage.LoadHandler), v is the checksum that
+		// makes the URL immutable.
+		query := url.Values{
+			"owner":    {detail.Owner},
+			"denom":    {detail.Denom},
+			"img_type": {detail.TokenID},
+			"width":    {strconv.FormatUint(uint64(image.Width), 10)},
+			"height":   {strconv.FormatUint(uint64(image.Height), 10)},
+			"v":        {image.MD5Sum},
+		}
+		detail.Images = append(detail.Images, imageView{
+			Width:  image.Width,
+			Height: image.Height,
+			URL:    a.imagesURL + common.LoadImagePath + "?" + query.Encode(),
+		})
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"net/http"
+
+	common "github.com/corestario/dwh/x/common"
+	"github.com/corestario/marketplace/x/marketplace/types"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/prometheus/common/log"
+)
+
+// getUser returns the profile of a user. Its NFTs are listed by listNFTs ("owner"
+// parameter) and its deals by listSales ("address").
+func (a *API) getUser(w http.ResponseWriter, r *http.Request) {
+	address := mux.Vars(r)["address"]
+	var user common.User
+	err := a.first(r, &user, "address = ?", address)
+	if gorm.IsRecordNotFoundError(err) {
+		writeError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	if err == errAmbiguous {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		log.Errorf("failed to get user %s: %v", address, err)
+		writeError(w, http.StatusInternalServerError, "failed to get user")
+		return
+	}
+	view, err := a.userProfile(&user)
+	if err != nil {
+		log.Errorf("failed to get statistics of user %s: %v", address, err)
+		writeError(w, http.StatusInternalServerError, "failed to get user")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, view)
+}
+
+// userProfile returns the view of the user with the statistics of its chain.
+func (a *API) userProfile(user *common.User) (userView, error) {
+	view := newUserView(user)
+	db := common.WithChainID(a.db.New(), user.ChainID)
+
+	var statuses []struct {
+		Status int
+		Count  int64
+	}
+	if err := db.Model(&common.NFT{}).Select("status, count(*) AS count").
+		Where("owner_address = ?", user.Address).Group("status").Scan(&statuses).Error; err != nil {
+		return view, err
+	}
+	for _, status := range statuses {
+		view.NFTsOwned += status.Count
+		switch status.Status {
+		case int(types.NFTStatusOnMarket):
+			view.NFTsOnMarket = status.Count
+		case int(types.NFTStatusOnAuction):
+			view.NFTsOnAuction = status.Count
+		}
+	}
+	if err := db.Model(&common.Sale{}).Where("seller = ?", user.Address).Count(&view.Sales).Error; err != nil {
+		return view, err
+	}
+	if err := db.Model(&common.Sale{}).Where("buyer = ?", user.Address).Count(&view.Purchases).Error; err != nil {
+		return view, err
+	}
+
+	return view, nil
+}
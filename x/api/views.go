@@ -0,0 +1,247 @@
+package api
+
+import (
+	"encoding/json"
+	"time"
+
+	common "github.com/corestario/dwh/x/common"
+	"github.com/corestario/marketplace/x/marketplace/types"
+)
+
+// Views are the representations of models in the API.
+
+// nftStatuses maps the names of NFT statuses, as returned by the API, to their values.
+var nftStatuses = map[string]int{
+	types.NFTStatusDefault.String():   int(types.NFTStatusDefault),
+	types.NFTStatusOnMarket.String():  int(types.NFTStatusOnMarket),
+	types.NFTStatusOnAuction.String(): int(types.NFTStatusOnAuction),
+}
+
+type nftView struct {
+	ID                uint       `json:"id"`
+	ChainID           string     `json:"chain_id"`
+	Denom             string     `json:"denom"`
+	TokenID           string     `json:"token_id"`
+	Owner             string     `json:"owner"`
+	TokenURI          string     `json:"token_uri"`
+	Status            string     `json:"status"`
+	Price             string     `json:"price"`
+	SellerBeneficiary string     `json:"seller_beneficiary"`
+	BuyoutPrice       string     `json:"buyout_price"`
+	OpeningPrice      string     `json:"opening_price"`
+	TimeToSell        *time.Time `json:"time_to_sell,omitempty"` // Auctions only.
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+}
+
+func newNFTView(nft *common.NFT) nftView {
+	view := nftView{
+		ID:                nft.ID,
+		ChainID:           nft.ChainID,
+		Denom:             nft.Denom,
+		TokenID:           nft.TokenID,
+		Owner:             nft.OwnerAddress,
+		TokenURI:          nft.TokenURI,
+		Status:            types.NFTStatus(nft.Status).String(),
+		Price:             nft.Price,
+		SellerBeneficiary: nft.SellerBeneficiary,
+		BuyoutPrice:       nft.BuyoutPrice,
+		OpeningPrice:      nft.OpeningPrice,
+		CreatedAt:         nft.CreatedAt,
+		UpdatedAt:         nft.UpdatedAt,
+	}
+	if nft.Status == int(types.NFTStatusOnAuction) {
+		view.TimeToSell = &nft.TimeToSell
+	}
+
+	return view
+}
+
+type offerView struct {
+	ID                    uint      `json:"id"`
+	OfferID               string    `json:"offer_id"`
+	Buyer                 string    `json:"buyer"`
+	Price                 string    `json:"price"`
+	BuyerBeneficiary      string    `json:"buyer_beneficiary"`
+	BeneficiaryCommission string    `json:"beneficiary_commission"`
+	CreatedAt             time.Time `json:"created_at"`
+}
+
+func newOfferView(offer *common.Offer) offerView {
+	return offerView{
+		ID:                    offer.ID,
+		OfferID:               offer.OfferID,
+		Buyer:                 offer.Buyer,
+		Price:                 offer.Price,
+		BuyerBeneficiary:      offer.BuyerBeneficiary,
+		BeneficiaryCommission: offer.BeneficiaryCommission,
+		CreatedAt:             offer.CreatedAt,
+	}
+}
+
+type bidView struct {
+	ID                    uint      `json:"id"`
+	Bidder                string    `json:"bidder"`
+	Price                 string    `json:"price"`
+	BidderBeneficiary     string    `json:"bidder_beneficiary"`
+	BeneficiaryCommission string    `json:"beneficiary_commission"`
+	CreatedAt             time.Time `json:"created_at"`
+}
+
+func newBidView(bid *common.AuctionBid) bidView {
+	return bidView{
+		ID:                    bid.ID,
+		Bidder:                bid.BidderAddress,
+		Price:                 bid.Price,
+		BidderBeneficiary:     bid.BidderBeneficiary,
+		BeneficiaryCommission: bid.BeneficiaryCommission,
+		CreatedAt:             bid.CreatedAt,
+	}
+}
+
+// nftDetailView is a token with its open offers, the bids of its auction, its metadata
+// (null until it is fetched) and its stored images.
+type nftDetailView struct {
+	nftView
+	Offers            []offerView     `json:"offers"`
+	Bids              []bidView       `json:"bids"`
+	Metadata          json.RawMessage `json:"metadata"`
+	MetadataUpdatedAt *time.Time      `json:"metadata_updated_at,omitempty"`
+	MetadataCheckedAt *time.Time      `json:"metadata_checked_at,omitempty"`
+	Images            []imageView     `json:"images"`
+}
+
+type saleView struct {
+	ID      uint      `json:"id"`
+	ChainID string    `json:"chain_id"`
+	Denom   string    `json:"denom"`
+	TokenID string    `json:"token_id"`
+	Seller  string    `json:"seller"`
+	Buyer   string    `json:"buyer"`
+	Price   string    `json:"price"`
+	MsgType string    `json:"msg_type"`
+	Height  int64     `json:"height"`
+	Time    time.Time `json:"time"`
+	TxHash  string    `json:"tx_hash"`
+}
+
+func newSaleView(sale *common.Sale) saleView {
+	return saleView{
+		ID:      sale.ID,
+		ChainID: sale.ChainID,
+		Denom:   sale.Denom,
+		TokenID: sale.TokenID,
+		Seller:  sale.Seller,
+		Buyer:   sale.Buyer,
+		Price:   sale.Price,
+		MsgType: sale.MsgType,
+		Height:  sale.Height,
+		Time:    sale.Time,
+		TxHash:  sale.TxHash,
+	}
+}
+
+type collectionView struct {
+	ChainID         string    `json:"chain_id"`
+	Denom           string    `json:"denom"`
+	Creator         string    `json:"creator"`
+	FirstMintHeight int64     `json:"first_mint_height"`
+	TotalMinted     int64     `json:"total_minted"`
+	Burned          int64     `json:"burned"`
+	UniqueHolders   int64     `json:"unique_holders"`
+	OnMarket        int64     `json:"on_market"`
+	OnAuction       int64     `json:"on_auction"`
+	FloorPrice      string    `json:"floor_price"`
+	Volume          string    `json:"volume"`
+	Volume24h       string    `json:"volume_24h"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+func newCollectionView(collection *common.Collection, volume24h string) collectionView {
+	return collectionView{
+		ChainID:         collection.ChainID,
+		Denom:           collection.Denom,
+		Creator:         collection.Creator,
+		FirstMintHeight: collection.FirstMintHeight,
+		TotalMinted:     collection.TotalMinted,
+		Burned:          collection.Burned,
+		UniqueHolders:   collection.UniqueHolders,
+		OnMarket:        collection.OnMarket,
+		OnAuction:       collection.OnAuction,
+		FloorPrice:      collection.FloorPrice,
+		Volume:          collection.Volume,
+		Volume24h:       volume24h,
+		UpdatedAt:       collection.UpdatedAt,
+	}
+}
+
+// userView is the profile of a user: its account and statistics of its tokens and
+// deals.
+type userView struct {
+	ChainID        string    `json:"chain_id"`
+	Address        string    `json:"address"`
+	Name           string    `json:"name"`
+	Balance        string    `json:"balance"`
+	AccountNumber  uint64    `json:"account_number"`
+	SequenceNumber uint64    `json:"sequence_number"`
+	AccountHeight  int64     `json:"account_height"`
+	FirstSeenAt    time.Time `json:"first_seen_at"`
+	NFTsOwned      int64     `json:"nfts_owned"`
+	NFTsOnMarket   int64     `json:"nfts_on_market"`
+	NFTsOnAuction  int64     `json:"nfts_on_auction"`
+	Sales          int64     `json:"sales"`
+	Purchases      int64     `json:"purchases"`
+}
+
+func newUserView(user *common.User) userView {
+	return userView{
+		ChainID:        user.ChainID,
+		Address:        user.Address,
+		Name:           user.Name,
+		Balance:        user.Balance,
+		AccountNumber:  user.AccountNumber,
+		SequenceNumber: user.SequenceNumber,
+		AccountHeight:  user.AccountHeight,
+		FirstSeenAt:    user.CreatedAt,
+	}
+}
+
+type dailyStatView struct {
+	Date           string `json:"date"`
+	Denom          string `json:"denom"`
+	SalesCount     int64  `json:"sales_count"`
+	Volume         string `json:"volume"`
+	UniqueBuyers   int64  `json:"unique_buyers"`
+	UniqueSellers  int64  `json:"unique_sellers"`
+	NewListings    int64  `json:"new_listings"`
+	NewAuctions    int64  `json:"new_auctions"`
+	BidsPlaced     int64  `json:"bids_placed"`
+	OffersMade     int64  `json:"offers_made"`
+	OffersAccepted int64  `json:"offers_accepted"`
+	Mints          int64  `json:"mints"`
+	Burns          int64  `json:"burns"`
+}
+
+func newDailyStatView(stat *common.MarketplaceDailyStat) dailyStatView {
+	return dailyStatView{
+		Date:           stat.Date.Format("2006-01-02"),
+		Denom:          stat.Denom,
+		SalesCount:     stat.SalesCount,
+		Volume:         stat.Volume,
+		UniqueBuyers:   stat.UniqueBuyers,
+		UniqueSellers:  stat.UniqueSellers,
+		NewListings:    stat.NewListings,
+		NewAuctions:    stat.NewAuctions,
+		BidsPlaced:     stat.BidsPlaced,
+		OffersMade:     stat.OffersMade,
+		OffersAccepted: stat.OffersAccepted,
+		Mints:          stat.Mints,
+		Burns:          stat.Burns,
+	}
+}
+
+// collectionDetailView is a collection with its daily statistics, oldest first.
+type collectionDetailView struct {
+	collectionView
+	Daily []dailyStatView `json:"daily"`
+}
@@ -0,0 +1,151 @@
+// Package changefeed notifies Postgres listeners of indexed changes. The indexer sends a
+// notification on the blocks channel after every indexed block, and triggers send one on
+// the rows channel for every inserted, updated or deleted row of the configured tables
+// (nfts, offers and auction_bids by default). Notifications are only delivered once
+// their transaction is committed. Payloads are compact JSON objects (see Block and Row):
+// listeners get the keys of changed rows and query the rows they are interested in.
+//
+// Listener subscribes to the channels and decodes the notifications. Notifications are
+// not stored, so those sent while a listener is disconnected are lost; Listener reports
+// reconnections, after which clients should resync from the tables.
+package changefeed
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	common "github.com/corestario/dwh/x/common"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+// Kinds of notifications.
+const (
+	KindBlock = "block"
+	KindRow   = "row"
+)
+
+// Operations on rows.
+const (
+	OpInsert = "INSERT"
+	OpUpdate = "UPDATE"
+	OpDelete = "DELETE"
+)
+
+// triggerName is the name of the triggers of the tables, which lets Setup find the
+// triggers of tables that were removed from the config.
+const triggerName = "dwh_change_feed"
+
+// notifyRowFunction sends the notification of a row on the channel given as the
+// argument of the trigger. Columns are read from the JSON of the row, so tables without
+// some of them get nulls.
+const notifyRowFunction = `CREATE OR REPLACE FUNCTION public.dwh_change_feed_notify() RETURNS trigger AS $$
+DECLARE
+	r jsonb;
+BEGIN
+	IF TG_OP = 'DELETE' THEN
+		r := to_jsonb(OLD);
+	ELSE
+		r := to_jsonb(NEW);
+	END IF;
+	PERFORM pg_notify(TG_ARGV[0], json_build_object(
+		'kind', 'row',
+		'table', TG_TABLE_NAME,
+		'op', TG_OP,
+		'chain_id', r->'chain_id',
+		'id', r->'id',
+		'denom', r->'denom',
+		'token_id', r->'token_id'
+	)::text);
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql`
+
+// Block is the payload of the notification of an indexed block. Txs is the number of
+// transactions in the block.
+type Block struct {
+	Kind    string    `json:"kind"`
+	ChainID string    `json:"chain_id"`
+	Height  int64     `json:"height"`
+	Time    time.Time `json:"time"`
+	Txs     int       `json:"txs"`
+}
+
+// Row is the payload of the notification of a changed row. ID is the primary key of the
+// row; Denom and TokenID identify the token that the row belongs to.
+type Row struct {
+	Kind    string `json:"kind"`
+	Table   string `json:"table"`
+	Op      string `json:"op"`
+	ChainID string `json:"chain_id"`
+	ID      int64  `json:"id"`
+	Denom   string `json:"denom"`
+	TokenID string `json:"token_id"`
+}
+
+// Setup creates the triggers of the configured tables, which must exist, and drops the
+// triggers of other tables. If the change feed is disabled, all triggers are dropped.
+func Setup(db *gorm.DB, cfg common.ChangeFeedCfg) error {
+	tx := db.New().Begin()
+	if err := setup(tx, cfg); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+func setup(tx *gorm.DB, cfg common.ChangeFeedCfg) error {
+	var triggers []struct{ Tbl string }
+	if err := tx.Raw("SELECT tgrelid::regclass::text AS tbl FROM pg_trigger WHERE tgname = ?", triggerName).
+		Scan(&triggers).Error; err != nil {
+		return fmt.Errorf("failed to get change feed triggers: %v", err)
+	}
+	for _, trigger := range triggers {
+		// Names given by regclass are already quoted as needed.
+		if err := tx.Exec(fmt.Sprintf("DROP TRIGGER %s ON %s", triggerName, trigger.Tbl)).Error; err != nil {
+			return fmt.Errorf("failed to drop change feed trigger of %s: %v", trigger.Tbl, err)
+		}
+	}
+	if !cfg.ChangeFeedEnabled || len(cfg.ChangeFeedTables) == 0 {
+		return nil
+	}
+	if err := tx.Exec(notifyRowFunction).Error; err != nil {
+		return fmt.Errorf("failed to create change feed function: %v", err)
+	}
+	for _, table := range cfg.ChangeFeedTables {
+		if err := tx.Exec(fmt.Sprintf(
+			"CREATE TRIGGER %s AFTER INSERT OR UPDATE OR DELETE ON %s FOR EACH ROW EXECUTE PROCEDURE public.dwh_change_feed_notify('%s')",
+			triggerName, pq.QuoteIdentifier(table), strings.Replace(cfg.ChangeFeedRowsChannel, "'", "''", -1),
+		)).Error; err != nil {
+			return fmt.Errorf("failed to create change feed trigger of %s: %v", table, err)
+		}
+	}
+
+	return nil
+}
+
+// NotifyBlock sends the notification of an indexed block, if the change feed is
+// enabled.
+func NotifyBlock(db *gorm.DB, cfg common.ChangeFeedCfg, height int64, blockTime time.Time, txs int) error {
+	if !cfg.ChangeFeedEnabled {
+		return nil
+	}
+	payload, err := json.Marshal(Block{
+		Kind:    KindBlock,
+		ChainID: common.ChainID(db),
+		Height:  height,
+		Time:    blockTime.UTC(),
+		Txs:     txs,
+	})
+	if err != nil {
+		return err
+	}
+	if err := db.New().Exec("SELECT pg_notify(?, ?)", cfg.ChangeFeedBlocksChannel, string(payload)).Error; err != nil {
+		return fmt.Errorf("failed to notify block %d: %v", height, err)
+	}
+
+	return nil
+}
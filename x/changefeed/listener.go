@@ -0,0 +1,101 @@
+package changefeed
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// pingInterval is how often an idle listener checks its connection, which is restored
+// if it was lost.
+const pingInterval = time.Minute
+
+// ErrReconnected is returned by Next after the connection to Postgres was lost and
+// restored: notifications sent in between were missed.
+var ErrReconnected = errors.New("reconnected to Postgres, notifications might have been missed")
+
+// Notification is a decoded notification. Either Block or Row is set, depending on its
+// kind.
+type Notification struct {
+	Channel string
+	Block   *Block
+	Row     *Row
+}
+
+// Listener receives the notifications of the change feed.
+type Listener struct {
+	listener *pq.Listener
+}
+
+// Listen connects to Postgres (see PostgresCfg.ConnString) and subscribes to the
+// channels, typically the blocks and rows channels of common.ChangeFeedCfg.
+func Listen(connString string, channels ...string) (*Listener, error) {
+	listener := pq.NewListener(connString, time.Second, time.Minute, nil)
+	for _, channel := range channels {
+		if err := listener.Listen(channel); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("failed to listen on %s: %v", channel, err)
+		}
+	}
+
+	return &Listener{listener: listener}, nil
+}
+
+// Next waits for the next notification until ctx is done. It returns ErrReconnected
+// after a reconnection; the listener can still be used.
+func (l *Listener) Next(ctx context.Context) (Notification, error) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return Notification{}, ctx.Err()
+		case n, ok := <-l.listener.Notify:
+			if !ok {
+				return Notification{}, errors.New("listener is closed")
+			}
+			if n == nil {
+				return Notification{}, ErrReconnected
+			}
+			return Decode(n.Channel, n.Extra)
+		case <-ticker.C:
+			go l.listener.Ping()
+		}
+	}
+}
+
+// Close closes the connection.
+func (l *Listener) Close() error {
+	return l.listener.Close()
+}
+
+// Decode decodes the payload of a notification.
+func Decode(channel, payload string) (Notification, error) {
+	var kind struct {
+		Kind string `json:"kind"`
+	}
+	if err := json.Unmarshal([]byte(payload), &kind); err != nil {
+		return Notification{}, fmt.Errorf("failed to decode notification: %v", err)
+	}
+	out := Notification{Channel: channel}
+	var err error
+	switch kind.Kind {
+	case KindBlock:
+		out.Block = &Block{}
+		err = json.Unmarshal([]byte(payload), out.Block)
+	case KindRow:
+		out.Row = &Row{}
+		err = json.Unmarshal([]byte(payload), out.Row)
+	default:
+		return out, fmt.Errorf("unknown kind of notification: %q", kind.Kind)
+	}
+	if err != nil {
+		return out, fmt.Errorf("failed to decode %s notification: %v", kind.Kind, err)
+	}
+
+	return out, nil
+}
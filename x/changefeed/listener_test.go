@@ -0,0 +1,36 @@
+package changefeed
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecode(t *testing.T) {
+	blockTime := time.Date(2020, 5, 1, 12, 30, 0, 0, time.UTC)
+	payload, err := json.Marshal(Block{Kind: KindBlock, ChainID: "mpchain", Height: 7, Time: blockTime, Txs: 2})
+	require.NoError(t, err)
+	n, err := Decode("dwh_blocks", string(payload))
+	require.NoError(t, err)
+	require.Nil(t, n.Row)
+	require.Equal(t, "dwh_blocks", n.Channel)
+	require.Equal(t, Block{Kind: KindBlock, ChainID: "mpchain", Height: 7, Time: blockTime, Txs: 2}, *n.Block)
+
+	// As built by the trigger function.
+	n, err = Decode("dwh_rows", `{"kind" : "row", "table" : "offers", "op" : "DELETE", "chain_id" : "mpchain", "id" : 12, "denom" : "cards", "token_id" : "1"}`)
+	require.NoError(t, err)
+	require.Nil(t, n.Block)
+	require.Equal(t, Row{Kind: KindRow, Table: "offers", Op: OpDelete, ChainID: "mpchain", ID: 12, Denom: "cards", TokenID: "1"}, *n.Row)
+
+	// Tables without tokens.
+	n, err = Decode("dwh_rows", `{"kind" : "row", "table" : "accounts", "op" : "UPDATE", "chain_id" : "mpchain", "id" : 3, "denom" : null, "token_id" : null}`)
+	require.NoError(t, err)
+	require.Equal(t, "", n.Row.Denom)
+
+	_, err = Decode("dwh_rows", `{"kind" : "column"}`)
+	require.Error(t, err)
+	_, err = Decode("dwh_rows", `not json`)
+	require.Error(t, err)
+}
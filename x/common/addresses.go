@@ -0,0 +1,104 @@
+package dwh_common
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+)
+
+// Kinds of addresses that can be found in messages.
+const (
+	AddressKindAccount   = "account"
+	AddressKindValidator = "validator"
+	AddressKindConsensus = "consensus"
+)
+
+// maxAddressDepth limits the nesting level ExtractAddresses looks at.
+const maxAddressDepth = 32
+
+var (
+	accAddressType  = reflect.TypeOf(sdk.AccAddress{})
+	valAddressType  = reflect.TypeOf(sdk.ValAddress{})
+	consAddressType = reflect.TypeOf(sdk.ConsAddress{})
+)
+
+// MsgAddress is an address found in a message. Path is the location of the address in
+// the message (e.g., "Inputs[0].Address").
+type MsgAddress struct {
+	Address string
+	Kind    string
+	Path    string
+}
+
+// ExtractAddresses returns all non-empty addresses (sdk.AccAddress, sdk.ValAddress and
+// sdk.ConsAddress) that v contains, looking into nested structs, pointers, interfaces,
+// slices, arrays and maps.
+func ExtractAddresses(v interface{}) []MsgAddress {
+	var out []MsgAddress
+	extractAddresses(reflect.ValueOf(v), "", 0, &out)
+
+	return out
+}
+
+func extractAddresses(v reflect.Value, path string, depth int, out *[]MsgAddress) {
+	if !v.IsValid() || depth > maxAddressDepth {
+		return
+	}
+
+	switch v.Type() {
+	case accAddressType:
+		if v.Len() > 0 {
+			*out = append(*out, MsgAddress{sdk.AccAddress(v.Bytes()).String(), AddressKindAccount, path})
+		}
+		return
+	case valAddressType:
+		if v.Len() > 0 {
+			*out = append(*out, MsgAddress{sdk.ValAddress(v.Bytes()).String(), AddressKindValidator, path})
+		}
+		return
+	case consAddressType:
+		if v.Len() > 0 {
+			*out = append(*out, MsgAddress{sdk.ConsAddress(v.Bytes()).String(), AddressKindConsensus, path})
+		}
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			extractAddresses(v.Elem(), path, depth+1, out)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if field.PkgPath != "" {
+				// Unexported field.
+				continue
+			}
+			fieldPath := field.Name
+			if path != "" {
+				fieldPath = path + "." + field.Name
+			}
+			extractAddresses(v.Field(i), fieldPath, depth+1, out)
+		}
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			// Raw bytes (e.g., a public key or a signature).
+			return
+		}
+		for i := 0; i < v.Len(); i++ {
+			extractAddresses(v.Index(i), fmt.Sprintf("%s[%d]", path, i), depth+1, out)
+		}
+	case reflect.Map:
+		// Sort keys to keep the order of addresses stable.
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+		})
+		for _, key := range keys {
+			extractAddresses(v.MapIndex(key), fmt.Sprintf("%s[%v]", path, key.Interface()), depth+1, out)
+		}
+	}
+}
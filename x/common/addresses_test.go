@@ -0,0 +1,55 @@
+package dwh_common
+
+import (
+	"testing"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/stretchr/testify/require"
+)
+
+type testInput struct {
+	Address sdk.AccAddress
+	Coins   sdk.Coins
+}
+
+type testMsg struct {
+	Sender    sdk.AccAddress
+	Validator sdk.ValAddress
+	Inputs    []testInput
+	Delegate  *testInput
+	Extra     interface{}
+	Empty     sdk.AccAddress
+	Data      []byte
+	hidden    sdk.AccAddress
+}
+
+func TestExtractAddresses(t *testing.T) {
+	var (
+		sender    = sdk.AccAddress([]byte("sender______________"))
+		input0    = sdk.AccAddress([]byte("input0______________"))
+		input1    = sdk.AccAddress([]byte("input1______________"))
+		delegate  = sdk.AccAddress([]byte("delegate____________"))
+		extra     = sdk.AccAddress([]byte("extra_______________"))
+		validator = sdk.ValAddress([]byte("validator___________"))
+	)
+	msg := testMsg{
+		Sender:    sender,
+		Validator: validator,
+		Inputs:    []testInput{{Address: input0}, {Address: input1}},
+		Delegate:  &testInput{Address: delegate},
+		Extra:     extra,
+		Data:      []byte("not an address"),
+		hidden:    sender,
+	}
+
+	require.Equal(t, []MsgAddress{
+		{sender.String(), AddressKindAccount, "Sender"},
+		{validator.String(), AddressKindValidator, "Validator"},
+		{input0.String(), AddressKindAccount, "Inputs[0].Address"},
+		{input1.String(), AddressKindAccount, "Inputs[1].Address"},
+		{delegate.String(), AddressKindAccount, "Delegate.Address"},
+		{extra.String(), AddressKindAccount, "Extra"},
+	}, ExtractAddresses(msg))
+
+	require.Empty(t, ExtractAddresses(testMsg{}))
+}
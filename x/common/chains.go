@@ -0,0 +1,95 @@
+package dwh_common
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+// chainIDSetting is the gorm setting that holds the chain a database handle is scoped to.
+const chainIDSetting = "dwh:chain_id"
+
+// WithChainID returns a handle of db that is scoped to the rows of the chain: rows that
+// are created through it are tagged with the chain ID, and queries, updates and
+// deletes of models that have a ChainID field only see the rows of the chain. Raw SQL
+// is not scoped, it must filter by ChainID(db) itself. An empty chain ID removes the
+// scope.
+func WithChainID(db *gorm.DB, chainID string) *gorm.DB {
+	return db.Set(chainIDSetting, chainID)
+}
+
+// ChainID returns the chain that db is scoped to, or an empty string.
+func ChainID(db *gorm.DB) string {
+	if value, ok := db.Get(chainIDSetting); ok {
+		return value.(string)
+	}
+
+	return ""
+}
+
+func scopeChainID(scope *gorm.Scope) (string, bool) {
+	value, ok := scope.Get(chainIDSetting)
+	if !ok || value.(string) == "" {
+		return "", false
+	}
+	if _, ok := scope.FieldByName("ChainID"); !ok {
+		return "", false
+	}
+
+	return value.(string), true
+}
+
+// registerChainCallbacks registers the callbacks that implement WithChainID.
+func registerChainCallbacks(db *gorm.DB) {
+	tag := func(scope *gorm.Scope) {
+		chainID, ok := scopeChainID(scope)
+		if !ok {
+			return
+		}
+		if field, _ := scope.FieldByName("ChainID"); field.IsBlank {
+			scope.Err(field.Set(chainID))
+		}
+	}
+	filter := func(scope *gorm.Scope) {
+		if chainID, ok := scopeChainID(scope); ok {
+			scope.Search.Where(fmt.Sprintf("%s.chain_id = ?", scope.QuotedTableName()), chainID)
+		}
+	}
+
+	callbacks := db.Callback()
+	callbacks.Create().Before("gorm:create").Register("dwh:tag_chain", tag)
+	callbacks.Query().Before("gorm:query").Register("dwh:scope_chain", filter)
+	callbacks.RowQuery().Before("gorm:row_query").Register("dwh:scope_chain", filter)
+	callbacks.Update().Before("gorm:update").Register("dwh:scope_chain", filter)
+	callbacks.Delete().Before("gorm:delete").Register("dwh:scope_chain", filter)
+}
+
+// AddChainIDColumn adds the chain_id column to the table, if it has none. Existing rows,
+// as well as rows that were created without a chain, are assigned to chainID.
+func AddChainIDColumn(db *gorm.DB, table, chainID string) error {
+	name := pq.QuoteIdentifier(table)
+	// A constant default does not rewrite the table.
+	if err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS chain_id varchar(64) NOT NULL DEFAULT '%s'",
+		name, strings.Replace(chainID, "'", "''", -1))).Error; err != nil {
+		return fmt.Errorf("failed to add column %s.chain_id: %v", table, err)
+	}
+	if err := db.Exec(fmt.Sprintf("ALTER TABLE %s ALTER COLUMN chain_id SET DEFAULT ''", name)).Error; err != nil {
+		return fmt.Errorf("failed to set default of %s.chain_id: %v", table, err)
+	}
+	if err := db.Exec(fmt.Sprintf("UPDATE %s SET chain_id = ? WHERE chain_id = ''", name), chainID).Error; err != nil {
+		return fmt.Errorf("failed to fill %s.chain_id: %v", table, err)
+	}
+
+	return nil
+}
+
+// DropChainIDColumn drops the chain_id column of the table, if the table exists.
+func DropChainIDColumn(db *gorm.DB, table string) error {
+	if err := db.Exec(fmt.Sprintf("ALTER TABLE IF EXISTS %s DROP COLUMN IF EXISTS chain_id", pq.QuoteIdentifier(table))).Error; err != nil {
+		return fmt.Errorf("failed to drop column %s.chain_id: %v", table, err)
+	}
+
+	return nil
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	stdLog "log"
 	"net/url"
+	"sort"
+	"strings"
 
 	"github.com/jinzhu/gorm"
 	_ "github.com/lib/pq"
@@ -38,6 +40,39 @@ type IndexerCfg struct {
 	MarketplaceAddr string `mapstructure:"marketplace_addr"`
 	ChainID         string `mapstructure:"chain_id"`
 	CliHome         string `mapstructure:"cli_home"`
+	// Chains are the chains to index. If empty, the chain above is indexed. Rows
+	// indexed before chains were introduced belong to the first of them.
+	Chains []ChainCfg `mapstructure:"chains"`
+}
+
+// ChainCfg is a chain followed by the indexer. Every chain has its own cursor, kept at
+// StatePath (by default, the state path of the indexer suffixed with the chain ID).
+type ChainCfg struct {
+	ChainID         string `mapstructure:"chain_id"`
+	MarketplaceAddr string `mapstructure:"marketplace_addr"`
+	CliHome         string `mapstructure:"cli_home"`
+	StatePath       string `mapstructure:"state_path"`
+}
+
+// IndexedChains returns the chains to index.
+func (cfg *IndexerCfg) IndexedChains() []ChainCfg {
+	if len(cfg.Chains) == 0 {
+		return []ChainCfg{{
+			ChainID:         cfg.ChainID,
+			MarketplaceAddr: cfg.MarketplaceAddr,
+			CliHome:         cfg.CliHome,
+			StatePath:       cfg.StatePath,
+		}}
+	}
+	chains := make([]ChainCfg, len(cfg.Chains))
+	for i, chain := range cfg.Chains {
+		if chain.StatePath == "" {
+			chain.StatePath = fmt.Sprintf("%s.%s", cfg.StatePath, chain.ChainID)
+		}
+		chains[i] = chain
+	}
+
+	return chains
 }
 
 type RabbitMQCfg struct {
@@ -80,6 +115,116 @@ type MongoDaemonServiceCfg struct {
 	DaemonUpdatePercent          int64  `mapstructure:"daemon_update_percent"`
 }
 
+type AccountServiceCfg struct {
+	AccountCacheSize              int `mapstructure:"account_cache_size"`
+	AccountRefreshIntervalSeconds int `mapstructure:"account_refresh_interval_seconds"`
+	AccountRefreshBatchSize       int `mapstructure:"account_refresh_batch_size"`
+}
+
+// OutboxCfg configures the relay of RabbitMQ messages (see package outbox). Pending
+// messages are published every OutboxRelayIntervalSeconds, in batches; a message that
+// fails is retried after a backoff that doubles with every attempt, up to
+// OutboxMaxBackoffSeconds. Published messages are deleted after OutboxRetentionHours.
+type OutboxCfg struct {
+	OutboxRelayIntervalSeconds int `mapstructure:"outbox_relay_interval_seconds"`
+	OutboxBatchSize            int `mapstructure:"outbox_batch_size"`
+	OutboxMaxBackoffSeconds    int `mapstructure:"outbox_max_backoff_seconds"`
+	OutboxRetentionHours       int `mapstructure:"outbox_retention_hours"`
+}
+
+// WebhooksCfg configures webhooks (see package webhooks). If WebhooksEnabled is set,
+// the indexer queues the events that match subscriptions; the webhooks service serves
+// the API on WebhooksAPIAddr and delivers queued events every
+// WebhooksDispatchIntervalSeconds. A delivery that fails is retried with a backoff that
+// doubles with every attempt, up to WebhooksMaxBackoffSeconds, and fails after
+// WebhooksMaxAttempts. If WebhooksAPIKey is set, API requests must have it as a bearer
+// token.
+type WebhooksCfg struct {
+	WebhooksEnabled                 bool   `mapstructure:"webhooks_enabled"`
+	WebhooksAPIAddr                 string `mapstructure:"webhooks_api_addr"`
+	WebhooksAPIKey                  string `mapstructure:"webhooks_api_key"`
+	WebhooksDispatchIntervalSeconds int    `mapstructure:"webhooks_dispatch_interval_seconds"`
+	WebhooksBatchSize               int    `mapstructure:"webhooks_batch_size"`
+	WebhooksTimeoutSeconds          int    `mapstructure:"webhooks_timeout_seconds"`
+	WebhooksMaxAttempts             int    `mapstructure:"webhooks_max_attempts"`
+	WebhooksMaxBackoffSeconds       int    `mapstructure:"webhooks_max_backoff_seconds"`
+}
+
+// APICfg configures the REST read API (see package api), served on APIAddr. Lists
+// return APIDefaultPageSize rows per page unless clients ask for up to APIMaxPageSize.
+// Responses may be cached for APICacheMaxAgeSeconds. APIImagesURL is the public URL of
+// the image storage that image URLs point to; by default it is the URL the API reaches
+// the image storage at.
+type APICfg struct {
+	APIAddr               string `mapstructure:"api_addr"`
+	APIDefaultPageSize    int    `mapstructure:"api_default_page_size"`
+	APIMaxPageSize        int    `mapstructure:"api_max_page_size"`
+	APICacheMaxAgeSeconds int    `mapstructure:"api_cache_max_age_seconds"`
+	APIImagesURL          string `mapstructure:"api_images_url"`
+}
+
+// ChangeFeedCfg configures the Postgres change feed (see package changefeed). If
+// ChangeFeedEnabled is set, the indexer notifies ChangeFeedBlocksChannel of every
+// indexed block and ChangeFeedRowsChannel of every changed row of ChangeFeedTables.
+type ChangeFeedCfg struct {
+	ChangeFeedEnabled       bool     `mapstructure:"change_feed_enabled"`
+	ChangeFeedBlocksChannel string   `mapstructure:"change_feed_blocks_channel"`
+	ChangeFeedRowsChannel   string   `mapstructure:"change_feed_rows_channel"`
+	ChangeFeedTables        []string `mapstructure:"change_feed_tables"`
+}
+
+// PartitioningCfg configures range partitioning of txes and messages by height (see
+// package partitions).
+type PartitioningCfg struct {
+	// PartitioningEnabled converts txes and messages to partitioned tables. Once
+	// converted, they stay partitioned.
+	PartitioningEnabled bool              `mapstructure:"partitioning_enabled"`
+	PartitionSize       int64             `mapstructure:"partition_size"` // Number of heights per partition.
+	ArchiveSchema       string            `mapstructure:"archive_schema"`
+	RetentionPolicies   []RetentionPolicy `mapstructure:"retention_policies"`
+}
+
+// RetentionPolicy removes the rows of Table (txes or messages) that are older than
+// MaxAgeDays. Only messages of Route (any route if empty) and with Status (failed,
+// succeeded or any if empty) are removed. Action is either drop or archive; archived
+// rows are moved to the archive schema.
+type RetentionPolicy struct {
+	Table      string `mapstructure:"table"`
+	Route      string `mapstructure:"route"`
+	Status     string `mapstructure:"status"`
+	MaxAgeDays int    `mapstructure:"max_age_days"`
+	Action     string `mapstructure:"action"`
+}
+
+// ClickHouseCfg configures the ClickHouse sink of domain events (see package sinks).
+// Committed events are inserted in batches of up to ClickHouseBatchSize, every
+// ClickHouseFlushIntervalSeconds.
+type ClickHouseCfg struct {
+	ClickHouseEnabled              bool   `mapstructure:"clickhouse_enabled"`
+	ClickHouseURL                  string `mapstructure:"clickhouse_url"` // URL of the HTTP interface.
+	ClickHouseDatabase             string `mapstructure:"clickhouse_database"`
+	ClickHouseTable                string `mapstructure:"clickhouse_table"`
+	ClickHouseUser                 string `mapstructure:"clickhouse_user"`
+	ClickHousePassword             string `mapstructure:"clickhouse_password"`
+	ClickHouseBatchSize            int    `mapstructure:"clickhouse_batch_size"`
+	ClickHouseFlushIntervalSeconds int    `mapstructure:"clickhouse_flush_interval_seconds"`
+}
+
+// StreamCfg configures the stream of typed domain events (see common.StreamEvent and
+// sinks.Stream). StreamBroker is "kafka" (through the REST Proxy), "nats" or empty to
+// disable the stream; StreamTopic is the Kafka topic or NATS subject. Events are
+// published in batches as described in ClickHouseCfg.
+type StreamCfg struct {
+	StreamBroker               string `mapstructure:"stream_broker"`
+	StreamTopic                string `mapstructure:"stream_topic"`
+	StreamKafkaRestURL         string `mapstructure:"stream_kafka_rest_url"`
+	StreamNATSAddr             string `mapstructure:"stream_nats_addr"` // host:port
+	StreamNATSUser             string `mapstructure:"stream_nats_user"`
+	StreamNATSPassword         string `mapstructure:"stream_nats_password"`
+	StreamBatchSize            int    `mapstructure:"stream_batch_size"`
+	StreamFlushIntervalSeconds int    `mapstructure:"stream_flush_interval_seconds"`
+}
+
 type MongoDBCfg struct {
 	MongoUserName   string `mapstructure:"mongo_user_name"`
 	MongoUserPass   string `mapstructure:"mongo_user_pass"`
@@ -94,6 +239,19 @@ type PostgresCfg struct {
 	PostgresHost     string `mapstructure:"postgres_host"`
 	PostgresPort     int    `mapstructure:"postgres_port"`
 	PostgresDBName   string `mapstructure:"postgres_db_name"`
+	// PostgresSchemas maps handlers (see MsgHandler.Migrations) to the Postgres schemas
+	// of their tables. Tables shared by all handlers are in the public schema.
+	PostgresSchemas map[string]string `mapstructure:"postgres_schemas"`
+}
+
+// PostgresSchema returns the Postgres schema of the handler's tables; by default it is
+// named after the handler.
+func (cfg *PostgresCfg) PostgresSchema(component string) string {
+	if schema, ok := cfg.PostgresSchemas[component]; ok && schema != "" {
+		return schema
+	}
+
+	return component
 }
 
 type DwhCommonServiceConfig struct {
@@ -103,6 +261,14 @@ type DwhCommonServiceConfig struct {
 	ImgStorageServiceCfg    `mapstructure:"img_storage_service"`
 	TokenMetaDataServiceCfg `mapstructure:"token_metadata_service"`
 	MongoDaemonServiceCfg   `mapstructure:"mongo_daemon_service"`
+	AccountServiceCfg       `mapstructure:"account_service"`
+	OutboxCfg               `mapstructure:"outbox"`
+	WebhooksCfg             `mapstructure:"webhooks"`
+	ChangeFeedCfg           `mapstructure:"change_feed"`
+	APICfg                  `mapstructure:"api"`
+	PartitioningCfg         `mapstructure:"partitioning"`
+	ClickHouseCfg           `mapstructure:"clickhouse"`
+	StreamCfg               `mapstructure:"stream"`
 	MongoDBCfg              `mapstructure:"mongo_db"`
 	PostgresCfg             `mapstructure:"postgres_db"`
 }
@@ -159,6 +325,67 @@ func DefaultDwhCommonServiceConfig() *DwhCommonServiceConfig {
 			DaemonUpdatePercent:          20,
 		},
 
+		AccountServiceCfg: AccountServiceCfg{
+			AccountCacheSize:              10000,
+			AccountRefreshIntervalSeconds: 5,
+			AccountRefreshBatchSize:       100,
+		},
+
+		OutboxCfg: OutboxCfg{
+			OutboxRelayIntervalSeconds: 1,
+			OutboxBatchSize:            100,
+			OutboxMaxBackoffSeconds:    300,
+			OutboxRetentionHours:       24 * 7,
+		},
+
+		WebhooksCfg: WebhooksCfg{
+			WebhooksEnabled:                 false,
+			WebhooksAPIAddr:                 "0.0.0.0:11600",
+			WebhooksDispatchIntervalSeconds: 1,
+			WebhooksBatchSize:               100,
+			WebhooksTimeoutSeconds:          10,
+			WebhooksMaxAttempts:             12,
+			WebhooksMaxBackoffSeconds:       3600,
+		},
+
+		ChangeFeedCfg: ChangeFeedCfg{
+			ChangeFeedEnabled:       false,
+			ChangeFeedBlocksChannel: "dwh_blocks",
+			ChangeFeedRowsChannel:   "dwh_rows",
+			ChangeFeedTables:        []string{"nfts", "offers", "auction_bids"},
+		},
+
+		APICfg: APICfg{
+			APIAddr:               "0.0.0.0:11700",
+			APIDefaultPageSize:    50,
+			APIMaxPageSize:        500,
+			APICacheMaxAgeSeconds: 10,
+		},
+
+		PartitioningCfg: PartitioningCfg{
+			PartitioningEnabled: false,
+			PartitionSize:       100000,
+			ArchiveSchema:       "archive",
+		},
+
+		ClickHouseCfg: ClickHouseCfg{
+			ClickHouseEnabled:              false,
+			ClickHouseURL:                  "http://localhost:8123",
+			ClickHouseDatabase:             "default",
+			ClickHouseTable:                "domain_events",
+			ClickHouseUser:                 "default",
+			ClickHouseBatchSize:            1000,
+			ClickHouseFlushIntervalSeconds: 5,
+		},
+
+		StreamCfg: StreamCfg{
+			StreamTopic:                "dwh.events",
+			StreamKafkaRestURL:         "http://localhost:8082",
+			StreamNATSAddr:             "localhost:4222",
+			StreamBatchSize:            500,
+			StreamFlushIntervalSeconds: 1,
+		},
+
 		MongoDBCfg: MongoDBCfg{
 			MongoUserName:   "dgaming",
 			MongoUserPass:   "dgaming",
@@ -173,10 +400,26 @@ func DefaultDwhCommonServiceConfig() *DwhCommonServiceConfig {
 			PostgresHost:     "localhost",
 			PostgresPort:     5432,
 			PostgresDBName:   "marketplace",
+			PostgresSchemas: map[string]string{
+				"marketplace": "marketplace",
+			},
 		},
 	}
 }
 
+// ForChain returns a copy of the config with the indexer settings of the chain, for the
+// services that index it (see GetEnv).
+func (cfg *DwhCommonServiceConfig) ForChain(chain ChainCfg) *DwhCommonServiceConfig {
+	out := *cfg
+	out.ChainID = chain.ChainID
+	out.MarketplaceAddr = chain.MarketplaceAddr
+	out.CliHome = chain.CliHome
+	out.StatePath = chain.StatePath
+	out.Chains = nil
+
+	return &out
+}
+
 func QueueAddrStringFromConfig(cfg *DwhCommonServiceConfig) string {
 	u := url.URL{
 		Scheme: cfg.RabbitMQCfg.QueueScheme,
@@ -231,15 +474,40 @@ func InitConfig() {
 }
 
 func GetDB(cfg *DwhCommonServiceConfig) (*gorm.DB, error) {
-	ConnString := fmt.Sprintf(
-		"host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
+	ConnString := cfg.ConnString()
+	stdLog.Println("ConnString:", ConnString)
+
+	db, err := gorm.Open("postgres", ConnString)
+	if err != nil {
+		return nil, err
+	}
+	registerChainCallbacks(db)
+
+	return db, nil
+}
+
+// ConnString returns the connection string of the database.
+func (cfg *PostgresCfg) ConnString() string {
+	// Tables are referred to by their unqualified names, so the search path includes the
+	// schemas of all handlers. The public schema goes first, so that it is the current
+	// schema (e.g., for gorm's HasTable).
+	searchPath := []string{"public"}
+	var components []string
+	for component := range cfg.PostgresSchemas {
+		components = append(components, component)
+	}
+	sort.Strings(components)
+	for _, component := range components {
+		searchPath = append(searchPath, cfg.PostgresSchema(component))
+	}
+
+	return fmt.Sprintf(
+		"host=%s port=%d user=%s password=%s dbname=%s sslmode=disable search_path=%s",
 		cfg.PostgresHost,
 		cfg.PostgresPort,
 		cfg.PostgresUserName,
 		cfg.PostgresUserPass,
 		cfg.PostgresDBName,
+		strings.Join(searchPath, ","),
 	)
-	stdLog.Println("ConnString:", ConnString)
-
-	return gorm.Open("postgres", ConnString)
 }
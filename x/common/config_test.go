@@ -0,0 +1,35 @@
+package dwh_common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexedChains(t *testing.T) {
+	cfg := DefaultDwhCommonServiceConfig()
+	cfg.ChainID, cfg.MarketplaceAddr, cfg.StatePath = "mpchain", "tcp://marketplace:26657", "./indexer.state"
+
+	chains := cfg.IndexedChains()
+	require.Equal(t, 1, len(chains))
+	require.Equal(t, "mpchain", chains[0].ChainID)
+	require.Equal(t, "tcp://marketplace:26657", chains[0].MarketplaceAddr)
+	require.Equal(t, "./indexer.state", chains[0].StatePath)
+
+	cfg.Chains = []ChainCfg{
+		{ChainID: "mainnet", MarketplaceAddr: "tcp://mainnet:26657"},
+		{ChainID: "testnet", MarketplaceAddr: "tcp://testnet:26657", StatePath: "./testnet.state"},
+	}
+	chains = cfg.IndexedChains()
+	require.Equal(t, 2, len(chains))
+	require.Equal(t, "./indexer.state.mainnet", chains[0].StatePath)
+	require.Equal(t, "./testnet.state", chains[1].StatePath)
+
+	chainCfg := cfg.ForChain(chains[1])
+	require.Equal(t, "testnet", chainCfg.ChainID)
+	require.Equal(t, "tcp://testnet:26657", chainCfg.MarketplaceAddr)
+	require.Equal(t, "./testnet.state", chainCfg.StatePath)
+	require.Empty(t, chainCfg.Chains)
+	require.Equal(t, "mpchain", cfg.ChainID)
+	require.Equal(t, 2, len(cfg.Chains))
+}
@@ -23,6 +23,7 @@ const (
 	PrometheusValueMsgTransferNFT            = "MsgTransferNFT"
 	PrometheusValueMsgCreateFungibleToken    = "MsgCreateFungibleToken"
 	PrometheusValueMsgTransferFungibleTokens = "MsgTransferFungibleTokens"
+	PrometheusValueMsgBurnFungibleTokens     = "MsgBurnFungibleTokens"
 	PrometheusValueMsgMakeOffer              = "MsgMakeOffer"
 	PrometheusValueMsgAcceptOffer            = "MsgAcceptOffer"
 	PrometheusValueMsgRemoveOffer            = "MsgRemoveOffer"
@@ -3,15 +3,24 @@ package dwh_common
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/streadway/amqp"
 )
 
+// confirmTimeout is how long PublishBody waits for the broker to confirm a message. A
+// broker that does not answer (e.g., because of a network partition) would otherwise
+// block publishing for good.
+const confirmTimeout = 30 * time.Second
+
 type RMQSender struct {
 	config *DwhCommonServiceConfig
 	conn   *amqp.Connection
 	ch     *amqp.Channel
 	imgQ   *amqp.Queue
+	// confirms receives the publisher confirmations of the broker if confirms are
+	// enabled (see EnableConfirms).
+	confirms chan amqp.Confirmation
 }
 
 func NewRMQSender(cfg *DwhCommonServiceConfig, queueName string, queueMaxPriority int) (*RMQSender, error) {
@@ -59,17 +68,52 @@ func (rs *RMQSender) Closer() error {
 	return nil
 }
 
-func (rs *RMQSender) Publish(taskUrl, owner, tokenId string, priority ImgQueuePriority) error {
+// EnableConfirms puts the channel in confirm mode: Publish waits for the broker to
+// confirm that it took responsibility for the message.
+func (rs *RMQSender) EnableConfirms() error {
+	if err := rs.ch.Confirm(false); err != nil {
+		return fmt.Errorf("could not put rabbitMQ channel in confirm mode, error: %+v", err)
+	}
+	rs.confirms = rs.ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+
+	return nil
+}
+
+// QueueName returns the name of the queue that messages are published to.
+func (rs *RMQSender) QueueName() string {
+	return rs.imgQ.Name
+}
+
+func (rs *RMQSender) Publish(taskUrl, owner, denom, tokenId string, priority ImgQueuePriority) error {
+	ba, err := MarshalTask(taskUrl, owner, denom, tokenId)
+	if err != nil {
+		return err
+	}
+
+	return rs.PublishBody(ba, priority)
+}
+
+// MarshalTask returns the body of the message of a task.
+func MarshalTask(taskUrl, owner, denom, tokenId string) ([]byte, error) {
 	ba, err := json.Marshal(&TaskInfo{
 		Owner:   owner,
 		URL:     taskUrl,
+		Denom:   denom,
 		TokenID: tokenId,
 	})
 	if err != nil {
-		return fmt.Errorf("could not marshal rabbitMQ task, error: %+v", err)
+		return nil, fmt.Errorf("could not marshal rabbitMQ task, error: %+v", err)
 	}
 
-	err = rs.ch.Publish(
+	return ba, nil
+}
+
+// PublishBody publishes a message with the given body (see MarshalTask). If confirms
+// are enabled, a message that is not confirmed within confirmTimeout fails, and the
+// sender should be closed, since a late confirmation would be taken for the next
+// message.
+func (rs *RMQSender) PublishBody(ba []byte, priority ImgQueuePriority) error {
+	err := rs.ch.Publish(
 		"",
 		rs.imgQ.Name,
 		false,
@@ -83,5 +127,18 @@ func (rs *RMQSender) Publish(taskUrl, owner, tokenId string, priority ImgQueuePr
 	if err != nil {
 		return fmt.Errorf("could not publish rabbitMQ message, error: %+v", err)
 	}
+	if rs.confirms != nil {
+		select {
+		case confirmation, ok := <-rs.confirms:
+			if !ok {
+				return fmt.Errorf("could not confirm rabbitMQ message, channel closed")
+			}
+			if !confirmation.Ack {
+				return fmt.Errorf("rabbitMQ message was not acknowledged by the broker")
+			}
+		case <-time.After(confirmTimeout):
+			return fmt.Errorf("could not confirm rabbitMQ message, no confirmation after %s", confirmTimeout)
+		}
+	}
 	return nil
 }
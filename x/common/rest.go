@@ -4,10 +4,20 @@ const (
 	StoreImagePath  = "/imgstore/store_img"
 	LoadImagePath   = "/imgstore/load_img"
 	GetCheckSumPath = "/imgstore/get_check_sum"
+	ListImagesPath  = "/imgstore/list_imgs"
+)
+
+// Cache policy of images. Images loaded with the checksum of the stored file (the "v"
+// parameter, see StoredImage) are immutable: a new image gets a new checksum, hence a
+// new URL. Other image URLs may serve a new image at any time.
+const (
+	ImmutableImageCacheControl = "public, max-age=31536000, immutable"
+	ImageCacheControl          = "public, max-age=300"
 )
 
 type ImageStoreRequest struct {
 	Owner      string `json:"owner"`
+	Denom      string `json:"denom"`
 	TokenId    string `json:"token_id"`
 	Resolution `json:"resolution"`
 	ImageBytes []byte `json:"image_bytes"` // compressed
@@ -15,6 +25,7 @@ type ImageStoreRequest struct {
 
 type ImageCheckSumRequest struct {
 	Owner      string `json:"owner"`
+	Denom      string `json:"denom"`
 	TokenId    string `json:"token_id"`
 	Resolution `json:"resolution"`
 	MD5Sum     []byte `json:"md5_sum"`
@@ -23,3 +34,16 @@ type ImageCheckSumRequest struct {
 type ImageCheckSumResponse struct {
 	ImageExists bool `json:"image_exists,omitempty"`
 }
+
+// StoredImage is an image of a token in a resolution; the original image has zero width
+// and height. MD5Sum is the checksum of the image.
+type StoredImage struct {
+	Width  uint   `json:"width"`
+	Height uint   `json:"height"`
+	MD5Sum string `json:"md5_sum"`
+}
+
+// ImageListResponse lists the stored images of a token (see ListImagesPath).
+type ImageListResponse struct {
+	Images []StoredImage `json:"images"`
+}
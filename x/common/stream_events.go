@@ -0,0 +1,167 @@
+package dwh_common
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Message types that tell stream events apart (see NewStreamEvent).
+const (
+	msgTypePutOnAuction = "put_on_auction_nft"
+	msgTypeMakeOffer    = "make_offer"
+)
+
+// Types of stream events (see StreamEvent).
+const (
+	StreamEventNFTMinted           = "NFTMinted"
+	StreamEventNFTTransferred      = "NFTTransferred"
+	StreamEventNFTListed           = "NFTListed"
+	StreamEventNFTSold             = "NFTSold"
+	StreamEventBidPlaced           = "BidPlaced"
+	StreamEventOfferMade           = "OfferMade"
+	StreamEventFungibleMinted      = "FungibleMinted"
+	StreamEventFungibleTransferred = "FungibleTransferred"
+)
+
+// StreamEventVersions are the current versions of the data of stream events. The
+// version of a type is increased when its data changes in a way that is not backward
+// compatible (e.g., a field is removed or changes its meaning).
+var StreamEventVersions = map[string]int{
+	StreamEventNFTMinted:           1,
+	StreamEventNFTTransferred:      1,
+	StreamEventNFTListed:           1,
+	StreamEventNFTSold:             1,
+	StreamEventBidPlaced:           1,
+	StreamEventOfferMade:           1,
+	StreamEventFungibleMinted:      1,
+	StreamEventFungibleTransferred: 1,
+}
+
+// StreamEvent is a typed domain event published to a broker (see sinks.Stream) and to
+// webhooks. Data is one of the *Data types below, depending on Type and Version. Events
+// may be delivered more than once (e.g., when a message is indexed again), so consumers
+// should dedupe them by ID, which is unique per event and built from the chain ID, tx
+// hash, message index and event index.
+type StreamEvent struct {
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	Version    int             `json:"version"`
+	ChainID    string          `json:"chain_id"`
+	Height     int64           `json:"height"`
+	TxHash     string          `json:"tx_hash"`
+	MsgIndex   int             `json:"msg_index"`
+	EventIndex int             `json:"event_index"`
+	Time       time.Time       `json:"time"`
+	Data       json.RawMessage `json:"data"`
+}
+
+type NFTMintedData struct {
+	Denom   string `json:"denom"`
+	TokenID string `json:"token_id"`
+	Minter  string `json:"minter"`
+	Owner   string `json:"owner"`
+}
+
+type NFTTransferredData struct {
+	Denom   string `json:"denom"`
+	TokenID string `json:"token_id"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+}
+
+// NFTListedData is the data of NFTListed. Price is the opening price of auctions.
+type NFTListedData struct {
+	Denom   string `json:"denom"`
+	TokenID string `json:"token_id"`
+	Owner   string `json:"owner"`
+	Price   string `json:"price"`
+	Auction bool   `json:"auction"`
+}
+
+type NFTSoldData struct {
+	Denom   string `json:"denom"`
+	TokenID string `json:"token_id"`
+	Seller  string `json:"seller"`
+	Buyer   string `json:"buyer"`
+	Price   string `json:"price"`
+}
+
+type BidPlacedData struct {
+	Denom   string `json:"denom"`
+	TokenID string `json:"token_id"`
+	Bidder  string `json:"bidder"`
+	Owner   string `json:"owner"`
+	Amount  string `json:"amount"`
+}
+
+type OfferMadeData struct {
+	Denom   string `json:"denom"`
+	TokenID string `json:"token_id"`
+	Buyer   string `json:"buyer"`
+	Owner   string `json:"owner"`
+	Price   string `json:"price"`
+}
+
+type FungibleMintedData struct {
+	Denom   string `json:"denom"`
+	Creator string `json:"creator"`
+	Amount  string `json:"amount"`
+}
+
+type FungibleTransferredData struct {
+	Denom  string `json:"denom"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Amount string `json:"amount"`
+}
+
+// NewStreamEvent returns the stream event of the domain event. ok is false if there is
+// none.
+func NewStreamEvent(event DomainEvent) (out StreamEvent, ok bool, err error) {
+	var data interface{}
+	switch event.Type {
+	case DomainEventMint:
+		if event.TokenID == "" {
+			out.Type, data = StreamEventFungibleMinted, FungibleMintedData{
+				Denom: event.Denom, Creator: event.Sender, Amount: event.Amount}
+		} else {
+			out.Type, data = StreamEventNFTMinted, NFTMintedData{
+				Denom: event.Denom, TokenID: event.TokenID, Minter: event.Sender, Owner: event.Recipient}
+		}
+	case DomainEventTransfer:
+		if event.TokenID == "" {
+			out.Type, data = StreamEventFungibleTransferred, FungibleTransferredData{
+				Denom: event.Denom, From: event.Sender, To: event.Recipient, Amount: event.Amount}
+		} else {
+			out.Type, data = StreamEventNFTTransferred, NFTTransferredData{
+				Denom: event.Denom, TokenID: event.TokenID, From: event.Sender, To: event.Recipient}
+		}
+	case DomainEventListing:
+		out.Type, data = StreamEventNFTListed, NFTListedData{
+			Denom: event.Denom, TokenID: event.TokenID, Owner: event.Sender, Price: event.Amount,
+			Auction: event.MsgType == msgTypePutOnAuction}
+	case DomainEventSale:
+		out.Type, data = StreamEventNFTSold, NFTSoldData{
+			Denom: event.Denom, TokenID: event.TokenID, Seller: event.Sender, Buyer: event.Recipient, Price: event.Amount}
+	case DomainEventBid:
+		if event.MsgType == msgTypeMakeOffer {
+			out.Type, data = StreamEventOfferMade, OfferMadeData{
+				Denom: event.Denom, TokenID: event.TokenID, Buyer: event.Sender, Owner: event.Recipient, Price: event.Amount}
+		} else {
+			out.Type, data = StreamEventBidPlaced, BidPlacedData{
+				Denom: event.Denom, TokenID: event.TokenID, Bidder: event.Sender, Owner: event.Recipient, Amount: event.Amount}
+		}
+	default:
+		return out, false, nil
+	}
+	if out.Data, err = json.Marshal(data); err != nil {
+		return out, false, fmt.Errorf("failed to encode %s data: %v", out.Type, err)
+	}
+	out.ID = fmt.Sprintf("%s/%s/%d/%d", event.ChainID, event.TxHash, event.MsgIndex, event.EventIndex)
+	out.Version = StreamEventVersions[out.Type]
+	out.ChainID, out.Height, out.TxHash, out.Time = event.ChainID, event.Height, event.TxHash, event.Time.UTC()
+	out.MsgIndex, out.EventIndex = event.MsgIndex, event.EventIndex
+
+	return out, true, nil
+}
@@ -1,7 +1,9 @@
 package dwh_common
 
 import (
+	"database/sql"
 	"encoding/json"
+	"strconv"
 	"strings"
 	"time"
 
@@ -9,6 +11,7 @@ import (
 	"github.com/corestario/marketplace/x/marketplace/types"
 	"github.com/jinzhu/gorm"
 	"github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/lib/pq"
 	coreTypes "github.com/tendermint/tendermint/rpc/core/types"
 )
 
@@ -28,14 +31,19 @@ type Resolution struct {
 
 type TaskInfo struct {
 	Owner   string `json:"owner"`
+	Denom   string `json:"denom"`
 	TokenID string `json:"token_id"`
 	URL     string `json:"url"`
 }
 
+// NFT is identified by a (Denom, TokenID) pair: token IDs are only unique within
+// a denom. Burned tokens are deleted for good rather than soft-deleted, so that their
+// key can be minted again.
 type NFT struct {
 	gorm.Model
-	Denom             string
-	TokenID           string `gorm:"unique;not null"`
+	ChainID           string `gorm:"type:varchar(64);not null;default:''"`
+	Denom             string `gorm:"unique_index:idx_nfts_denom_token_id;not null"`
+	TokenID           string `gorm:"unique_index:idx_nfts_denom_token_id;not null"`
 	OwnerAddress      string `gorm:"type:varchar(45)"`
 	TokenURI          string
 	Status            int
@@ -48,8 +56,8 @@ type NFT struct {
 	TimeToSell   time.Time
 
 	// Relations
-	Offers []Offer      `gorm:"ForeignKey:TokenID"`
-	Bids   []AuctionBid `gorm:"ForeignKey:TokenID"`
+	Offers []Offer      `gorm:"ForeignKey:Denom,TokenID;AssociationForeignKey:Denom,TokenID"`
+	Bids   []AuctionBid `gorm:"ForeignKey:Denom,TokenID;AssociationForeignKey:Denom,TokenID"`
 }
 
 func NewNFTFromMarketplaceNFT(denom, tokenID, ownerAddress, tokenURI string) *NFT {
@@ -64,44 +72,391 @@ func NewNFTFromMarketplaceNFT(denom, tokenID, ownerAddress, tokenURI string) *NF
 
 type Offer struct {
 	gorm.Model
+	ChainID               string `gorm:"type:varchar(64);not null;default:''"`
 	OfferID               string
 	Buyer                 string
 	Price                 string
 	BuyerBeneficiary      string
 	BeneficiaryCommission string
 	TokenID               string
+	Denom                 string
 }
 
-func NewOffer(offer *types.Offer, tokenID string) *Offer {
+func NewOffer(offer *types.Offer, denom, tokenID string) *Offer {
 	return &Offer{
 		OfferID:               offer.ID,
 		Buyer:                 offer.Buyer.String(),
 		BuyerBeneficiary:      offer.BuyerBeneficiary.String(),
 		BeneficiaryCommission: offer.BeneficiaryCommission,
 		TokenID:               tokenID,
+		Denom:                 denom,
 		Price:                 offer.Price.String(),
 	}
 }
 
 type AuctionBid struct {
 	gorm.Model
+	ChainID               string `gorm:"type:varchar(64);not null;default:''"`
 	BidderAddress         string
 	BidderBeneficiary     string
 	BeneficiaryCommission string
 	Price                 string
 	TokenID               string
+	Denom                 string
 }
 
+// Names of the marketplace tables that own price amounts.
+const (
+	AmountOwnerNFTs        = "nfts"
+	AmountOwnerOffers      = "offers"
+	AmountOwnerAuctionBids = "auction_bids"
+)
+
+// Names of the price fields that are stored as amounts.
+const (
+	AmountFieldPrice        = "price"
+	AmountFieldBuyoutPrice  = "buyout_price"
+	AmountFieldOpeningPrice = "opening_price"
+)
+
+// Amount is a single coin of a price (sdk.Coins) stored in a normalized form:
+// one row per denom with a NUMERIC amount, so that prices can be sorted, summed
+// and filtered in SQL. OwnerTable, OwnerID and Field point to the price the coin
+// belongs to (e.g., "nfts", 42, "buyout_price").
+type Amount struct {
+	gorm.Model
+	ChainID    string `gorm:"type:varchar(64);not null;default:''"`
+	OwnerTable string `gorm:"not null"`
+	OwnerID    uint   `gorm:"not null"`
+	Field      string `gorm:"not null"`
+	Denom      string `gorm:"not null"`
+	Amount     string `gorm:"type:numeric;not null"`
+}
+
+func NewAmounts(ownerTable string, ownerID uint, field string, coins sdk.Coins) []*Amount {
+	var out []*Amount
+	for _, coin := range coins {
+		out = append(out, &Amount{
+			OwnerTable: ownerTable,
+			OwnerID:    ownerID,
+			Field:      field,
+			Denom:      coin.Denom,
+			Amount:     coin.Amount.String(),
+		})
+	}
+
+	return out
+}
+
+// Names of the collection statistics tables and their price fields.
+const (
+	AmountOwnerCollections = "collections"
+	AmountOwnerSales       = "sales"
+
+	AmountFieldFloorPrice = "floor_price"
+	AmountFieldVolume     = "volume"
+
+	// CollectionVolumes24hView holds the volume of the sales of the last 24 hours by
+	// collection (chain_id, collection, denom and amount rows).
+	CollectionVolumes24hView = "collection_volumes_24h"
+)
+
+// Collection holds statistics of the NFTs that share a denom. It is updated by the
+// indexer as messages arrive. FloorPrice and Volume are also stored as amounts; the
+// volume of the last 24 hours is computed when it is read (see
+// CollectionVolumes24hView).
+type Collection struct {
+	gorm.Model
+	ChainID         string `gorm:"type:varchar(64);not null;default:''"`
+	Denom           string `gorm:"unique;not null"`
+	Creator         string `gorm:"type:varchar(45)"`
+	FirstMintHeight int64
+	TotalMinted     int64
+	Burned          int64
+	UniqueHolders   int64
+	OnMarket        int64
+	OnAuction       int64
+	FloorPrice      string
+	Volume          string
+}
+
+// Sale is a completed deal: an NFT that was sold on the market, on an auction or by
+// accepting an offer. Price is also stored as amounts.
+type Sale struct {
+	gorm.Model
+	ChainID string `gorm:"type:varchar(64);not null;default:''"`
+	Denom   string `gorm:"not null"`
+	TokenID string `gorm:"not null"`
+	Seller  string `gorm:"type:varchar(45)"`
+	Buyer   string `gorm:"type:varchar(45)"`
+	Price   string
+	MsgType string
+	Height  int64
+	Time    time.Time
+	TxHash  string
+}
+
+// Beneficiary roles in a deal.
+const (
+	BeneficiaryRoleSeller = "seller"
+	BeneficiaryRoleBuyer  = "buyer"
+)
+
+// Names of the beneficiary earnings table and its amount field.
+const (
+	AmountOwnerBeneficiaryEarnings = "beneficiary_earnings"
+	AmountFieldAmount              = "amount"
+)
+
+// BeneficiaryEarning is a commission that a beneficiary got from a sale: Share is the
+// fraction of the sale price paid to the beneficiary, Amount is also stored as
+// amounts.
+type BeneficiaryEarning struct {
+	gorm.Model
+	ChainID     string `gorm:"type:varchar(64);not null;default:''"`
+	SaleID      uint   `gorm:"not null;index"`
+	Beneficiary string `gorm:"type:varchar(45);not null;index"`
+	Role        string `gorm:"not null"`
+	Share       string `gorm:"type:numeric;not null"`
+	Amount      string
+}
+
+func NewBeneficiaryEarning(saleID uint, beneficiary, role string, share float64, amount sdk.Coins) *BeneficiaryEarning {
+	return &BeneficiaryEarning{
+		SaleID:      saleID,
+		Beneficiary: beneficiary,
+		Role:        role,
+		Share:       strconv.FormatFloat(share, 'f', -1, 64),
+		Amount:      amount.String(),
+	}
+}
+
+// MarketplaceDailyStat holds the marketplace activity of a collection (an NFT denom)
+// during a day (UTC, by block time). Activity that involves a price is accounted under
+// each coin denom of the price; mints and burns are accounted under an empty Denom.
+type MarketplaceDailyStat struct {
+	gorm.Model
+	ChainID        string    `gorm:"type:varchar(64);not null;default:''"`
+	Date           time.Time `gorm:"type:date;unique_index:idx_marketplace_daily_stats_key;not null"`
+	Denom          string    `gorm:"unique_index:idx_marketplace_daily_stats_key;not null"`
+	Collection     string    `gorm:"unique_index:idx_marketplace_daily_stats_key;not null"`
+	SalesCount     int64
+	Volume         string `gorm:"type:numeric;not null;default:0"`
+	UniqueBuyers   int64
+	UniqueSellers  int64
+	NewListings    int64
+	NewAuctions    int64
+	BidsPlaced     int64
+	OffersMade     int64
+	OffersAccepted int64
+	Mints          int64
+	Burns          int64
+}
+
+// Roles of an address in an activity.
+const (
+	ActivityRoleSeller    = "seller"
+	ActivityRoleBuyer     = "buyer"
+	ActivityRoleBidder    = "bidder"
+	ActivityRoleRecipient = "recipient"
+	ActivityRoleSigner    = "signer"
+)
+
+// AddressActivity is an entry of the activity feed of an address: a message (Action is
+// the message type) that involves the address in the given role. Denom and TokenID
+// identify the token (TokenID is empty for fungible tokens); Amount is a coins string.
+type AddressActivity struct {
+	gorm.Model
+	ChainID  string `gorm:"type:varchar(64);not null;default:''"`
+	Address  string `gorm:"type:varchar(45);not null"`
+	Role     string `gorm:"not null"`
+	Action   string `gorm:"not null"`
+	Denom    string
+	TokenID  string
+	Amount   string
+	Height   int64 `gorm:"not null"`
+	Time     time.Time
+	TxHash   string
+	MsgIndex int
+}
+
+func (AddressActivity) TableName() string {
+	return "address_activity"
+}
+
+// Types of domain events.
+const (
+	DomainEventSale     = "sale"
+	DomainEventListing  = "listing"
+	DomainEventBid      = "bid"
+	DomainEventTransfer = "transfer"
+	DomainEventMint     = "mint"
+)
+
+// DomainEvent is a normalized marketplace event (a sale, a listing, a bid, a transfer or
+// a mint), written in the same shape to every sink (see package sinks). Denom and
+// TokenID identify the token (TokenID is empty for fungible tokens); Sender and
+// Recipient are the parties (e.g., the seller and the buyer of a sale, or the bidder
+// and the owner of the token for a bid); Amount is a coins string (e.g., the price of a
+// listing). EventIndex orders the events of a message.
+type DomainEvent struct {
+	gorm.Model
+	ChainID    string `gorm:"type:varchar(64);not null;default:''"`
+	Type       string `gorm:"not null"`
+	MsgType    string `gorm:"not null"`
+	Height     int64  `gorm:"not null"`
+	Time       time.Time
+	TxHash     string
+	MsgIndex   int
+	EventIndex int
+	Denom      string
+	TokenID    string
+	Sender     string `gorm:"type:varchar(45)"`
+	Recipient  string `gorm:"type:varchar(45)"`
+	Amount     string
+}
+
+// SQLTx runs SQL in a transaction, e.g. the *sql.Tx of a gorm transaction (see
+// gorm.DB.CommonDB). Sinks of domain events take it rather than a gorm handle, so they
+// do not depend on the ORM of the handlers. Queries use Postgres placeholders ($1).
+type SQLTx interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// DomainEventCursor is the ID of the last domain event of a chain that was exported to
+// an external sink (see sinks.Relay).
+type DomainEventCursor struct {
+	ID        uint      `gorm:"primary_key"`
+	ChainID   string    `gorm:"type:varchar(64);not null;default:''"`
+	Sink      string    `gorm:"not null"`
+	EventID   uint      `gorm:"not null"`
+	UpdatedAt time.Time `gorm:"not null"`
+}
+
+// OutboxMessage is a RabbitMQ message that is written in the transaction of the changes
+// it follows from, and published by a relay (see package outbox). Messages that fail to
+// be published are retried at NextAttemptAt; SentAt is set once they are published.
+type OutboxMessage struct {
+	ID            uint `gorm:"primary_key"`
+	CreatedAt     time.Time
+	ChainID       string    `gorm:"type:varchar(64);not null;default:''"`
+	Queue         string    `gorm:"not null"`
+	Priority      int       `gorm:"not null"`
+	Body          string    `gorm:"type:text;not null"`
+	Attempts      int       `gorm:"not null"`
+	LastError     string    `gorm:"type:text"`
+	NextAttemptAt time.Time `gorm:"not null"`
+	SentAt        *time.Time
+}
+
+func (OutboxMessage) TableName() string {
+	return "outbox"
+}
+
+// Statuses of webhook deliveries.
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliveryDelivered = "delivered"
+	WebhookDeliveryFailed    = "failed" // All attempts failed.
+)
+
+// WebhookSubscription is a URL that is sent the stream events (see StreamEvent) that
+// match its filters (see package webhooks). Empty filters match any event; ChainID
+// matches the chain of an event, and Address either party of it (e.g., the owner of a
+// token that receives a bid). Deliveries are signed with Secret.
+type WebhookSubscription struct {
+	ID         uint           `gorm:"primary_key" json:"id"`
+	CreatedAt  time.Time      `json:"created_at"`
+	UpdatedAt  time.Time      `json:"updated_at"`
+	ChainID    string         `gorm:"type:varchar(64);not null;default:''" json:"chain_id"`
+	URL        string         `gorm:"not null" json:"url"`
+	Secret     string         `gorm:"not null" json:"secret,omitempty"`
+	Address    string         `gorm:"type:varchar(45);not null" json:"address"`
+	Denom      string         `gorm:"not null" json:"denom"`
+	TokenID    string         `gorm:"not null" json:"token_id"`
+	EventTypes pq.StringArray `gorm:"type:text[]" json:"event_types"`
+	Active     bool           `gorm:"not null" json:"active"`
+}
+
+// WebhookDelivery is the delivery of an event to a subscription. Deliveries are kept as
+// a log: Attempts, LastStatusCode and LastError describe the last attempt, and a
+// pending delivery is attempted again at NextAttemptAt.
+type WebhookDelivery struct {
+	ID             uint       `gorm:"primary_key" json:"id"`
+	CreatedAt      time.Time  `json:"created_at"`
+	ChainID        string     `gorm:"type:varchar(64);not null;default:''" json:"chain_id"`
+	SubscriptionID uint       `gorm:"not null" json:"subscription_id"`
+	EventID        string     `gorm:"not null" json:"event_id"`
+	EventType      string     `gorm:"not null" json:"event_type"`
+	Payload        string     `gorm:"type:text;not null" json:"payload"`
+	Status         string     `gorm:"not null" json:"status"`
+	Attempts       int        `gorm:"not null" json:"attempts"`
+	NextAttemptAt  time.Time  `gorm:"not null" json:"next_attempt_at"`
+	LastStatusCode int        `json:"last_status_code"`
+	LastError      string     `gorm:"type:text" json:"last_error"`
+	DeliveredAt    *time.Time `json:"delivered_at"`
+}
+
+// NFTMetadata is the projection of the metadata of a token that the token metadata
+// worker writes along with the MongoDB document, so that storefront queries can join
+// it with nfts by denom and token ID. Like the documents, it is not tagged with chains.
+// Fields that the metadata lacks, or that are not strings, are empty; ValidERC721
+// reports whether the metadata follows the ERC-721 metadata JSON schema.
+type NFTMetadata struct {
+	ID          uint      `gorm:"primary_key"`
+	Denom       string    `gorm:"not null"`
+	TokenID     string    `gorm:"not null"`
+	Name        string    `gorm:"type:text;not null"`
+	Description string    `gorm:"type:text;not null"`
+	Image       string    `gorm:"type:text;not null"`
+	ExternalURL string    `gorm:"type:text;not null"`
+	FetchedAt   time.Time `gorm:"not null"`
+	ValidERC721 bool      `gorm:"column:valid_erc721;not null"`
+}
+
+func (NFTMetadata) TableName() string {
+	return "nft_metadata"
+}
+
+// NFTAttribute is an attribute (trait) of the metadata of a token (see NFTMetadata).
+// Values are kept as text: strings as they are, other values as JSON (e.g., 5 or
+// true).
+type NFTAttribute struct {
+	ID          uint   `gorm:"primary_key"`
+	Denom       string `gorm:"not null"`
+	TokenID     string `gorm:"not null"`
+	TraitType   string `gorm:"type:text;not null"`
+	Value       string `gorm:"type:text;not null"`
+	DisplayType string `gorm:"not null"`
+}
+
+// FungibleToken is an in-game currency. Its supply is EmissionAmount - BurnedAmount;
+// Inconsistent is set if the holder balances do not add up to the supply (see
+// FungibleTokenBalance).
 type FungibleToken struct {
 	gorm.Model
+	ChainID                string `gorm:"type:varchar(64);not null;default:''"`
 	OwnerAddress           string `gorm:"type:varchar(45)"`
 	Denom                  string `gorm:"unique;not null"`
 	EmissionAmount         int64
+	BurnedAmount           int64
+	Inconsistent           bool
 	FungibleTokenTransfers []FungibleTokenTransfer `gorm:"ForeignKey:FungibleTokenID"`
 }
 
+// FungibleTokenBalance is the amount of a fungible token held by an address.
+type FungibleTokenBalance struct {
+	gorm.Model
+	ChainID string `gorm:"type:varchar(64);not null;default:''"`
+	Denom   string `gorm:"unique_index:idx_fungible_token_balances_denom_holder;not null"`
+	Holder  string `gorm:"type:varchar(45);unique_index:idx_fungible_token_balances_denom_holder;not null"`
+	Amount  int64  `gorm:"not null"`
+}
+
 type FungibleTokenTransfer struct {
 	gorm.Model
+	ChainID          string `gorm:"type:varchar(64);not null;default:''"`
 	SenderAddress    string `gorm:"type:varchar(45)"`
 	RecipientAddress string `gorm:"type:varchar(45)"`
 	FungibleTokenID  int64
@@ -110,11 +465,15 @@ type FungibleTokenTransfer struct {
 
 type User struct {
 	gorm.Model
+	ChainID        string `gorm:"type:varchar(64);not null;default:''"`
 	Name           string
 	Address        string `gorm:"type:varchar(45);unique;not null"`
 	Balance        string
 	AccountNumber  uint64
 	SequenceNumber uint64
+	// AccountHeight is the height the account data (balance, account and sequence
+	// numbers) was queried at.
+	AccountHeight  int64
 	Tokens         []NFT           `gorm:"ForeignKey:OwnerAddress"`
 	FungibleTokens []FungibleToken `gorm:"ForeignKey:OwnerAddress"`
 }
@@ -132,6 +491,7 @@ func NewUser(name string, addr sdk.AccAddress, balance sdk.Coins, accountNumber,
 
 type Tx struct {
 	gorm.Model
+	ChainID   string `gorm:"type:varchar(64);not null;default:''"`
 	Hash      string `gorm:"not null"`
 	Height    int64  `gorm:"not null"`
 	Index     uint32 `gorm:"not null"`
@@ -160,6 +520,7 @@ func NewTx(tx *coreTypes.ResultTx) *Tx {
 
 type Message struct {
 	gorm.Model
+	ChainID   string `gorm:"type:varchar(64);not null;default:''"`
 	Route     string
 	MsgType   string
 	Signature postgres.Jsonb
@@ -167,6 +528,32 @@ type Message struct {
 	Failed    bool
 	Error     string
 	TxID      uint
+	Height    int64 // Height of the transaction, the partition key of messages.
+}
+
+// MessageAddress links a message to an address that the message contains (see
+// ExtractAddresses).
+type MessageAddress struct {
+	gorm.Model
+	ChainID   string `gorm:"type:varchar(64);not null;default:''"`
+	MessageID uint   `gorm:"not null"`
+	Address   string `gorm:"not null"`
+	Kind      string `gorm:"not null"`
+	Path      string
+}
+
+func NewMessageAddresses(messageID uint, msg sdk.Msg) []*MessageAddress {
+	var out []*MessageAddress
+	for _, addr := range ExtractAddresses(msg) {
+		out = append(out, &MessageAddress{
+			MessageID: messageID,
+			Address:   addr.Address,
+			Kind:      addr.Kind,
+			Path:      addr.Path,
+		})
+	}
+
+	return out
 }
 
 func NewMessage(
@@ -177,6 +564,7 @@ func NewMessage(
 	failed bool,
 	error string,
 	txID uint,
+	height int64,
 ) *Message {
 	var strSigners []string
 	for _, signer := range signers {
@@ -191,5 +579,6 @@ func NewMessage(
 		Failed:    failed,
 		Error:     error,
 		TxID:      txID,
+		Height:    height,
 	}
 }
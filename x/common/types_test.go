@@ -0,0 +1,36 @@
+package dwh_common
+
+import (
+	"testing"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewAmounts(t *testing.T) {
+	coins := sdk.NewCoins(sdk.NewInt64Coin("token", 100), sdk.NewInt64Coin("gold", 7))
+
+	amounts := NewAmounts(AmountOwnerNFTs, 42, AmountFieldPrice, coins)
+	require.Equal(t, 2, len(amounts))
+	require.Equal(t, "gold", amounts[0].Denom)
+	require.Equal(t, "7", amounts[0].Amount)
+	require.Equal(t, "token", amounts[1].Denom)
+	require.Equal(t, "100", amounts[1].Amount)
+	for _, amount := range amounts {
+		require.Equal(t, AmountOwnerNFTs, amount.OwnerTable)
+		require.Equal(t, uint(42), amount.OwnerID)
+		require.Equal(t, AmountFieldPrice, amount.Field)
+	}
+
+	require.Empty(t, NewAmounts(AmountOwnerOffers, 1, AmountFieldPrice, sdk.Coins{}))
+}
+
+func TestNewBeneficiaryEarning(t *testing.T) {
+	earning := NewBeneficiaryEarning(3, "cosmos1beneficiary", BeneficiaryRoleSeller, 0.0075,
+		sdk.NewCoins(sdk.NewInt64Coin("token", 7)))
+	require.Equal(t, uint(3), earning.SaleID)
+	require.Equal(t, "cosmos1beneficiary", earning.Beneficiary)
+	require.Equal(t, BeneficiaryRoleSeller, earning.Role)
+	require.Equal(t, "0.0075", earning.Share)
+	require.Equal(t, "7token", earning.Amount)
+}
@@ -0,0 +1,130 @@
+package dwh_common
+
+import (
+	"time"
+)
+
+// Versions are snapshots of rows of the nfts, offers and users tables. A version is
+// valid from ValidFromHeight (inclusive) to ValidToHeight (exclusive); the current
+// version of a row has no ValidToHeight. A row that was deleted has no current
+// version.
+
+// Validity is the validity period of a version.
+type Validity struct {
+	ValidFromHeight int64 `gorm:"not null"`
+	ValidToHeight   *int64
+	ValidFromTime   time.Time `gorm:"not null"`
+	ValidToTime     *time.Time
+}
+
+// Names of the version tables and of the functions that return their rows valid at a
+// given height or time.
+const (
+	NFTVersionsTable   = "nft_versions"
+	OfferVersionsTable = "offer_versions"
+	UserVersionsTable  = "user_versions"
+
+	NFTsAtHeightFunc   = "nfts_at_height"
+	NFTsAtTimeFunc     = "nfts_at_time"
+	OffersAtHeightFunc = "offers_at_height"
+	OffersAtTimeFunc   = "offers_at_time"
+	UsersAtHeightFunc  = "users_at_height"
+)
+
+type NFTVersion struct {
+	ID                uint   `gorm:"primary_key"`
+	ChainID           string `gorm:"type:varchar(64);not null;default:''"`
+	Denom             string `gorm:"not null"`
+	TokenID           string `gorm:"not null"`
+	OwnerAddress      string `gorm:"type:varchar(45)"`
+	TokenURI          string
+	Status            int
+	Price             string
+	SellerBeneficiary string
+	BuyoutPrice       string
+	OpeningPrice      string
+	TimeToSell        time.Time
+	Validity
+}
+
+func NewNFTVersion(token *NFT, height int64, t time.Time) *NFTVersion {
+	return &NFTVersion{
+		Denom:             token.Denom,
+		TokenID:           token.TokenID,
+		OwnerAddress:      token.OwnerAddress,
+		TokenURI:          token.TokenURI,
+		Status:            token.Status,
+		Price:             token.Price,
+		SellerBeneficiary: token.SellerBeneficiary,
+		BuyoutPrice:       token.BuyoutPrice,
+		OpeningPrice:      token.OpeningPrice,
+		TimeToSell:        token.TimeToSell,
+		Validity:          Validity{ValidFromHeight: height, ValidFromTime: t},
+	}
+}
+
+// SameState reports whether both versions describe the same state of a token.
+func (v *NFTVersion) SameState(other *NFTVersion) bool {
+	return v.Denom == other.Denom &&
+		v.TokenID == other.TokenID &&
+		v.OwnerAddress == other.OwnerAddress &&
+		v.TokenURI == other.TokenURI &&
+		v.Status == other.Status &&
+		v.Price == other.Price &&
+		v.SellerBeneficiary == other.SellerBeneficiary &&
+		v.BuyoutPrice == other.BuyoutPrice &&
+		v.OpeningPrice == other.OpeningPrice &&
+		v.TimeToSell.Equal(other.TimeToSell)
+}
+
+// OfferVersion is a version of an offer. Offers do not change once made, so an offer
+// has a single version that is closed when the offer is removed or accepted.
+type OfferVersion struct {
+	ID                    uint   `gorm:"primary_key"`
+	ChainID               string `gorm:"type:varchar(64);not null;default:''"`
+	OfferID               string `gorm:"not null"`
+	Buyer                 string
+	Price                 string
+	BuyerBeneficiary      string
+	BeneficiaryCommission string
+	TokenID               string `gorm:"not null"`
+	Denom                 string `gorm:"not null"`
+	Validity
+}
+
+func NewOfferVersion(offer *Offer, height int64, t time.Time) *OfferVersion {
+	return &OfferVersion{
+		OfferID:               offer.OfferID,
+		Buyer:                 offer.Buyer,
+		Price:                 offer.Price,
+		BuyerBeneficiary:      offer.BuyerBeneficiary,
+		BeneficiaryCommission: offer.BeneficiaryCommission,
+		TokenID:               offer.TokenID,
+		Denom:                 offer.Denom,
+		Validity:              Validity{ValidFromHeight: height, ValidFromTime: t},
+	}
+}
+
+// UserVersion is a version of the account data of a user. Account data is queried at
+// the heights the user appeared at (see users.account_height), so versions are only
+// accurate at those heights, and have no block time.
+type UserVersion struct {
+	ID              uint   `gorm:"primary_key"`
+	ChainID         string `gorm:"type:varchar(64);not null;default:''"`
+	Address         string `gorm:"type:varchar(45);not null"`
+	Balance         string
+	AccountNumber   uint64
+	SequenceNumber  uint64
+	ValidFromHeight int64 `gorm:"not null"`
+	ValidToHeight   *int64
+}
+
+func NewUserVersion(user *User) *UserVersion {
+	return &UserVersion{
+		Address:         user.Address,
+		Balance:         user.Balance,
+		AccountNumber:   user.AccountNumber,
+		SequenceNumber:  user.SequenceNumber,
+		ValidFromHeight: user.AccountHeight,
+	}
+}
@@ -138,6 +138,7 @@ func (irw *ImageProcessingWorker) checkImgExistence(imgBytes []byte, resolution
 	sum := md5.Sum(imgBytes)
 	req := dwh_common.ImageCheckSumRequest{
 		Owner:      info.Owner,
+		Denom:      info.Denom,
 		TokenId:    info.TokenID,
 		Resolution: resolution,
 		MD5Sum:     sum[:],
@@ -286,6 +287,7 @@ func (irw *ImageProcessingWorker) sendImage(
 
 	req := dwh_common.ImageStoreRequest{
 		Owner:      info.Owner,
+		Denom:      info.Denom,
 		TokenId:    info.TokenID,
 		Resolution: resolution,
 		ImageBytes: gzipBuf.Bytes(),
@@ -6,6 +6,7 @@ import (
 	stdLog "log"
 	"net/http"
 	"strconv"
+	"strings"
 
 	dwh_common "github.com/corestario/dwh/x/common"
 )
@@ -33,6 +34,7 @@ func (ims *ImgStorage) StoreHandler(w http.ResponseWriter, r *http.Request) {
 
 func (ims *ImgStorage) LoadHandler(w http.ResponseWriter, r *http.Request) {
 	owner := r.FormValue("owner")
+	denom := r.FormValue("denom")
 	imgType := r.FormValue("img_type")
 	widthString := r.FormValue("width")
 	heightString := r.FormValue("height")
@@ -49,16 +51,47 @@ func (ims *ImgStorage) LoadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fileName, err := ims.loadImg(owner, imgType, width, height)
+	fileName, err := ims.loadImg(owner, denom, imgType, width, height)
 	if err != nil {
+		w.Header().Set("Cache-Control", "no-store")
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte("img not found"))
 		return
 	}
 
+	// File names end with the checksum of the image.
+	if version := r.FormValue("v"); version != "" && strings.HasSuffix(fileName, "+"+version) {
+		w.Header().Set("Cache-Control", dwh_common.ImmutableImageCacheControl)
+	} else {
+		w.Header().Set("Cache-Control", dwh_common.ImageCacheControl)
+	}
 	http.ServeFile(w, r, fileName)
 }
 
+// ListHandler returns the stored images of a token ("owner", "denom" and "token_id"
+// parameters).
+func (ims *ImgStorage) ListHandler(w http.ResponseWriter, r *http.Request) {
+	images, err := ims.listImgs(r.FormValue("owner"), r.FormValue("denom"), r.FormValue("token_id"))
+	if err != nil {
+		stdLog.Println("list images error:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	ba, err := json.Marshal(&dwh_common.ImageListResponse{Images: images})
+	if err != nil {
+		stdLog.Println("list images marshal response error:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(ba); err != nil {
+		stdLog.Println("list images write response error:", err)
+		return
+	}
+}
+
 func (ims *ImgStorage) GetCheckSumHandler(w http.ResponseWriter, r *http.Request) {
 	reqB, err := ioutil.ReadAll(r.Body)
 	if err != nil {
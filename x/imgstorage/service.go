@@ -4,7 +4,8 @@ import (
 	dwh_common "github.com/corestario/dwh/x/common"
 )
 
-const FileNameFormat = "%s_%s_%d_%d"
+// FileNameFormat is used to build image keys: owner, denom, token ID, width and height.
+const FileNameFormat = "%s_%s_%s_%d_%d"
 
 type ImgStorage struct {
 	cfg                   *dwh_common.DwhCommonServiceConfig
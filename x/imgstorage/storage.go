@@ -9,6 +9,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 
 	dwh_common "github.com/corestario/dwh/x/common"
 )
@@ -34,7 +35,7 @@ func (ims *ImgStorage) storeImg(req *dwh_common.ImageStoreRequest) error {
 		}
 	}
 
-	name := fmt.Sprintf(FileNameFormat, req.Owner, req.TokenId, req.Resolution.Width, req.Resolution.Height)
+	name := fmt.Sprintf(FileNameFormat, req.Owner, req.Denom, req.TokenId, req.Resolution.Width, req.Resolution.Height)
 	filePrefix := fmt.Sprintf("%x", md5.Sum([]byte(name)))
 	names, err := filepath.Glob(path.Join(dirPath, filePrefix) + "*")
 	if err != nil {
@@ -83,7 +84,7 @@ func (ims *ImgStorage) storeImg(req *dwh_common.ImageStoreRequest) error {
 	return nil
 }
 
-func (ims *ImgStorage) loadImg(owner, imgType string, width, height int) (string, error) {
+func (ims *ImgStorage) loadImg(owner, denom, imgType string, width, height int) (string, error) {
 	dirPath := path.Join(ims.storagePath, owner)
 	inf, err := os.Stat(dirPath)
 	if os.IsNotExist(err) {
@@ -93,7 +94,7 @@ func (ims *ImgStorage) loadImg(owner, imgType string, width, height int) (string
 		return "", fmt.Errorf("error: dir not found")
 	}
 
-	name := fmt.Sprintf(FileNameFormat, owner, imgType, width, height)
+	name := fmt.Sprintf(FileNameFormat, owner, denom, imgType, width, height)
 	filePrefix := fmt.Sprintf("%x+", md5.Sum([]byte(name)))
 
 	names, err := filepath.Glob(path.Join(dirPath, filePrefix) + "*")
@@ -102,7 +103,7 @@ func (ims *ImgStorage) loadImg(owner, imgType string, width, height int) (string
 	}
 
 	if len(names) == 0 {
-		name = fmt.Sprintf(FileNameFormat, owner, imgType, 0, 0)
+		name = fmt.Sprintf(FileNameFormat, owner, denom, imgType, 0, 0)
 		filePrefix = fmt.Sprintf("%x+", md5.Sum([]byte(name)))
 		names, err = filepath.Glob(path.Join(dirPath, filePrefix) + "*")
 		if err != nil {
@@ -124,6 +125,32 @@ func (ims *ImgStorage) loadImg(owner, imgType string, width, height int) (string
 	return fullFileName, nil
 }
 
+// listImgs returns the stored images of a token in the configured resolutions and in the
+// original size.
+func (ims *ImgStorage) listImgs(owner, denom, tokenID string) ([]dwh_common.StoredImage, error) {
+	dirPath := path.Join(ims.storagePath, owner)
+	images := []dwh_common.StoredImage{}
+	resolutions := append([]dwh_common.Resolution{{}}, ims.cfg.Resolutions...)
+	for _, resolution := range resolutions {
+		name := fmt.Sprintf(FileNameFormat, owner, denom, tokenID, resolution.Width, resolution.Height)
+		filePrefix := fmt.Sprintf("%x+", md5.Sum([]byte(name)))
+		names, err := filepath.Glob(path.Join(dirPath, filePrefix) + "*")
+		if err != nil {
+			return nil, fmt.Errorf("glob error: %v", err)
+		}
+		if len(names) == 0 {
+			continue
+		}
+		images = append(images, dwh_common.StoredImage{
+			Width:  resolution.Width,
+			Height: resolution.Height,
+			MD5Sum: strings.TrimPrefix(filepath.Base(names[0]), filePrefix),
+		})
+	}
+
+	return images, nil
+}
+
 func (ims *ImgStorage) getCheckFile(req *dwh_common.ImageCheckSumRequest) bool {
 	dirPath := path.Join(ims.storagePath, req.Owner)
 	inf, err := os.Stat(dirPath)
@@ -135,7 +162,7 @@ func (ims *ImgStorage) getCheckFile(req *dwh_common.ImageCheckSumRequest) bool {
 		return false
 	}
 
-	name := fmt.Sprintf(FileNameFormat, req.Owner, req.TokenId, req.Resolution.Width, req.Resolution.Height)
+	name := fmt.Sprintf(FileNameFormat, req.Owner, req.Denom, req.TokenId, req.Resolution.Width, req.Resolution.Height)
 	filename := fmt.Sprintf("%x+%x", md5.Sum([]byte(name)), req.MD5Sum)
 	fileFullName := path.Join(ims.storagePath, req.Owner, filename)
 
@@ -145,3 +172,39 @@ func (ims *ImgStorage) getCheckFile(req *dwh_common.ImageCheckSumRequest) bool {
 	}
 	return true
 }
+
+// migrateKey renames the stored image of a token from the old key format (owner,
+// token ID, width, height) to the current one that includes the token denom.
+func (ims *ImgStorage) migrateKey(owner, denom, tokenID string, resolution dwh_common.Resolution) error {
+	dirPath := path.Join(ims.storagePath, owner)
+	oldName := fmt.Sprintf("%s_%s_%d_%d", owner, tokenID, resolution.Width, resolution.Height)
+	oldPrefix := fmt.Sprintf("%x+", md5.Sum([]byte(oldName)))
+	names, err := filepath.Glob(path.Join(dirPath, oldPrefix) + "*")
+	if err != nil {
+		return fmt.Errorf("glob error: %v", err)
+	}
+
+	newName := fmt.Sprintf(FileNameFormat, owner, denom, tokenID, resolution.Width, resolution.Height)
+	newPrefix := fmt.Sprintf("%x+", md5.Sum([]byte(newName)))
+	for _, name := range names {
+		sum := strings.TrimPrefix(filepath.Base(name), oldPrefix)
+		if err := os.Rename(name, path.Join(dirPath, newPrefix+sum)); err != nil {
+			return fmt.Errorf("could not rename file, error: %+v", err)
+		}
+	}
+
+	return nil
+}
+
+// MigrateKeys renames all stored images of a token (in every configured resolution
+// and in the original size) to the key format that includes the token denom.
+func (ims *ImgStorage) MigrateKeys(owner, denom, tokenID string) error {
+	resolutions := append([]dwh_common.Resolution{{}}, ims.cfg.Resolutions...)
+	for _, resolution := range resolutions {
+		if err := ims.migrateKey(owner, denom, tokenID, resolution); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -1,28 +1,44 @@
 package handlers
 
 import (
+	"time"
+
 	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/corestario/dwh/x/migrations"
 	"github.com/jinzhu/gorm"
 	abciTypes "github.com/tendermint/tendermint/abci/types"
 )
 
+// MsgInfo describes where a message comes from: the block and the transaction
+// that contain the message.
+type MsgInfo struct {
+	Height    int64
+	BlockTime time.Time
+	TxHash    string
+	TxIndex   uint32
+	MsgIndex  int
+}
+
 // MsgHandler is an interface for a handler used by Indexer to process messages
 // that belong to various modules. Modules are distinguished by their RouterKey
 // (e.g., cosmos-sdk/x/auth.RouterKey).
 //
 // A handler is supposed to process values of type sdk.Msg using the DB
-// connection that is utilized by Indexer.
+// transaction that Indexer opens for every message: it is committed if Handle
+// succeeds and rolled back otherwise. Messages to other services should be added
+// to an outbox in that transaction (see package outbox) rather than published
+// directly. Normalized domain events of messages (e.g., sales) should be written
+// to a sink in that transaction too (see package sinks); relays export them to
+// analytics storages once they are committed.
 type MsgHandler interface {
 	// Handle is supposed to handle a message along with its associated events.
 	// NOTE:  only events that have the same type as the message
 	// can be associated with that message.
-	Handle(db *gorm.DB, msg sdk.Msg, events ...abciTypes.Event) error
-	// Setup is supposed to prepare the storage. For example, you can create necessary tables
-	// and indices for your module here.
-	Setup(db *gorm.DB) (*gorm.DB, error)
-	// Reset is meant to clear the storage. For example, it is supposed to drop any tables
-	// and indices created by the handler.
-	Reset(db *gorm.DB) (*gorm.DB, error)
+	Handle(db *gorm.DB, info MsgInfo, msg sdk.Msg, events ...abciTypes.Event) error
+	// Migrations should return the versioned migrations that prepare the storage of the
+	// handler (e.g., create necessary tables and indices). They are applied by Indexer
+	// on start; the Down steps are supposed to drop everything the Up steps create.
+	Migrations() migrations.Source
 	// RouterKey should return the RouterKeys that are used in messages for handler's
 	// module. Multiple keys allow for using the same handler for multiple routes
 	// (which might be required if the application intercepts some other module's
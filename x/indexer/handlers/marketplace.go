@@ -1,19 +1,17 @@
 package handlers
 
 import (
-	"database/sql"
 	"errors"
 	"fmt"
-	stdLog "log"
-	"reflect"
 	"time"
 
 	sdk "github.com/cosmos/cosmos-sdk/types"
-	"github.com/cosmos/cosmos-sdk/x/auth/exported"
-	authtypes "github.com/cosmos/cosmos-sdk/x/auth/types"
 	"github.com/cosmos/modules/incubator/nft"
 	cliContext "github.com/corestario/cosmos-utils/client/context"
+	"github.com/corestario/dwh/x/accountService"
 	common "github.com/corestario/dwh/x/common"
+	"github.com/corestario/dwh/x/outbox"
+	"github.com/corestario/dwh/x/sinks"
 	app "github.com/corestario/marketplace"
 	appTypes "github.com/corestario/marketplace/x/marketplace/types"
 	mptypes "github.com/corestario/marketplace/x/marketplace/types"
@@ -25,67 +23,45 @@ import (
 
 type MarketplaceHandler struct {
 	cdc        *amino.Codec
-	cliCtx     cliContext.Context
+	cliCtx     *cliContext.Context
 	msgMetrics *common.MsgMetrics
-	uriSender  *common.RMQSender
+	uris       *outbox.Outbox // Tasks of the token metadata service.
+	accounts   *accountService.AccountService
+	schema     string // Postgres schema of the marketplace tables.
+	chainID    string // Chain that the handler indexes.
+	sink       sinks.Sink
+	events     []domainEvent // Domain events of the message being handled.
 }
 
-func NewMarketplaceHandler(cliCtx cliContext.Context) MsgHandler {
+// NewMarketplaceHandler returns a handler that writes domain events to sink (and
+// closes it when stopped) and adds the tasks of the token metadata service to uris,
+// whose relay is run by the caller.
+func NewMarketplaceHandler(
+	cliCtx *cliContext.Context,
+	accounts *accountService.AccountService,
+	chainID string,
+	sink sinks.Sink,
+	uris *outbox.Outbox,
+) MsgHandler {
 	msgMetr := common.NewPrometheusMsgMetrics("marketplace")
 	cfg := common.ReadCommonConfig(common.DefaultConfigName, common.DefaultConfigPath)
 
-	sender, err := common.NewRMQSender(cfg, cfg.UriQueueName, cfg.UriQueueMaxPriority)
-	if err != nil {
-		log.Fatalln(err.Error())
-	}
 	return &MarketplaceHandler{
 		cdc:        app.MakeCodec(),
 		cliCtx:     cliCtx,
 		msgMetrics: msgMetr,
-		uriSender:  sender,
+		uris:       uris,
+		accounts:   accounts,
+		schema:     cfg.PostgresSchema(MarketplaceMigrationsComponent),
+		chainID:    chainID,
+		sink:       sink,
 	}
 }
 
-func (m *MarketplaceHandler) findOrCreateUser(db *gorm.DB, accAddress sdk.AccAddress) (*common.User, error) {
-	user := &common.User{}
-	acc, err := m.getAccount(accAddress)
-	if err != nil {
-		return nil, fmt.Errorf("failed to find owner with addr %s: %v", accAddress.String(), err)
-	}
-	row := db.Table("users").Where("address = ?", accAddress.String()).Row()
-	err = row.Scan(
-		&user.ID,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-		&user.DeletedAt,
-		&user.Name,
-		&user.Address,
-		&user.Balance,
-		&user.AccountNumber,
-		&user.SequenceNumber)
-	if err == sql.ErrNoRows {
-		// Create a new user.
-		user = common.NewUser(
-			"",
-			acc.GetAddress(),
-			acc.GetCoins(),
-			acc.GetAccountNumber(),
-			acc.GetSequence(),
-			nil,
-		)
-		if db.Create(&user).Error != nil {
-			return nil, fmt.Errorf("failed to add user for address %s: %v", accAddress, db.Error)
-		}
-		return nil, nil
-	} else if err != nil {
-		return nil, err
-	}
-	user.SequenceNumber = acc.GetSequence()
-	db = db.Model(&user).Update("sequence_number", user.SequenceNumber)
-	if db.Error != nil {
-		return nil, fmt.Errorf("failed to update user %s: %v", accAddress, db.Error)
-	}
-	return user, nil
+// findOrCreateUser returns the user with the given address, creating it if needed. Account
+// data of the user is updated in the background by the account service.
+func (m *MarketplaceHandler) findOrCreateUser(db *gorm.DB, info MsgInfo, accAddress sdk.AccAddress) (*common.User, error) {
+	return m.accounts.FindOrCreateUser(db, accAddress, info.Height)
 }
 
 func (m *MarketplaceHandler) increaseCounter(labels ...string) {
@@ -97,71 +73,98 @@ func (m *MarketplaceHandler) increaseCounter(labels ...string) {
 	counter.Inc()
 }
 
-func (m *MarketplaceHandler) Handle(db *gorm.DB, msg sdk.Msg, events ...abciTypes.Event) error {
+func (m *MarketplaceHandler) Handle(db *gorm.DB, info MsgInfo, msg sdk.Msg, events ...abciTypes.Event) error {
 	m.increaseCounter(common.PrometheusValueReceived, common.PrometheusValueCommon)
 	log.Infof("got message of type %s: %+v", msg.Type(), msg)
+	m.events = m.events[:0]
 
 	msgAddrs, err := m.getMsgAddresses(db, msg)
 	if err != nil {
 		return fmt.Errorf("failed to get message addresses")
 	}
 	for _, addr := range msgAddrs {
-		if _, err := m.findOrCreateUser(db, addr); err != nil {
+		if _, err := m.findOrCreateUser(db, info, addr); err != nil {
 			return fmt.Errorf("failed to preemptively create users for message: %v", err)
 		}
 	}
 
+	// denom is the collection affected by the message, if any.
+	var denom string
 	switch value := msg.(type) {
 	case nft.MsgMintNFT:
 		m.increaseCounter(common.PrometheusValueReceived, common.PrometheusValueMsgMintNFT)
+		// The collection is updated before the token is created: a new collection is
+		// seeded from the tokens that already exist, which must not include this one.
+		if err := onMint(db, info, value.Denom, value.Sender.String()); err != nil {
+			return fmt.Errorf("failed to update collection (MsgMintNFT): %v", err)
+		}
 		db = db.Create(
 			common.NewNFTFromMarketplaceNFT(value.Denom, value.ID, value.Recipient.String(), value.TokenURI),
 		)
 		if db.Error != nil {
 			return fmt.Errorf("failed to create nft: %v", db.Error)
 		}
-		if err := m.uriSender.Publish(value.TokenURI, value.Recipient.String(), value.ID, common.FreshlyMadePriority); err != nil {
-			return fmt.Errorf("failed to send message to RabbitMQ: %v", err)
+		denom = value.Denom
+		if err := m.uris.Publish(db, value.TokenURI, value.Recipient.String(), value.Denom, value.ID, common.FreshlyMadePriority); err != nil {
+			return fmt.Errorf("failed to queue message for RabbitMQ: %v", err)
 		}
 		m.increaseCounter(common.PrometheusValueAccepted, common.PrometheusValueMsgMintNFT)
 	case nft.MsgBurnNFT:
 		m.increaseCounter(common.PrometheusValueReceived, common.PrometheusValueMsgBurnNFT)
-		db.Where("token_id = ?", value.ID).Delete(&common.NFT{})
-		if db.Error != nil {
-			return fmt.Errorf("failed to delete token (MsgBurnNFT): %v", db.Error)
+		// The amounts of the offers and bids of the token go along with the token's.
+		for _, owner := range []string{common.AmountOwnerNFTs, common.AmountOwnerOffers, common.AmountOwnerAuctionBids} {
+			if err := deleteAmounts(db, owner, "denom = ? AND token_id = ?", value.Denom, value.ID); err != nil {
+				return fmt.Errorf("failed to delete token amounts (MsgBurnNFT): %v", err)
+			}
+		}
+		// The collection is updated before the token is deleted: a new collection is
+		// seeded from the tokens that exist, which must include this one.
+		if err := onBurn(db, info, value.Denom); err != nil {
+			return fmt.Errorf("failed to update collection (MsgBurnNFT): %v", err)
 		}
+		// Offers and bids of the token are deleted along with it.
+		if err := db.Unscoped().Where("denom = ? AND token_id = ?", value.Denom, value.ID).Delete(&common.NFT{}).Error; err != nil {
+			return fmt.Errorf("failed to delete token (MsgBurnNFT): %v", err)
+		}
+		denom = value.Denom
 		m.increaseCounter(common.PrometheusValueAccepted, common.PrometheusValueMsgBurnNFT)
 	case nft.MsgEditNFTMetadata:
 		m.increaseCounter(common.PrometheusValueReceived, common.PrometheusValueMsgEditNFTMetadata)
-		db = db.Model(&common.NFT{}).Where("token_id = ?", value.ID).UpdateColumn(map[string]interface{}{
+		db = db.Model(&common.NFT{}).Where("denom = ? AND token_id = ?", value.Denom, value.ID).UpdateColumn(map[string]interface{}{
 			"TokenURI": value.TokenURI,
 		})
 		if db.Error != nil {
 			return fmt.Errorf("failed to update nft (MsgEditNFTMetadata): %v", db.Error)
 		}
-		if err := m.uriSender.Publish(value.TokenURI, value.Sender.String(), value.ID, common.ForcedUpdatesPriority); err != nil {
-			return fmt.Errorf("failed to send message to RabbitMQ: %v", err)
+		denom = value.Denom
+		if err := m.uris.Publish(db, value.TokenURI, value.Sender.String(), value.Denom, value.ID, common.ForcedUpdatesPriority); err != nil {
+			return fmt.Errorf("failed to queue message for RabbitMQ: %v", err)
 		}
 		m.increaseCounter(common.PrometheusValueAccepted, common.PrometheusValueMsgEditNFTMetadata)
 	case nft.MsgTransferNFT:
 		m.increaseCounter(common.PrometheusValueReceived, common.PrometheusValueMsgTransferNFT)
-		db = db.Model(&common.NFT{}).Where("token_id = ?", value.ID).UpdateColumns(map[string]interface{}{
+		db = db.Model(&common.NFT{}).Where("denom = ? AND token_id = ?", value.Denom, value.ID).UpdateColumns(map[string]interface{}{
 			"OwnerAddress": value.Recipient.String(),
 		})
 		if db.Error != nil {
 			return fmt.Errorf("failed to update nft (MsgTransferNFT): %v", db.Error)
 		}
-		tokenInfo, err := m.queryNFT(value.ID)
+		denom = value.Denom
+		tokenURI, _, err := m.getTokenURI(db, info, value.Denom, value.ID)
 		if err != nil {
-			return fmt.Errorf("failed to query nft #%s (MsgTransferNFT): %v", value.ID, err)
+			return fmt.Errorf("failed to get token URI of nft #%s (MsgTransferNFT): %v", value.ID, err)
 		}
-		if err := m.uriSender.Publish(tokenInfo.TokenURI, value.Sender.String(), value.ID, common.TransferTriggeredPriority); err != nil {
-			return fmt.Errorf("failed to send message to RabbitMQ: %v", err)
+		if err := m.uris.Publish(db, tokenURI, value.Sender.String(), value.Denom, value.ID, common.TransferTriggeredPriority); err != nil {
+			return fmt.Errorf("failed to queue message for RabbitMQ: %v", err)
 		}
 		m.increaseCounter(common.PrometheusValueAccepted, common.PrometheusValueMsgTransferNFT)
 	case mptypes.MsgPutNFTOnMarket:
 		m.increaseCounter(common.PrometheusValueReceived, common.PrometheusValueMsgPutNFTOnMarket)
-		db = db.Model(&common.NFT{}).Where("token_id = ?", value.TokenID).UpdateColumns(map[string]interface{}{
+		denom, err = m.findDenom(db, info, value.TokenID)
+		if err != nil {
+			return fmt.Errorf("failed to find denom of nft #%s (MsgPutNFTOnMarket): %v", value.TokenID, err)
+		}
+		db = db.Model(&common.NFT{}).Where("denom = ? AND token_id = ?", denom, value.TokenID).UpdateColumns(map[string]interface{}{
 			"Status":            mptypes.NFTStatusOnMarket,
 			"Price":             value.Price.String(),
 			"SellerBeneficiary": value.Beneficiary.String(),
@@ -169,10 +172,17 @@ func (m *MarketplaceHandler) Handle(db *gorm.DB, msg sdk.Msg, events ...abciType
 		if db.Error != nil {
 			return fmt.Errorf("failed to update nft (MsgPutNFTOnMarket): %v", db.Error)
 		}
+		if err := setNFTAmounts(db, denom, value.TokenID, common.AmountFieldPrice, value.Price); err != nil {
+			return fmt.Errorf("failed to set nft price (MsgPutNFTOnMarket): %v", err)
+		}
 		m.increaseCounter(common.PrometheusValueAccepted, common.PrometheusValueMsgPutNFTOnMarket)
 	case mptypes.MsgRemoveNFTFromMarket:
 		m.increaseCounter(common.PrometheusValueReceived, common.PrometheusValueMsgRemoveNFTFromMarket)
-		db = db.Model(&common.NFT{}).Where("token_id = ?", value.TokenID).UpdateColumns(map[string]interface{}{
+		denom, err = m.findDenom(db, info, value.TokenID)
+		if err != nil {
+			return fmt.Errorf("failed to find denom of nft #%s (MsgRemoveNFTFromMarket): %v", value.TokenID, err)
+		}
+		db = db.Model(&common.NFT{}).Where("denom = ? AND token_id = ?", denom, value.TokenID).UpdateColumns(map[string]interface{}{
 			"Status":            mptypes.NFTStatusDefault,
 			"SellerBeneficiary": "",
 			"Price":             sdk.Coins{}.String(),
@@ -180,10 +190,25 @@ func (m *MarketplaceHandler) Handle(db *gorm.DB, msg sdk.Msg, events ...abciType
 		if db.Error != nil {
 			return fmt.Errorf("failed to update nft (MsgRemoveNFTFromMarket): %v", db.Error)
 		}
+		if err := setNFTAmounts(db, denom, value.TokenID, common.AmountFieldPrice, nil); err != nil {
+			return fmt.Errorf("failed to reset nft price (MsgRemoveNFTFromMarket): %v", err)
+		}
 		m.increaseCounter(common.PrometheusValueAccepted, common.PrometheusValueMsgRemoveNFTFromMarket)
 	case mptypes.MsgBuyNFT:
 		m.increaseCounter(common.PrometheusValueReceived, common.PrometheusValueMsgBuyNFT)
-		db = db.Model(&common.NFT{}).Where("token_id = ?", value.TokenID).UpdateColumns(map[string]interface{}{
+		denom, err = m.findDenom(db, info, value.TokenID)
+		if err != nil {
+			return fmt.Errorf("failed to find denom of nft #%s (MsgBuyNFT): %v", value.TokenID, err)
+		}
+		token, err := getNFT(db, denom, value.TokenID)
+		if err != nil {
+			return fmt.Errorf("failed to get nft (MsgBuyNFT): %v", err)
+		}
+		price, err := sdk.ParseCoins(token.Price)
+		if err != nil {
+			return fmt.Errorf("failed to parse nft price (MsgBuyNFT): %v", err)
+		}
+		db = db.Model(&common.NFT{}).Where("denom = ? AND token_id = ?", denom, value.TokenID).UpdateColumns(map[string]interface{}{
 			"Status":       mptypes.NFTStatusDefault,
 			"OwnerAddress": value.Buyer.String(),
 			"Price":        sdk.Coins{}.String(),
@@ -191,17 +216,31 @@ func (m *MarketplaceHandler) Handle(db *gorm.DB, msg sdk.Msg, events ...abciType
 		if db.Error != nil {
 			return fmt.Errorf("failed to update nft (MsgBuyNFT): %v", db.Error)
 		}
-		tokenInfo, err := m.queryNFT(value.TokenID)
+		if err := setNFTAmounts(db, denom, value.TokenID, common.AmountFieldPrice, nil); err != nil {
+			return fmt.Errorf("failed to reset nft price (MsgBuyNFT): %v", err)
+		}
+		if err := m.recordSale(db, info, msg, token, value.Buyer.String(), price, beneficiaries{
+			seller:     token.SellerBeneficiary,
+			buyer:      value.Beneficiary.String(),
+			commission: value.BeneficiaryCommission,
+		}); err != nil {
+			return fmt.Errorf("failed to record sale (MsgBuyNFT): %v", err)
+		}
+		tokenURI, _, err := m.getTokenURI(db, info, denom, value.TokenID)
 		if err != nil {
-			return fmt.Errorf("failed to query nft #%s (MsgBuyNFT): %v", value.TokenID, err)
+			return fmt.Errorf("failed to get token URI of nft #%s (MsgBuyNFT): %v", value.TokenID, err)
 		}
-		if err := m.uriSender.Publish(tokenInfo.TokenURI, value.Buyer.String(), value.TokenID, common.TransferTriggeredPriority); err != nil {
-			return fmt.Errorf("failed to send message to RabbitMQ: %v", err)
+		if err := m.uris.Publish(db, tokenURI, value.Buyer.String(), denom, value.TokenID, common.TransferTriggeredPriority); err != nil {
+			return fmt.Errorf("failed to queue message for RabbitMQ: %v", err)
 		}
 		m.increaseCounter(common.PrometheusValueAccepted, common.PrometheusValueMsgBuyNFT)
 	case mptypes.MsgPutNFTOnAuction:
 		m.increaseCounter(common.PrometheusValueReceived, common.PrometheusValueMsgPutNFTOnAuction)
-		db = db.Model(&common.NFT{}).Where("token_id = ?", value.TokenID).UpdateColumns(map[string]interface{}{
+		denom, err = m.findDenom(db, info, value.TokenID)
+		if err != nil {
+			return fmt.Errorf("failed to find denom of nft #%s (MsgPutNFTOnAuction): %v", value.TokenID, err)
+		}
+		db = db.Model(&common.NFT{}).Where("denom = ? AND token_id = ?", denom, value.TokenID).UpdateColumns(map[string]interface{}{
 			"Status":            mptypes.NFTStatusOnAuction,
 			"BuyoutPrice":       value.BuyoutPrice.String(),
 			"OpeningPrice":      value.OpeningPrice.String(),
@@ -211,10 +250,20 @@ func (m *MarketplaceHandler) Handle(db *gorm.DB, msg sdk.Msg, events ...abciType
 		if db.Error != nil {
 			return fmt.Errorf("failed to update nft (MsgPutNFTOnAuction): %v", db.Error)
 		}
+		if err := setNFTAmounts(db, denom, value.TokenID, common.AmountFieldBuyoutPrice, value.BuyoutPrice); err != nil {
+			return fmt.Errorf("failed to set nft buyout price (MsgPutNFTOnAuction): %v", err)
+		}
+		if err := setNFTAmounts(db, denom, value.TokenID, common.AmountFieldOpeningPrice, value.OpeningPrice); err != nil {
+			return fmt.Errorf("failed to set nft opening price (MsgPutNFTOnAuction): %v", err)
+		}
 		m.increaseCounter(common.PrometheusValueAccepted, common.PrometheusValueMsgPutNFTOnAuction)
 	case mptypes.MsgRemoveNFTFromAuction:
 		m.increaseCounter(common.PrometheusValueReceived, common.PrometheusValueMsgRemoveFromAuction)
-		db = db.Model(&common.NFT{}).Where("token_id = ?", value.TokenID).UpdateColumns(map[string]interface{}{
+		denom, err = m.findDenom(db, info, value.TokenID)
+		if err != nil {
+			return fmt.Errorf("failed to find denom of nft #%s (MsgRemoveNFTFromAuction): %v", value.TokenID, err)
+		}
+		db = db.Model(&common.NFT{}).Where("denom = ? AND token_id = ?", denom, value.TokenID).UpdateColumns(map[string]interface{}{
 			"Status":            mptypes.NFTStatusDefault,
 			"BuyoutPrice":       sdk.Coins{}.String(),
 			"OpeningPrice":      sdk.Coins{}.String(),
@@ -224,18 +273,36 @@ func (m *MarketplaceHandler) Handle(db *gorm.DB, msg sdk.Msg, events ...abciType
 		if db.Error != nil {
 			return fmt.Errorf("failed to update nft (MsgRemoveNFTFromAuction): %v", db.Error)
 		}
-		db.Where("token_id = ?", value.TokenID).Delete(&common.AuctionBid{})
+		if err := resetAuctionAmounts(db, denom, value.TokenID); err != nil {
+			return fmt.Errorf("failed to reset auction amounts (MsgRemoveNFTFromAuction): %v", err)
+		}
+		db.Where("denom = ? AND token_id = ?", denom, value.TokenID).Delete(&common.AuctionBid{})
 		if db.Error != nil {
 			return fmt.Errorf("failed to delete bids (MsgRemoveNFTFromAuction): %v", db.Error)
 		}
 		m.increaseCounter(common.PrometheusValueAccepted, common.PrometheusValueMsgRemoveFromAuction)
 	case mptypes.MsgMakeBidOnAuction:
 		m.increaseCounter(common.PrometheusValueReceived, common.PrometheusValueMsgMakeBidOnAuction)
+		denom, err = m.findDenom(db, info, value.TokenID)
+		if err != nil {
+			return fmt.Errorf("failed to find denom of nft #%s (MsgMakeBidOnAuction): %v", value.TokenID, err)
+		}
+		if err := m.addBidEvent(db, denom, value.TokenID, value.Bidder.String(), value.Bid); err != nil {
+			return fmt.Errorf("failed to add bid event (MsgMakeBidOnAuction): %v", err)
+		}
 		// Find out whether we had a buyout.
 		_, isBuyout := m.getEventAttr(events, msg.Type(), mptypes.AttributeKeyIsBuyout)
 		if isBuyout {
+			token, err := getNFT(db, denom, value.TokenID)
+			if err != nil {
+				return fmt.Errorf("failed to get nft (MsgMakeBidOnAuction): %v", err)
+			}
+			price, err := sdk.ParseCoins(token.BuyoutPrice)
+			if err != nil {
+				return fmt.Errorf("failed to parse nft buyout price (MsgMakeBidOnAuction): %v", err)
+			}
 			// Reset all auction-related fields, delete all related bids.
-			db = db.Model(&common.NFT{}).Where("token_id = ?", value.TokenID).UpdateColumns(map[string]interface{}{
+			db = db.Model(&common.NFT{}).Where("denom = ? AND token_id = ?", denom, value.TokenID).UpdateColumns(map[string]interface{}{
 				"OwnerAddress":      value.Bidder.String(),
 				"Status":            mptypes.NFTStatusDefault,
 				"BuyoutPrice":       sdk.Coins{}.String(),
@@ -246,27 +313,54 @@ func (m *MarketplaceHandler) Handle(db *gorm.DB, msg sdk.Msg, events ...abciType
 			if db.Error != nil {
 				return fmt.Errorf("failed to update token (MsgMakeBidOnAuction): %v", db.Error)
 			}
-			db = db.Where("token_id = ?", value.TokenID).Delete(&common.AuctionBid{})
+			if err := resetAuctionAmounts(db, denom, value.TokenID); err != nil {
+				return fmt.Errorf("failed to reset auction amounts (MsgMakeBidOnAuction): %v", err)
+			}
+			db = db.Where("denom = ? AND token_id = ?", denom, value.TokenID).Delete(&common.AuctionBid{})
 			if db.Error != nil {
 				return fmt.Errorf("failed to delete auction bids (MsgMakeBidOnAuction): %v", db.Error)
 			}
+			if err := m.recordSale(db, info, msg, token, value.Bidder.String(), price, beneficiaries{
+				seller:     token.SellerBeneficiary,
+				buyer:      value.BuyerBeneficiary.String(),
+				commission: value.BeneficiaryCommission,
+			}); err != nil {
+				return fmt.Errorf("failed to record sale (MsgMakeBidOnAuction): %v", err)
+			}
 		} else {
-			db = db.Create(&common.AuctionBid{
+			bid := &common.AuctionBid{
 				BidderAddress:         value.Bidder.String(),
 				BidderBeneficiary:     value.BuyerBeneficiary.String(),
 				BeneficiaryCommission: value.BeneficiaryCommission,
 				Price:                 value.Bid.String(),
 				TokenID:               value.TokenID,
-			})
+				Denom:                 denom,
+			}
+			db = db.Create(bid)
 			if db.Error != nil {
 				return fmt.Errorf("failed to add auction bid (MsgMakeBidOnAuction): %v", db.Error)
 			}
+			if err := setAmounts(db, common.AmountOwnerAuctionBids, bid.ID, common.AmountFieldPrice, value.Bid); err != nil {
+				return fmt.Errorf("failed to set auction bid price (MsgMakeBidOnAuction): %v", err)
+			}
 		}
 		m.increaseCounter(common.PrometheusValueAccepted, common.PrometheusValueMsgMakeBidOnAuction)
 	case mptypes.MsgBuyoutOnAuction:
 		m.increaseCounter(common.PrometheusValueReceived, common.PrometheusValueMsgBuyoutOnAuction)
+		denom, err = m.findDenom(db, info, value.TokenID)
+		if err != nil {
+			return fmt.Errorf("failed to find denom of nft #%s (MsgBuyoutOnAuction): %v", value.TokenID, err)
+		}
+		token, err := getNFT(db, denom, value.TokenID)
+		if err != nil {
+			return fmt.Errorf("failed to get nft (MsgBuyoutOnAuction): %v", err)
+		}
+		price, err := sdk.ParseCoins(token.BuyoutPrice)
+		if err != nil {
+			return fmt.Errorf("failed to parse nft buyout price (MsgBuyoutOnAuction): %v", err)
+		}
 		// Reset all auction-related fields, delete all related bids.
-		db = db.Model(&common.NFT{}).Where("token_id = ?", value.TokenID).UpdateColumns(map[string]interface{}{
+		db = db.Model(&common.NFT{}).Where("denom = ? AND token_id = ?", denom, value.TokenID).UpdateColumns(map[string]interface{}{
 			"OwnerAddress":      value.Buyer.String(),
 			"Status":            mptypes.NFTStatusDefault,
 			"BuyoutPrice":       sdk.Coins{}.String(),
@@ -277,25 +371,50 @@ func (m *MarketplaceHandler) Handle(db *gorm.DB, msg sdk.Msg, events ...abciType
 		if db.Error != nil {
 			return fmt.Errorf("failed to transfer update token (MsgBuyoutOnAuction): %v", db.Error)
 		}
-		db.Where("token_id = ?", value.TokenID).Delete(&common.AuctionBid{})
+		if err := resetAuctionAmounts(db, denom, value.TokenID); err != nil {
+			return fmt.Errorf("failed to reset auction amounts (MsgBuyoutOnAuction): %v", err)
+		}
+		db.Where("denom = ? AND token_id = ?", denom, value.TokenID).Delete(&common.AuctionBid{})
 		if db.Error != nil {
 			return fmt.Errorf("failed to delete auction bids (MsgBuyoutOnAuction): %v", db.Error)
 		}
-		tokenInfo, err := m.queryNFT(value.TokenID)
+		if err := m.recordSale(db, info, msg, token, value.Buyer.String(), price, beneficiaries{
+			seller:     token.SellerBeneficiary,
+			buyer:      value.BuyerBeneficiary.String(),
+			commission: value.BeneficiaryCommission,
+		}); err != nil {
+			return fmt.Errorf("failed to record sale (MsgBuyoutOnAuction): %v", err)
+		}
+		tokenURI, _, err := m.getTokenURI(db, info, denom, value.TokenID)
 		if err != nil {
-			return fmt.Errorf("failed to query nft #%s (MsgBuyoutOnAuction): %v", value.TokenID, err)
+			return fmt.Errorf("failed to get token URI of nft #%s (MsgBuyoutOnAuction): %v", value.TokenID, err)
 		}
-		if err := m.uriSender.Publish(tokenInfo.TokenURI, value.Buyer.String(), value.TokenID, common.TransferTriggeredPriority); err != nil {
-			return fmt.Errorf("failed to send message to RabbitMQ: %v", err)
+		if err := m.uris.Publish(db, tokenURI, value.Buyer.String(), denom, value.TokenID, common.TransferTriggeredPriority); err != nil {
+			return fmt.Errorf("failed to queue message for RabbitMQ: %v", err)
 		}
 		m.increaseCounter(common.PrometheusValueAccepted, common.PrometheusValueMsgBuyoutOnAuction)
 	case mptypes.MsgFinishAuction:
 		m.increaseCounter(common.PrometheusValueReceived, common.PrometheusValueMsgFinishAuction)
+		denom, err = m.findDenom(db, info, value.TokenID)
+		if err != nil {
+			return fmt.Errorf("failed to find denom of nft #%s (MsgFinishAuction): %v", value.TokenID, err)
+		}
 		newOwner, ok := m.getEventAttr(events, msg.Type(), mptypes.AttributeKeyOwner)
 		if !ok {
 			return errors.New("failed to find new owner")
 		}
-		db = db.Model(&common.NFT{}).Where("token_id = ?", value.TokenID).UpdateColumns(map[string]interface{}{
+		token, err := getNFT(db, denom, value.TokenID)
+		if err != nil {
+			return fmt.Errorf("failed to get nft (MsgFinishAuction): %v", err)
+		}
+		// The auction is won by the last bid (if there were no bids, the token just
+		// goes back to its owner).
+		var lastBid common.AuctionBid
+		err = db.New().Where("denom = ? AND token_id = ?", denom, value.TokenID).Order("id DESC").First(&lastBid).Error
+		if err != nil && !gorm.IsRecordNotFoundError(err) {
+			return fmt.Errorf("failed to find last bid (MsgFinishAuction): %v", err)
+		}
+		db = db.Model(&common.NFT{}).Where("denom = ? AND token_id = ?", denom, value.TokenID).UpdateColumns(map[string]interface{}{
 			"OwnerAddress":      newOwner,
 			"Status":            mptypes.NFTStatusDefault,
 			"BuyoutPrice":       sdk.Coins{}.String(),
@@ -306,17 +425,40 @@ func (m *MarketplaceHandler) Handle(db *gorm.DB, msg sdk.Msg, events ...abciType
 		if db.Error != nil {
 			return fmt.Errorf("failed to update nft (MsgFinishAuction): %v", db.Error)
 		}
-		db.Where("token_id = ?", value.TokenID).Delete(&common.AuctionBid{})
-		tokenInfo, err := m.queryNFT(value.TokenID)
+		if err := resetAuctionAmounts(db, denom, value.TokenID); err != nil {
+			return fmt.Errorf("failed to reset auction amounts (MsgFinishAuction): %v", err)
+		}
+		db.Where("denom = ? AND token_id = ?", denom, value.TokenID).Delete(&common.AuctionBid{})
+		if lastBid.ID != 0 {
+			price, err := sdk.ParseCoins(lastBid.Price)
+			if err != nil {
+				return fmt.Errorf("failed to parse last bid price (MsgFinishAuction): %v", err)
+			}
+			if err := m.recordSale(db, info, msg, token, lastBid.BidderAddress, price, beneficiaries{
+				seller:     token.SellerBeneficiary,
+				buyer:      lastBid.BidderBeneficiary,
+				commission: lastBid.BeneficiaryCommission,
+			}); err != nil {
+				return fmt.Errorf("failed to record sale (MsgFinishAuction): %v", err)
+			}
+		}
+		tokenURI, _, err := m.getTokenURI(db, info, denom, value.TokenID)
 		if err != nil {
-			return fmt.Errorf("failed to query nft #%s (MsgFinishAuction): %v", value.TokenID, err)
+			return fmt.Errorf("failed to get token URI of nft #%s (MsgFinishAuction): %v", value.TokenID, err)
 		}
-		if err := m.uriSender.Publish(tokenInfo.TokenURI, newOwner, value.TokenID, common.TransferTriggeredPriority); err != nil {
-			return fmt.Errorf("failed to send message to RabbitMQ: %v", err)
+		if err := m.uris.Publish(db, tokenURI, newOwner, denom, value.TokenID, common.TransferTriggeredPriority); err != nil {
+			return fmt.Errorf("failed to queue message for RabbitMQ: %v", err)
 		}
 		m.increaseCounter(common.PrometheusValueAccepted, common.PrometheusValueMsgFinishAuction)
 	case mptypes.MsgMakeOffer:
 		m.increaseCounter(common.PrometheusValueReceived, common.PrometheusValueMsgMakeOffer)
+		denom, err = m.findDenom(db, info, value.TokenID)
+		if err != nil {
+			return fmt.Errorf("failed to find denom of nft #%s (MsgMakeOffer): %v", value.TokenID, err)
+		}
+		if err := m.addBidEvent(db, denom, value.TokenID, value.Buyer.String(), value.Price); err != nil {
+			return fmt.Errorf("failed to add bid event (MsgMakeOffer): %v", err)
+		}
 		var offer = &mptypes.Offer{}
 		// Retrieve the event that holds the offer ID (it is generated by the application and
 		// can not be retrieved from the transaction message).
@@ -330,56 +472,88 @@ func (m *MarketplaceHandler) Handle(db *gorm.DB, msg sdk.Msg, events ...abciType
 		offer.BuyerBeneficiary = value.BuyerBeneficiary
 		offer.BeneficiaryCommission = value.BeneficiaryCommission
 
-		db = db.Create(common.NewOffer(offer, value.TokenID))
+		dbOffer := common.NewOffer(offer, denom, value.TokenID)
+		db = db.Create(dbOffer)
 		if db.Error != nil {
 			return fmt.Errorf("failed to create an offer: %v", db.Error)
 		}
+		if err := setAmounts(db, common.AmountOwnerOffers, dbOffer.ID, common.AmountFieldPrice, value.Price); err != nil {
+			return fmt.Errorf("failed to set offer price (MsgMakeOffer): %v", err)
+		}
 		m.increaseCounter(common.PrometheusValueAccepted, common.PrometheusValueMsgMakeOffer)
 	case mptypes.MsgAcceptOffer:
 		m.increaseCounter(common.PrometheusValueReceived, common.PrometheusValueMsgAcceptOffer)
+		denom, err = m.findDenom(db, info, value.TokenID)
+		if err != nil {
+			return fmt.Errorf("failed to find denom of nft #%s (MsgAcceptOffer): %v", value.TokenID, err)
+		}
 
 		var offer = common.Offer{}
-		if err := db.Table("offers").Where("token_id = ? AND offer_id = ?", value.TokenID, value.OfferID).
-			Row().Scan(&offer.ID, &offer.CreatedAt, &offer.UpdatedAt, &offer.DeletedAt, &offer.OfferID, &offer.Buyer,
-			&offer.Price, &offer.BuyerBeneficiary, &offer.BeneficiaryCommission, &offer.TokenID); err != nil {
+		if err := db.New().Where("denom = ? AND token_id = ? AND offer_id = ?", denom, value.TokenID, value.OfferID).
+			First(&offer).Error; err != nil {
 			return fmt.Errorf("failed to scan offers (MsgAcceptOffer): %v", err)
 		}
 		if offer.ID == 0 {
 			return fmt.Errorf("unknown offer ID (not found in related offers): %s", value.OfferID)
 		}
-		db = db.Model(&common.NFT{}).Where("token_id = ?", value.TokenID).UpdateColumns(map[string]interface{}{
+		token, err := getNFT(db, denom, value.TokenID)
+		if err != nil {
+			return fmt.Errorf("failed to get nft (MsgAcceptOffer): %v", err)
+		}
+		price, err := sdk.ParseCoins(offer.Price)
+		if err != nil {
+			return fmt.Errorf("failed to parse offer price (MsgAcceptOffer): %v", err)
+		}
+		db = db.Model(&common.NFT{}).Where("denom = ? AND token_id = ?", denom, value.TokenID).UpdateColumns(map[string]interface{}{
 			"OwnerAddress": offer.Buyer,
 		})
 		if db.Error != nil {
 			return fmt.Errorf("failed to update token (MsgAcceptOffer): %v", db.Error)
 		}
-		db.Where("token_id = ? AND offer_id = ?", value.TokenID, value.OfferID).Delete(&common.Offer{})
+		if err := deleteAmounts(db, common.AmountOwnerOffers, "denom = ? AND token_id = ? AND offer_id = ?", denom, value.TokenID, value.OfferID); err != nil {
+			return fmt.Errorf("failed to delete offer amounts (MsgAcceptOffer): %v", err)
+		}
+		db.Where("denom = ? AND token_id = ? AND offer_id = ?", denom, value.TokenID, value.OfferID).Delete(&common.Offer{})
 		if db.Error != nil {
 			return fmt.Errorf("failed to delete offers (MsgAcceptOffer): %v", db.Error)
 		}
-		tokenInfo, err := m.queryNFT(value.TokenID)
+		if err := m.recordSale(db, info, msg, token, offer.Buyer, price, beneficiaries{
+			seller:     value.SellerBeneficiary.String(),
+			buyer:      offer.BuyerBeneficiary,
+			commission: value.BeneficiaryCommission,
+		}); err != nil {
+			return fmt.Errorf("failed to record sale (MsgAcceptOffer): %v", err)
+		}
+		tokenURI, _, err := m.getTokenURI(db, info, denom, value.TokenID)
 		if err != nil {
-			return fmt.Errorf("failed to query nft #%s (MsgAcceptOffer): %v", value.TokenID, err)
+			return fmt.Errorf("failed to get token URI of nft #%s (MsgAcceptOffer): %v", value.TokenID, err)
 		}
-		if err := m.uriSender.Publish(tokenInfo.TokenURI, offer.Buyer, value.TokenID, common.TransferTriggeredPriority); err != nil {
-			return fmt.Errorf("failed to send message to RabbitMQ: %v", err)
+		if err := m.uris.Publish(db, tokenURI, offer.Buyer, denom, value.TokenID, common.TransferTriggeredPriority); err != nil {
+			return fmt.Errorf("failed to queue message for RabbitMQ: %v", err)
 		}
 		m.increaseCounter(common.PrometheusValueAccepted, common.PrometheusValueMsgAcceptOffer)
 	case mptypes.MsgRemoveOffer:
 		m.increaseCounter(common.PrometheusValueReceived, common.PrometheusValueMsgRemoveOffer)
+		denom, err = m.findDenom(db, info, value.TokenID)
+		if err != nil {
+			return fmt.Errorf("failed to find denom of nft #%s (MsgRemoveOffer): %v", value.TokenID, err)
+		}
 
-		db.Where("token_id = ? AND offer_id = ?", value.TokenID, value.OfferID).Delete(&common.Offer{})
+		if err := deleteAmounts(db, common.AmountOwnerOffers, "denom = ? AND token_id = ? AND offer_id = ?", denom, value.TokenID, value.OfferID); err != nil {
+			return fmt.Errorf("failed to delete offer amounts (MsgRemoveOffer): %v", err)
+		}
+		db.Where("denom = ? AND token_id = ? AND offer_id = ?", denom, value.TokenID, value.OfferID).Delete(&common.Offer{})
 		if db.Error != nil {
 			return fmt.Errorf("failed to delete offers (MsgRemoveOffer): %v", db.Error)
 		}
 
-		tokenInfo, err := m.queryNFT(value.TokenID)
+		tokenURI, owner, err := m.getTokenURI(db, info, denom, value.TokenID)
 		if err != nil {
-			return fmt.Errorf("failed to query nft #%s (MsgRemoveOffer): %v", value.TokenID, err)
+			return fmt.Errorf("failed to get token URI of nft #%s (MsgRemoveOffer): %v", value.TokenID, err)
 		}
 
-		if err := m.uriSender.Publish(tokenInfo.TokenURI, tokenInfo.Owner.String(), value.TokenID, common.TransferTriggeredPriority); err != nil {
-			return fmt.Errorf("failed to send message to RabbitMQ: %v", err)
+		if err := m.uris.Publish(db, tokenURI, owner, denom, value.TokenID, common.TransferTriggeredPriority); err != nil {
+			return fmt.Errorf("failed to queue message for RabbitMQ: %v", err)
 		}
 
 		m.increaseCounter(common.PrometheusValueAccepted, common.PrometheusValueMsgRemoveOffer)
@@ -393,6 +567,12 @@ func (m *MarketplaceHandler) Handle(db *gorm.DB, msg sdk.Msg, events ...abciType
 		if db.Error != nil {
 			return fmt.Errorf("failed to create nft: %v", db.Error)
 		}
+		if err := addFungibleBalance(db, value.Denom, value.Creator.String(), value.Amount); err != nil {
+			return fmt.Errorf("failed to update balances (MsgCreateFungibleToken): %v", err)
+		}
+		if err := checkFungibleSupply(db, value.Denom); err != nil {
+			return fmt.Errorf("failed to check supply (MsgCreateFungibleToken): %v", err)
+		}
 		m.increaseCounter(common.PrometheusValueAccepted, common.PrometheusValueMsgCreateFungibleToken)
 	case mptypes.MsgTransferFungibleTokens:
 		m.increaseCounter(common.PrometheusValueReceived, common.PrometheusValueMsgTransferFungibleTokens)
@@ -401,10 +581,10 @@ func (m *MarketplaceHandler) Handle(db *gorm.DB, msg sdk.Msg, events ...abciType
 			sender, recipient *common.User
 			err               error
 		)
-		if sender, err = m.findOrCreateUser(db, value.Owner); err != nil {
+		if sender, err = m.findOrCreateUser(db, info, value.Owner); err != nil {
 			return err
 		}
-		if recipient, err = m.findOrCreateUser(db, value.Recipient); err != nil {
+		if recipient, err = m.findOrCreateUser(db, info, value.Recipient); err != nil {
 			return err
 		}
 		db.Where("denom = ?", value.Denom).First(&ft)
@@ -419,138 +599,77 @@ func (m *MarketplaceHandler) Handle(db *gorm.DB, msg sdk.Msg, events ...abciType
 		if db.Error != nil {
 			return fmt.Errorf("failed to transfer fungible token: %v", db.Error)
 		}
+		if err := addFungibleBalance(db, value.Denom, value.Owner.String(), -value.Amount); err != nil {
+			return fmt.Errorf("failed to update balances (MsgTransferFungibleTokens): %v", err)
+		}
+		if err := addFungibleBalance(db, value.Denom, value.Recipient.String(), value.Amount); err != nil {
+			return fmt.Errorf("failed to update balances (MsgTransferFungibleTokens): %v", err)
+		}
+		if err := checkFungibleSupply(db, value.Denom); err != nil {
+			return fmt.Errorf("failed to check supply (MsgTransferFungibleTokens): %v", err)
+		}
 		m.increaseCounter(common.PrometheusValueAccepted, common.PrometheusValueMsgTransferFungibleTokens)
-	}
-	m.increaseCounter(common.PrometheusValueAccepted, common.PrometheusValueCommon)
-	return nil
-}
-
-func (m *MarketplaceHandler) RouterKeys() []string {
-	return []string{mptypes.ModuleName, nft.ModuleName}
-}
-
-func (m *MarketplaceHandler) Setup(db *gorm.DB) (*gorm.DB, error) {
-	if !db.HasTable(&common.NFT{}) {
-		db = db.CreateTable(&common.NFT{})
+	case mptypes.MsgBurnFungibleTokens:
+		m.increaseCounter(common.PrometheusValueReceived, common.PrometheusValueMsgBurnFungibleTokens)
+		db = db.Model(&common.FungibleToken{}).Where("denom = ?", value.Denom).UpdateColumn(
+			"burned_amount", gorm.Expr("burned_amount + ?", value.Amount))
 		if db.Error != nil {
-			return nil, fmt.Errorf("failed to create table Nfts: %v", db.Error)
+			return fmt.Errorf("failed to update fungible token (MsgBurnFungibleTokens): %v", db.Error)
 		}
-	}
-	if !db.HasTable(&common.FungibleToken{}) {
-		db = db.CreateTable(&common.FungibleToken{})
-		if db.Error != nil {
-			return nil, fmt.Errorf("failed to create table FungibleTokens: %v", db.Error)
+		if err := addFungibleBalance(db, value.Denom, value.Owner.String(), -value.Amount); err != nil {
+			return fmt.Errorf("failed to update balances (MsgBurnFungibleTokens): %v", err)
 		}
-	}
-	if !db.HasTable(&common.FungibleTokenTransfer{}) {
-		db = db.CreateTable(&common.FungibleTokenTransfer{})
-		if db.Error != nil {
-			return nil, fmt.Errorf("failed to create table FungibleTokenTransfers: %v", db.Error)
+		if err := checkFungibleSupply(db, value.Denom); err != nil {
+			return fmt.Errorf("failed to check supply (MsgBurnFungibleTokens): %v", err)
 		}
+		m.increaseCounter(common.PrometheusValueAccepted, common.PrometheusValueMsgBurnFungibleTokens)
 	}
-	if !db.HasTable(&common.User{}) {
-		db = db.CreateTable(&common.User{})
-		if db.Error != nil {
-			return nil, fmt.Errorf("failed to create table Users: %v", db.Error)
+	if denom != "" {
+		if err := refreshCollection(db, info, denom); err != nil {
+			return fmt.Errorf("failed to refresh collection %s: %v", denom, err)
 		}
-	}
-	if !db.HasTable(&common.Offer{}) {
-		db = db.CreateTable(&common.Offer{})
-		if db.Error != nil {
-			return nil, fmt.Errorf("failed to create table Offers: %v", db.Error)
+		if err := countDailyStats(db, info, denom, msg); err != nil {
+			return fmt.Errorf("failed to update daily stats: %v", err)
 		}
-	}
-	if !db.HasTable(&common.AuctionBid{}) {
-		db = db.CreateTable(&common.AuctionBid{})
-		if db.Error != nil {
-			return nil, fmt.Errorf("failed to create table AuctionBids: %v", db.Error)
+		if tokenID := msgTokenID(msg); tokenID != "" {
+			if err := recordNFTVersions(db, info, denom, tokenID); err != nil {
+				return fmt.Errorf("failed to record versions: %v", err)
+			}
 		}
 	}
-
-	db = db.Model(&common.NFT{}).AddForeignKey(
-		"owner_address", "users(address)", "CASCADE", "CASCADE")
-	if db.Error != nil {
-		return nil, fmt.Errorf("failed to add foreign key (nfts): %v", db.Error)
-	}
-
-	db = db.Model(&common.FungibleToken{}).AddForeignKey(
-		"owner_address", "users(address)", "CASCADE", "CASCADE")
-	if db.Error != nil {
-		return nil, fmt.Errorf("failed to add foreign key (fuingible_tokens): %v", db.Error)
-	}
-
-	db = db.Model(&common.Offer{}).AddForeignKey(
-		"token_id", "nfts(token_id)", "CASCADE", "CASCADE")
-	if db.Error != nil {
-		return nil, fmt.Errorf("failed to add foreign key (offers): %v", db.Error)
-	}
-	db = db.Model(&common.AuctionBid{}).AddForeignKey(
-		"token_id", "nfts(token_id)", "CASCADE", "CASCADE")
-	if db.Error != nil {
-		return nil, fmt.Errorf("failed to add foreign key (auction_bids): %v", db.Error)
-	}
-
-	db = db.Model(&common.FungibleTokenTransfer{}).AddForeignKey(
-		"sender_address", "users(address)", "CASCADE", "CASCADE")
-	if db.Error != nil {
-		return nil, fmt.Errorf("failed to add foreign key (fungible_tokens_transfers): %v", db.Error)
+	if err := recordMsgActivity(db, info, msg, denom); err != nil {
+		return fmt.Errorf("failed to record activity: %v", err)
 	}
-	db = db.Model(&common.FungibleTokenTransfer{}).AddForeignKey(
-		"recipient_address", "users(address)", "CASCADE", "CASCADE")
-	if db.Error != nil {
-		return nil, fmt.Errorf("failed to add foreign key (fungible_tokens_transfers): %v", db.Error)
-	}
-	db = db.Model(&common.FungibleTokenTransfer{}).AddForeignKey(
-		"fungible_token_id", "fungible_tokens(id)", "CASCADE", "CASCADE")
-	if db.Error != nil {
-		return nil, fmt.Errorf("failed to add foreign key (fungible_tokens_transfers): %v", db.Error)
+	if err := m.writeEvents(db, info, msg, append(msgEvents(msg, denom), m.events...)); err != nil {
+		return err
 	}
+	m.increaseCounter(common.PrometheusValueAccepted, common.PrometheusValueCommon)
+	return nil
+}
 
-	return db, nil
+func (m *MarketplaceHandler) RouterKeys() []string {
+	return []string{mptypes.ModuleName, nft.ModuleName}
 }
 
-func (m *MarketplaceHandler) Reset(db *gorm.DB) (*gorm.DB, error) {
-	db = db.DropTableIfExists(&common.Offer{})
-	if db.Error != nil {
-		return nil, fmt.Errorf("failed to drop table Offers: %v", db.Error)
-	}
-	db = db.DropTableIfExists(&common.AuctionBid{})
-	if db.Error != nil {
-		return nil, fmt.Errorf("failed to drop table AuctionBids: %v", db.Error)
-	}
-	db = db.DropTableIfExists(&common.NFT{})
-	if db.Error != nil {
-		return nil, fmt.Errorf("failed to drop table Nfts: %v", db.Error)
-	}
-	db = db.DropTableIfExists(&common.FungibleTokenTransfer{})
-	if db.Error != nil {
-		return nil, fmt.Errorf("failed to drop table FungibleTokenTransferss: %v", db.Error)
-	}
-	db = db.DropTableIfExists(&common.FungibleToken{})
-	if db.Error != nil {
-		return nil, fmt.Errorf("failed to drop table FungibleTokens: %v", db.Error)
-	}
-	db = db.DropTableIfExists(&common.User{})
-	if db.Error != nil {
-		return nil, fmt.Errorf("failed to drop table Users: %v", db.Error)
+func setupMarketplaceTables(db *gorm.DB) error {
+	if err := db.Exec(marketplaceBaselineUp).Error; err != nil {
+		return fmt.Errorf("failed to create marketplace tables: %v", err)
 	}
 
-	return db, nil
+	return nil
 }
 
-func (m *MarketplaceHandler) getAccount(addr sdk.AccAddress) (exported.Account, error) {
-	accGetter := authtypes.NewAccountRetriever(m.cliCtx)
-	if err := accGetter.EnsureExists(addr); err != nil {
-		return nil, err
+func resetMarketplaceTables(db *gorm.DB) error {
+	if err := db.Exec(marketplaceBaselineDown).Error; err != nil {
+		return fmt.Errorf("failed to drop marketplace tables: %v", err)
 	}
 
-	return accGetter.GetAccount(addr)
+	return nil
 }
 
+// Stop does nothing: the sink writes in the transactions of messages, and the outbox
+// and the account service are stopped by their owner.
 func (m *MarketplaceHandler) Stop() {
-	if err := m.uriSender.Closer(); err != nil {
-		stdLog.Printf("error occured when stopping indexer marketplaceHandler: %v", err)
-	}
 }
 func (m *MarketplaceHandler) getEventAttr(events []abciTypes.Event, eventType, attrKey string) (string, bool) {
 	for _, event := range events {
@@ -565,13 +684,16 @@ func (m *MarketplaceHandler) getEventAttr(events []abciTypes.Event, eventType, a
 	return "", false
 }
 
-func (m *MarketplaceHandler) queryNFT(tokenID string) (*appTypes.NFTInfo, error) {
+// queryNFT queries the token with the given ID at the given height, so that
+// replaying old blocks does not return the current state of the token.
+func (m *MarketplaceHandler) queryNFT(tokenID string, height int64) (*appTypes.NFTInfo, error) {
 	var (
 		tokenInfo *appTypes.NFTInfo
 		err       error
 		res       []byte
 	)
-	if res, _, err = m.cliCtx.QueryWithData(fmt.Sprintf("custom/marketplace/nft/%s", tokenID), nil); err != nil {
+	// The context of the handler is only queried here, so its height is set in place.
+	if res, _, err = m.cliCtx.WithHeight(height).QueryWithData(fmt.Sprintf("custom/marketplace/nft/%s", tokenID), nil); err != nil {
 		return tokenInfo, err
 	}
 	if err = m.cliCtx.Codec.UnmarshalJSON(res, &tokenInfo); err != nil {
@@ -580,14 +702,64 @@ func (m *MarketplaceHandler) queryNFT(tokenID string) (*appTypes.NFTInfo, error)
 	return tokenInfo, nil
 }
 
+// findDenom returns the denom of the token with the given ID. Marketplace messages
+// only carry token IDs, so we look the denom up in the nfts table and fall back to
+// querying the chain if the ID is ambiguous.
+func (m *MarketplaceHandler) findDenom(db *gorm.DB, info MsgInfo, tokenID string) (string, error) {
+	var denoms []string
+	if err := db.New().Model(&common.NFT{}).Where("token_id = ?", tokenID).Pluck("denom", &denoms).Error; err != nil {
+		return "", err
+	}
+	if len(denoms) == 1 {
+		return denoms[0], nil
+	}
+	tokenInfo, err := m.queryNFT(tokenID, info.Height)
+	if err != nil {
+		return "", err
+	}
+	if tokenInfo.MPNFTInfo == nil {
+		return "", fmt.Errorf("nft #%s has no marketplace info", tokenID)
+	}
+
+	return tokenInfo.MPNFTInfo.Denom, nil
+}
+
+// getTokenURI returns the token URI and the owner of the token. They are taken from
+// the nfts table, so that replaying blocks publishes the same URIs; the chain is only
+// queried (at the height being indexed) for tokens that are not in the table, e.g.,
+// ones minted before the indexer was started.
+func (m *MarketplaceHandler) getTokenURI(db *gorm.DB, info MsgInfo, denom, tokenID string) (string, string, error) {
+	var token common.NFT
+	err := db.New().Where("denom = ? AND token_id = ?", denom, tokenID).First(&token).Error
+	if err == nil && token.TokenURI != "" {
+		return token.TokenURI, token.OwnerAddress, nil
+	}
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return "", "", err
+	}
+	tokenInfo, err := m.queryNFT(tokenID, info.Height)
+	if err != nil {
+		return "", "", err
+	}
+
+	return tokenInfo.TokenURI, tokenInfo.Owner.String(), nil
+}
+
 func (m *MarketplaceHandler) getMsgAddresses(db *gorm.DB, msg sdk.Msg) ([]sdk.AccAddress, error) {
-	var out []sdk.AccAddress
-	accAddrType := reflect.ValueOf(sdk.AccAddress{}).Type()
-	reflectedValue := reflect.ValueOf(msg)
-	for i := 0; i < reflectedValue.NumField(); i++ {
-		if reflectedAddr := reflectedValue.Field(i); reflectedAddr.Type().AssignableTo(accAddrType) {
-			out = append(out, sdk.AccAddress(reflectedAddr.Bytes()))
+	var (
+		out  []sdk.AccAddress
+		seen = map[string]bool{}
+	)
+	for _, addr := range common.ExtractAddresses(msg) {
+		if addr.Kind != common.AddressKindAccount || seen[addr.Address] {
+			continue
+		}
+		seen[addr.Address] = true
+		accAddr, err := sdk.AccAddressFromBech32(addr.Address)
+		if err != nil {
+			return nil, err
 		}
+		out = append(out, accAddr)
 	}
 
 	return out, nil
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"fmt"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/cosmos/modules/incubator/nft"
+	common "github.com/corestario/dwh/x/common"
+	mptypes "github.com/corestario/marketplace/x/marketplace/types"
+	"github.com/jinzhu/gorm"
+)
+
+// activity is a role of an address in a message.
+type activity struct {
+	address string
+	role    string
+	denom   string
+	tokenID string
+	amount  sdk.Coins
+}
+
+// recordActivity adds entries to the activity feeds of the addresses involved in msg.
+func recordActivity(db *gorm.DB, info MsgInfo, msg sdk.Msg, activities ...activity) error {
+	for _, a := range activities {
+		if a.address == "" {
+			continue
+		}
+		if err := db.New().Create(&common.AddressActivity{
+			Address:  a.address,
+			Role:     a.role,
+			Action:   msg.Type(),
+			Denom:    a.denom,
+			TokenID:  a.tokenID,
+			Amount:   a.amount.String(),
+			Height:   info.Height,
+			Time:     info.BlockTime,
+			TxHash:   info.TxHash,
+			MsgIndex: info.MsgIndex,
+		}).Error; err != nil {
+			return fmt.Errorf("failed to add activity of %s: %v", a.address, err)
+		}
+	}
+
+	return nil
+}
+
+// recordMsgActivity adds the entries that follow from the message itself (sales are
+// recorded by recordSale). Signers that have no other role in the message get a
+// signer entry. denom is the NFT denom of the message, if any.
+func recordMsgActivity(db *gorm.DB, info MsgInfo, msg sdk.Msg, denom string) error {
+	var activities []activity
+	switch value := msg.(type) {
+	case nft.MsgMintNFT:
+		activities = append(activities, activity{value.Recipient.String(), common.ActivityRoleRecipient, denom, value.ID, nil})
+	case nft.MsgTransferNFT:
+		activities = append(activities, activity{value.Recipient.String(), common.ActivityRoleRecipient, denom, value.ID, nil})
+	case mptypes.MsgPutNFTOnMarket:
+		activities = append(activities, activity{value.Owner.String(), common.ActivityRoleSeller, denom, value.TokenID, value.Price})
+	case mptypes.MsgRemoveNFTFromMarket:
+		activities = append(activities, activity{value.Owner.String(), common.ActivityRoleSeller, denom, value.TokenID, nil})
+	case mptypes.MsgPutNFTOnAuction:
+		activities = append(activities, activity{value.Owner.String(), common.ActivityRoleSeller, denom, value.TokenID, value.OpeningPrice})
+	case mptypes.MsgRemoveNFTFromAuction:
+		activities = append(activities, activity{value.Owner.String(), common.ActivityRoleSeller, denom, value.TokenID, nil})
+	case mptypes.MsgMakeBidOnAuction:
+		activities = append(activities, activity{value.Bidder.String(), common.ActivityRoleBidder, denom, value.TokenID, value.Bid})
+	case mptypes.MsgMakeOffer:
+		activities = append(activities, activity{value.Buyer.String(), common.ActivityRoleBidder, denom, value.TokenID, value.Price})
+	case mptypes.MsgRemoveOffer:
+		activities = append(activities, activity{value.Buyer.String(), common.ActivityRoleBidder, denom, value.TokenID, nil})
+	case mptypes.MsgCreateFungibleToken:
+		activities = append(activities, activity{value.Creator.String(), common.ActivityRoleRecipient, value.Denom, "",
+			sdk.NewCoins(sdk.NewInt64Coin(value.Denom, value.Amount))})
+	case mptypes.MsgTransferFungibleTokens:
+		activities = append(activities,
+			activity{value.Owner.String(), common.ActivityRoleSigner, value.Denom, "", sdk.NewCoins(sdk.NewInt64Coin(value.Denom, value.Amount))},
+			activity{value.Recipient.String(), common.ActivityRoleRecipient, value.Denom, "", sdk.NewCoins(sdk.NewInt64Coin(value.Denom, value.Amount))},
+		)
+	case mptypes.MsgBurnFungibleTokens:
+		activities = append(activities, activity{value.Owner.String(), common.ActivityRoleSigner, value.Denom, "",
+			sdk.NewCoins(sdk.NewInt64Coin(value.Denom, value.Amount))})
+	}
+
+	var recorded []string
+	if err := db.New().Model(&common.AddressActivity{}).Where("tx_hash = ? AND msg_index = ?", info.TxHash, info.MsgIndex).
+		Pluck("address", &recorded).Error; err != nil {
+		return fmt.Errorf("failed to get recorded activities: %v", err)
+	}
+	involved := map[string]bool{}
+	for _, address := range recorded {
+		involved[address] = true
+	}
+	for _, a := range activities {
+		involved[a.address] = true
+	}
+	for _, signer := range msg.GetSigners() {
+		if !involved[signer.String()] {
+			activities = append(activities, activity{signer.String(), common.ActivityRoleSigner, denom, msgTokenID(msg), nil})
+			involved[signer.String()] = true
+		}
+	}
+
+	return recordActivity(db, info, msg, activities...)
+}
+
+// msgTokenID returns the ID of the NFT that msg refers to, if any.
+func msgTokenID(msg sdk.Msg) string {
+	switch value := msg.(type) {
+	case nft.MsgMintNFT:
+		return value.ID
+	case nft.MsgBurnNFT:
+		return value.ID
+	case nft.MsgEditNFTMetadata:
+		return value.ID
+	case nft.MsgTransferNFT:
+		return value.ID
+	case mptypes.MsgPutNFTOnMarket:
+		return value.TokenID
+	case mptypes.MsgRemoveNFTFromMarket:
+		return value.TokenID
+	case mptypes.MsgBuyNFT:
+		return value.TokenID
+	case mptypes.MsgPutNFTOnAuction:
+		return value.TokenID
+	case mptypes.MsgRemoveNFTFromAuction:
+		return value.TokenID
+	case mptypes.MsgMakeBidOnAuction:
+		return value.TokenID
+	case mptypes.MsgBuyoutOnAuction:
+		return value.TokenID
+	case mptypes.MsgFinishAuction:
+		return value.TokenID
+	case mptypes.MsgMakeOffer:
+		return value.TokenID
+	case mptypes.MsgAcceptOffer:
+		return value.TokenID
+	case mptypes.MsgRemoveOffer:
+		return value.TokenID
+	}
+
+	return ""
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"fmt"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	common "github.com/corestario/dwh/x/common"
+	"github.com/jinzhu/gorm"
+)
+
+// setAmounts replaces the normalized amounts of the given price field with coins.
+// Empty coins just clear the field.
+func setAmounts(db *gorm.DB, ownerTable string, ownerID uint, field string, coins sdk.Coins) error {
+	db = db.New()
+	if err := db.Unscoped().Where("owner_table = ? AND owner_id = ? AND field = ?", ownerTable, ownerID, field).
+		Delete(&common.Amount{}).Error; err != nil {
+		return fmt.Errorf("failed to delete amounts (%s #%d, %s): %v", ownerTable, ownerID, field, err)
+	}
+	for _, amount := range common.NewAmounts(ownerTable, ownerID, field, coins) {
+		if err := db.Create(amount).Error; err != nil {
+			return fmt.Errorf("failed to create amount (%s #%d, %s): %v", ownerTable, ownerID, field, err)
+		}
+	}
+
+	return nil
+}
+
+// setNFTAmounts is the same as setAmounts for a price field of the token with the
+// given denom and ID.
+func setNFTAmounts(db *gorm.DB, denom, tokenID string, field string, coins sdk.Coins) error {
+	var token common.NFT
+	if err := db.New().Where("denom = ? AND token_id = ?", denom, tokenID).First(&token).Error; err != nil {
+		return fmt.Errorf("failed to find nft %s/%s: %v", denom, tokenID, err)
+	}
+
+	return setAmounts(db, common.AmountOwnerNFTs, token.ID, field, coins)
+}
+
+// deleteAmounts removes all amounts that belong to rows of ownerTable (of the chain
+// that db is scoped to) matching the given condition.
+func deleteAmounts(db *gorm.DB, ownerTable string, where string, args ...interface{}) error {
+	db = db.New()
+	ownerIDs := db.Unscoped().Table(ownerTable).Select("id").Where("chain_id = ?", common.ChainID(db)).
+		Where(where, args...).SubQuery()
+	if err := db.Unscoped().Where("owner_table = ? AND owner_id IN ?", ownerTable, ownerIDs).
+		Delete(&common.Amount{}).Error; err != nil {
+		return fmt.Errorf("failed to delete amounts (%s): %v", ownerTable, err)
+	}
+
+	return nil
+}
+
+// resetAuctionAmounts clears the auction prices of the token with the given denom
+// and ID along with the prices of all its bids.
+func resetAuctionAmounts(db *gorm.DB, denom, tokenID string) error {
+	if err := setNFTAmounts(db, denom, tokenID, common.AmountFieldBuyoutPrice, nil); err != nil {
+		return err
+	}
+	if err := setNFTAmounts(db, denom, tokenID, common.AmountFieldOpeningPrice, nil); err != nil {
+		return err
+	}
+
+	return deleteAmounts(db, common.AmountOwnerAuctionBids, "denom = ? AND token_id = ?", denom, tokenID)
+}
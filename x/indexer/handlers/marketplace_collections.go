@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/cosmos/modules/incubator/nft"
+	common "github.com/corestario/dwh/x/common"
+	mptypes "github.com/corestario/marketplace/x/marketplace/types"
+	"github.com/jinzhu/gorm"
+)
+
+// getNFT returns the token with the given denom and ID.
+func getNFT(db *gorm.DB, denom, tokenID string) (*common.NFT, error) {
+	var token common.NFT
+	if err := db.New().Where("denom = ? AND token_id = ?", denom, tokenID).First(&token).Error; err != nil {
+		return nil, fmt.Errorf("failed to find nft %s/%s: %v", denom, tokenID, err)
+	}
+
+	return &token, nil
+}
+
+// getCollection returns the collection for the given denom. If there is no such
+// collection yet (e.g., the tokens were indexed before collections were introduced),
+// it is created.
+func getCollection(db *gorm.DB, info MsgInfo, denom string) (*common.Collection, error) {
+	db = db.New()
+	var collection common.Collection
+	err := db.Where("denom = ?", denom).First(&collection).Error
+	if err == nil {
+		return &collection, nil
+	}
+	if !gorm.IsRecordNotFoundError(err) {
+		return nil, fmt.Errorf("failed to find collection %s: %v", denom, err)
+	}
+	collection = common.Collection{
+		Denom:           denom,
+		FirstMintHeight: info.Height,
+	}
+	// Messages are stored after they are handled, so the current message is not
+	// among the indexed mints.
+	var firstMint sql.NullInt64
+	if err := db.Raw(`
+		SELECT MIN(height) FROM messages
+		WHERE chain_id = ? AND route = ? AND msg_type = ? AND NOT failed AND deleted_at IS NULL
+			AND signature->'value'->>'Denom' = ?`,
+		common.ChainID(db), nft.ModuleName, nft.MsgMintNFT{}.Type(), denom,
+	).Row().Scan(&firstMint); err != nil {
+		return nil, fmt.Errorf("failed to find first mint of collection %s: %v", denom, err)
+	}
+	if firstMint.Valid && firstMint.Int64 < collection.FirstMintHeight {
+		collection.FirstMintHeight = firstMint.Int64
+	}
+	if err := db.Unscoped().Model(&common.NFT{}).Where("denom = ?", denom).Count(&collection.TotalMinted).Error; err != nil {
+		return nil, fmt.Errorf("failed to count nfts of collection %s: %v", denom, err)
+	}
+	if err := db.Create(&collection).Error; err != nil {
+		return nil, fmt.Errorf("failed to create collection %s: %v", denom, err)
+	}
+
+	return &collection, nil
+}
+
+// onMint accounts for a freshly minted token in its collection.
+func onMint(db *gorm.DB, info MsgInfo, denom, creator string) error {
+	collection, err := getCollection(db, info, denom)
+	if err != nil {
+		return err
+	}
+	updates := map[string]interface{}{"total_minted": gorm.Expr("total_minted + 1")}
+	if collection.Creator == "" {
+		updates["creator"] = creator
+	}
+	if err := db.New().Model(collection).UpdateColumns(updates).Error; err != nil {
+		return fmt.Errorf("failed to update collection %s: %v", denom, err)
+	}
+
+	return nil
+}
+
+// onBurn accounts for a burned token in its collection.
+func onBurn(db *gorm.DB, info MsgInfo, denom string) error {
+	collection, err := getCollection(db, info, denom)
+	if err != nil {
+		return err
+	}
+	if err := db.New().Model(collection).UpdateColumn("burned", gorm.Expr("burned + 1")).Error; err != nil {
+		return fmt.Errorf("failed to update collection %s: %v", denom, err)
+	}
+
+	return nil
+}
+
+// recordSale stores a completed deal along with the beneficiary earnings and adds its
+// price to the all-time volume of the token collection and to the daily statistics.
+// token must hold the state of the token before the deal.
+func (m *MarketplaceHandler) recordSale(db *gorm.DB, info MsgInfo, msg sdk.Msg, token *common.NFT, buyer string, price sdk.Coins, b beneficiaries) error {
+	sale := &common.Sale{
+		Denom:   token.Denom,
+		TokenID: token.TokenID,
+		Seller:  token.OwnerAddress,
+		Buyer:   buyer,
+		Price:   price.String(),
+		MsgType: msg.Type(),
+		Height:  info.Height,
+		Time:    info.BlockTime,
+		TxHash:  info.TxHash,
+	}
+	if err := db.New().Create(sale).Error; err != nil {
+		return fmt.Errorf("failed to create sale: %v", err)
+	}
+	if err := setAmounts(db, common.AmountOwnerSales, sale.ID, common.AmountFieldPrice, price); err != nil {
+		return err
+	}
+	if err := recordEarnings(db, sale, price, b); err != nil {
+		return err
+	}
+	if err := recordActivity(db, info, msg,
+		activity{sale.Seller, common.ActivityRoleSeller, sale.Denom, sale.TokenID, price},
+		activity{sale.Buyer, common.ActivityRoleBuyer, sale.Denom, sale.TokenID, price},
+	); err != nil {
+		return err
+	}
+	m.events = append(m.events, domainEvent{common.DomainEventSale, sale.Denom, sale.TokenID, sale.Seller, sale.Buyer, price})
+	for _, coin := range price {
+		if err := refreshDailySales(db, dailyStatsDate(info.BlockTime), token.Denom, coin.Denom); err != nil {
+			return err
+		}
+	}
+
+	collection, err := getCollection(db, info, token.Denom)
+	if err != nil {
+		return err
+	}
+	volume, err := sdk.ParseCoins(collection.Volume)
+	if err != nil {
+		return fmt.Errorf("failed to parse volume of collection %s: %v", token.Denom, err)
+	}
+	volume = volume.Add(price)
+	if err := db.New().Model(collection).UpdateColumn("volume", volume.String()).Error; err != nil {
+		return fmt.Errorf("failed to update collection %s: %v", token.Denom, err)
+	}
+
+	return setAmounts(db, common.AmountOwnerCollections, collection.ID, common.AmountFieldVolume, volume)
+}
+
+// refreshCollection recomputes the statistics of a collection that depend on the
+// current state of its tokens: holders, tokens on sale and floor price. The volume of
+// the last 24 hours is computed when it is read (see common.CollectionVolumes24hView).
+func refreshCollection(db *gorm.DB, info MsgInfo, denom string) error {
+	collection, err := getCollection(db, info, denom)
+	if err != nil {
+		return err
+	}
+	tokens := db.New().Model(&common.NFT{}).Where("denom = ?", denom)
+	if err := tokens.Select("COUNT(DISTINCT owner_address)").Row().Scan(&collection.UniqueHolders); err != nil {
+		return fmt.Errorf("failed to count holders of collection %s: %v", denom, err)
+	}
+	if err := tokens.Where("status = ?", mptypes.NFTStatusOnMarket).Count(&collection.OnMarket).Error; err != nil {
+		return fmt.Errorf("failed to count tokens on market of collection %s: %v", denom, err)
+	}
+	if err := tokens.Where("status = ?", mptypes.NFTStatusOnAuction).Count(&collection.OnAuction).Error; err != nil {
+		return fmt.Errorf("failed to count tokens on auction of collection %s: %v", denom, err)
+	}
+
+	floorPrice, err := queryCoins(db, `
+		SELECT amounts.denom, MIN(amounts.amount) FROM nfts
+		JOIN amounts ON amounts.owner_table = ? AND amounts.owner_id = nfts.id AND amounts.field = ?
+		WHERE nfts.chain_id = ? AND nfts.denom = ? AND nfts.status = ? AND nfts.deleted_at IS NULL
+			AND amounts.deleted_at IS NULL
+		GROUP BY amounts.denom`,
+		common.AmountOwnerNFTs, common.AmountFieldPrice, common.ChainID(db), denom, mptypes.NFTStatusOnMarket)
+	if err != nil {
+		return fmt.Errorf("failed to get floor price of collection %s: %v", denom, err)
+	}
+	if err := db.New().Model(collection).UpdateColumns(map[string]interface{}{
+		"unique_holders": collection.UniqueHolders,
+		"on_market":      collection.OnMarket,
+		"on_auction":     collection.OnAuction,
+		"floor_price":    floorPrice.String(),
+	}).Error; err != nil {
+		return fmt.Errorf("failed to update collection %s: %v", denom, err)
+	}
+
+	return setAmounts(db, common.AmountOwnerCollections, collection.ID, common.AmountFieldFloorPrice, floorPrice)
+}
+
+// queryCoins runs a query that returns (denom, amount) rows and collects them into
+// coins.
+func queryCoins(db *gorm.DB, query string, args ...interface{}) (sdk.Coins, error) {
+	rows, err := db.New().Raw(query, args...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var coins sdk.Coins
+	for rows.Next() {
+		var denom, amount string
+		if err := rows.Scan(&denom, &amount); err != nil {
+			return nil, err
+		}
+		value, ok := sdk.NewIntFromString(amount)
+		if !ok {
+			return nil, fmt.Errorf("invalid amount %s%s", amount, denom)
+		}
+		if value.IsPositive() {
+			coins = append(coins, sdk.NewCoin(denom, value))
+		}
+	}
+
+	return coins.Sort(), rows.Err()
+}
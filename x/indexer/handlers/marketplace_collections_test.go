@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"testing"
+
+	common "github.com/corestario/dwh/x/common"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectionMints(t *testing.T) {
+	cfg := common.DefaultDwhCommonServiceConfig()
+	db, err := common.GetDB(cfg)
+	if err != nil {
+		t.Errorf("failed to establish database connection: %v", err)
+		return
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("failed to close database connection: %v", err)
+		}
+	}()
+	db = common.WithChainID(db, "test-collections")
+	require.NoError(t, db.AutoMigrate(&common.Message{}, &common.NFT{}, &common.Collection{}).Error)
+	clean := func() {
+		require.NoError(t, db.New().Unscoped().Where("denom IN (?)", []string{"fresh", "legacy"}).Delete(&common.NFT{}).Error)
+		require.NoError(t, db.New().Unscoped().Where("denom IN (?)", []string{"fresh", "legacy"}).Delete(&common.Collection{}).Error)
+		require.NoError(t, db.New().Unscoped().Delete(&common.Message{}).Error)
+	}
+	clean()
+	defer clean()
+
+	// mint does what the handler does for MsgMintNFT.
+	mint := func(height int64, denom, tokenID string) *common.Collection {
+		require.NoError(t, onMint(db, MsgInfo{Height: height}, denom, "cosmos1creator"))
+		require.NoError(t, db.New().Create(common.NewNFTFromMarketplaceNFT(denom, tokenID, "cosmos1owner", "")).Error)
+		var collection common.Collection
+		require.NoError(t, db.New().Where("denom = ?", denom).First(&collection).Error)
+		return &collection
+	}
+
+	collection := mint(10, "fresh", "1")
+	require.Equal(t, int64(1), collection.TotalMinted)
+	require.Equal(t, int64(10), collection.FirstMintHeight)
+	require.Equal(t, "cosmos1creator", collection.Creator)
+	collection = mint(11, "fresh", "2")
+	require.Equal(t, int64(2), collection.TotalMinted)
+	require.Equal(t, int64(10), collection.FirstMintHeight)
+
+	// A collection of tokens indexed before collections were introduced is seeded from
+	// the existing tokens and mint messages.
+	require.NoError(t, db.New().Create(common.NewNFTFromMarketplaceNFT("legacy", "1", "cosmos1owner", "")).Error)
+	require.NoError(t, db.New().Create(common.NewMessage("nft", "mint_nft",
+		`{"type":"cosmos-sdk/MsgMintNFT","value":{"Denom":"legacy","ID":"1"}}`, nil, false, "", 0, 5)).Error)
+	collection = mint(20, "legacy", "2")
+	require.Equal(t, int64(2), collection.TotalMinted)
+	require.Equal(t, int64(5), collection.FirstMintHeight)
+}
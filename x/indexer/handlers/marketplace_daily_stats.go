@@ -0,0 +1,410 @@
+package handlers
+
+import (
+	"fmt"
+	"time"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/cosmos/modules/incubator/nft"
+	common "github.com/corestario/dwh/x/common"
+	mptypes "github.com/corestario/marketplace/x/marketplace/types"
+	"github.com/jinzhu/gorm"
+)
+
+// dailyStatsDate returns the day (UTC) that t belongs to.
+func dailyStatsDate(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// getDailyStats returns the statistics row for the given key, creating it if needed.
+func getDailyStats(db *gorm.DB, date time.Time, collection, denom string) (*common.MarketplaceDailyStat, error) {
+	db = db.New()
+	var stat common.MarketplaceDailyStat
+	err := db.Where("date = ? AND collection = ? AND denom = ?", date, collection, denom).First(&stat).Error
+	if err == nil {
+		return &stat, nil
+	}
+	if !gorm.IsRecordNotFoundError(err) {
+		return nil, fmt.Errorf("failed to find daily stats (%s, %s, %s): %v", date.Format("2006-01-02"), collection, denom, err)
+	}
+	stat = common.MarketplaceDailyStat{Date: date, Collection: collection, Denom: denom, Volume: "0"}
+	if err := db.Create(&stat).Error; err != nil {
+		return nil, fmt.Errorf("failed to create daily stats (%s, %s, %s): %v", date.Format("2006-01-02"), collection, denom, err)
+	}
+
+	return &stat, nil
+}
+
+// addDailyStats increments a counter of the daily statistics of collection under each
+// coin denom of price, or under an empty denom if there is no price.
+func addDailyStats(db *gorm.DB, info MsgInfo, collection string, price sdk.Coins, column string) error {
+	denoms := []string{""}
+	if len(price) > 0 {
+		denoms = denoms[:0]
+		for _, coin := range price {
+			denoms = append(denoms, coin.Denom)
+		}
+	}
+	for _, denom := range denoms {
+		stat, err := getDailyStats(db, dailyStatsDate(info.BlockTime), collection, denom)
+		if err != nil {
+			return err
+		}
+		if err := db.New().Model(stat).UpdateColumn(column, gorm.Expr(column+" + 1")).Error; err != nil {
+			return fmt.Errorf("failed to update daily stats %s: %v", column, err)
+		}
+	}
+
+	return nil
+}
+
+// refreshDailySales recomputes the sales statistics of the given day, collection and
+// price denom from the sales table.
+func refreshDailySales(db *gorm.DB, date time.Time, collection, denom string) error {
+	stat, err := getDailyStats(db, date, collection, denom)
+	if err != nil {
+		return err
+	}
+
+	var (
+		sales, buyers, sellers int64
+		volume                 string
+	)
+	if err := db.New().Raw(`
+		SELECT COUNT(*), COALESCE(SUM(amounts.amount), 0), COUNT(DISTINCT sales.buyer), COUNT(DISTINCT sales.seller)
+		FROM sales
+		JOIN amounts ON amounts.owner_table = ? AND amounts.owner_id = sales.id AND amounts.field = ?
+		WHERE sales.chain_id = ? AND sales.denom = ? AND amounts.denom = ? AND sales.time >= ? AND sales.time < ?
+			AND sales.deleted_at IS NULL AND amounts.deleted_at IS NULL`,
+		common.AmountOwnerSales, common.AmountFieldPrice, common.ChainID(db), collection, denom, date, date.AddDate(0, 0, 1),
+	).Row().Scan(&sales, &volume, &buyers, &sellers); err != nil {
+		return fmt.Errorf("failed to sum daily sales (%s, %s, %s): %v", date.Format("2006-01-02"), collection, denom, err)
+	}
+	if err := db.New().Model(stat).UpdateColumns(map[string]interface{}{
+		"sales_count":    sales,
+		"volume":         volume,
+		"unique_buyers":  buyers,
+		"unique_sellers": sellers,
+	}).Error; err != nil {
+		return fmt.Errorf("failed to update daily stats (%s, %s, %s): %v", date.Format("2006-01-02"), collection, denom, err)
+	}
+
+	return nil
+}
+
+// countDailyStats accounts for the activity of msg (except for sales, which are
+// accounted by recordSale) in the daily statistics of collection.
+func countDailyStats(db *gorm.DB, info MsgInfo, collection string, msg sdk.Msg) error {
+	switch value := msg.(type) {
+	case nft.MsgMintNFT:
+		return addDailyStats(db, info, collection, nil, "mints")
+	case nft.MsgBurnNFT:
+		return addDailyStats(db, info, collection, nil, "burns")
+	case mptypes.MsgPutNFTOnMarket:
+		return addDailyStats(db, info, collection, value.Price, "new_listings")
+	case mptypes.MsgPutNFTOnAuction:
+		return addDailyStats(db, info, collection, value.OpeningPrice, "new_auctions")
+	case mptypes.MsgMakeBidOnAuction:
+		return addDailyStats(db, info, collection, value.Bid, "bids_placed")
+	case mptypes.MsgMakeOffer:
+		return addDailyStats(db, info, collection, value.Price, "offers_made")
+	case mptypes.MsgAcceptOffer:
+		// The offer is already deleted at this point.
+		var offer common.Offer
+		if err := db.New().Unscoped().Where("denom = ? AND token_id = ? AND offer_id = ?", collection, value.TokenID, value.OfferID).
+			Last(&offer).Error; err != nil {
+			return fmt.Errorf("failed to find offer %s: %v", value.OfferID, err)
+		}
+		price, err := sdk.ParseCoins(offer.Price)
+		if err != nil {
+			return fmt.Errorf("failed to parse price of offer %s: %v", value.OfferID, err)
+		}
+		return addDailyStats(db, info, collection, price, "offers_accepted")
+	}
+
+	return nil
+}
+
+// BackfillDailyStats accounts for the activity of an already indexed message in the
+// daily statistics. It is used to fill the statistics for the history that was
+// indexed before they were introduced (see ResetDailyStats).
+func BackfillDailyStats(db *gorm.DB, info MsgInfo, msg sdk.Msg) error {
+	var tokenID string
+	switch value := msg.(type) {
+	case nft.MsgMintNFT:
+		return countDailyStats(db, info, value.Denom, msg)
+	case nft.MsgBurnNFT:
+		return countDailyStats(db, info, value.Denom, msg)
+	case mptypes.MsgPutNFTOnMarket:
+		tokenID = value.TokenID
+	case mptypes.MsgPutNFTOnAuction:
+		tokenID = value.TokenID
+	case mptypes.MsgMakeBidOnAuction:
+		tokenID = value.TokenID
+	case mptypes.MsgMakeOffer:
+		tokenID = value.TokenID
+	case mptypes.MsgAcceptOffer:
+		tokenID = value.TokenID
+	default:
+		return nil
+	}
+
+	collection, err := backfillCollection(db, tokenID)
+	if err != nil {
+		return err
+	}
+
+	return countDailyStats(db, info, collection, msg)
+}
+
+// backfillCollection returns the denom of the token with the given ID. Burned tokens
+// are deleted, so their denoms are taken from their mint messages.
+func backfillCollection(db *gorm.DB, tokenID string) (string, error) {
+	rows, err := db.New().Raw(`
+		SELECT denom FROM nfts WHERE chain_id = ? AND token_id = ? AND deleted_at IS NULL
+		UNION
+		SELECT signature->'value'->>'Denom' FROM messages
+		WHERE chain_id = ? AND route = ? AND msg_type = ? AND NOT failed AND deleted_at IS NULL
+			AND signature->'value'->>'ID' = ?`,
+		common.ChainID(db), tokenID, common.ChainID(db), nft.ModuleName, nft.MsgMintNFT{}.Type(), tokenID,
+	).Rows()
+	if err != nil {
+		return "", fmt.Errorf("failed to find denom of nft #%s: %v", tokenID, err)
+	}
+	defer rows.Close()
+	var denoms []string
+	for rows.Next() {
+		var denom string
+		if err := rows.Scan(&denom); err != nil {
+			return "", fmt.Errorf("failed to find denom of nft #%s: %v", tokenID, err)
+		}
+		denoms = append(denoms, denom)
+	}
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("failed to find denom of nft #%s: %v", tokenID, err)
+	}
+	if len(denoms) != 1 {
+		return "", fmt.Errorf("failed to find denom of nft #%s: %d candidates", tokenID, len(denoms))
+	}
+
+	return denoms[0], nil
+}
+
+// SalesReplay reconstructs the sales of the history that was indexed before the sales
+// table was introduced. The indexed messages are replayed in order to follow the
+// tokens on the market and on auctions, so that the seller and the price of every deal
+// are known when it is closed.
+type SalesReplay struct {
+	listings map[string]*replayedLot // Tokens on the market by token ID.
+	auctions map[string]*replayedLot // Tokens on auctions by token ID.
+	sales    []replayedSale
+}
+
+type replayedLot struct {
+	seller        string
+	price, buyout sdk.Coins
+	bidder        string // The last bid, if any.
+	bid           sdk.Coins
+}
+
+type replayedSale struct {
+	date                      time.Time
+	collection, seller, buyer string
+	price                     sdk.Coins
+}
+
+func NewSalesReplay() *SalesReplay {
+	return &SalesReplay{
+		listings: make(map[string]*replayedLot),
+		auctions: make(map[string]*replayedLot),
+	}
+}
+
+// Add replays an indexed message. Messages must be added in the order they were
+// indexed, failed messages must be skipped.
+func (r *SalesReplay) Add(db *gorm.DB, info MsgInfo, msg sdk.Msg) error {
+	switch value := msg.(type) {
+	case mptypes.MsgPutNFTOnMarket:
+		r.listings[value.TokenID] = &replayedLot{seller: value.Owner.String(), price: value.Price}
+	case mptypes.MsgRemoveNFTFromMarket:
+		delete(r.listings, value.TokenID)
+	case mptypes.MsgBuyNFT:
+		lot, ok := r.listings[value.TokenID]
+		if !ok {
+			return fmt.Errorf("failed to find listing of nft #%s", value.TokenID)
+		}
+		delete(r.listings, value.TokenID)
+		return r.addSale(db, info, value.TokenID, lot.seller, value.Buyer.String(), lot.price)
+	case mptypes.MsgPutNFTOnAuction:
+		r.auctions[value.TokenID] = &replayedLot{seller: value.Owner.String(), price: value.OpeningPrice, buyout: value.BuyoutPrice}
+	case mptypes.MsgRemoveNFTFromAuction:
+		delete(r.auctions, value.TokenID)
+	case mptypes.MsgMakeBidOnAuction:
+		lot, ok := r.auctions[value.TokenID]
+		if !ok {
+			return fmt.Errorf("failed to find auction of nft #%s", value.TokenID)
+		}
+		// A bid that reaches the buyout price buys the token out at that price.
+		if !lot.buyout.IsZero() && value.Bid.IsAllGTE(lot.buyout) {
+			delete(r.auctions, value.TokenID)
+			return r.addSale(db, info, value.TokenID, lot.seller, value.Bidder.String(), lot.buyout)
+		}
+		lot.bidder, lot.bid = value.Bidder.String(), value.Bid
+	case mptypes.MsgBuyoutOnAuction:
+		lot, ok := r.auctions[value.TokenID]
+		if !ok {
+			return fmt.Errorf("failed to find auction of nft #%s", value.TokenID)
+		}
+		delete(r.auctions, value.TokenID)
+		return r.addSale(db, info, value.TokenID, lot.seller, value.Buyer.String(), lot.buyout)
+	case mptypes.MsgFinishAuction:
+		lot, ok := r.auctions[value.TokenID]
+		if !ok {
+			return fmt.Errorf("failed to find auction of nft #%s", value.TokenID)
+		}
+		delete(r.auctions, value.TokenID)
+		if lot.bidder == "" {
+			return nil
+		}
+		return r.addSale(db, info, value.TokenID, lot.seller, lot.bidder, lot.bid)
+	case mptypes.MsgAcceptOffer:
+		collection, err := backfillCollection(db, value.TokenID)
+		if err != nil {
+			return err
+		}
+		// The offer is already deleted at this point.
+		var offer common.Offer
+		if err := db.New().Unscoped().Where("denom = ? AND token_id = ? AND offer_id = ?", collection, value.TokenID, value.OfferID).
+			Last(&offer).Error; err != nil {
+			return fmt.Errorf("failed to find offer %s: %v", value.OfferID, err)
+		}
+		price, err := sdk.ParseCoins(offer.Price)
+		if err != nil {
+			return fmt.Errorf("failed to parse price of offer %s: %v", value.OfferID, err)
+		}
+		r.sales = append(r.sales, replayedSale{dailyStatsDate(info.BlockTime), collection, value.Seller.String(), offer.Buyer, price})
+	}
+
+	return nil
+}
+
+func (r *SalesReplay) addSale(db *gorm.DB, info MsgInfo, tokenID, seller, buyer string, price sdk.Coins) error {
+	collection, err := backfillCollection(db, tokenID)
+	if err != nil {
+		return err
+	}
+	r.sales = append(r.sales, replayedSale{dailyStatsDate(info.BlockTime), collection, seller, buyer, price})
+
+	return nil
+}
+
+// Save stores the sales statistics of the replayed sales in the daily statistics of
+// the chain that db is scoped to. The days that have rows in the sales table are
+// skipped, as their statistics are computed from it by ResetDailyStats.
+func (r *SalesReplay) Save(db *gorm.DB) error {
+	type key struct {
+		date              time.Time
+		collection, denom string
+	}
+	type sums struct {
+		sales           int64
+		volume          sdk.Int
+		buyers, sellers map[string]bool
+	}
+	var (
+		keys    []key
+		byKey   = make(map[key]*sums)
+		hasRows = make(map[time.Time]bool)
+	)
+	for _, sale := range r.sales {
+		rows, ok := hasRows[sale.date]
+		if !ok {
+			var count int
+			if err := db.New().Model(&common.Sale{}).Where("time >= ? AND time < ?", sale.date, sale.date.AddDate(0, 0, 1)).
+				Count(&count).Error; err != nil {
+				return fmt.Errorf("failed to count sales of %s: %v", sale.date.Format("2006-01-02"), err)
+			}
+			rows = count > 0
+			hasRows[sale.date] = rows
+		}
+		if rows {
+			continue
+		}
+		for _, coin := range sale.price {
+			k := key{sale.date, sale.collection, coin.Denom}
+			s, ok := byKey[k]
+			if !ok {
+				s = &sums{volume: sdk.ZeroInt(), buyers: make(map[string]bool), sellers: make(map[string]bool)}
+				byKey[k] = s
+				keys = append(keys, k)
+			}
+			s.sales++
+			s.volume = s.volume.Add(coin.Amount)
+			s.buyers[sale.buyer] = true
+			s.sellers[sale.seller] = true
+		}
+	}
+
+	for _, k := range keys {
+		s := byKey[k]
+		stat, err := getDailyStats(db, k.date, k.collection, k.denom)
+		if err != nil {
+			return err
+		}
+		if err := db.New().Model(stat).UpdateColumns(map[string]interface{}{
+			"sales_count":    s.sales,
+			"volume":         s.volume.String(),
+			"unique_buyers":  len(s.buyers),
+			"unique_sellers": len(s.sellers),
+		}).Error; err != nil {
+			return fmt.Errorf("failed to update daily stats (%s, %s, %s): %v", k.date.Format("2006-01-02"), k.collection, k.denom, err)
+		}
+	}
+
+	return nil
+}
+
+// ResetDailyStats clears the daily statistics of the chain that db is scoped to (see
+// common.WithChainID) and recomputes their sales part from the sales table. The rest of the statistics must be filled with BackfillDailyStats,
+// and the sales of the days before the sales table with SalesReplay.
+func ResetDailyStats(db *gorm.DB) error {
+	if err := db.New().Unscoped().Delete(&common.MarketplaceDailyStat{}).Error; err != nil {
+		return fmt.Errorf("failed to clear daily stats: %v", err)
+	}
+
+	rows, err := db.New().Raw(`
+		SELECT DISTINCT DATE(sales.time AT TIME ZONE 'UTC'), sales.denom, amounts.denom
+		FROM sales
+		JOIN amounts ON amounts.owner_table = ? AND amounts.owner_id = sales.id AND amounts.field = ?
+		WHERE sales.chain_id = ? AND sales.deleted_at IS NULL AND amounts.deleted_at IS NULL`,
+		common.AmountOwnerSales, common.AmountFieldPrice, common.ChainID(db),
+	).Rows()
+	if err != nil {
+		return fmt.Errorf("failed to list daily sales: %v", err)
+	}
+	defer rows.Close()
+
+	type key struct {
+		date              time.Time
+		collection, denom string
+	}
+	var keys []key
+	for rows.Next() {
+		var k key
+		if err := rows.Scan(&k.date, &k.collection, &k.denom); err != nil {
+			return fmt.Errorf("failed to list daily sales: %v", err)
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to list daily sales: %v", err)
+	}
+	for _, k := range keys {
+		if err := refreshDailySales(db, dailyStatsDate(k.date), k.collection, k.denom); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
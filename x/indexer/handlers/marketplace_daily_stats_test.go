@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	common "github.com/corestario/dwh/x/common"
+	mptypes "github.com/corestario/marketplace/x/marketplace/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSalesReplay(t *testing.T) {
+	cfg := common.DefaultDwhCommonServiceConfig()
+	db, err := common.GetDB(cfg)
+	if err != nil {
+		t.Errorf("failed to establish database connection: %v", err)
+		return
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("failed to close database connection: %v", err)
+		}
+	}()
+	db = common.WithChainID(db, "test-sales-replay")
+	require.NoError(t, db.AutoMigrate(&common.NFT{}, &common.Offer{}, &common.Sale{}, &common.MarketplaceDailyStat{}).Error)
+	clean := func() {
+		for _, model := range []interface{}{&common.NFT{}, &common.Offer{}, &common.Sale{}, &common.MarketplaceDailyStat{}} {
+			require.NoError(t, db.New().Unscoped().Delete(model).Error)
+		}
+	}
+	clean()
+	defer clean()
+
+	var (
+		seller = sdk.AccAddress("seller______________")
+		buyer  = sdk.AccAddress("buyer_______________")
+		bidder = sdk.AccAddress("bidder______________")
+		day1   = time.Date(2019, 11, 1, 12, 0, 0, 0, time.UTC)
+		day2   = day1.AddDate(0, 0, 1)
+		coins  = func(amount int64) sdk.Coins { return sdk.NewCoins(sdk.NewInt64Coin("token", amount)) }
+	)
+	for _, tokenID := range []string{"1", "2", "3", "4"} {
+		require.NoError(t, db.New().Create(common.NewNFTFromMarketplaceNFT("cards", tokenID, seller.String(), "")).Error)
+	}
+	offer := &common.Offer{OfferID: "offer", Buyer: buyer.String(), Price: coins(3).String(), TokenID: "3", Denom: "cards"}
+	require.NoError(t, db.New().Create(offer).Error)
+	require.NoError(t, db.New().Delete(offer).Error)
+	// The sales of the second day are indexed in the sales table.
+	require.NoError(t, db.New().Create(&common.Sale{Denom: "cards", TokenID: "4", Time: day2}).Error)
+
+	replay := NewSalesReplay()
+	for _, msg := range []struct {
+		time time.Time
+		msg  sdk.Msg
+	}{
+		{day1, mptypes.MsgPutNFTOnMarket{Owner: seller, TokenID: "1", Price: coins(10)}},
+		{day1, mptypes.MsgBuyNFT{Buyer: buyer, TokenID: "1"}},
+		{day1, mptypes.MsgPutNFTOnAuction{Owner: seller, TokenID: "2", OpeningPrice: coins(5), BuyoutPrice: coins(20)}},
+		{day1, mptypes.MsgMakeBidOnAuction{Bidder: buyer, TokenID: "2", Bid: coins(6)}},
+		{day1, mptypes.MsgMakeBidOnAuction{Bidder: bidder, TokenID: "2", Bid: coins(7)}},
+		{day1, mptypes.MsgFinishAuction{TokenID: "2"}},
+		{day1, mptypes.MsgAcceptOffer{Seller: seller, TokenID: "3", OfferID: "offer"}},
+		{day2, mptypes.MsgPutNFTOnMarket{Owner: seller, TokenID: "4", Price: coins(1)}},
+		{day2, mptypes.MsgBuyNFT{Buyer: buyer, TokenID: "4"}},
+	} {
+		require.NoError(t, replay.Add(db, MsgInfo{BlockTime: msg.time}, msg.msg))
+	}
+	require.NoError(t, replay.Save(db))
+
+	var stats []common.MarketplaceDailyStat
+	require.NoError(t, db.New().Find(&stats).Error)
+	require.Len(t, stats, 1)
+	require.Equal(t, "cards", stats[0].Collection)
+	require.Equal(t, "token", stats[0].Denom)
+	require.Equal(t, int64(3), stats[0].SalesCount)
+	require.Equal(t, "20", stats[0].Volume)
+	require.Equal(t, int64(2), stats[0].UniqueBuyers)
+	require.Equal(t, int64(1), stats[0].UniqueSellers)
+}
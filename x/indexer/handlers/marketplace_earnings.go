@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"fmt"
+	"strconv"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	common "github.com/corestario/dwh/x/common"
+	"github.com/corestario/marketplace/x/marketplace"
+	mptypes "github.com/corestario/marketplace/x/marketplace/types"
+	"github.com/jinzhu/gorm"
+)
+
+// beneficiaries describes who gets the beneficiary commission of a deal.
+type beneficiaries struct {
+	seller string
+	buyer  string
+	// commission is the beneficiaries commission as it is specified in the message
+	// (the default commission is used if it is empty or invalid, as the marketplace
+	// does).
+	commission string
+}
+
+// share returns the fraction of the price that each of the beneficiaries gets.
+func (b beneficiaries) share() float64 {
+	commission := mptypes.DefaultBeneficiariesCommission
+	if parsed, err := strconv.ParseFloat(b.commission, 64); err == nil {
+		commission = parsed
+	}
+
+	return commission / 2
+}
+
+// recordEarnings stores the commissions that the beneficiaries of a sale earned.
+func recordEarnings(db *gorm.DB, sale *common.Sale, price sdk.Coins, b beneficiaries) error {
+	share := b.share()
+	amount := marketplace.GetCommission(price, share)
+	for _, earning := range []*common.BeneficiaryEarning{
+		common.NewBeneficiaryEarning(sale.ID, b.seller, common.BeneficiaryRoleSeller, share, amount),
+		common.NewBeneficiaryEarning(sale.ID, b.buyer, common.BeneficiaryRoleBuyer, share, amount),
+	} {
+		// The marketplace does not require beneficiaries to be set.
+		if earning.Beneficiary == "" {
+			continue
+		}
+		if err := db.New().Create(earning).Error; err != nil {
+			return fmt.Errorf("failed to create beneficiary earning: %v", err)
+		}
+		if err := setAmounts(db, common.AmountOwnerBeneficiaryEarnings, earning.ID, common.AmountFieldAmount, amount); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -8,7 +8,7 @@ import (
 	app "github.com/corestario/marketplace"
 )
 
-func GetEnv(config *common.DwhCommonServiceConfig) (cliContext.Context, sdk.TxDecoder, error) {
+func GetEnv(config *common.DwhCommonServiceConfig) (*cliContext.Context, sdk.TxDecoder, error) {
 	cdc := app.MakeCodec()
 	cliCtx, err := cliContext.NewContext(
 		config.ChainID,
@@ -16,9 +16,8 @@ func GetEnv(config *common.DwhCommonServiceConfig) (cliContext.Context, sdk.TxDe
 		config.CliHome,
 	)
 	if err != nil {
-		return cliContext.Context{}, nil, err
+		return nil, nil, err
 	}
-	cliCtx = cliCtx.WithCodec(cdc)
 
-	return *cliCtx, auth.DefaultTxDecoder(cdc), nil
+	return cliCtx.WithCodec(cdc), auth.DefaultTxDecoder(cdc), nil
 }
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"fmt"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	"github.com/cosmos/modules/incubator/nft"
+	common "github.com/corestario/dwh/x/common"
+	mptypes "github.com/corestario/marketplace/x/marketplace/types"
+	"github.com/jinzhu/gorm"
+)
+
+// domainEvent is a domain event of the message being handled (see common.DomainEvent).
+type domainEvent struct {
+	eventType string
+	denom     string
+	tokenID   string
+	sender    string
+	recipient string
+	amount    sdk.Coins
+}
+
+// msgEvents returns the domain events that follow from the message itself (bids are
+// added by the handler, which knows the owner of the token, and sales by recordSale).
+// denom is the NFT denom of the message, if any.
+func msgEvents(msg sdk.Msg, denom string) []domainEvent {
+	switch value := msg.(type) {
+	case nft.MsgMintNFT:
+		return []domainEvent{{common.DomainEventMint, denom, value.ID, value.Sender.String(), value.Recipient.String(), nil}}
+	case nft.MsgTransferNFT:
+		return []domainEvent{{common.DomainEventTransfer, denom, value.ID, value.Sender.String(), value.Recipient.String(), nil}}
+	case mptypes.MsgPutNFTOnMarket:
+		return []domainEvent{{common.DomainEventListing, denom, value.TokenID, value.Owner.String(), "", value.Price}}
+	case mptypes.MsgPutNFTOnAuction:
+		return []domainEvent{{common.DomainEventListing, denom, value.TokenID, value.Owner.String(), "", value.OpeningPrice}}
+	case mptypes.MsgCreateFungibleToken:
+		return []domainEvent{{common.DomainEventMint, value.Denom, "", value.Creator.String(), value.Creator.String(),
+			sdk.NewCoins(sdk.NewInt64Coin(value.Denom, value.Amount))}}
+	case mptypes.MsgTransferFungibleTokens:
+		return []domainEvent{{common.DomainEventTransfer, value.Denom, "", value.Owner.String(), value.Recipient.String(),
+			sdk.NewCoins(sdk.NewInt64Coin(value.Denom, value.Amount))}}
+	}
+
+	return nil
+}
+
+// addBidEvent adds the event of a bid (or an offer) on the token, addressed to the
+// current owner of the token.
+func (m *MarketplaceHandler) addBidEvent(db *gorm.DB, denom, tokenID, bidder string, amount sdk.Coins) error {
+	var token common.NFT
+	err := db.New().Where("denom = ? AND token_id = ?", denom, tokenID).First(&token).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return fmt.Errorf("failed to find owner of nft %s/%s: %v", denom, tokenID, err)
+	}
+	m.events = append(m.events, domainEvent{common.DomainEventBid, denom, tokenID, bidder, token.OwnerAddress, amount})
+
+	return nil
+}
+
+// writeEvents writes the domain events of the message to the sink of the handler, in
+// the transaction of the message.
+func (m *MarketplaceHandler) writeEvents(db *gorm.DB, info MsgInfo, msg sdk.Msg, events []domainEvent) error {
+	if m.sink == nil || len(events) == 0 {
+		return nil
+	}
+	out := make([]common.DomainEvent, len(events))
+	for i, event := range events {
+		out[i] = common.DomainEvent{
+			ChainID:    m.chainID,
+			Type:       event.eventType,
+			MsgType:    msg.Type(),
+			Height:     info.Height,
+			Time:       info.BlockTime,
+			TxHash:     info.TxHash,
+			MsgIndex:   info.MsgIndex,
+			EventIndex: i,
+			Denom:      event.denom,
+			TokenID:    event.tokenID,
+			Sender:     event.sender,
+			Recipient:  event.recipient,
+			Amount:     event.amount.String(),
+		}
+	}
+	if err := m.sink.Write(db.CommonDB(), out); err != nil {
+		return fmt.Errorf("failed to write domain events: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"fmt"
+
+	common "github.com/corestario/dwh/x/common"
+	"github.com/jinzhu/gorm"
+	"github.com/prometheus/common/log"
+)
+
+// addFungibleBalance adds delta (which can be negative) to the balance of holder.
+func addFungibleBalance(db *gorm.DB, denom, holder string, delta int64) error {
+	db = db.New()
+	var balance common.FungibleTokenBalance
+	err := db.Where("denom = ? AND holder = ?", denom, holder).First(&balance).Error
+	if gorm.IsRecordNotFoundError(err) {
+		balance = common.FungibleTokenBalance{Denom: denom, Holder: holder, Amount: delta}
+		if err := db.Create(&balance).Error; err != nil {
+			return fmt.Errorf("failed to create balance of %s (%s): %v", holder, denom, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to find balance of %s (%s): %v", holder, denom, err)
+	}
+	if err := db.Model(&balance).UpdateColumn("amount", gorm.Expr("amount + ?", delta)).Error; err != nil {
+		return fmt.Errorf("failed to update balance of %s (%s): %v", holder, denom, err)
+	}
+
+	return nil
+}
+
+// checkFungibleSupply checks the supply invariants of a fungible token: no balance
+// is negative and the balances add up to the emitted amount minus the burned one.
+// The result is stored in fungible_tokens.inconsistent; a violation is logged, but
+// is not an error of the message, because the balances may also change outside of
+// the marketplace module (e.g., bank transfers).
+func checkFungibleSupply(db *gorm.DB, denom string) error {
+	db = db.New()
+	var ft common.FungibleToken
+	if err := db.Where("denom = ?", denom).First(&ft).Error; err != nil {
+		return fmt.Errorf("failed to find fungible token %s: %v", denom, err)
+	}
+
+	var total, negative int64
+	if err := db.Model(&common.FungibleTokenBalance{}).Where("denom = ?", denom).
+		Select("COALESCE(SUM(amount), 0), COUNT(CASE WHEN amount < 0 THEN 1 END)").
+		Row().Scan(&total, &negative); err != nil {
+		return fmt.Errorf("failed to sum balances of %s: %v", denom, err)
+	}
+
+	inconsistent := false
+	if supply := ft.EmissionAmount - ft.BurnedAmount; total != supply {
+		log.Errorf("fungible token %s: balances add up to %d, supply is %d", denom, total, supply)
+		inconsistent = true
+	}
+	if negative > 0 {
+		log.Errorf("fungible token %s: %d negative balances", denom, negative)
+		inconsistent = true
+	}
+	if err := db.Model(&ft).UpdateColumn("inconsistent", inconsistent).Error; err != nil {
+		return fmt.Errorf("failed to update fungible token %s: %v", denom, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,931 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	common "github.com/corestario/dwh/x/common"
+	"github.com/corestario/dwh/x/migrations"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+// MarketplaceMigrationsComponent is the name of the marketplace handler in the
+// schema_migrations table.
+const MarketplaceMigrationsComponent = "marketplace"
+
+// MarketplaceMigrations returns the migrations of the marketplace tables, which are put
+// in the given Postgres schema. New schema changes must be added as new migrations
+// rather than to the existing ones, since applied migrations are never run again. Rows
+// indexed before chain IDs were introduced are assigned to chainID.
+func MarketplaceMigrations(schema, chainID string) migrations.Source {
+	return migrations.Source{
+		Component: MarketplaceMigrationsComponent,
+		Schema:    schema,
+		Migrations: []migrations.Migration{
+			// The schema as it was before versioned migrations were introduced. It can
+			// be applied to databases that were set up by older versions, which put
+			// the tables in public; the "schema" migration moves them.
+			{Version: 1, Name: "baseline", Schema: "public", Up: setupMarketplaceTables, Down: resetMarketplaceTables},
+			publicSQL(2, "amounts", amountsUp, amountsDown),
+			// NFTs are identified by (denom, token_id) rather than token_id.
+			publicSQL(3, "nft_identity", nftIdentityUp, nftIdentityDown),
+			publicSQL(4, "collections_sales", collectionsSalesUp, collectionsSalesDown),
+			publicSQL(5, "fungible_balances", fungibleBalancesUp, fungibleBalancesDown),
+			publicSQL(6, "daily_stats", dailyStatsUp, dailyStatsDown),
+			publicSQL(7, "beneficiary_earnings", beneficiaryEarningsUp, beneficiaryEarningsDown),
+			publicSQL(8, "address_activity", addressActivityUp, addressActivityDown),
+			// Heights that the account data of users was queried at (see package
+			// accountService).
+			publicSQL(9, "user_account_heights", userAccountHeightsUp, userAccountHeightsDown),
+			publicSQL(10, "versions", versionsUp, versionsDown),
+			{
+				Version: 11,
+				Name:    "schema",
+				Up:      func(db *gorm.DB) error { return moveMarketplaceTables(db, "public", schema) },
+				Down:    func(db *gorm.DB) error { return moveMarketplaceTables(db, schema, "public") },
+			},
+			migrations.CreateIndexes(12, "indexes", marketplaceIndexes...),
+			{
+				Version: 13,
+				Name:    "chain_ids",
+				Up:      func(db *gorm.DB) error { return addMarketplaceChainIDs(db, chainID) },
+				Down:    dropMarketplaceChainIDs,
+			},
+			// Token metadata projected by the token metadata worker.
+			migrations.SQL(14, "nft_metadata", nftMetadataUp, nftMetadataDown),
+			// Amounts of the prices that were indexed before amounts were introduced.
+			{Version: 15, Name: "amounts_backfill", Up: backfillAmounts, Down: keep},
+			// Burned tokens are deleted rather than soft-deleted, so that they can be
+			// minted again.
+			{
+				Version: 16,
+				Name:    "burned_nfts",
+				Up:      func(db *gorm.DB) error { return db.Exec(burnedNFTsUp).Error },
+				Down:    keep,
+			},
+			// The 24h volume of collections is computed when it is read rather than
+			// stored, so that it goes down when a collection has no sales.
+			migrations.SQL(17, "collection_volumes_24h", collectionVolumes24hUp, collectionVolumes24hDown),
+			// Heights and times of chains overlap, so versions are looked up by chain.
+			migrations.SQL(18, "chain_version_functions", chainVersionFunctionsUp, chainVersionFunctionsDown),
+		},
+		Indexes: append(append(append(append([]migrations.Index{}, marketplaceBaselineIndexes...), marketplaceIndexes...),
+			marketplaceChainIndexes...), nftMetadataIndexes...),
+	}
+}
+
+// versionFunctions are the functions created by the "versions" migration, which
+// return the versions of rows that were valid at a given height or time. Hasura exposes
+// them as queries. The "chain_version_functions" migration replaces them with functions
+// that also take a chain ID.
+var versionFunctions = []struct {
+	name, argType string
+}{
+	{common.NFTsAtHeightFunc, "bigint"},
+	{common.NFTsAtTimeFunc, "timestamp with time zone"},
+	{common.OffersAtHeightFunc, "bigint"},
+	{common.OffersAtTimeFunc, "timestamp with time zone"},
+	{common.UsersAtHeightFunc, "bigint"},
+}
+
+// keep is the down step of migrations that only change rows, which are kept as they
+// are when the migrations are reverted.
+func keep(*gorm.DB) error {
+	return nil
+}
+
+// publicSQL returns a migration that runs the given SQL in public. The migrations that
+// precede the "schema" one are run there, where older versions put the tables.
+func publicSQL(version int64, name, up, down string) migrations.Migration {
+	migration := migrations.SQL(version, name, up, down)
+	migration.Schema = "public"
+	return migration
+}
+
+// marketplaceIndexes are the indexes that storefront queries and the marketplace
+// handler rely on, created by the "indexes" migration. New indexes must be created by
+// a new migration.
+var marketplaceIndexes = []migrations.Index{
+	{Table: "nfts", Name: "idx_nfts_owner_address", Columns: []string{"owner_address"}},
+	{Table: "nfts", Name: "idx_nfts_status", Columns: []string{"status"}},
+	{Table: "nfts", Name: "idx_nfts_denom_status", Columns: []string{"denom", "status"}},
+	// Marketplace messages only carry token IDs (see findDenom).
+	{Table: "nfts", Name: "idx_nfts_token_id", Columns: []string{"token_id"}},
+	{Table: "offers", Name: "idx_offers_token_id", Columns: []string{"token_id", "denom"}},
+	{Table: "offers", Name: "idx_offers_buyer", Columns: []string{"buyer"}},
+	{Table: "auction_bids", Name: "idx_auction_bids_token_id", Columns: []string{"token_id", "denom"}},
+}
+
+// marketplaceBaselineIndexes are the indexes created along with the tables by the
+// migrations that precede "schema" (except for the unique ones, which the "chain_ids"
+// migration replaced).
+var marketplaceBaselineIndexes = []migrations.Index{
+	{Table: "amounts", Name: "idx_amounts_owner", Columns: []string{"owner_table", "owner_id", "field"}},
+	{Table: "sales", Name: "idx_sales_denom_time", Columns: []string{"denom", "time"}},
+	{Table: "address_activity", Name: "idx_address_activity_address_height", Columns: []string{"address", "height"}},
+	{Table: "address_activity", Name: "idx_address_activity_tx_hash", Columns: []string{"tx_hash", "msg_index"}},
+	{Table: "nft_versions", Name: "idx_nft_versions_token", Columns: []string{"denom", "token_id", "valid_from_height"}},
+	{Table: "offer_versions", Name: "idx_offer_versions_token", Columns: []string{"denom", "token_id", "valid_from_height"}},
+	{Table: "user_versions", Name: "idx_user_versions_address", Columns: []string{"address", "valid_from_height"}},
+}
+
+// marketplaceUniqueKeys are the unique keys of the marketplace tables. Keys are only
+// unique within a chain, so the "chain_ids" migration replaces the baseline ones
+// (old) with ones that start with the chain ID (new).
+var marketplaceUniqueKeys = []struct {
+	table, old, new string
+	columns         []string
+}{
+	{"nfts", "idx_nfts_denom_token_id", "idx_nfts_chain_id_denom_token_id", []string{"denom", "token_id"}},
+	{"collections", "collections_denom_key", "idx_collections_chain_id_denom", []string{"denom"}},
+	{"fungible_tokens", "fungible_tokens_denom_key", "idx_fungible_tokens_chain_id_denom", []string{"denom"}},
+	{"fungible_token_balances", "idx_fungible_token_balances_denom_holder",
+		"idx_fungible_token_balances_chain_id_denom_holder", []string{"denom", "holder"}},
+	{"marketplace_daily_stats", "idx_marketplace_daily_stats_key",
+		"idx_marketplace_daily_stats_chain_id_key", []string{"date", "denom", "collection"}},
+}
+
+// marketplaceChainIndexes are the unique keys created by the "chain_ids" migration.
+var marketplaceChainIndexes = func() []migrations.Index {
+	out := make([]migrations.Index, len(marketplaceUniqueKeys))
+	for i, key := range marketplaceUniqueKeys {
+		out[i] = migrations.Index{Table: key.table, Name: key.new, Columns: append([]string{"chain_id"}, key.columns...)}
+	}
+	return out
+}()
+
+// nftMetadataIndexes are the indexes created by the "nft_metadata" migration: the
+// unique key of the metadata of a token, the attributes of a token, and the tokens that
+// have an attribute (e.g., on-market items filtered by trait).
+var nftMetadataIndexes = []migrations.Index{
+	{Table: "nft_metadata", Name: "idx_nft_metadata_denom_token_id", Columns: []string{"denom", "token_id"}},
+	{Table: "nft_attributes", Name: "idx_nft_attributes_token", Columns: []string{"denom", "token_id"}},
+	{Table: "nft_attributes", Name: "idx_nft_attributes_trait", Columns: []string{"trait_type", "value"}},
+}
+
+// marketplaceForeignKeys are the foreign keys of the marketplace tables that reference
+// rows by keys which are only unique within a chain. The "chain_ids" migration makes
+// them include the chain ID.
+var marketplaceForeignKeys = []struct {
+	value         interface{}
+	columns, dest string
+	destColumns   string
+}{
+	{&common.NFT{}, "owner_address", "users", "address"},
+	{&common.FungibleToken{}, "owner_address", "users", "address"},
+	{&common.Offer{}, "denom, token_id", "nfts", "denom, token_id"},
+	{&common.AuctionBid{}, "denom, token_id", "nfts", "denom, token_id"},
+	{&common.FungibleTokenTransfer{}, "sender_address", "users", "address"},
+	{&common.FungibleTokenTransfer{}, "recipient_address", "users", "address"},
+	{&common.FungibleTokenBalance{}, "denom", "fungible_tokens", "denom"},
+	{&common.FungibleTokenBalance{}, "holder", "users", "address"},
+}
+
+func (m *MarketplaceHandler) Migrations() migrations.Source {
+	return MarketplaceMigrations(m.schema, m.chainID)
+}
+
+// marketplaceTables are the tables created by the marketplace handler.
+var marketplaceTables = []interface{}{
+	&common.NFT{},
+	&common.Offer{},
+	&common.AuctionBid{},
+	&common.FungibleToken{},
+	&common.FungibleTokenTransfer{},
+	&common.FungibleTokenBalance{},
+	&common.Amount{},
+	&common.Collection{},
+	&common.Sale{},
+	&common.BeneficiaryEarning{},
+	&common.AddressActivity{},
+	&common.MarketplaceDailyStat{},
+	&common.NFTVersion{},
+	&common.OfferVersion{},
+	&common.UserVersion{},
+}
+
+// backfilledPrices are the price fields that were indexed before amounts were
+// introduced, by table.
+var backfilledPrices = []struct {
+	table, field string
+}{
+	{"nfts", "price"},
+	{"nfts", "buyout_price"},
+	{"nfts", "opening_price"},
+	{"offers", "price"},
+	{"auction_bids", "price"},
+}
+
+// backfillAmounts adds the amounts of the prices of current rows that have none.
+func backfillAmounts(db *gorm.DB) error {
+	for _, price := range backfilledPrices {
+		rows, err := db.Raw(fmt.Sprintf(`
+			SELECT id, chain_id, %[2]s FROM %[1]s
+			WHERE deleted_at IS NULL AND COALESCE(%[2]s, '') <> '' AND NOT EXISTS (
+				SELECT 1 FROM amounts
+				WHERE owner_table = '%[1]s' AND owner_id = %[1]s.id AND field = '%[2]s' AND deleted_at IS NULL
+			)`, price.table, price.field)).Rows()
+		if err != nil {
+			return fmt.Errorf("failed to get prices (%s.%s): %v", price.table, price.field, err)
+		}
+		var amounts []*common.Amount
+		for rows.Next() {
+			var (
+				id             uint
+				chainID, value string
+			)
+			if err := rows.Scan(&id, &chainID, &value); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to get prices (%s.%s): %v", price.table, price.field, err)
+			}
+			coins, err := sdk.ParseCoins(value)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to parse price of %s #%d (%s): %v", price.table, id, price.field, err)
+			}
+			for _, amount := range common.NewAmounts(price.table, id, price.field, coins) {
+				amount.ChainID = chainID
+				amounts = append(amounts, amount)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to get prices (%s.%s): %v", price.table, price.field, err)
+		}
+		for _, amount := range amounts {
+			if err := db.Exec(`INSERT INTO amounts (created_at, updated_at, chain_id, owner_table, owner_id, field, denom, amount)
+				VALUES (NOW(), NOW(), ?, ?, ?, ?, ?, ?)`,
+				amount.ChainID, amount.OwnerTable, amount.OwnerID, amount.Field, amount.Denom, amount.Amount).Error; err != nil {
+				return fmt.Errorf("failed to create amount (%s #%d, %s): %v", amount.OwnerTable, amount.OwnerID, amount.Field, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// moveMarketplaceTables moves the marketplace tables and functions from one schema to
+// another. Tables and functions that are not in the source schema are skipped.
+func moveMarketplaceTables(db *gorm.DB, from, to string) error {
+	if from == to {
+		return nil
+	}
+	for _, table := range marketplaceTables {
+		name := db.NewScope(table).TableName()
+		if err := db.Exec(fmt.Sprintf("ALTER TABLE IF EXISTS %s.%s SET SCHEMA %s",
+			pq.QuoteIdentifier(from), pq.QuoteIdentifier(name), pq.QuoteIdentifier(to))).Error; err != nil {
+			return fmt.Errorf("failed to move table %s to schema %s: %v", name, to, err)
+		}
+	}
+	for _, f := range versionFunctions {
+		exists, err := hasFunction(db, from, f.name, f.argType)
+		if err != nil {
+			return err
+		}
+		if exists {
+			if err := db.Exec(fmt.Sprintf("ALTER FUNCTION %s.%s(%s) SET SCHEMA %s",
+				pq.QuoteIdentifier(from), f.name, f.argType, pq.QuoteIdentifier(to))).Error; err != nil {
+				return fmt.Errorf("failed to move function %s to schema %s: %v", f.name, to, err)
+			}
+		}
+		if exists, err = hasFunction(db, to, f.name, f.argType); err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		// Functions look up their tables in the schema they are in, whatever the search
+		// path of the caller is.
+		setSearchPath := fmt.Sprintf("SET search_path = %s, public", pq.QuoteIdentifier(to))
+		if to == "public" {
+			setSearchPath = "RESET search_path"
+		}
+		if err := db.Exec(fmt.Sprintf("ALTER FUNCTION %s.%s(%s) %s",
+			pq.QuoteIdentifier(to), f.name, f.argType, setSearchPath)).Error; err != nil {
+			return fmt.Errorf("failed to set search path of function %s: %v", f.name, err)
+		}
+	}
+
+	return nil
+}
+
+func hasFunction(db *gorm.DB, schema, name, argType string) (bool, error) {
+	var exists bool
+	if err := db.Raw("SELECT to_regprocedure(?) IS NOT NULL",
+		fmt.Sprintf("%s.%s(%s)", pq.QuoteIdentifier(schema), name, argType)).Row().Scan(&exists); err != nil {
+		return false, fmt.Errorf("failed to check function %s: %v", name, err)
+	}
+
+	return exists, nil
+}
+
+// addMarketplaceChainIDs tags the rows of the marketplace tables with chain IDs and
+// makes their unique and foreign keys include the chain ID. It also drops the unique key
+// of users on address, which the indexer kept for the foreign keys replaced here.
+func addMarketplaceChainIDs(db *gorm.DB, chainID string) error {
+	for _, key := range marketplaceForeignKeys {
+		if err := dropForeignKey(db, key.value, key.columns, key.dest, key.destColumns); err != nil {
+			return err
+		}
+	}
+	for _, table := range marketplaceTables {
+		if err := common.AddChainIDColumn(db, db.NewScope(table).TableName(), chainID); err != nil {
+			return err
+		}
+	}
+	for _, key := range marketplaceUniqueKeys {
+		if err := dropUniqueKey(db, key.table, key.old); err != nil {
+			return err
+		}
+		if err := db.Exec(fmt.Sprintf("CREATE UNIQUE INDEX %s ON %s (chain_id, %s)",
+			pq.QuoteIdentifier(key.new), pq.QuoteIdentifier(key.table), strings.Join(key.columns, ", "))).Error; err != nil {
+			return fmt.Errorf("failed to add unique key %s: %v", key.new, err)
+		}
+	}
+	if err := dropUniqueKey(db, "users", "users_address_key"); err != nil {
+		return err
+	}
+	for _, key := range marketplaceForeignKeys {
+		if err := addForeignKey(db, key.value, "chain_id, "+key.columns, key.dest, "chain_id, "+key.destColumns); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dropMarketplaceChainIDs reverts addMarketplaceChainIDs. It fails if the rows of
+// several chains share keys.
+func dropMarketplaceChainIDs(db *gorm.DB) error {
+	for _, key := range marketplaceForeignKeys {
+		if err := dropForeignKey(db, key.value, "chain_id, "+key.columns, key.dest, "chain_id, "+key.destColumns); err != nil {
+			return err
+		}
+	}
+	if err := db.Exec("ALTER TABLE users ADD CONSTRAINT users_address_key UNIQUE (address)").Error; err != nil {
+		return fmt.Errorf("failed to add unique key users_address_key: %v", err)
+	}
+	for _, key := range marketplaceUniqueKeys {
+		if err := db.Exec("DROP INDEX IF EXISTS " + pq.QuoteIdentifier(key.new)).Error; err != nil {
+			return fmt.Errorf("failed to drop unique key %s: %v", key.new, err)
+		}
+		if err := db.Exec(fmt.Sprintf("CREATE UNIQUE INDEX %s ON %s (%s)",
+			pq.QuoteIdentifier(key.old), pq.QuoteIdentifier(key.table), strings.Join(key.columns, ", "))).Error; err != nil {
+			return fmt.Errorf("failed to add unique key %s: %v", key.old, err)
+		}
+	}
+	for _, table := range marketplaceTables {
+		if err := common.DropChainIDColumn(db, db.NewScope(table).TableName()); err != nil {
+			return err
+		}
+	}
+	for _, key := range marketplaceForeignKeys {
+		if err := addForeignKey(db, key.value, key.columns, key.dest, key.destColumns); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// foreignKeyName returns the name that gorm gives to a foreign key (see
+// gorm.DB.AddForeignKey). Postgres truncates long names, which gorm does not expect, so
+// foreign keys are added and dropped here rather than by gorm.
+func foreignKeyName(db *gorm.DB, value interface{}, columns, dest, destColumns string) (string, string) {
+	table := db.NewScope(value).TableName()
+	return table, db.Dialect().BuildKeyName(table, columns, fmt.Sprintf("%s(%s)", dest, destColumns), "foreign")
+}
+
+// addForeignKey adds a foreign key that cascades deletes and updates, like the ones of
+// the baseline.
+func addForeignKey(db *gorm.DB, value interface{}, columns, dest, destColumns string) error {
+	table, name := foreignKeyName(db, value, columns, dest, destColumns)
+	if err := db.Exec(fmt.Sprintf(
+		"ALTER TABLE %s ADD CONSTRAINT %s FOREIGN KEY (%s) REFERENCES %s (%s) ON DELETE CASCADE ON UPDATE CASCADE",
+		pq.QuoteIdentifier(table), pq.QuoteIdentifier(name), columns, pq.QuoteIdentifier(dest), destColumns)).Error; err != nil {
+		return fmt.Errorf("failed to add foreign key (%s): %v", table, err)
+	}
+
+	return nil
+}
+
+func dropForeignKey(db *gorm.DB, value interface{}, columns, dest, destColumns string) error {
+	table, name := foreignKeyName(db, value, columns, dest, destColumns)
+	if err := db.Exec(fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT IF EXISTS %s",
+		pq.QuoteIdentifier(table), pq.QuoteIdentifier(name))).Error; err != nil {
+		return fmt.Errorf("failed to drop foreign key (%s): %v", table, err)
+	}
+
+	return nil
+}
+
+// dropUniqueKey drops the unique constraint or index of the table, whichever it is.
+func dropUniqueKey(db *gorm.DB, table, name string) error {
+	if err := db.Exec(fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT IF EXISTS %s",
+		pq.QuoteIdentifier(table), pq.QuoteIdentifier(name))).Error; err != nil {
+		return fmt.Errorf("failed to drop unique key %s: %v", name, err)
+	}
+	if err := db.Exec("DROP INDEX IF EXISTS " + pq.QuoteIdentifier(name)).Error; err != nil {
+		return fmt.Errorf("failed to drop unique key %s: %v", name, err)
+	}
+
+	return nil
+}
+
+// modelColumns are the columns of gorm.Model. Like the ones of the indexer, the
+// migrations spell their tables out rather than derive them from the models.
+const modelColumns = `id serial PRIMARY KEY,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone`
+
+// marketplaceBaselineUp creates the marketplace tables as older versions did. Users are
+// also created by the indexer, which shares them with other handlers. Foreign keys are
+// created again, since older versions (re)created them on every start.
+const marketplaceBaselineUp = `
+CREATE TABLE IF NOT EXISTS users (
+	` + modelColumns + `,
+	name text,
+	address varchar(45) NOT NULL UNIQUE,
+	balance text,
+	account_number bigint,
+	sequence_number bigint
+);
+CREATE INDEX IF NOT EXISTS idx_users_deleted_at ON users (deleted_at);
+CREATE TABLE IF NOT EXISTS nfts (
+	` + modelColumns + `,
+	denom text,
+	token_id text NOT NULL UNIQUE,
+	owner_address varchar(45),
+	token_uri text,
+	status integer,
+	price text,
+	seller_beneficiary text,
+	buyout_price text,
+	opening_price text,
+	time_to_sell timestamp with time zone
+);
+CREATE INDEX IF NOT EXISTS idx_nfts_deleted_at ON nfts (deleted_at);
+CREATE TABLE IF NOT EXISTS offers (
+	` + modelColumns + `,
+	offer_id text,
+	buyer text,
+	price text,
+	buyer_beneficiary text,
+	beneficiary_commission text,
+	token_id text
+);
+CREATE INDEX IF NOT EXISTS idx_offers_deleted_at ON offers (deleted_at);
+CREATE TABLE IF NOT EXISTS auction_bids (
+	` + modelColumns + `,
+	bidder_address text,
+	bidder_beneficiary text,
+	beneficiary_commission text,
+	price text,
+	token_id text
+);
+CREATE INDEX IF NOT EXISTS idx_auction_bids_deleted_at ON auction_bids (deleted_at);
+CREATE TABLE IF NOT EXISTS fungible_tokens (
+	` + modelColumns + `,
+	owner_address varchar(45),
+	denom text NOT NULL UNIQUE,
+	emission_amount bigint
+);
+CREATE INDEX IF NOT EXISTS idx_fungible_tokens_deleted_at ON fungible_tokens (deleted_at);
+CREATE TABLE IF NOT EXISTS fungible_token_transfers (
+	` + modelColumns + `,
+	sender_address varchar(45),
+	recipient_address varchar(45),
+	fungible_token_id bigint,
+	amount bigint
+);
+CREATE INDEX IF NOT EXISTS idx_fungible_token_transfers_deleted_at ON fungible_token_transfers (deleted_at);
+ALTER TABLE nfts DROP CONSTRAINT IF EXISTS nfts_owner_address_users_address_foreign;
+ALTER TABLE nfts ADD CONSTRAINT nfts_owner_address_users_address_foreign
+	FOREIGN KEY (owner_address) REFERENCES users (address) ON DELETE CASCADE ON UPDATE CASCADE;
+ALTER TABLE fungible_tokens DROP CONSTRAINT IF EXISTS fungible_tokens_owner_address_users_address_foreign;
+ALTER TABLE fungible_tokens ADD CONSTRAINT fungible_tokens_owner_address_users_address_foreign
+	FOREIGN KEY (owner_address) REFERENCES users (address) ON DELETE CASCADE ON UPDATE CASCADE;
+ALTER TABLE offers DROP CONSTRAINT IF EXISTS offers_token_id_nfts_token_id_foreign;
+ALTER TABLE offers ADD CONSTRAINT offers_token_id_nfts_token_id_foreign
+	FOREIGN KEY (token_id) REFERENCES nfts (token_id) ON DELETE CASCADE ON UPDATE CASCADE;
+ALTER TABLE auction_bids DROP CONSTRAINT IF EXISTS auction_bids_token_id_nfts_token_id_foreign;
+ALTER TABLE auction_bids ADD CONSTRAINT auction_bids_token_id_nfts_token_id_foreign
+	FOREIGN KEY (token_id) REFERENCES nfts (token_id) ON DELETE CASCADE ON UPDATE CASCADE;
+ALTER TABLE fungible_token_transfers DROP CONSTRAINT IF EXISTS fungible_token_transfers_sender_address_users_address_foreign;
+ALTER TABLE fungible_token_transfers ADD CONSTRAINT fungible_token_transfers_sender_address_users_address_foreign
+	FOREIGN KEY (sender_address) REFERENCES users (address) ON DELETE CASCADE ON UPDATE CASCADE;
+ALTER TABLE fungible_token_transfers DROP CONSTRAINT IF EXISTS fungible_token_transfers_recipient_address_users_address_foreign;
+ALTER TABLE fungible_token_transfers ADD CONSTRAINT fungible_token_transfers_recipient_address_users_address_foreign
+	FOREIGN KEY (recipient_address) REFERENCES users (address) ON DELETE CASCADE ON UPDATE CASCADE;
+ALTER TABLE fungible_token_transfers DROP CONSTRAINT IF EXISTS fungible_token_transfers_fungible_token_id_fungible_tokens_id_foreign;
+ALTER TABLE fungible_token_transfers ADD CONSTRAINT fungible_token_transfers_fungible_token_id_fungible_tokens_id_foreign
+	FOREIGN KEY (fungible_token_id) REFERENCES fungible_tokens (id) ON DELETE CASCADE ON UPDATE CASCADE;
+`
+
+// marketplaceBaselineDown drops the foreign keys of other handlers to users as well.
+const marketplaceBaselineDown = `
+DROP TABLE IF EXISTS offers, auction_bids, nfts, fungible_token_transfers, fungible_tokens;
+DROP TABLE IF EXISTS users CASCADE;
+`
+
+// amountsUp creates the amounts that prices are normalized to (see setAmounts).
+const amountsUp = `
+CREATE TABLE amounts (
+	` + modelColumns + `,
+	owner_table text NOT NULL,
+	owner_id integer NOT NULL,
+	field text NOT NULL,
+	denom text NOT NULL,
+	amount numeric NOT NULL
+);
+CREATE INDEX idx_amounts_deleted_at ON amounts (deleted_at);
+CREATE INDEX idx_amounts_owner ON amounts (owner_table, owner_id, field);
+`
+
+const amountsDown = `DROP TABLE amounts`
+
+// nftIdentityUp moves offers and bids from the token_id NFT identity to the (denom,
+// token_id) one. Token IDs used to be unique, so the denoms of offers and bids are
+// taken from their tokens.
+const nftIdentityUp = `
+ALTER TABLE offers DROP CONSTRAINT offers_token_id_nfts_token_id_foreign;
+ALTER TABLE auction_bids DROP CONSTRAINT auction_bids_token_id_nfts_token_id_foreign;
+ALTER TABLE offers ADD COLUMN denom text;
+ALTER TABLE auction_bids ADD COLUMN denom text;
+UPDATE offers SET denom = nfts.denom FROM nfts WHERE nfts.token_id = offers.token_id;
+UPDATE auction_bids SET denom = nfts.denom FROM nfts WHERE nfts.token_id = auction_bids.token_id;
+ALTER TABLE nfts DROP CONSTRAINT nfts_token_id_key;
+CREATE UNIQUE INDEX idx_nfts_denom_token_id ON nfts (denom, token_id);
+ALTER TABLE offers ADD CONSTRAINT offers_denom_token_id_nfts_denom_token_id_foreign
+	FOREIGN KEY (denom, token_id) REFERENCES nfts (denom, token_id) ON DELETE CASCADE ON UPDATE CASCADE;
+ALTER TABLE auction_bids ADD CONSTRAINT auction_bids_denom_token_id_nfts_denom_token_id_foreign
+	FOREIGN KEY (denom, token_id) REFERENCES nfts (denom, token_id) ON DELETE CASCADE ON UPDATE CASCADE;
+`
+
+// nftIdentityDown fails if tokens of several denoms share IDs.
+const nftIdentityDown = `
+ALTER TABLE offers DROP CONSTRAINT offers_denom_token_id_nfts_denom_token_id_foreign;
+ALTER TABLE auction_bids DROP CONSTRAINT auction_bids_denom_token_id_nfts_denom_token_id_foreign;
+DROP INDEX idx_nfts_denom_token_id;
+ALTER TABLE nfts ADD CONSTRAINT nfts_token_id_key UNIQUE (token_id);
+ALTER TABLE offers DROP COLUMN denom;
+ALTER TABLE auction_bids DROP COLUMN denom;
+ALTER TABLE offers ADD CONSTRAINT offers_token_id_nfts_token_id_foreign
+	FOREIGN KEY (token_id) REFERENCES nfts (token_id) ON DELETE CASCADE ON UPDATE CASCADE;
+ALTER TABLE auction_bids ADD CONSTRAINT auction_bids_token_id_nfts_token_id_foreign
+	FOREIGN KEY (token_id) REFERENCES nfts (token_id) ON DELETE CASCADE ON UPDATE CASCADE;
+`
+
+// collectionsSalesUp creates the statistics of collections and the sales they are
+// computed from (see marketplace_collections.go).
+const collectionsSalesUp = `
+CREATE TABLE collections (
+	` + modelColumns + `,
+	denom text NOT NULL UNIQUE,
+	creator varchar(45),
+	first_mint_height bigint,
+	total_minted bigint,
+	burned bigint,
+	unique_holders bigint,
+	on_market bigint,
+	on_auction bigint,
+	floor_price text,
+	volume text,
+	volume_24h text
+);
+CREATE INDEX idx_collections_deleted_at ON collections (deleted_at);
+CREATE TABLE sales (
+	` + modelColumns + `,
+	denom text NOT NULL,
+	token_id text NOT NULL,
+	seller varchar(45),
+	buyer varchar(45),
+	price text,
+	msg_type text,
+	height bigint,
+	time timestamp with time zone,
+	tx_hash text
+);
+CREATE INDEX idx_sales_deleted_at ON sales (deleted_at);
+CREATE INDEX idx_sales_denom_time ON sales (denom, time);
+`
+
+const collectionsSalesDown = `DROP TABLE collections, sales`
+
+// fungibleBalancesUp creates the balances of fungible tokens and computes the ones of
+// the tokens indexed so far from their emissions and transfers. Tokens whose balances
+// do not pass the supply invariants are marked inconsistent (see checkFungibleSupply).
+const fungibleBalancesUp = `
+ALTER TABLE fungible_tokens ADD COLUMN burned_amount bigint NOT NULL DEFAULT 0;
+ALTER TABLE fungible_tokens ADD COLUMN inconsistent boolean NOT NULL DEFAULT false;
+CREATE TABLE fungible_token_balances (
+	` + modelColumns + `,
+	denom text NOT NULL,
+	holder varchar(45) NOT NULL,
+	amount bigint NOT NULL
+);
+CREATE INDEX idx_fungible_token_balances_deleted_at ON fungible_token_balances (deleted_at);
+CREATE UNIQUE INDEX idx_fungible_token_balances_denom_holder ON fungible_token_balances (denom, holder);
+INSERT INTO fungible_token_balances (created_at, updated_at, denom, holder, amount)
+SELECT NOW(), NOW(), denom, holder, SUM(amount) FROM (
+	SELECT denom, owner_address AS holder, emission_amount AS amount
+	FROM fungible_tokens WHERE deleted_at IS NULL
+	UNION ALL
+	SELECT fungible_tokens.denom, sender_address, -amount
+	FROM fungible_token_transfers JOIN fungible_tokens ON fungible_tokens.id = fungible_token_id
+	WHERE fungible_token_transfers.deleted_at IS NULL
+	UNION ALL
+	SELECT fungible_tokens.denom, recipient_address, amount
+	FROM fungible_token_transfers JOIN fungible_tokens ON fungible_tokens.id = fungible_token_id
+	WHERE fungible_token_transfers.deleted_at IS NULL
+) AS changes
+GROUP BY denom, holder;
+UPDATE fungible_tokens SET inconsistent = balances.total <> COALESCE(emission_amount, 0) OR balances.negative > 0
+FROM (
+	SELECT denom, SUM(amount) AS total, COUNT(CASE WHEN amount < 0 THEN 1 END) AS negative
+	FROM fungible_token_balances GROUP BY denom
+) AS balances
+WHERE balances.denom = fungible_tokens.denom;
+ALTER TABLE fungible_token_balances ADD CONSTRAINT fungible_token_balances_denom_fungible_tokens_denom_foreign
+	FOREIGN KEY (denom) REFERENCES fungible_tokens (denom) ON DELETE CASCADE ON UPDATE CASCADE;
+ALTER TABLE fungible_token_balances ADD CONSTRAINT fungible_token_balances_holder_users_address_foreign
+	FOREIGN KEY (holder) REFERENCES users (address) ON DELETE CASCADE ON UPDATE CASCADE;
+`
+
+const fungibleBalancesDown = `
+DROP TABLE fungible_token_balances;
+ALTER TABLE fungible_tokens DROP COLUMN burned_amount, DROP COLUMN inconsistent;
+`
+
+// dailyStatsUp creates the daily statistics of collections (see
+// marketplace_stats.go).
+const dailyStatsUp = `
+CREATE TABLE marketplace_daily_stats (
+	` + modelColumns + `,
+	date date NOT NULL,
+	denom text NOT NULL,
+	collection text NOT NULL,
+	sales_count bigint,
+	volume numeric NOT NULL DEFAULT 0,
+	unique_buyers bigint,
+	unique_sellers bigint,
+	new_listings bigint,
+	new_auctions bigint,
+	bids_placed bigint,
+	offers_made bigint,
+	offers_accepted bigint,
+	mints bigint,
+	burns bigint
+);
+CREATE INDEX idx_marketplace_daily_stats_deleted_at ON marketplace_daily_stats (deleted_at);
+CREATE UNIQUE INDEX idx_marketplace_daily_stats_key ON marketplace_daily_stats (date, denom, collection);
+`
+
+const dailyStatsDown = `DROP TABLE marketplace_daily_stats`
+
+// beneficiaryEarningsUp creates the commissions that beneficiaries earned from sales.
+const beneficiaryEarningsUp = `
+CREATE TABLE beneficiary_earnings (
+	` + modelColumns + `,
+	sale_id integer NOT NULL,
+	beneficiary varchar(45) NOT NULL,
+	role text NOT NULL,
+	share numeric NOT NULL,
+	amount text
+);
+CREATE INDEX idx_beneficiary_earnings_deleted_at ON beneficiary_earnings (deleted_at);
+CREATE INDEX idx_beneficiary_earnings_sale_id ON beneficiary_earnings (sale_id);
+CREATE INDEX idx_beneficiary_earnings_beneficiary ON beneficiary_earnings (beneficiary);
+ALTER TABLE beneficiary_earnings ADD CONSTRAINT beneficiary_earnings_sale_id_sales_id_foreign
+	FOREIGN KEY (sale_id) REFERENCES sales (id) ON DELETE CASCADE ON UPDATE CASCADE;
+`
+
+const beneficiaryEarningsDown = `DROP TABLE beneficiary_earnings`
+
+// addressActivityUp creates the activity feeds of addresses. Feeds are paginated by
+// (height, id), newest first, optionally filtered by action.
+const addressActivityUp = `
+CREATE TABLE address_activity (
+	` + modelColumns + `,
+	address varchar(45) NOT NULL,
+	role text NOT NULL,
+	action text NOT NULL,
+	denom text,
+	token_id text,
+	amount text,
+	height bigint NOT NULL,
+	time timestamp with time zone,
+	tx_hash text,
+	msg_index integer
+);
+CREATE INDEX idx_address_activity_deleted_at ON address_activity (deleted_at);
+CREATE INDEX idx_address_activity_address_height ON address_activity (address, height DESC, id DESC);
+CREATE INDEX idx_address_activity_address_action_height ON address_activity (address, action, height DESC, id DESC);
+CREATE INDEX idx_address_activity_tx_hash ON address_activity (tx_hash, msg_index);
+`
+
+const addressActivityDown = `DROP TABLE address_activity`
+
+const userAccountHeightsUp = `ALTER TABLE users ADD COLUMN account_height bigint`
+
+const userAccountHeightsDown = `ALTER TABLE users DROP COLUMN account_height`
+
+// versionsUp creates the versions of nfts, offers and users, and the functions that
+// return the versions valid at a given height or time (see versionFunctions). Rows
+// indexed so far get versions that are valid from the last indexed height, or, for
+// users, from the height their account data was queried at.
+const versionsUp = `
+CREATE TABLE nft_versions (
+	id serial PRIMARY KEY,
+	denom text NOT NULL,
+	token_id text NOT NULL,
+	owner_address varchar(45),
+	token_uri text,
+	status integer,
+	price text,
+	seller_beneficiary text,
+	buyout_price text,
+	opening_price text,
+	time_to_sell timestamp with time zone,
+	valid_from_height bigint NOT NULL,
+	valid_to_height bigint,
+	valid_from_time timestamp with time zone NOT NULL,
+	valid_to_time timestamp with time zone
+);
+CREATE INDEX idx_nft_versions_token ON nft_versions (denom, token_id, valid_from_height);
+CREATE INDEX idx_nft_versions_owner ON nft_versions (owner_address, valid_from_height);
+CREATE TABLE offer_versions (
+	id serial PRIMARY KEY,
+	offer_id text NOT NULL,
+	buyer text,
+	price text,
+	buyer_beneficiary text,
+	beneficiary_commission text,
+	token_id text NOT NULL,
+	denom text NOT NULL,
+	valid_from_height bigint NOT NULL,
+	valid_to_height bigint,
+	valid_from_time timestamp with time zone NOT NULL,
+	valid_to_time timestamp with time zone
+);
+CREATE INDEX idx_offer_versions_token ON offer_versions (denom, token_id, valid_from_height);
+CREATE TABLE user_versions (
+	id serial PRIMARY KEY,
+	address varchar(45) NOT NULL,
+	balance text,
+	account_number bigint,
+	sequence_number bigint,
+	valid_from_height bigint NOT NULL,
+	valid_to_height bigint
+);
+CREATE INDEX idx_user_versions_address ON user_versions (address, valid_from_height);
+INSERT INTO nft_versions (denom, token_id, owner_address, token_uri, status, price, seller_beneficiary,
+	buyout_price, opening_price, time_to_sell, valid_from_height, valid_from_time)
+SELECT denom, token_id, owner_address, token_uri, status, price, seller_beneficiary,
+	buyout_price, opening_price, time_to_sell, (SELECT COALESCE(MAX(height), 0) FROM txes), NOW()
+FROM nfts WHERE deleted_at IS NULL;
+INSERT INTO offer_versions (offer_id, buyer, price, buyer_beneficiary, beneficiary_commission, token_id, denom,
+	valid_from_height, valid_from_time)
+SELECT offer_id, buyer, price, buyer_beneficiary, beneficiary_commission, token_id, denom,
+	(SELECT COALESCE(MAX(height), 0) FROM txes), NOW()
+FROM offers WHERE deleted_at IS NULL;
+INSERT INTO user_versions (address, balance, account_number, sequence_number, valid_from_height)
+SELECT address, balance, account_number, sequence_number, COALESCE(account_height, 0)
+FROM users WHERE deleted_at IS NULL;
+CREATE FUNCTION nfts_at_height(h bigint) RETURNS SETOF nft_versions AS $$
+	SELECT * FROM nft_versions WHERE valid_from_height <= h AND (valid_to_height IS NULL OR valid_to_height > h)
+$$ LANGUAGE sql STABLE;
+CREATE FUNCTION nfts_at_time(t timestamp with time zone) RETURNS SETOF nft_versions AS $$
+	SELECT * FROM nft_versions WHERE valid_from_time <= t AND (valid_to_time IS NULL OR valid_to_time > t)
+$$ LANGUAGE sql STABLE;
+CREATE FUNCTION offers_at_height(h bigint) RETURNS SETOF offer_versions AS $$
+	SELECT * FROM offer_versions WHERE valid_from_height <= h AND (valid_to_height IS NULL OR valid_to_height > h)
+$$ LANGUAGE sql STABLE;
+CREATE FUNCTION offers_at_time(t timestamp with time zone) RETURNS SETOF offer_versions AS $$
+	SELECT * FROM offer_versions WHERE valid_from_time <= t AND (valid_to_time IS NULL OR valid_to_time > t)
+$$ LANGUAGE sql STABLE;
+CREATE FUNCTION users_at_height(h bigint) RETURNS SETOF user_versions AS $$
+	SELECT * FROM user_versions WHERE valid_from_height <= h AND (valid_to_height IS NULL OR valid_to_height > h)
+$$ LANGUAGE sql STABLE;
+`
+
+const versionsDown = `
+DROP FUNCTION nfts_at_height(bigint), nfts_at_time(timestamp with time zone),
+	offers_at_height(bigint), offers_at_time(timestamp with time zone), users_at_height(bigint);
+DROP TABLE nft_versions, offer_versions, user_versions;
+`
+
+// nftMetadataUp creates the metadata of tokens and their attributes. The worker upserts
+// the metadata of a token by its key.
+const nftMetadataUp = `
+CREATE TABLE nft_metadata (
+	id serial PRIMARY KEY,
+	denom text NOT NULL,
+	token_id text NOT NULL,
+	name text NOT NULL,
+	description text NOT NULL,
+	image text NOT NULL,
+	external_url text NOT NULL,
+	fetched_at timestamp with time zone NOT NULL,
+	valid_erc721 boolean NOT NULL
+);
+CREATE UNIQUE INDEX idx_nft_metadata_denom_token_id ON nft_metadata (denom, token_id);
+CREATE TABLE nft_attributes (
+	id serial PRIMARY KEY,
+	denom text NOT NULL,
+	token_id text NOT NULL,
+	trait_type text NOT NULL,
+	value text NOT NULL,
+	display_type text NOT NULL
+);
+CREATE INDEX idx_nft_attributes_token ON nft_attributes (denom, token_id);
+CREATE INDEX idx_nft_attributes_trait ON nft_attributes (trait_type, value);
+`
+
+const nftMetadataDown = `DROP TABLE nft_attributes, nft_metadata`
+
+// burnedNFTsUp deletes the tokens that were soft-deleted when they were burned, along
+// with their offers and bids (by the foreign keys) and the amounts of all of them.
+const burnedNFTsUp = `
+DELETE FROM amounts WHERE owner_table = 'offers' AND owner_id IN (
+	SELECT offers.id FROM offers JOIN nfts USING (chain_id, denom, token_id) WHERE nfts.deleted_at IS NOT NULL
+);
+DELETE FROM amounts WHERE owner_table = 'auction_bids' AND owner_id IN (
+	SELECT auction_bids.id FROM auction_bids JOIN nfts USING (chain_id, denom, token_id) WHERE nfts.deleted_at IS NOT NULL
+);
+DELETE FROM amounts WHERE owner_table = 'nfts' AND owner_id IN (SELECT id FROM nfts WHERE deleted_at IS NOT NULL);
+DELETE FROM nfts WHERE deleted_at IS NOT NULL;
+`
+
+// collectionVolumes24hUp replaces collections.volume_24h, which was updated along with
+// the other statistics of a collection and went stale once the collection had no
+// more activity, with a view of the sales of the last 24 hours: one row per coin
+// denom of the prices of every collection.
+const collectionVolumes24hUp = `
+ALTER TABLE collections DROP COLUMN volume_24h;
+DELETE FROM amounts WHERE owner_table = 'collections' AND field = 'volume_24h';
+CREATE VIEW collection_volumes_24h AS
+SELECT sales.chain_id, sales.denom AS collection, amounts.denom, SUM(amounts.amount) AS amount
+FROM sales
+JOIN amounts ON amounts.owner_table = 'sales' AND amounts.owner_id = sales.id AND amounts.field = 'price'
+WHERE sales.time > NOW() - INTERVAL '24 hours' AND sales.deleted_at IS NULL AND amounts.deleted_at IS NULL
+GROUP BY sales.chain_id, sales.denom, amounts.denom;
+`
+
+// collectionVolumes24hDown adds the column back empty; it is filled again as the
+// collections are updated.
+const collectionVolumes24hDown = `
+DROP VIEW collection_volumes_24h;
+ALTER TABLE collections ADD COLUMN volume_24h text;
+`
+
+// chainVersionFunctionsUp replaces the version functions with ones that take the chain
+// ID first. Like the functions moved by the "schema" migration, they look up their
+// tables in the schema of the migration whatever the search path of the caller is.
+const chainVersionFunctionsUp = `
+DROP FUNCTION nfts_at_height(bigint), nfts_at_time(timestamp with time zone),
+	offers_at_height(bigint), offers_at_time(timestamp with time zone), users_at_height(bigint);
+CREATE FUNCTION nfts_at_height(chain text, h bigint) RETURNS SETOF nft_versions AS $$
+	SELECT * FROM nft_versions
+	WHERE chain_id = chain AND valid_from_height <= h AND (valid_to_height IS NULL OR valid_to_height > h)
+$$ LANGUAGE sql STABLE SET search_path FROM CURRENT;
+CREATE FUNCTION nfts_at_time(chain text, t timestamp with time zone) RETURNS SETOF nft_versions AS $$
+	SELECT * FROM nft_versions
+	WHERE chain_id = chain AND valid_from_time <= t AND (valid_to_time IS NULL OR valid_to_time > t)
+$$ LANGUAGE sql STABLE SET search_path FROM CURRENT;
+CREATE FUNCTION offers_at_height(chain text, h bigint) RETURNS SETOF offer_versions AS $$
+	SELECT * FROM offer_versions
+	WHERE chain_id = chain AND valid_from_height <= h AND (valid_to_height IS NULL OR valid_to_height > h)
+$$ LANGUAGE sql STABLE SET search_path FROM CURRENT;
+CREATE FUNCTION offers_at_time(chain text, t timestamp with time zone) RETURNS SETOF offer_versions AS $$
+	SELECT * FROM offer_versions
+	WHERE chain_id = chain AND valid_from_time <= t AND (valid_to_time IS NULL OR valid_to_time > t)
+$$ LANGUAGE sql STABLE SET search_path FROM CURRENT;
+CREATE FUNCTION users_at_height(chain text, h bigint) RETURNS SETOF user_versions AS $$
+	SELECT * FROM user_versions
+	WHERE chain_id = chain AND valid_from_height <= h AND (valid_to_height IS NULL OR valid_to_height > h)
+$$ LANGUAGE sql STABLE SET search_path FROM CURRENT;
+`
+
+const chainVersionFunctionsDown = `
+DROP FUNCTION nfts_at_height(text, bigint), nfts_at_time(text, timestamp with time zone),
+	offers_at_height(text, bigint), offers_at_time(text, timestamp with time zone), users_at_height(text, bigint);
+CREATE FUNCTION nfts_at_height(h bigint) RETURNS SETOF nft_versions AS $$
+	SELECT * FROM nft_versions WHERE valid_from_height <= h AND (valid_to_height IS NULL OR valid_to_height > h)
+$$ LANGUAGE sql STABLE SET search_path FROM CURRENT;
+CREATE FUNCTION nfts_at_time(t timestamp with time zone) RETURNS SETOF nft_versions AS $$
+	SELECT * FROM nft_versions WHERE valid_from_time <= t AND (valid_to_time IS NULL OR valid_to_time > t)
+$$ LANGUAGE sql STABLE SET search_path FROM CURRENT;
+CREATE FUNCTION offers_at_height(h bigint) RETURNS SETOF offer_versions AS $$
+	SELECT * FROM offer_versions WHERE valid_from_height <= h AND (valid_to_height IS NULL OR valid_to_height > h)
+$$ LANGUAGE sql STABLE SET search_path FROM CURRENT;
+CREATE FUNCTION offers_at_time(t timestamp with time zone) RETURNS SETOF offer_versions AS $$
+	SELECT * FROM offer_versions WHERE valid_from_time <= t AND (valid_to_time IS NULL OR valid_to_time > t)
+$$ LANGUAGE sql STABLE SET search_path FROM CURRENT;
+CREATE FUNCTION users_at_height(h bigint) RETURNS SETOF user_versions AS $$
+	SELECT * FROM user_versions WHERE valid_from_height <= h AND (valid_to_height IS NULL OR valid_to_height > h)
+$$ LANGUAGE sql STABLE SET search_path FROM CURRENT;
+`
@@ -1,15 +1,11 @@
 package handlers
 
 import (
-	"os/user"
-	"path"
 	"testing"
 
 	sdk "github.com/cosmos/cosmos-sdk/types"
 	"github.com/cosmos/cosmos-sdk/x/nft"
-	cliContext "github.com/corestario/cosmos-utils/client/context"
 	common "github.com/corestario/dwh/x/common"
-	app "github.com/corestario/marketplace"
 	"github.com/stretchr/testify/require"
 )
 
@@ -38,12 +34,6 @@ func TestEnsureUserExists(t *testing.T) {
 }
 
 func TestMarketplaceHandlerResetAndSetup(t *testing.T) {
-	usr, err := user.Current()
-	if err != nil {
-		t.Errorf("failed to get current user, exiting: %v", err)
-		return
-	}
-
 	cfg := common.DefaultDwhCommonServiceConfig()
 	db, err := common.GetDB(cfg)
 	if err != nil {
@@ -55,21 +45,7 @@ func TestMarketplaceHandlerResetAndSetup(t *testing.T) {
 			t.Errorf("failed to close database connection: %v", err)
 		}
 	}()
-	cdc := app.MakeCodec()
-
-	cliCtx, err := cliContext.NewContext(
-		"mpchain",
-		"tcp://localhost:26657",
-		path.Join(usr.HomeDir, ".mpcli"))
-	if err != nil {
-		t.Errorf("failed to create cliCtx connection: %v", err)
-		return
-	}
-	cliCtx = cliCtx.WithCodec(cdc)
-
-	handler := NewMarketplaceHandler(cliCtx)
-	db, err = handler.Reset(db)
-	if err != nil {
+	if err := resetMarketplaceTables(db); err != nil {
 		t.Errorf("failed to Reset db: %v", err)
 	}
 	require.False(t, db.HasTable(&common.NFT{}))
@@ -77,8 +53,7 @@ func TestMarketplaceHandlerResetAndSetup(t *testing.T) {
 	require.False(t, db.HasTable(&common.FungibleTokenTransfer{}))
 	require.False(t, db.HasTable(&common.User{}))
 
-	db, err = handler.Setup(db)
-	if err != nil {
+	if err := setupMarketplaceTables(db); err != nil {
 		t.Errorf("failed to Setup db: %v", err)
 	}
 
@@ -87,8 +62,7 @@ func TestMarketplaceHandlerResetAndSetup(t *testing.T) {
 	require.True(t, db.HasTable(&common.FungibleTokenTransfer{}))
 	require.True(t, db.HasTable(&common.User{}))
 
-	db, err = handler.Reset(db)
-	if err != nil {
+	if err := resetMarketplaceTables(db); err != nil {
 		t.Errorf("failed to Reset db: %v", err)
 	}
 
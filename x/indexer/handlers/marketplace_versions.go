@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"fmt"
+
+	common "github.com/corestario/dwh/x/common"
+	"github.com/jinzhu/gorm"
+)
+
+// closeVersions ends the validity of the current versions that match the query at
+// info.Height. Versions that became valid at this very height are deleted instead.
+func closeVersions(db *gorm.DB, model interface{}, info MsgInfo, query string, args ...interface{}) error {
+	current := db.New().Model(model).Where("valid_to_height IS NULL").Where(query, args...)
+	if err := current.Where("valid_from_height = ?", info.Height).Delete(model).Error; err != nil {
+		return err
+	}
+
+	return current.UpdateColumns(map[string]interface{}{
+		"valid_to_height": info.Height,
+		"valid_to_time":   info.BlockTime,
+	}).Error
+}
+
+// recordNFTVersions records the state of the token and its offers after the message
+// as new versions, if it has changed.
+func recordNFTVersions(db *gorm.DB, info MsgInfo, denom, tokenID string) error {
+	var current, last common.NFTVersion
+	err := db.New().Where("denom = ? AND token_id = ? AND valid_to_height IS NULL", denom, tokenID).First(&last).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return fmt.Errorf("failed to get current version of nft %s/%s: %v", denom, tokenID, err)
+	}
+	hasLast := err == nil
+
+	var token common.NFT
+	err = db.New().Where("denom = ? AND token_id = ?", denom, tokenID).First(&token).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return fmt.Errorf("failed to find nft %s/%s: %v", denom, tokenID, err)
+	}
+	exists := err == nil
+	if exists {
+		current = *common.NewNFTVersion(&token, info.Height, info.BlockTime)
+	}
+
+	if !hasLast || !exists || !last.SameState(&current) {
+		if err := closeVersions(db, &common.NFTVersion{}, info, "denom = ? AND token_id = ?", denom, tokenID); err != nil {
+			return fmt.Errorf("failed to close versions of nft %s/%s: %v", denom, tokenID, err)
+		}
+		if exists {
+			if err := db.New().Create(&current).Error; err != nil {
+				return fmt.Errorf("failed to add version of nft %s/%s: %v", denom, tokenID, err)
+			}
+		}
+	}
+
+	return recordOfferVersions(db, info, denom, tokenID)
+}
+
+// recordOfferVersions adds versions for new offers of the token and closes the
+// versions of offers that were removed or accepted.
+func recordOfferVersions(db *gorm.DB, info MsgInfo, denom, tokenID string) error {
+	var offers []common.Offer
+	if err := db.New().Where("denom = ? AND token_id = ?", denom, tokenID).Find(&offers).Error; err != nil {
+		return fmt.Errorf("failed to find offers of nft %s/%s: %v", denom, tokenID, err)
+	}
+	var versioned []string
+	if err := db.New().Model(&common.OfferVersion{}).Where("denom = ? AND token_id = ? AND valid_to_height IS NULL", denom, tokenID).
+		Pluck("offer_id", &versioned).Error; err != nil {
+		return fmt.Errorf("failed to get current offer versions of nft %s/%s: %v", denom, tokenID, err)
+	}
+
+	removed := map[string]bool{}
+	for _, offerID := range versioned {
+		removed[offerID] = true
+	}
+	for i := range offers {
+		if removed[offers[i].OfferID] {
+			delete(removed, offers[i].OfferID)
+			continue
+		}
+		if err := db.New().Create(common.NewOfferVersion(&offers[i], info.Height, info.BlockTime)).Error; err != nil {
+			return fmt.Errorf("failed to add version of offer %s: %v", offers[i].OfferID, err)
+		}
+	}
+	for offerID := range removed {
+		if err := closeVersions(db, &common.OfferVersion{}, info, "denom = ? AND token_id = ? AND offer_id = ?",
+			denom, tokenID, offerID); err != nil {
+			return fmt.Errorf("failed to close versions of offer %s: %v", offerID, err)
+		}
+	}
+
+	return nil
+}
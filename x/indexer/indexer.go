@@ -4,14 +4,18 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	sdk "github.com/cosmos/cosmos-sdk/types"
 	cliCtx "github.com/corestario/cosmos-utils/client/context"
+	"github.com/corestario/dwh/x/changefeed"
 	common "github.com/corestario/dwh/x/common"
 	"github.com/corestario/dwh/x/indexer/handlers"
+	"github.com/corestario/dwh/x/migrations"
+	"github.com/corestario/dwh/x/partitions"
 	"github.com/jinzhu/gorm"
 	log "github.com/sirupsen/logrus"
 	"github.com/syndtr/goleveldb/leveldb"
@@ -29,20 +33,29 @@ var (
 )
 
 type Indexer struct {
-	mu        sync.Mutex
-	ctx       context.Context                // Global context for Indexer.
-	cfg       *common.DwhCommonServiceConfig // Config for all services
-	cancel    context.CancelFunc             // Used to stop main processing loop.
-	cliCtx    cliCtx.Context                 // Cosmos CLIContext, used to talk to node.
-	txDecoder sdk.TxDecoder
-	db        *gorm.DB                       // Database to store data to.
-	stateDB   *leveldb.DB                    // State database to keep indexer state.
-	handlers  map[string]handlers.MsgHandler // A map from module name to its handler (e.g., bank, ibc, marketplace, etc.)
-	cursor    *cursor                        // Indexer cursor (keeps track of the last processed message).
+	mu         sync.Mutex
+	ctx        context.Context                // Global context for Indexer.
+	cfg        *common.DwhCommonServiceConfig // Config for all services
+	cancel     context.CancelFunc             // Used to stop main processing loop.
+	cliCtx     *cliCtx.Context                // Cosmos CLIContext, used to talk to node.
+	txDecoder  sdk.TxDecoder
+	db         *gorm.DB                       // Database to store data to, scoped to the chain (see common.WithChainID).
+	stateDB    *leveldb.DB                    // State database to keep indexer state.
+	handlers   map[string]handlers.MsgHandler // A map from module name to its handler (e.g., bank, ibc, marketplace, etc.)
+	cursor     *cursor                        // Indexer cursor (keeps track of the last processed message).
+	partitions *partitions.Manager            // Creates partitions of txes and messages as the cursor advances.
 }
 
 type Option func(indexer *Indexer)
 
+// WithPartitions makes the indexer share the partitions manager with the indexers of
+// other chains.
+func WithPartitions(manager *partitions.Manager) Option {
+	return func(indexer *Indexer) {
+		indexer.partitions = manager
+	}
+}
+
 func WithHandler(handler handlers.MsgHandler) Option {
 	return func(indexer *Indexer) {
 		if indexer.handlers == nil {
@@ -57,7 +70,7 @@ func WithHandler(handler handlers.MsgHandler) Option {
 func NewIndexer(
 	ctx context.Context,
 	cfg *common.DwhCommonServiceConfig,
-	cliCtx cliCtx.Context,
+	cliCtx *cliCtx.Context,
 	txDecoder sdk.TxDecoder,
 	db *gorm.DB,
 	opts ...Option,
@@ -69,15 +82,16 @@ func NewIndexer(
 	}
 
 	idxr := &Indexer{
-		mu:        sync.Mutex{},
-		ctx:       ctx,
-		cfg:       cfg,
-		cancel:    cancel,
-		cliCtx:    cliCtx,
-		txDecoder: txDecoder,
-		db:        db,
-		stateDB:   stateDB,
-		cursor:    &cursor{},
+		mu:         sync.Mutex{},
+		ctx:        ctx,
+		cfg:        cfg,
+		cancel:     cancel,
+		cliCtx:     cliCtx,
+		txDecoder:  txDecoder,
+		db:         common.WithChainID(db, cfg.ChainID),
+		stateDB:    stateDB,
+		cursor:     &cursor{},
+		partitions: partitions.NewManager(db, cfg.PartitioningCfg, cfg.IndexedChains()),
 	}
 	for _, opt := range opts {
 		opt(idxr)
@@ -104,64 +118,63 @@ func NewIndexer(
 	return idxr, nil
 }
 
+// Setup migrates the database. If several chains are indexed, it must be run once, by
+// the indexer of the first chain (see common.IndexerCfg.Chains).
 func (m *Indexer) Setup(reset bool) error {
 	if m.db == nil {
 		return errors.New("can not set up indexer, db connection is not initialized")
 	}
 
-	if err := m.setupIndexerTables(reset); err != nil {
-		return fmt.Errorf("failed to setup Indexer tables: %v", err)
+	// Migrations deal with the rows of all chains.
+	migrator, err := migrations.NewMigrator(common.WithChainID(m.db, ""), m.Migrations()...)
+	if err != nil {
+		return fmt.Errorf("failed to create migrator: %v", err)
 	}
-
-	// Do handler-specific setup.
-	var err error
-	for routerKey, handler := range m.handlers {
-		log.Printf("setting up module %s", routerKey)
-		if reset {
-			if m.db, err = handler.Reset(m.db); err != nil {
-				log.Errorf("failed to reset module %s: %v", routerKey, err)
-				continue
-			}
+	if reset {
+		count, err := migrator.Reset()
+		if err != nil {
+			return fmt.Errorf("failed to reset database: %v", err)
 		}
-		if m.db, err = handler.Setup(m.db); err != nil {
-			log.Errorf("failed to set up module %s: %v", routerKey, err)
+		log.Infof("reverted %d migrations", count)
+	}
+	count, err := migrator.Up()
+	if err != nil {
+		return fmt.Errorf("failed to migrate database: %v", err)
+	}
+	log.Infof("applied %d migrations", count)
+
+	if m.cfg.PartitioningEnabled {
+		if err := m.partitions.Partition(); err != nil {
+			return fmt.Errorf("failed to partition tables: %v", err)
 		}
 	}
+	if err := changefeed.Setup(m.db, m.cfg.ChangeFeedCfg); err != nil {
+		return fmt.Errorf("failed to set up change feed: %v", err)
+	}
 
 	return nil
 }
 
-func (m *Indexer) setupIndexerTables(reset bool) error {
-	// Setup global Indexer tables.
-	if reset {
-		m.db = m.db.DropTableIfExists(&common.Message{})
-		if m.db.Error != nil {
-			return fmt.Errorf("failed to drop table messages: %v", m.db.Error)
-		}
-		m.db = m.db.DropTableIfExists(&common.Tx{})
-		if m.db.Error != nil {
-			return fmt.Errorf("failed to drop table txes: %v", m.db.Error)
-		}
-	}
-	if !m.db.HasTable(&common.Tx{}) {
-		m.db = m.db.CreateTable(&common.Tx{})
-		if m.db.Error != nil {
-			return fmt.Errorf("failed to create table txes: %v", m.db.Error)
-		}
-	}
-	if !m.db.HasTable(&common.Message{}) {
-		m.db = m.db.CreateTable(&common.Message{})
-		if m.db.Error != nil {
-			return fmt.Errorf("failed to create table messages: %v", m.db.Error)
+// Migrations returns the migrations of the indexer tables followed by the migrations
+// of the handlers (ordered by component name).
+func (m *Indexer) Migrations() []migrations.Source {
+	var (
+		sources []migrations.Source
+		seen    = map[string]bool{}
+	)
+	for _, handler := range m.handlers {
+		// A handler is registered for each of its router keys.
+		source := handler.Migrations()
+		if !seen[source.Component] {
+			seen[source.Component] = true
+			sources = append(sources, source)
 		}
 	}
-	m.db = m.db.Model(&common.Message{}).AddForeignKey(
-		"tx_id", "txes(id)", "CASCADE", "CASCADE")
-	if m.db.Error != nil {
-		return fmt.Errorf("failed to add foreign key (messages): %v", m.db.Error)
-	}
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i].Component < sources[j].Component
+	})
 
-	return nil
+	return append([]migrations.Source{Migrations(m.cfg.ChainID)}, sources...)
 }
 
 func (m *Indexer) Start() error {
@@ -190,18 +203,23 @@ func (m *Indexer) Start() error {
 			log.Infof("retrieved block #%d, block ID %s, transactions: %d",
 				m.cursor.Height, block.BlockMeta.BlockID, block.BlockMeta.Header.NumTxs)
 
-			if err := m.processTxs(rpcClient, block.Block.Data.Txs); err != nil {
+			if err := m.processTxs(rpcClient, block.Block); err != nil {
 				return fmt.Errorf("failed to processTxs: %v", err)
 			}
 		}
 	}
 }
 
-func (m *Indexer) processTxs(rpcClient client.Client, txs types.Txs) error {
+func (m *Indexer) processTxs(rpcClient client.Client, block *types.Block) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	for _, txBytes := range txs {
+	if err := m.partitions.Ensure(m.cfg.ChainID, block.Header.Height, block.Header.Time); err != nil {
+		// Transactions of the block can not be stored without partitions.
+		return fmt.Errorf("failed to create partitions: %v", err)
+	}
+
+	for _, txBytes := range block.Data.Txs {
 		txRes, err := rpcClient.Tx(txBytes.Hash(), true)
 		if err != nil {
 			log.Debugf("failed to get transaction %s: %v", txBytes.String(), err)
@@ -238,8 +256,15 @@ func (m *Indexer) processTxs(rpcClient client.Client, txs types.Txs) error {
 		}
 
 		for msgID, msg := range tx.GetMsgs() {
-			if err := m.processMsg(dbTx.ID, dbTx.Index, msgID, msg, txRes.TxResult.GetEvents()...); err != nil {
-				log.Errorf("failed to process message, msg: %v, error: %v", err)
+			info := handlers.MsgInfo{
+				Height:    txRes.Height,
+				BlockTime: block.Header.Time,
+				TxHash:    dbTx.Hash,
+				TxIndex:   txRes.Index,
+				MsgIndex:  msgID,
+			}
+			if err := m.processMsg(dbTx.ID, info, msg, txRes.TxResult.GetEvents()...); err != nil {
+				log.Errorf("failed to process message, msg: %v, error: %v", msg, err)
 				if err == errCursor {
 					// This is a fatal error, indexer should be stopped.
 					return err
@@ -251,13 +276,16 @@ func (m *Indexer) processTxs(rpcClient client.Client, txs types.Txs) error {
 		// This is a fatal error, indexer should be stopped.
 		return errCursor
 	}
+	if err := changefeed.NotifyBlock(m.db, m.cfg.ChangeFeedCfg, block.Header.Height, block.Header.Time, len(block.Data.Txs)); err != nil {
+		log.Errorf("failed to notify change feed: %v", err)
+	}
 
 	return nil
 }
 
-func (m *Indexer) processMsg(txID uint, txIndex uint32, msgID int, msg sdk.Msg, events ...abciTypes.Event) error {
-	if msgID < m.cursor.MsgID {
-		log.Debugf("old message (%d < %d), skipping", msgID, m.cursor.MsgID)
+func (m *Indexer) processMsg(txID uint, info handlers.MsgInfo, msg sdk.Msg, events ...abciTypes.Event) error {
+	if info.MsgIndex < m.cursor.MsgID {
+		log.Debugf("old message (%d < %d), skipping", info.MsgIndex, m.cursor.MsgID)
 		return nil
 	}
 
@@ -269,19 +297,26 @@ func (m *Indexer) processMsg(txID uint, txIndex uint32, msgID int, msg sdk.Msg,
 		errMsg string
 	)
 	defer func() {
-		m.db = m.db.Create(
-			common.NewMessage(
-				msg.Route(),
-				msg.Type(),
-				fmt.Sprintf("%s", msg.GetSignBytes()),
-				msg.GetSigners(),
-				failed,
-				errMsg,
-				txID,
-			),
+		dbMsg := common.NewMessage(
+			msg.Route(),
+			msg.Type(),
+			fmt.Sprintf("%s", msg.GetSignBytes()),
+			msg.GetSigners(),
+			failed,
+			errMsg,
+			txID,
+			info.Height,
 		)
+		m.db = m.db.Create(dbMsg)
 		if m.db.Error != nil {
 			log.Errorf("failed to add auto migrate: %v", m.db.Error)
+			return
+		}
+		for _, addr := range common.NewMessageAddresses(dbMsg.ID, msg) {
+			m.db = m.db.Create(addr)
+			if m.db.Error != nil {
+				log.Errorf("failed to add message address: %v", m.db.Error)
+			}
 		}
 	}()
 
@@ -292,12 +327,24 @@ func (m *Indexer) processMsg(txID uint, txIndex uint32, msgID int, msg sdk.Msg,
 		return errors.New(errMsg)
 	}
 
-	if err := handler.Handle(m.db, msg, events...); err != nil {
+	// The changes of a handler (including the messages it adds to the outbox) are
+	// committed together, or not at all if the message fails.
+	tx := m.db.Begin()
+	if tx.Error != nil {
+		failed, errMsg = true, fmt.Sprintf("failed to begin transaction for message %+v: %v", msg, tx.Error)
+		return errors.New(errMsg)
+	}
+	if err := handler.Handle(tx, info, msg, events...); err != nil {
+		tx.Rollback()
 		failed, errMsg = true, fmt.Sprintf("failed to process message %+v: %v", msg, err)
 		return errors.New(errMsg)
 	}
+	if err := tx.Commit().Error; err != nil {
+		failed, errMsg = true, fmt.Sprintf("failed to commit message %+v: %v", msg, err)
+		return errors.New(errMsg)
+	}
 
-	if err := m.updateCursor(m.cursor.Height, txIndex, msgID); err != nil {
+	if err := m.updateCursor(m.cursor.Height, info.TxIndex, info.MsgIndex); err != nil {
 		return errCursor
 	}
 
@@ -308,9 +355,8 @@ func (m *Indexer) Stop() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if err := m.db.Close(); err != nil {
-		log.Errorf("failed to close database connection: %v", err)
-	}
+	// The database connection is shared by the indexers of all chains, it is closed by
+	// the caller.
 	if err := m.stateDB.Close(); err != nil {
 		log.Errorf("failed to close state database connection: %v", err)
 	}
@@ -0,0 +1,402 @@
+package indexer
+
+import (
+	"fmt"
+
+	common "github.com/corestario/dwh/x/common"
+	"github.com/corestario/dwh/x/migrations"
+	"github.com/corestario/dwh/x/partitions"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// MigrationsComponent is the name of the indexer in the schema_migrations table.
+	MigrationsComponent = "indexer"
+	// CoreSchema is the Postgres schema of the tables shared by all handlers.
+	CoreSchema = "public"
+)
+
+// Migrations returns the migrations of the tables shared by all handlers (txes,
+// messages, message_addresses, users, domain_events and their relay cursors, outbox and
+// webhooks). They are applied before the migrations of the handlers. Rows indexed
+// before chain IDs were introduced are assigned to chainID.
+func Migrations(chainID string) migrations.Source {
+	return migrations.Source{
+		Component: MigrationsComponent,
+		Schema:    CoreSchema,
+		Migrations: []migrations.Migration{
+			// The schema as it was before versioned migrations were introduced. It can
+			// be applied to databases that were set up by older versions.
+			migrations.SQL(1, "baseline", baselineUp, baselineDown),
+			migrations.SQL(2, "message_addresses", messageAddressesUp, messageAddressesDown),
+			// Users used to be created by the marketplace handler.
+			migrations.SQL(3, "core_users", usersUp, usersDown),
+			migrations.CreateIndexes(4, "indexes", indexes...),
+			// Messages are partitioned by height (see package partitions).
+			{Version: 5, Name: "message_heights", Up: addMessageHeights, Down: dropMessageHeights},
+			migrations.SQL(6, "partitions", partitionsUp, partitionsDown),
+			{
+				Version: 7,
+				Name:    "chain_ids",
+				Up:      func(db *gorm.DB) error { return addChainIDs(db, chainID) },
+				Down:    dropChainIDs,
+			},
+			// Domain events of all handlers (see package sinks).
+			migrations.SQL(8, "domain_events", domainEventsUp, domainEventsDown),
+			// RabbitMQ messages of all handlers (see package outbox).
+			migrations.SQL(9, "outbox", outboxUp, outboxDown),
+			// Webhook subscriptions and deliveries (see package webhooks).
+			migrations.SQL(10, "webhooks", webhooksUp, webhooksDown),
+			// Positions of the relays of domain events (see package sinks).
+			migrations.SQL(11, "domain_event_cursors", domainEventCursorsUp, domainEventCursorsDown),
+			// Height ranges removed by retention policies (see package partitions).
+			migrations.SQL(12, "removed_ranges", removedRangesUp, removedRangesDown),
+			migrations.SQL(13, "partition_ends", partitionEndsUp, partitionEndsDown),
+			// Subscriptions that only match the events of a chain.
+			migrations.SQL(14, "webhook_subscription_chains", webhookSubscriptionChainsUp, webhookSubscriptionChainsDown),
+		},
+		Indexes: append(append(append(append([]migrations.Index{}, baselineIndexes...), indexes...), messageHeightIndex),
+			append(append(chainIndexes, domainEventsIndex, outboxIndex), append(webhookIndexes, domainEventCursorsIndex)...)...),
+	}
+}
+
+// indexes are the indexes that queries to the indexer tables rely on, created by the
+// "indexes" migration. New indexes must be created by a new migration.
+var indexes = []migrations.Index{
+	{Table: "txes", Name: "idx_txes_hash", Columns: []string{"hash"}},
+	{Table: "txes", Name: "idx_txes_height", Columns: []string{"height"}},
+	{Table: "messages", Name: "idx_messages_tx_id", Columns: []string{"tx_id"}},
+}
+
+var messageHeightIndex = migrations.Index{Table: "messages", Name: "idx_messages_height", Columns: []string{"height"}}
+
+// baselineIndexes are the indexes created along with the tables by the
+// "message_addresses" migration.
+var baselineIndexes = []migrations.Index{
+	{Table: "message_addresses", Name: "idx_message_addresses_address", Columns: []string{"address", "message_id"}},
+	{Table: "message_addresses", Name: "idx_message_addresses_message_id", Columns: []string{"message_id"}},
+}
+
+// chainIndexes are the indexes created by the "chain_ids" migration.
+var chainIndexes = []migrations.Index{
+	{Table: "txes", Name: "idx_txes_chain_id_height", Columns: []string{"chain_id", "height"}},
+	{Table: "users", Name: "users_chain_id_address_key", Columns: []string{"chain_id", "address"}},
+}
+
+var domainEventsIndex = migrations.Index{
+	Table: "domain_events", Name: "idx_domain_events_chain_id_height", Columns: []string{"chain_id", "height"},
+}
+
+// outboxIndex serves the relay, which looks for the pending messages of a chain.
+var outboxIndex = migrations.Index{
+	Table: "outbox", Name: "idx_outbox_chain_id_sent_at", Columns: []string{"chain_id", "sent_at"},
+}
+
+// webhookIndexes serve the dispatcher, which looks for pending deliveries, and the
+// delivery log of subscriptions. Events are delivered once per subscription.
+var webhookIndexes = []migrations.Index{
+	{Table: "webhook_deliveries", Name: "idx_webhook_deliveries_status_next_attempt_at", Columns: []string{"status", "next_attempt_at"}},
+	{Table: "webhook_deliveries", Name: "webhook_deliveries_subscription_id_event_id_key", Columns: []string{"subscription_id", "event_id"}},
+}
+
+var domainEventCursorsIndex = migrations.Index{
+	Table: "domain_event_cursors", Name: "domain_event_cursors_chain_id_sink_key", Columns: []string{"chain_id", "sink"},
+}
+
+// chainTables are the tables whose rows are tagged with chain IDs.
+var chainTables = []string{"txes", "messages", "message_addresses", "users"}
+
+// The migrations spell their tables out rather than derive them from the models, so that
+// they keep creating the schema of their version when the models change. Tables that
+// have a gorm.Model start with its columns, and have the index on deleted_at that gorm
+// creates.
+const modelColumns = `id serial PRIMARY KEY,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	deleted_at timestamp with time zone`
+
+// baselineUp creates txes and messages as older versions did. The foreign key is
+// created again, since older versions (re)created it on every start.
+const baselineUp = `
+CREATE TABLE IF NOT EXISTS txes (
+	` + modelColumns + `,
+	hash text NOT NULL,
+	height bigint NOT NULL,
+	"index" bigint NOT NULL,
+	code bigint NOT NULL,
+	data bytea,
+	log jsonb,
+	info text,
+	gas_wanted bigint,
+	gas_used bigint
+);
+CREATE INDEX IF NOT EXISTS idx_txes_deleted_at ON txes (deleted_at);
+CREATE TABLE IF NOT EXISTS messages (
+	` + modelColumns + `,
+	route text,
+	msg_type text,
+	signature jsonb,
+	signers text,
+	failed boolean,
+	error text,
+	tx_id integer
+);
+CREATE INDEX IF NOT EXISTS idx_messages_deleted_at ON messages (deleted_at);
+ALTER TABLE messages DROP CONSTRAINT IF EXISTS messages_tx_id_txes_id_foreign;
+ALTER TABLE messages ADD CONSTRAINT messages_tx_id_txes_id_foreign
+	FOREIGN KEY (tx_id) REFERENCES txes (id) ON DELETE CASCADE ON UPDATE CASCADE;
+`
+
+const baselineDown = `DROP TABLE IF EXISTS messages, txes`
+
+const messageAddressesUp = `
+CREATE TABLE message_addresses (
+	` + modelColumns + `,
+	message_id integer NOT NULL,
+	address text NOT NULL,
+	kind text NOT NULL,
+	path text
+);
+CREATE INDEX idx_message_addresses_deleted_at ON message_addresses (deleted_at);
+CREATE INDEX idx_message_addresses_address ON message_addresses (address, message_id);
+CREATE INDEX idx_message_addresses_message_id ON message_addresses (message_id);
+ALTER TABLE message_addresses ADD CONSTRAINT message_addresses_message_id_messages_id_foreign
+	FOREIGN KEY (message_id) REFERENCES messages (id) ON DELETE CASCADE ON UPDATE CASCADE;
+`
+
+const messageAddressesDown = `DROP TABLE message_addresses`
+
+// usersUp creates users as the marketplace baseline does, unless it already did. The
+// account heights of users are added by the marketplace handler, which maintained the
+// table when they were introduced.
+const usersUp = `
+CREATE TABLE IF NOT EXISTS users (
+	` + modelColumns + `,
+	name text,
+	address varchar(45) NOT NULL UNIQUE,
+	balance text,
+	account_number bigint,
+	sequence_number bigint
+);
+CREATE INDEX IF NOT EXISTS idx_users_deleted_at ON users (deleted_at);
+`
+
+// usersDown drops the foreign keys of handlers to users as well.
+const usersDown = `DROP TABLE IF EXISTS users CASCADE`
+
+func addMessageHeights(db *gorm.DB) error {
+	if err := db.Exec("ALTER TABLE messages ADD COLUMN IF NOT EXISTS height bigint").Error; err != nil {
+		return fmt.Errorf("failed to add column messages.height: %v", err)
+	}
+	// Messages of unknown transactions get height 0, since partitions have no room for
+	// NULL heights.
+	if err := db.Exec(`
+		UPDATE messages SET height = COALESCE((SELECT height FROM txes WHERE txes.id = messages.tx_id), 0)
+		WHERE height IS NULL`).Error; err != nil {
+		return fmt.Errorf("failed to fill message heights: %v", err)
+	}
+	if err := db.Exec(messageHeightIndex.Statement("")).Error; err != nil {
+		return fmt.Errorf("failed to create index %s: %v", messageHeightIndex.Name, err)
+	}
+
+	return nil
+}
+
+func dropMessageHeights(db *gorm.DB) error {
+	if err := db.Exec("DROP INDEX IF EXISTS " + messageHeightIndex.Name).Error; err != nil {
+		return fmt.Errorf("failed to drop index %s: %v", messageHeightIndex.Name, err)
+	}
+	// The partition key of a partitioned table can not be dropped; the table is
+	// dropped by the baseline migration anyway.
+	partitioned, err := partitions.IsPartitioned(db, "messages")
+	if err != nil || partitioned {
+		return err
+	}
+	if err := db.Exec("ALTER TABLE messages DROP COLUMN IF EXISTS height").Error; err != nil {
+		return fmt.Errorf("failed to drop column messages.height: %v", err)
+	}
+
+	return nil
+}
+
+const partitionsUp = `
+CREATE TABLE partitions (
+	id serial PRIMARY KEY,
+	parent text NOT NULL,
+	name text NOT NULL,
+	from_height bigint NOT NULL,
+	to_height bigint NOT NULL,
+	end_time timestamp with time zone
+);
+CREATE UNIQUE INDEX uix_partitions_name ON partitions (name);
+`
+
+const partitionsDown = `DROP TABLE partitions`
+
+// addChainIDs tags the rows of the indexer tables with chain IDs. Addresses are only
+// unique within a chain, so users get a unique key that includes the chain ID. The old
+// unique key on address is still referenced by the foreign keys of handler baselines;
+// the marketplace handler drops it once it has replaced them.
+func addChainIDs(db *gorm.DB, chainID string) error {
+	for _, table := range chainTables {
+		if err := common.AddChainIDColumn(db, table, chainID); err != nil {
+			return err
+		}
+	}
+	if err := db.Exec("ALTER TABLE users ADD CONSTRAINT users_chain_id_address_key UNIQUE (chain_id, address)").Error; err != nil {
+		return fmt.Errorf("failed to add unique key of users: %v", err)
+	}
+	if err := db.Exec(chainIndexes[0].Statement("")).Error; err != nil {
+		return fmt.Errorf("failed to create index %s: %v", chainIndexes[0].Name, err)
+	}
+
+	return nil
+}
+
+// dropChainIDs reverts addChainIDs.
+func dropChainIDs(db *gorm.DB) error {
+	if err := db.Exec("DROP INDEX IF EXISTS " + chainIndexes[0].Name).Error; err != nil {
+		return fmt.Errorf("failed to drop index %s: %v", chainIndexes[0].Name, err)
+	}
+	// The marketplace baseline drops users when it is reverted.
+	if err := db.Exec("ALTER TABLE IF EXISTS users DROP CONSTRAINT IF EXISTS users_chain_id_address_key").Error; err != nil {
+		return fmt.Errorf("failed to drop unique key of users: %v", err)
+	}
+	for _, table := range chainTables {
+		if err := common.DropChainIDColumn(db, table); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+const domainEventsUp = `
+CREATE TABLE domain_events (
+	` + modelColumns + `,
+	chain_id varchar(64) NOT NULL DEFAULT '',
+	type text NOT NULL,
+	msg_type text NOT NULL,
+	height bigint NOT NULL,
+	time timestamp with time zone,
+	tx_hash text,
+	msg_index integer,
+	event_index integer,
+	denom text,
+	token_id text,
+	sender varchar(45),
+	recipient varchar(45),
+	amount text
+);
+CREATE INDEX idx_domain_events_deleted_at ON domain_events (deleted_at);
+CREATE INDEX idx_domain_events_chain_id_height ON domain_events (chain_id, height);
+`
+
+const domainEventsDown = `DROP TABLE domain_events`
+
+const outboxUp = `
+CREATE TABLE outbox (
+	id serial PRIMARY KEY,
+	created_at timestamp with time zone,
+	chain_id varchar(64) NOT NULL DEFAULT '',
+	queue text NOT NULL,
+	priority integer NOT NULL,
+	body text NOT NULL,
+	attempts integer NOT NULL,
+	last_error text,
+	next_attempt_at timestamp with time zone NOT NULL,
+	sent_at timestamp with time zone
+);
+CREATE INDEX idx_outbox_chain_id_sent_at ON outbox (chain_id, sent_at);
+`
+
+const outboxDown = `DROP TABLE outbox`
+
+// webhooksUp creates the subscriptions and their deliveries. The deliveries of a
+// subscription are its log, they are deleted along with it; events are delivered once
+// per subscription.
+const webhooksUp = `
+CREATE TABLE webhook_subscriptions (
+	id serial PRIMARY KEY,
+	created_at timestamp with time zone,
+	updated_at timestamp with time zone,
+	url text NOT NULL,
+	secret text NOT NULL,
+	address varchar(45) NOT NULL,
+	denom text NOT NULL,
+	token_id text NOT NULL,
+	event_types text[],
+	active boolean NOT NULL
+);
+CREATE TABLE webhook_deliveries (
+	id serial PRIMARY KEY,
+	created_at timestamp with time zone,
+	chain_id varchar(64) NOT NULL DEFAULT '',
+	subscription_id integer NOT NULL,
+	event_id text NOT NULL,
+	event_type text NOT NULL,
+	payload text NOT NULL,
+	status text NOT NULL,
+	attempts integer NOT NULL,
+	next_attempt_at timestamp with time zone NOT NULL,
+	last_status_code integer,
+	last_error text,
+	delivered_at timestamp with time zone,
+	CONSTRAINT webhook_deliveries_subscription_id_event_id_key UNIQUE (subscription_id, event_id),
+	CONSTRAINT webhook_deliveries_subscription_id_foreign
+		FOREIGN KEY (subscription_id) REFERENCES webhook_subscriptions (id) ON DELETE CASCADE
+);
+CREATE INDEX idx_webhook_deliveries_status_next_attempt_at ON webhook_deliveries (status, next_attempt_at);
+`
+
+const webhooksDown = `DROP TABLE webhook_deliveries, webhook_subscriptions`
+
+// domainEventCursorsUp creates the cursors of the relays, which upsert them by chain
+// and sink.
+const domainEventCursorsUp = `
+CREATE TABLE domain_event_cursors (
+	id serial PRIMARY KEY,
+	chain_id varchar(64) NOT NULL DEFAULT '',
+	sink text NOT NULL,
+	event_id integer NOT NULL,
+	updated_at timestamp with time zone NOT NULL,
+	CONSTRAINT domain_event_cursors_chain_id_sink_key UNIQUE (chain_id, sink)
+);
+`
+
+const domainEventCursorsDown = `DROP TABLE domain_event_cursors`
+
+const removedRangesUp = `
+CREATE TABLE removed_ranges (
+	id serial PRIMARY KEY,
+	parent text NOT NULL,
+	from_height bigint NOT NULL,
+	to_height bigint NOT NULL,
+	route text NOT NULL,
+	status text NOT NULL,
+	removed_at timestamp with time zone NOT NULL
+);
+`
+
+const removedRangesDown = `DROP TABLE removed_ranges`
+
+// partitionEndsUp creates the times at which every chain got past the partitions,
+// which are deleted along with them.
+const partitionEndsUp = `
+CREATE TABLE partition_ends (
+	partition_id integer NOT NULL REFERENCES partitions (id) ON DELETE CASCADE,
+	chain_id varchar(64) NOT NULL,
+	end_time timestamp with time zone NOT NULL,
+	PRIMARY KEY (partition_id, chain_id)
+);
+`
+
+const partitionEndsDown = `DROP TABLE partition_ends`
+
+// webhookSubscriptionChainsUp adds the chain filter of subscriptions; existing ones
+// keep matching the events of all chains.
+const webhookSubscriptionChainsUp = `
+ALTER TABLE webhook_subscriptions ADD COLUMN chain_id varchar(64) NOT NULL DEFAULT '';
+`
+
+const webhookSubscriptionChainsDown = `ALTER TABLE webhook_subscriptions DROP COLUMN chain_id`
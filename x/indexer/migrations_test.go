@@ -0,0 +1,56 @@
+package indexer
+
+import (
+	"testing"
+
+	common "github.com/corestario/dwh/x/common"
+	"github.com/corestario/dwh/x/indexer/handlers"
+	"github.com/corestario/dwh/x/migrations"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	cfg := common.DefaultDwhCommonServiceConfig()
+	db, err := common.GetDB(cfg)
+	if err != nil {
+		t.Errorf("failed to establish database connection: %v", err)
+		return
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("failed to close database connection: %v", err)
+		}
+	}()
+	// Migrations deal with the rows of all chains.
+	db = common.WithChainID(db, "")
+	schema := cfg.PostgresSchema(handlers.MarketplaceMigrationsComponent)
+	indexer := Migrations("legacy")
+	marketplace := handlers.MarketplaceMigrations(schema, "legacy")
+	migrator, err := migrations.NewMigrator(db, indexer, marketplace)
+	require.NoError(t, err)
+	_, err = migrator.Reset()
+	require.NoError(t, err)
+	defer func() {
+		_, err := migrator.Reset()
+		require.NoError(t, err)
+	}()
+
+	// Older versions created all tables in public and did not record migrations.
+	require.NoError(t, indexer.Migrations[0].Up(db))
+	require.NoError(t, marketplace.Migrations[0].Up(db))
+	require.NoError(t, db.Exec("INSERT INTO public.nfts (created_at, updated_at, denom, token_id) VALUES (now(), now(), 'cards', '1')").Error)
+
+	_, err = migrator.Up()
+	require.NoError(t, err)
+
+	var count int
+	require.NoError(t, db.Raw("SELECT COUNT(*) FROM "+pq.QuoteIdentifier(schema)+".nfts WHERE denom = 'cards' AND chain_id = 'legacy'").
+		Row().Scan(&count))
+	require.Equal(t, 1, count)
+	var exists bool
+	require.NoError(t, db.Raw("SELECT to_regclass('public.nfts') IS NOT NULL").Row().Scan(&exists))
+	require.False(t, exists)
+	require.NoError(t, db.Raw("SELECT to_regclass('public.users') IS NOT NULL").Row().Scan(&exists))
+	require.True(t, exists)
+}
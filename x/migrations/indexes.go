@@ -0,0 +1,150 @@
+package migrations
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+// Index is an index that known queries rely on (e.g., storefront queries that filter
+// tokens by owner).
+type Index struct {
+	Table   string
+	Name    string
+	Columns []string
+}
+
+// Statement returns the statement that creates the index. If schema is empty, the
+// table is looked up in the search path. It locks writes to the table while the index
+// is built, which migrations do in their transaction anyway.
+func (i Index) Statement(schema string) string {
+	return i.statement("CREATE INDEX IF NOT EXISTS", schema)
+}
+
+// ConcurrentStatement returns the statement that creates the index without locking
+// writes to the table, e.g. to create a missing index on a live database. It must run
+// outside of a transaction, and is not supported on partitioned tables.
+func (i Index) ConcurrentStatement(schema string) string {
+	return i.statement("CREATE INDEX CONCURRENTLY IF NOT EXISTS", schema)
+}
+
+func (i Index) statement(create, schema string) string {
+	table := pq.QuoteIdentifier(i.Table)
+	if schema != "" {
+		table = pq.QuoteIdentifier(schema) + "." + table
+	}
+	columns := make([]string, len(i.Columns))
+	for k, column := range i.Columns {
+		columns[k] = pq.QuoteIdentifier(column)
+	}
+
+	return fmt.Sprintf("%s %s ON %s (%s)", create, pq.QuoteIdentifier(i.Name), table, strings.Join(columns, ", "))
+}
+
+// CreateIndexes returns a migration that creates the given indexes.
+func CreateIndexes(version int64, name string, indexes ...Index) Migration {
+	return Migration{
+		Version: version,
+		Name:    name,
+		Up: func(db *gorm.DB) error {
+			for _, index := range indexes {
+				if err := db.Exec(index.Statement("")).Error; err != nil {
+					return fmt.Errorf("failed to create index %s: %v", index.Name, err)
+				}
+			}
+			return nil
+		},
+		Down: func(db *gorm.DB) error {
+			for _, index := range indexes {
+				if err := db.Exec("DROP INDEX IF EXISTS " + pq.QuoteIdentifier(index.Name)).Error; err != nil {
+					return fmt.Errorf("failed to drop index %s: %v", index.Name, err)
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// MissingIndex is a declared index whose columns are not covered by any index of its
+// table, i.e., there is no index that starts with these columns.
+type MissingIndex struct {
+	Component string
+	Schema    string
+	Index
+}
+
+// MissingIndexes reports the declared indexes (see Source.Indexes) that are missing.
+func (m *Migrator) MissingIndexes() ([]MissingIndex, error) {
+	var out []MissingIndex
+	for _, source := range m.sources {
+		existing := map[string][][]string{}
+		for _, index := range source.Indexes {
+			if _, ok := existing[index.Table]; ok {
+				continue
+			}
+			columns, err := m.indexColumns(source.Schema, index.Table)
+			if err != nil {
+				return nil, err
+			}
+			existing[index.Table] = columns
+		}
+		for _, index := range source.Indexes {
+			if !covered(index.Columns, existing[index.Table]) {
+				out = append(out, MissingIndex{Component: source.Component, Schema: source.Schema, Index: index})
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// indexColumns returns the columns of every index of the table.
+func (m *Migrator) indexColumns(schema, table string) ([][]string, error) {
+	rows, err := m.db.New().Raw(`
+		SELECT array_to_string(ARRAY(
+			SELECT pg_get_indexdef(ix.indexrelid, k + 1, true)
+			FROM generate_subscripts(ix.indkey, 1) AS k ORDER BY k
+		), ',')
+		FROM pg_index ix
+		JOIN pg_class t ON t.oid = ix.indrelid
+		JOIN pg_namespace n ON n.oid = t.relnamespace
+		WHERE n.nspname = ? AND t.relname = ?`, schema, table).Rows()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get indexes of %s.%s: %v", schema, table, err)
+	}
+	defer rows.Close()
+
+	var out [][]string
+	for rows.Next() {
+		var columns string
+		if err := rows.Scan(&columns); err != nil {
+			return nil, fmt.Errorf("failed to get indexes of %s.%s: %v", schema, table, err)
+		}
+		out = append(out, strings.Split(columns, ","))
+	}
+
+	return out, rows.Err()
+}
+
+// covered reports whether one of the indexes starts with the given columns.
+func covered(columns []string, indexes [][]string) bool {
+	for _, index := range indexes {
+		if len(index) < len(columns) {
+			continue
+		}
+		prefix := true
+		for k, column := range columns {
+			if strings.Trim(index[k], `"`) != column {
+				prefix = false
+				break
+			}
+		}
+		if prefix {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,300 @@
+// Package migrations applies versioned schema migrations. Each component (the indexer
+// and every handler) has its own list of migrations; applied migrations are recorded in
+// the schema_migrations table.
+package migrations
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+// Migration is a versioned change of the database schema. Up applies the change and
+// Down reverts it; both are run in a transaction. Schema overrides the schema of the
+// source (e.g., for a baseline that must find the tables where older versions put
+// them).
+type Migration struct {
+	Version int64
+	Name    string
+	Schema  string
+	Up      func(db *gorm.DB) error
+	Down    func(db *gorm.DB) error
+}
+
+// SQL returns a migration that executes the given SQL statements.
+func SQL(version int64, name, up, down string) Migration {
+	return Migration{
+		Version: version,
+		Name:    name,
+		Up:      func(db *gorm.DB) error { return db.Exec(up).Error },
+		Down:    func(db *gorm.DB) error { return db.Exec(down).Error },
+	}
+}
+
+// Source is the list of migrations of a component, ordered by version. The
+// migrations are run with the search path set to Schema (and public), so tables they
+// create are put in Schema; the schema is created if needed. Indexes are the indexes
+// that the known queries of the component rely on (see MissingIndexes).
+type Source struct {
+	Component  string
+	Schema     string
+	Migrations []Migration
+	Indexes    []Index
+}
+
+// schema returns the schema that migration is run in.
+func (s Source) schema(migration Migration) string {
+	if migration.Schema != "" {
+		return migration.Schema
+	}
+
+	return s.Schema
+}
+
+func (s Source) validate() error {
+	if s.Component == "" {
+		return fmt.Errorf("component name is empty")
+	}
+	if s.Schema == "" {
+		return fmt.Errorf("schema of %s is empty", s.Component)
+	}
+	for i, migration := range s.Migrations {
+		if migration.Up == nil || migration.Down == nil {
+			return fmt.Errorf("migration %s/%d has no up or down step", s.Component, migration.Version)
+		}
+		if i > 0 && migration.Version <= s.Migrations[i-1].Version {
+			return fmt.Errorf("migrations of %s are not ordered by version: %d after %d",
+				s.Component, migration.Version, s.Migrations[i-1].Version)
+		}
+	}
+
+	return nil
+}
+
+// SchemaMigration is a migration that was applied.
+type SchemaMigration struct {
+	ID        uint   `gorm:"primary_key"`
+	Component string `gorm:"unique_index:idx_schema_migrations_key;not null"`
+	Version   int64  `gorm:"unique_index:idx_schema_migrations_key;not null"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// Status is the state of a migration.
+type Status struct {
+	Component string
+	Version   int64
+	Name      string
+	AppliedAt *time.Time // Nil if the migration is pending.
+}
+
+// Migrator applies and reverts the migrations of the given sources. Sources are
+// migrated up in the given order and down in the reverse order of application.
+type Migrator struct {
+	db      *gorm.DB
+	sources []Source
+}
+
+func NewMigrator(db *gorm.DB, sources ...Source) (*Migrator, error) {
+	components := map[string]bool{}
+	for _, source := range sources {
+		if err := source.validate(); err != nil {
+			return nil, err
+		}
+		if components[source.Component] {
+			return nil, fmt.Errorf("duplicate component %s", source.Component)
+		}
+		components[source.Component] = true
+	}
+	if !db.HasTable(&SchemaMigration{}) {
+		if err := db.CreateTable(&SchemaMigration{}).Error; err != nil {
+			return nil, fmt.Errorf("failed to create table schema_migrations: %v", err)
+		}
+	}
+
+	return &Migrator{db: db, sources: sources}, nil
+}
+
+func (m *Migrator) applied() (map[string]map[int64]SchemaMigration, error) {
+	var rows []SchemaMigration
+	if err := m.db.New().Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to get applied migrations: %v", err)
+	}
+	out := map[string]map[int64]SchemaMigration{}
+	for _, row := range rows {
+		if out[row.Component] == nil {
+			out[row.Component] = map[int64]SchemaMigration{}
+		}
+		out[row.Component][row.Version] = row
+	}
+
+	return out, nil
+}
+
+// Up applies all pending migrations and returns the number of applied ones.
+func (m *Migrator) Up() (int, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return 0, err
+	}
+	var count int
+	for _, source := range m.sources {
+		for _, migration := range source.Migrations {
+			if _, ok := applied[source.Component][migration.Version]; ok {
+				continue
+			}
+			if err := m.run(source.schema(migration), migration.Up, func(tx *gorm.DB) error {
+				return tx.Create(&SchemaMigration{
+					Component: source.Component,
+					Version:   migration.Version,
+					Name:      migration.Name,
+					AppliedAt: time.Now().UTC(),
+				}).Error
+			}); err != nil {
+				return count, fmt.Errorf("failed to apply migration %s/%d (%s): %v",
+					source.Component, migration.Version, migration.Name, err)
+			}
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// Down reverts the last steps applied migrations (all of them if steps is negative),
+// newest first, and returns the number of reverted ones. If component is not empty,
+// only the migrations of that component are reverted.
+func (m *Migrator) Down(component string, steps int) (int, error) {
+	var rows []SchemaMigration
+	query := m.db.New().Order("id DESC")
+	if component != "" {
+		query = query.Where("component = ?", component)
+	}
+	if steps >= 0 {
+		query = query.Limit(steps)
+	}
+	if err := query.Find(&rows).Error; err != nil {
+		return 0, fmt.Errorf("failed to get applied migrations: %v", err)
+	}
+	var count int
+	for _, row := range rows {
+		source, migration, ok := m.find(row.Component, row.Version)
+		if !ok {
+			return count, fmt.Errorf("unknown migration %s/%d (%s)", row.Component, row.Version, row.Name)
+		}
+		if err := m.run(source.schema(migration), migration.Down, func(tx *gorm.DB) error {
+			return tx.Delete(&SchemaMigration{ID: row.ID}).Error
+		}); err != nil {
+			return count, fmt.Errorf("failed to revert migration %s/%d (%s): %v",
+				row.Component, row.Version, row.Name, err)
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// Reset reverts all applied migrations and returns the number of reverted ones. If no
+// migration is recorded, the database may have been created before migrations were
+// introduced: the down steps of the baselines (the first migration of every source)
+// are run instead, in the reverse order of the sources, so that the existing tables
+// are dropped anyway. Baseline down steps must tolerate missing tables.
+func (m *Migrator) Reset() (int, error) {
+	count, err := m.Down("", -1)
+	if err != nil || count > 0 {
+		return count, err
+	}
+	for i := len(m.sources) - 1; i >= 0; i-- {
+		source := m.sources[i]
+		if len(source.Migrations) == 0 {
+			continue
+		}
+		baseline := source.Migrations[0]
+		if err := m.run(source.schema(baseline), baseline.Down, func(tx *gorm.DB) error { return nil }); err != nil {
+			return count, fmt.Errorf("failed to revert baseline %s/%d (%s): %v",
+				source.Component, baseline.Version, baseline.Name, err)
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// Status returns the state of all known migrations, as well as of applied migrations
+// that are not known (e.g., ones added by a newer version of DWH).
+func (m *Migrator) Status() ([]Status, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	var out []Status
+	for _, source := range m.sources {
+		for _, migration := range source.Migrations {
+			status := Status{Component: source.Component, Version: migration.Version, Name: migration.Name}
+			if row, ok := applied[source.Component][migration.Version]; ok {
+				status.AppliedAt = &row.AppliedAt
+				delete(applied[source.Component], migration.Version)
+			}
+			out = append(out, status)
+		}
+	}
+	var unknown []Status
+	for _, rows := range applied {
+		for _, row := range rows {
+			appliedAt := row.AppliedAt
+			unknown = append(unknown, Status{Component: row.Component, Version: row.Version, Name: row.Name, AppliedAt: &appliedAt})
+		}
+	}
+	sort.Slice(unknown, func(i, j int) bool {
+		if unknown[i].Component != unknown[j].Component {
+			return unknown[i].Component < unknown[j].Component
+		}
+		return unknown[i].Version < unknown[j].Version
+	})
+
+	return append(out, unknown...), nil
+}
+
+func (m *Migrator) find(component string, version int64) (Source, Migration, bool) {
+	for _, source := range m.sources {
+		if source.Component != component {
+			continue
+		}
+		for _, migration := range source.Migrations {
+			if migration.Version == version {
+				return source, migration, true
+			}
+		}
+	}
+
+	return Source{}, Migration{}, false
+}
+
+// run runs step and record in a transaction, in the given schema.
+func (m *Migrator) run(schema string, step, record func(tx *gorm.DB) error) error {
+	tx := m.db.New().Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if err := tx.Exec("CREATE SCHEMA IF NOT EXISTS " + pq.QuoteIdentifier(schema)).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to create schema %s: %v", schema, err)
+	}
+	if err := tx.Exec(fmt.Sprintf("SET LOCAL search_path TO %s, public", pq.QuoteIdentifier(schema))).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to set search path: %v", err)
+	}
+	if err := step(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := record(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
@@ -0,0 +1,51 @@
+package migrations
+
+import (
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSourceValidate(t *testing.T) {
+	noop := func(db *gorm.DB) error { return nil }
+
+	require.NoError(t, Source{Component: "test", Schema: "test", Migrations: []Migration{
+		{Version: 1, Name: "first", Up: noop, Down: noop},
+		{Version: 3, Name: "second", Up: noop, Down: noop},
+	}}.validate())
+	require.NoError(t, Source{Component: "empty", Schema: "empty"}.validate())
+
+	require.Error(t, Source{Schema: "test", Migrations: []Migration{{Version: 1, Up: noop, Down: noop}}}.validate())
+	require.Error(t, Source{Component: "test", Migrations: []Migration{{Version: 1, Up: noop, Down: noop}}}.validate())
+	require.Error(t, Source{Component: "test", Schema: "test", Migrations: []Migration{{Version: 1, Up: noop}}}.validate())
+	require.Error(t, Source{Component: "test", Schema: "test", Migrations: []Migration{
+		{Version: 2, Up: noop, Down: noop},
+		{Version: 1, Up: noop, Down: noop},
+	}}.validate())
+	require.Error(t, Source{Component: "test", Schema: "test", Migrations: []Migration{
+		{Version: 1, Up: noop, Down: noop},
+		{Version: 1, Up: noop, Down: noop},
+	}}.validate())
+}
+
+func TestCovered(t *testing.T) {
+	indexes := [][]string{{"id"}, {"denom", "token_id"}, {`"time"`}}
+
+	require.True(t, covered([]string{"denom"}, indexes))
+	require.True(t, covered([]string{"denom", "token_id"}, indexes))
+	require.True(t, covered([]string{"time"}, indexes))
+	require.False(t, covered([]string{"token_id"}, indexes))
+	require.False(t, covered([]string{"denom", "status"}, indexes))
+	require.False(t, covered([]string{"id", "denom"}, indexes))
+}
+
+func TestIndexStatement(t *testing.T) {
+	index := Index{Table: "nfts", Name: "idx_nfts_denom_status", Columns: []string{"denom", "status"}}
+
+	require.Equal(t, `CREATE INDEX IF NOT EXISTS "idx_nfts_denom_status" ON "nfts" ("denom", "status")`, index.Statement(""))
+	require.Equal(t, `CREATE INDEX IF NOT EXISTS "idx_nfts_denom_status" ON "marketplace"."nfts" ("denom", "status")`,
+		index.Statement("marketplace"))
+	require.Equal(t, `CREATE INDEX CONCURRENTLY IF NOT EXISTS "idx_nfts_denom_status" ON "marketplace"."nfts" ("denom", "status")`,
+		index.ConcurrentStatement("marketplace"))
+}
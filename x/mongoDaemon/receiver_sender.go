@@ -179,8 +179,9 @@ func (rs *RMQReceiverSender) GetTaskMessageChan() (<-chan amqp.Delivery, error)
 	return msgs, nil
 }
 
-func (rs *RMQReceiverSender) PublishUriTask(url, owner, tokenId string) error {
+func (rs *RMQReceiverSender) PublishUriTask(url, owner, denom, tokenId string) error {
 	ba, err := json.Marshal(&dwh_common.TaskInfo{
+		Denom:   denom,
 		TokenID: tokenId,
 		URL:     url,
 		Owner:   owner,
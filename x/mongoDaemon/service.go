@@ -144,6 +144,12 @@ func (md *MongoDaemon) processMessage(msg []byte) error {
 			stdLog.Println(err)
 			continue
 		}
+		denom, ok := dwh["denom"]
+		if !ok {
+			err = fmt.Errorf("no denom field in dwhData")
+			stdLog.Println(err)
+			continue
+		}
 		tokenId, ok := dwh["tokenID"]
 		if !ok {
 			err = fmt.Errorf("no tokenID field in dwhData")
@@ -164,6 +170,7 @@ func (md *MongoDaemon) processMessage(msg []byte) error {
 		if err := md.rmqReceiverSender.PublishUriTask(
 			fmt.Sprintf("%v", uri),
 			fmt.Sprintf("%v", owner),
+			fmt.Sprintf("%v", denom),
 			fmt.Sprintf("%v", tokenId),
 		); err != nil {
 			return fmt.Errorf("failed to publish uri tasks, error: %v", err)
@@ -0,0 +1,207 @@
+// Package outbox publishes RabbitMQ messages along with the changes they follow from.
+// Handlers add messages to the outbox table in their database transaction, so messages
+// are only published if the changes are committed, and a failing RabbitMQ does not fail
+// the handler; a relay then publishes the pending messages with retries and marks them
+// sent. Messages are published at least once, in order unless they are retried.
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	common "github.com/corestario/dwh/x/common"
+	"github.com/jinzhu/gorm"
+	"github.com/prometheus/common/log"
+)
+
+// publisher publishes the bodies of messages to a queue (see common.RMQSender).
+type publisher interface {
+	PublishBody(body []byte, priority common.ImgQueuePriority) error
+	Closer() error
+}
+
+// Outbox adds the messages of a queue to the outbox table and relays them to RabbitMQ.
+// The relay of a chain must run in a single process.
+type Outbox struct {
+	db      *gorm.DB // Scoped to the chain (see common.WithChainID).
+	cfg     common.OutboxCfg
+	queue   string
+	dial    func() (publisher, error)
+	sender  publisher // Connected by the relay, and again after failures.
+	cleaned time.Time // Last time sent messages were deleted.
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// NewOutbox returns the outbox of a queue. Its relay publishes messages with publisher
+// confirms, so messages are only marked sent once RabbitMQ has them.
+func NewOutbox(db *gorm.DB, cfg *common.DwhCommonServiceConfig, queueName string, queueMaxPriority int) *Outbox {
+	return newOutbox(db, cfg.OutboxCfg, queueName, func() (publisher, error) {
+		sender, err := common.NewRMQSender(cfg, queueName, queueMaxPriority)
+		if err != nil {
+			return nil, err
+		}
+		if err := sender.EnableConfirms(); err != nil {
+			sender.Closer()
+			return nil, err
+		}
+
+		return sender, nil
+	})
+}
+
+func newOutbox(db *gorm.DB, cfg common.OutboxCfg, queue string, dial func() (publisher, error)) *Outbox {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Outbox{
+		db:     db,
+		cfg:    cfg,
+		queue:  queue,
+		dial:   dial,
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+}
+
+// Publish adds a task to the outbox using db, which should be the transaction of the
+// changes that the task follows from. The task is published by the relay once the
+// transaction is committed.
+func (o *Outbox) Publish(db *gorm.DB, taskUrl, owner, denom, tokenId string, priority common.ImgQueuePriority) error {
+	body, err := common.MarshalTask(taskUrl, owner, denom, tokenId)
+	if err != nil {
+		return err
+	}
+	message := &common.OutboxMessage{
+		Queue:         o.queue,
+		Priority:      int(priority),
+		Body:          string(body),
+		NextAttemptAt: time.Now(),
+	}
+	if err := db.New().Create(message).Error; err != nil {
+		return fmt.Errorf("failed to add message to outbox: %v", err)
+	}
+
+	return nil
+}
+
+// Start runs the relay until Stop is called.
+func (o *Outbox) Start() {
+	go func() {
+		defer close(o.done)
+		ticker := time.NewTicker(time.Duration(o.cfg.OutboxRelayIntervalSeconds) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-o.ctx.Done():
+				o.relay()
+				if o.sender != nil {
+					if err := o.sender.Closer(); err != nil {
+						log.Errorf("failed to close outbox sender: %v", err)
+					}
+				}
+				return
+			case <-ticker.C:
+				o.relay()
+				o.cleanup()
+			}
+		}
+	}()
+}
+
+// Stop stops the relay after publishing the pending messages that are due.
+func (o *Outbox) Stop() {
+	o.cancel()
+	<-o.done
+}
+
+// relay publishes the pending messages that are due, in batches. It stops at the first
+// message that fails, which is retried after a backoff.
+func (o *Outbox) relay() {
+	for {
+		var batch []common.OutboxMessage
+		if err := o.db.New().Where("queue = ? AND sent_at IS NULL AND next_attempt_at <= ?", o.queue, time.Now()).
+			Order("id").Limit(o.cfg.OutboxBatchSize).Find(&batch).Error; err != nil {
+			log.Errorf("failed to get outbox messages: %v", err)
+			return
+		}
+		for _, message := range batch {
+			if err := o.publish(message); err != nil {
+				log.Errorf("failed to publish outbox message #%d (attempt %d): %v", message.ID, message.Attempts+1, err)
+				o.retry(message, err)
+				return
+			}
+			if err := o.db.New().Model(&message).UpdateColumns(map[string]interface{}{
+				"sent_at":  time.Now(),
+				"attempts": message.Attempts + 1,
+			}).Error; err != nil {
+				// The message will be published again.
+				log.Errorf("failed to mark outbox message #%d sent: %v", message.ID, err)
+				return
+			}
+		}
+		if len(batch) < o.cfg.OutboxBatchSize {
+			return
+		}
+	}
+}
+
+func (o *Outbox) publish(message common.OutboxMessage) error {
+	if o.sender == nil {
+		sender, err := o.dial()
+		if err != nil {
+			return fmt.Errorf("failed to connect: %v", err)
+		}
+		o.sender = sender
+	}
+	if err := o.sender.PublishBody([]byte(message.Body), common.ImgQueuePriority(message.Priority)); err != nil {
+		// The channel might be closed, it is opened again on the next attempt.
+		o.sender.Closer()
+		o.sender = nil
+		return err
+	}
+
+	return nil
+}
+
+// retry schedules the next attempt to publish the message.
+func (o *Outbox) retry(message common.OutboxMessage, publishErr error) {
+	attempts := message.Attempts + 1
+	maxBackoff := time.Duration(o.cfg.OutboxMaxBackoffSeconds) * time.Second
+	if err := o.db.New().Model(&message).UpdateColumns(map[string]interface{}{
+		"attempts":        attempts,
+		"last_error":      publishErr.Error(),
+		"next_attempt_at": time.Now().Add(backoff(attempts, maxBackoff)),
+	}).Error; err != nil {
+		log.Errorf("failed to update outbox message #%d: %v", message.ID, err)
+	}
+}
+
+// cleanup deletes the messages that were sent before the retention period.
+func (o *Outbox) cleanup() {
+	if o.cfg.OutboxRetentionHours <= 0 || time.Since(o.cleaned) < time.Hour {
+		return
+	}
+	o.cleaned = time.Now()
+	before := time.Now().Add(-time.Duration(o.cfg.OutboxRetentionHours) * time.Hour)
+	if err := o.db.New().Where("queue = ? AND sent_at < ?", o.queue, before).
+		Delete(&common.OutboxMessage{}).Error; err != nil {
+		log.Errorf("failed to delete sent outbox messages: %v", err)
+	}
+}
+
+// backoff returns the delay before the next attempt after the given number of attempts:
+// one second, doubled with every attempt, up to max.
+func backoff(attempts int, max time.Duration) time.Duration {
+	delay := time.Second
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		return max
+	}
+
+	return delay
+}
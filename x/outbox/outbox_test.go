@@ -0,0 +1,116 @@
+package outbox
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	common "github.com/corestario/dwh/x/common"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoff(t *testing.T) {
+	max := time.Minute
+	require.Equal(t, time.Second, backoff(0, max))
+	require.Equal(t, time.Second, backoff(1, max))
+	require.Equal(t, 2*time.Second, backoff(2, max))
+	require.Equal(t, 32*time.Second, backoff(6, max))
+	require.Equal(t, max, backoff(7, max))
+	require.Equal(t, max, backoff(1000, max))
+}
+
+// fakePublisher records the published bodies, and fails to publish the bodies in fail.
+type fakePublisher struct {
+	published []string
+	fail      map[string]bool
+	closed    bool
+}
+
+func (p *fakePublisher) PublishBody(body []byte, priority common.ImgQueuePriority) error {
+	if p.fail[string(body)] {
+		return fmt.Errorf("not acknowledged")
+	}
+	p.published = append(p.published, string(body))
+
+	return nil
+}
+
+func (p *fakePublisher) Closer() error {
+	p.closed = true
+	return nil
+}
+
+func TestRelay(t *testing.T) {
+	cfg := common.DefaultDwhCommonServiceConfig()
+	db, err := common.GetDB(cfg)
+	if err != nil {
+		t.Errorf("failed to establish database connection: %v", err)
+		return
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("failed to close database connection: %v", err)
+		}
+	}()
+	db = common.WithChainID(db, "test-outbox")
+	require.NoError(t, db.AutoMigrate(&common.OutboxMessage{}).Error)
+	const queue = "test-outbox"
+	clean := func() {
+		require.NoError(t, db.New().Where("queue = ?", queue).Delete(&common.OutboxMessage{}).Error)
+	}
+	clean()
+	defer clean()
+
+	var publishers []*fakePublisher
+	fail := map[string]bool{}
+	outboxCfg := cfg.OutboxCfg
+	outboxCfg.OutboxBatchSize = 2
+	o := newOutbox(db, outboxCfg, queue, func() (publisher, error) {
+		publishers = append(publishers, &fakePublisher{fail: fail})
+		return publishers[len(publishers)-1], nil
+	})
+	var bodies []string
+	for i := 0; i < 3; i++ {
+		require.NoError(t, o.Publish(db, fmt.Sprintf("https://example.com/%d", i), "owner", "cards", fmt.Sprint(i), common.RegularUpdatePriority))
+		var message common.OutboxMessage
+		require.NoError(t, db.New().Where("queue = ?", queue).Order("id DESC").First(&message).Error)
+		bodies = append(bodies, message.Body)
+	}
+	messages := func() []common.OutboxMessage {
+		var out []common.OutboxMessage
+		require.NoError(t, db.New().Where("queue = ?", queue).Order("id").Find(&out).Error)
+		return out
+	}
+
+	// The second message fails: the first one is sent, and the rest wait for it.
+	fail[bodies[1]] = true
+	o.relay()
+	require.Len(t, publishers, 1)
+	require.Equal(t, bodies[:1], publishers[0].published)
+	require.True(t, publishers[0].closed)
+	sent := messages()
+	require.NotNil(t, sent[0].SentAt)
+	require.Equal(t, 1, sent[0].Attempts)
+	require.Nil(t, sent[1].SentAt)
+	require.Equal(t, 1, sent[1].Attempts)
+	require.Equal(t, "not acknowledged", sent[1].LastError)
+	require.True(t, sent[1].NextAttemptAt.After(time.Now()))
+	require.Nil(t, sent[2].SentAt)
+	require.Equal(t, 0, sent[2].Attempts)
+
+	// Once the backoff is over, the messages are published in order, by a new sender.
+	delete(fail, bodies[1])
+	require.NoError(t, db.New().Model(&common.OutboxMessage{}).Where("id = ?", sent[1].ID).
+		UpdateColumn("next_attempt_at", time.Now()).Error)
+	o.relay()
+	require.Len(t, publishers, 2)
+	require.Equal(t, bodies[1:], publishers[1].published)
+	for _, message := range messages() {
+		require.NotNil(t, message.SentAt)
+	}
+	require.Equal(t, 2, messages()[1].Attempts)
+
+	// Sent messages are not published again.
+	o.relay()
+	require.Equal(t, bodies[1:], publishers[1].published)
+}
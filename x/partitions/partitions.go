@@ -0,0 +1,317 @@
+// Package partitions partitions the txes and messages tables by height range. New
+// partitions are created as the indexer advances, and old ones are dropped or archived
+// according to retention policies, which avoids deleting rows (and vacuuming) in place.
+package partitions
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	common "github.com/corestario/dwh/x/common"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+// Tables are the tables that are partitioned by height.
+var Tables = []string{"txes", "messages"}
+
+// indexes are the indexes of the partitioned tables. They are created on the parent
+// tables, so every partition has them.
+var indexes = map[string][][]string{
+	"txes":     {{"id"}, {"hash"}, {"height"}, {"chain_id", "height"}},
+	"messages": {{"id"}, {"tx_id"}, {"height"}},
+}
+
+// foreignKeys are dropped when tables are partitioned: they can not reference
+// partitioned tables, and would not let retention remove partitions.
+var foreignKeys = map[string]string{
+	"messages":          "messages_tx_id_txes_id_foreign",
+	"message_addresses": "message_addresses_message_id_messages_id_foreign",
+}
+
+// Partition is a partition of a partitioned table. It holds the rows with heights from
+// FromHeight (inclusive) to ToHeight (exclusive).
+type Partition struct {
+	ID         uint   `gorm:"primary_key"`
+	Parent     string `gorm:"not null"`
+	Name       string `gorm:"unique_index;not null"`
+	FromHeight int64  `gorm:"not null"`
+	ToHeight   int64  `gorm:"not null"`
+	// EndTime is the block time at which all indexed chains were past the partition,
+	// i.e., all the rows of the partition are older. It is nil while the partition is
+	// being written to. The time each chain got past the partition is kept in the
+	// partition_ends table.
+	EndTime *time.Time
+}
+
+// Manager creates partitions and applies retention policies.
+type Manager struct {
+	mu          sync.Mutex
+	db          *gorm.DB
+	cfg         common.PartitioningCfg
+	chainIDs    []string             // Indexed chains, which partitions end once all of them are past.
+	checked     bool                 // Whether partitioned was queried.
+	partitioned bool                 // Whether the tables are partitioned.
+	current     map[string]Partition // Chain ID -> partition of txes that the last height of the chain belongs to.
+}
+
+func NewManager(db *gorm.DB, cfg common.PartitioningCfg, chains []common.ChainCfg) *Manager {
+	m := &Manager{db: db, cfg: cfg, current: map[string]Partition{}}
+	for _, chain := range chains {
+		m.chainIDs = append(m.chainIDs, chain.ChainID)
+	}
+
+	return m
+}
+
+// Partitioned reports whether the tables are partitioned.
+func (m *Manager) Partitioned() (bool, error) {
+	if m.checked {
+		return m.partitioned, nil
+	}
+	for _, table := range Tables {
+		partitioned, err := IsPartitioned(m.db.New(), table)
+		if err != nil {
+			return false, err
+		}
+		if !partitioned {
+			m.checked = true
+			return false, nil
+		}
+	}
+	m.checked, m.partitioned = true, true
+
+	return true, nil
+}
+
+// Partition converts the tables to partitioned ones. Existing rows are kept in a
+// single "legacy" partition. It takes ACCESS EXCLUSIVE locks on the tables until it is
+// done, and scans the existing rows (to check their heights and to build the primary
+// key of the legacy partitions), so it must run in a maintenance window: writes and
+// reads of the tables, including the API, are blocked while it runs.
+func (m *Manager) Partition() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.cfg.PartitionSize <= 0 {
+		return fmt.Errorf("invalid partition size %d", m.cfg.PartitionSize)
+	}
+	tx := m.db.New().Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	for table, name := range foreignKeys {
+		if err := tx.Exec(fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT IF EXISTS %s",
+			pq.QuoteIdentifier(table), pq.QuoteIdentifier(name))).Error; err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to drop foreign key %s: %v", name, err)
+		}
+	}
+	for _, table := range Tables {
+		partitioned, err := IsPartitioned(tx, table)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if partitioned {
+			continue
+		}
+		if err := partitionTable(tx, table, m.cfg.PartitionSize); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to partition table %s: %v", table, err)
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	m.checked, m.partitioned = true, true
+
+	return nil
+}
+
+// partitionTable replaces the table with a partitioned one that has the original table
+// as its first partition. The primary key of a partitioned table must include the
+// partition key, so ids are only unique along with heights.
+func partitionTable(tx *gorm.DB, table string, size int64) error {
+	var maxHeight int64
+	if err := tx.Raw(fmt.Sprintf("SELECT COALESCE(MAX(height), 0) FROM %s", pq.QuoteIdentifier(table))).
+		Row().Scan(&maxHeight); err != nil {
+		return fmt.Errorf("failed to get max height: %v", err)
+	}
+	legacy := Partition{Parent: table, Name: table + "_legacy", FromHeight: 0, ToHeight: partitionStart(maxHeight, size) + size}
+
+	parent, name := pq.QuoteIdentifier(table), pq.QuoteIdentifier(legacy.Name)
+	statements := []string{
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s", parent, name),
+		// The primary key of the parent table takes the name of the original one.
+		fmt.Sprintf("ALTER TABLE %s RENAME CONSTRAINT %s TO %s", name, pq.QuoteIdentifier(table+"_pkey"), pq.QuoteIdentifier(legacy.Name+"_pkey")),
+		// Partitions must have the NOT NULL constraints of the primary key.
+		fmt.Sprintf("ALTER TABLE %s ALTER COLUMN height SET NOT NULL", name),
+		fmt.Sprintf("CREATE TABLE %s (LIKE %s INCLUDING DEFAULTS) PARTITION BY RANGE (height)", parent, name),
+		fmt.Sprintf("ALTER TABLE %s ADD PRIMARY KEY (id, height)", parent),
+		// Otherwise the sequence would be dropped along with the legacy partition.
+		fmt.Sprintf("ALTER SEQUENCE %s OWNED BY %s.id", pq.QuoteIdentifier(table+"_id_seq"), parent),
+		// Attaching builds the index of the primary key on the legacy partition.
+		fmt.Sprintf("ALTER TABLE %s ATTACH PARTITION %s FOR VALUES FROM (MINVALUE) TO (%d)", parent, name, legacy.ToHeight),
+	}
+	for _, columns := range indexes[table] {
+		// The index of the legacy partition gives its name to the index of the parent
+		// table, and is attached to it instead of being built again.
+		index := indexName(table, columns)
+		statements = append(statements,
+			fmt.Sprintf("ALTER INDEX IF EXISTS %s RENAME TO %s", pq.QuoteIdentifier(index), pq.QuoteIdentifier(index+"_legacy")),
+			fmt.Sprintf("CREATE INDEX %s ON %s (%s)", pq.QuoteIdentifier(index), parent, strings.Join(columns, ", ")),
+		)
+	}
+	for _, statement := range statements {
+		if err := tx.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+
+	return tx.Create(&legacy).Error
+}
+
+// Ensure creates the partitions that the rows of the chain at the given height belong
+// to, if the tables are partitioned. The chain is past the partitions that end at the
+// height or before since blockTime; partitions that every indexed chain is past are
+// closed at the latest of these times. It is safe for concurrent use by the indexers of
+// several chains, and by several indexer processes.
+func (m *Manager) Ensure(chainID string, height int64, blockTime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if current, ok := m.current[chainID]; ok && height >= current.FromHeight && height < current.ToHeight {
+		return nil
+	}
+	partitioned, err := m.Partitioned()
+	if err != nil || !partitioned {
+		return err
+	}
+
+	current, err := m.partitionOf(height)
+	if err != nil {
+		return err
+	}
+	m.current[chainID] = current
+
+	// Heights of chains overlap, so a partition only ends once all of them are past it.
+	// Chains are tracked in the database, since they may be indexed by other processes
+	// and not all of them call Ensure after a restart.
+	if err := m.db.New().Exec(`
+		INSERT INTO partition_ends (partition_id, chain_id, end_time)
+		SELECT id, ?, ? FROM partitions WHERE to_height <= ? AND end_time IS NULL
+		ON CONFLICT (partition_id, chain_id) DO NOTHING`, chainID, blockTime, height).Error; err != nil {
+		return fmt.Errorf("failed to record partitions that chain %s is past: %v", chainID, err)
+	}
+	if err := m.db.New().Exec(`
+		UPDATE partitions SET end_time = ends.end_time FROM (
+			SELECT partition_id, MAX(end_time) AS end_time FROM partition_ends
+			WHERE chain_id IN (?) GROUP BY partition_id HAVING COUNT(*) = ?
+		) ends
+		WHERE partitions.id = ends.partition_id AND partitions.end_time IS NULL`,
+		m.chainIDs, len(m.chainIDs)).Error; err != nil {
+		return fmt.Errorf("failed to close partitions: %v", err)
+	}
+
+	return nil
+}
+
+// partitionOf returns the partition of txes that the height belongs to, creating the
+// partitions of all tables if needed.
+func (m *Manager) partitionOf(height int64) (Partition, error) {
+	var current Partition
+	err := m.db.New().Where("parent = ? AND from_height <= ? AND to_height > ?", Tables[0], height, height).First(&current).Error
+	if err == nil {
+		return current, nil
+	}
+	if !gorm.IsRecordNotFoundError(err) {
+		return current, fmt.Errorf("failed to find partition of height %d: %v", height, err)
+	}
+
+	from, to, err := m.bounds(height)
+	if err != nil {
+		return current, err
+	}
+	tx := m.db.New().Begin()
+	if tx.Error != nil {
+		return current, tx.Error
+	}
+	for _, table := range Tables {
+		partition := Partition{Parent: table, Name: fmt.Sprintf("%s_p%d", table, from), FromHeight: from, ToHeight: to}
+		if err := tx.Exec(fmt.Sprintf("CREATE TABLE %s PARTITION OF %s FOR VALUES FROM (%d) TO (%d)",
+			pq.QuoteIdentifier(partition.Name), pq.QuoteIdentifier(table), from, to)).Error; err != nil {
+			tx.Rollback()
+			return current, fmt.Errorf("failed to create partition %s: %v", partition.Name, err)
+		}
+		if err := tx.Create(&partition).Error; err != nil {
+			tx.Rollback()
+			return current, fmt.Errorf("failed to add partition %s: %v", partition.Name, err)
+		}
+		if table == Tables[0] {
+			current = partition
+		}
+	}
+
+	return current, tx.Commit().Error
+}
+
+// bounds returns the bounds of a new partition for the height. Partitions are aligned
+// to the partition size, but do not overlap existing ones (e.g., if the size changed).
+func (m *Manager) bounds(height int64) (int64, int64, error) {
+	size := m.cfg.PartitionSize
+	if size <= 0 {
+		return 0, 0, fmt.Errorf("invalid partition size %d", size)
+	}
+	from, to := partitionStart(height, size), partitionStart(height, size)+size
+
+	var prevTo, nextFrom *int64
+	if err := m.db.New().Raw("SELECT MAX(to_height) FROM partitions WHERE parent = ? AND to_height <= ?",
+		Tables[0], height).Row().Scan(&prevTo); err != nil {
+		return 0, 0, fmt.Errorf("failed to get previous partition: %v", err)
+	}
+	if err := m.db.New().Raw("SELECT MIN(from_height) FROM partitions WHERE parent = ? AND from_height > ?",
+		Tables[0], height).Row().Scan(&nextFrom); err != nil {
+		return 0, 0, fmt.Errorf("failed to get next partition: %v", err)
+	}
+	if prevTo != nil && *prevTo > from {
+		from = *prevTo
+	}
+	if nextFrom != nil && *nextFrom < to {
+		to = *nextFrom
+	}
+
+	return from, to, nil
+}
+
+// List returns the partitions ordered by table and height.
+func (m *Manager) List() ([]Partition, error) {
+	var out []Partition
+	if err := m.db.New().Order("parent, from_height").Find(&out).Error; err != nil {
+		return nil, fmt.Errorf("failed to get partitions: %v", err)
+	}
+
+	return out, nil
+}
+
+// partitionStart returns the first height of the partition that the height belongs to.
+func partitionStart(height, size int64) int64 {
+	return height / size * size
+}
+
+func indexName(table string, columns []string) string {
+	return fmt.Sprintf("idx_%s_%s", table, strings.Join(columns, "_"))
+}
+
+// IsPartitioned reports whether the table is a partitioned table.
+func IsPartitioned(db *gorm.DB, table string) (bool, error) {
+	var partitioned bool
+	if err := db.Raw("SELECT EXISTS(SELECT 1 FROM pg_partitioned_table WHERE partrelid = to_regclass(?))", table).
+		Row().Scan(&partitioned); err != nil {
+		return false, fmt.Errorf("failed to check whether %s is partitioned: %v", table, err)
+	}
+
+	return partitioned, nil
+}
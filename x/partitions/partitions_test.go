@@ -0,0 +1,50 @@
+package partitions
+
+import (
+	"testing"
+
+	common "github.com/corestario/dwh/x/common"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartitionStart(t *testing.T) {
+	require.Equal(t, int64(0), partitionStart(0, 1000))
+	require.Equal(t, int64(0), partitionStart(999, 1000))
+	require.Equal(t, int64(1000), partitionStart(1000, 1000))
+	require.Equal(t, int64(5000), partitionStart(5123, 1000))
+}
+
+func TestValidatePolicy(t *testing.T) {
+	policy := common.RetentionPolicy{Table: "messages", Route: "nft", Status: StatusFailed, MaxAgeDays: 90, Action: ActionDrop}
+	require.NoError(t, validatePolicy(policy))
+	require.NoError(t, validatePolicy(common.RetentionPolicy{Table: "txes", MaxAgeDays: 1, Action: ActionArchive}))
+
+	invalid := []func(p *common.RetentionPolicy){
+		func(p *common.RetentionPolicy) { p.Table = "users" },
+		func(p *common.RetentionPolicy) { p.Table = "txes" }, // Routes are only known for messages.
+		func(p *common.RetentionPolicy) { p.Status = "pending" },
+		func(p *common.RetentionPolicy) { p.MaxAgeDays = 0 },
+		func(p *common.RetentionPolicy) { p.Action = "delete" },
+	}
+	for _, change := range invalid {
+		p := policy
+		change(&p)
+		require.Error(t, validatePolicy(p))
+	}
+}
+
+func TestPredicate(t *testing.T) {
+	condition, args := predicate(common.RetentionPolicy{Table: "messages"})
+	require.Equal(t, "", condition)
+	require.Empty(t, args)
+
+	condition, args = predicate(common.RetentionPolicy{Table: "messages", Route: "nft", Status: StatusFailed})
+	require.Equal(t, "COALESCE(route = ? AND failed, false)", condition)
+	require.Equal(t, []interface{}{"nft"}, args)
+
+	condition, _ = predicate(common.RetentionPolicy{Table: "messages", Status: StatusSucceeded})
+	require.Equal(t, "COALESCE(NOT failed, false)", condition)
+
+	condition, _ = predicate(common.RetentionPolicy{Table: "txes", Status: StatusFailed})
+	require.Equal(t, "COALESCE(code <> 0, false)", condition)
+}
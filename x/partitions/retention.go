@@ -0,0 +1,300 @@
+package partitions
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	common "github.com/corestario/dwh/x/common"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+// Retention policy actions and statuses (see common.RetentionPolicy).
+const (
+	ActionDrop    = "drop"
+	ActionArchive = "archive"
+
+	StatusFailed    = "failed"
+	StatusSucceeded = "succeeded"
+)
+
+// Removal is the removal of rows of a partition by a retention policy.
+type Removal struct {
+	Partition Partition
+	Policy    common.RetentionPolicy
+	Rows      int64
+	Whole     bool // Whether the whole partition was removed.
+}
+
+// RemovedRange is a height range of a table that a retention policy removed rows from.
+// Removed rows can not be replayed anymore (see RemovedRanges).
+type RemovedRange struct {
+	ID         uint      `gorm:"primary_key"`
+	Parent     string    `gorm:"not null"`
+	FromHeight int64     `gorm:"not null"`
+	ToHeight   int64     `gorm:"not null"`
+	Route      string    `gorm:"not null"` // Route of the policy, empty for all routes.
+	Status     string    `gorm:"not null"` // Status of the policy, empty for all statuses.
+	RemovedAt  time.Time `gorm:"not null"`
+}
+
+// RemovedRanges returns the ranges that retention policies may have removed succeeded
+// messages of the routes from (along with their transactions), ordered by table and
+// height. Commands that replay the indexed messages must not run over them.
+func RemovedRanges(db *gorm.DB, routes []string) ([]RemovedRange, error) {
+	var out []RemovedRange
+	if err := db.New().Where("status <> ? AND (route = '' OR route IN (?))", StatusFailed, routes).
+		Order("parent, from_height").Find(&out).Error; err != nil {
+		return nil, fmt.Errorf("failed to get removed ranges: %v", err)
+	}
+
+	return out, nil
+}
+
+func validatePolicy(policy common.RetentionPolicy) error {
+	if policy.Table != "txes" && policy.Table != "messages" {
+		return fmt.Errorf("unknown table %q", policy.Table)
+	}
+	if policy.Route != "" && policy.Table != "messages" {
+		return fmt.Errorf("route is only supported for messages")
+	}
+	if policy.Status != "" && policy.Status != StatusFailed && policy.Status != StatusSucceeded {
+		return fmt.Errorf("unknown status %q", policy.Status)
+	}
+	if policy.MaxAgeDays <= 0 {
+		return fmt.Errorf("invalid max age %d", policy.MaxAgeDays)
+	}
+	if policy.Action != ActionDrop && policy.Action != ActionArchive {
+		return fmt.Errorf("unknown action %q", policy.Action)
+	}
+
+	return nil
+}
+
+// predicate returns the condition that the rows removed by the policy match. It is
+// empty if the policy removes whole partitions.
+func predicate(policy common.RetentionPolicy) (string, []interface{}) {
+	var (
+		conditions []string
+		args       []interface{}
+	)
+	if policy.Route != "" {
+		conditions, args = append(conditions, "route = ?"), append(args, policy.Route)
+	}
+	switch {
+	case policy.Status == StatusFailed && policy.Table == "messages":
+		conditions = append(conditions, "failed")
+	case policy.Status == StatusSucceeded && policy.Table == "messages":
+		conditions = append(conditions, "NOT failed")
+	case policy.Status == StatusFailed:
+		conditions = append(conditions, "code <> 0")
+	case policy.Status == StatusSucceeded:
+		conditions = append(conditions, "code = 0")
+	}
+	if len(conditions) == 0 {
+		return "", nil
+	}
+
+	return "COALESCE(" + strings.Join(conditions, " AND ") + ", false)", args
+}
+
+// Retain applies the retention policies to the partitions that ended before now minus
+// the max age of a policy. Rows of messages are removed along with their addresses, and
+// the removed ranges are recorded. If dryRun is set, nothing is removed.
+func (m *Manager) Retain(now time.Time, dryRun bool) ([]Removal, error) {
+	var out []Removal
+	for _, policy := range m.cfg.RetentionPolicies {
+		if err := validatePolicy(policy); err != nil {
+			return out, fmt.Errorf("invalid retention policy for %s: %v", policy.Table, err)
+		}
+		var partitions []Partition
+		cutoff := now.Add(-time.Duration(policy.MaxAgeDays) * 24 * time.Hour)
+		if err := m.db.New().Where("parent = ? AND end_time < ?", policy.Table, cutoff).
+			Order("from_height").Find(&partitions).Error; err != nil {
+			return out, fmt.Errorf("failed to get partitions of %s: %v", policy.Table, err)
+		}
+		for _, partition := range partitions {
+			removal, err := m.retain(partition, policy, now, dryRun)
+			if err != nil {
+				return out, fmt.Errorf("failed to apply retention policy to %s: %v", partition.Name, err)
+			}
+			if removal.Rows > 0 || removal.Whole {
+				out = append(out, removal)
+			}
+		}
+	}
+
+	return out, nil
+}
+
+func (m *Manager) retain(partition Partition, policy common.RetentionPolicy, now time.Time, dryRun bool) (Removal, error) {
+	removal := Removal{Partition: partition, Policy: policy}
+	condition, args := predicate(policy)
+	removal.Whole = condition == ""
+	if removal.Whole {
+		condition = "true"
+	}
+	name := pq.QuoteIdentifier(partition.Name)
+	if err := m.db.New().Raw(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s", name, condition), args...).
+		Row().Scan(&removal.Rows); err != nil {
+		return removal, fmt.Errorf("failed to count rows: %v", err)
+	}
+	if dryRun || (removal.Rows == 0 && !removal.Whole) {
+		return removal, nil
+	}
+
+	tx := m.db.New().Begin()
+	if tx.Error != nil {
+		return removal, tx.Error
+	}
+	var err error
+	if removal.Whole {
+		err = m.removePartition(tx, partition, policy.Action)
+	} else {
+		err = m.rewritePartition(tx, partition, policy.Action, condition, args)
+	}
+	if err == nil {
+		err = tx.Create(&RemovedRange{
+			Parent:     partition.Parent,
+			FromHeight: partition.FromHeight,
+			ToHeight:   partition.ToHeight,
+			Route:      policy.Route,
+			Status:     policy.Status,
+			RemovedAt:  now,
+		}).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return removal, err
+	}
+
+	return removal, tx.Commit().Error
+}
+
+// removePartition detaches the partition and drops it or moves it to the archive
+// schema.
+func (m *Manager) removePartition(tx *gorm.DB, partition Partition, action string) error {
+	parent, name := pq.QuoteIdentifier(partition.Parent), pq.QuoteIdentifier(partition.Name)
+	if err := removeAddresses(tx, partition, "true", nil); err != nil {
+		return err
+	}
+	if err := tx.Exec(fmt.Sprintf("ALTER TABLE %s DETACH PARTITION %s", parent, name)).Error; err != nil {
+		return fmt.Errorf("failed to detach partition: %v", err)
+	}
+	if action == ActionArchive {
+		archived, err := m.archiveExists(tx, partition)
+		if err != nil {
+			return err
+		}
+		if !archived {
+			if err := m.createArchiveSchema(tx); err != nil {
+				return err
+			}
+			if err := tx.Exec(fmt.Sprintf("ALTER TABLE %s SET SCHEMA %s",
+				name, pq.QuoteIdentifier(m.cfg.ArchiveSchema))).Error; err != nil {
+				return fmt.Errorf("failed to archive partition: %v", err)
+			}
+			return tx.Delete(&Partition{ID: partition.ID}).Error
+		}
+		// Rows of the partition were archived by other policies already.
+		if err := m.archiveRows(tx, partition, "true", nil); err != nil {
+			return err
+		}
+	}
+	if err := tx.Exec("DROP TABLE " + name).Error; err != nil {
+		return fmt.Errorf("failed to drop partition: %v", err)
+	}
+
+	return tx.Delete(&Partition{ID: partition.ID}).Error
+}
+
+// rewritePartition replaces the partition with a copy that has no rows matching the
+// condition. Unlike deleting the rows, it leaves no dead tuples behind.
+func (m *Manager) rewritePartition(tx *gorm.DB, partition Partition, action, condition string, args []interface{}) error {
+	if action == ActionArchive {
+		if err := m.archiveRows(tx, partition, condition, args); err != nil {
+			return err
+		}
+	}
+	if err := removeAddresses(tx, partition, condition, args); err != nil {
+		return err
+	}
+
+	parent, name := pq.QuoteIdentifier(partition.Parent), pq.QuoteIdentifier(partition.Name)
+	tmp := pq.QuoteIdentifier(partition.Name + "_new")
+	if err := tx.Exec(fmt.Sprintf("CREATE TABLE %s (LIKE %s INCLUDING DEFAULTS)", tmp, parent)).Error; err != nil {
+		return fmt.Errorf("failed to create table: %v", err)
+	}
+	if err := tx.Exec(fmt.Sprintf("INSERT INTO %s SELECT * FROM %s WHERE NOT %s", tmp, name, condition), args...).Error; err != nil {
+		return fmt.Errorf("failed to copy rows: %v", err)
+	}
+	from := fmt.Sprint(partition.FromHeight)
+	if partition.FromHeight == 0 {
+		from = "MINVALUE"
+	}
+	statements := []string{
+		fmt.Sprintf("ALTER TABLE %s DETACH PARTITION %s", parent, name),
+		"DROP TABLE " + name,
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s", tmp, name),
+		fmt.Sprintf("ALTER TABLE %s ATTACH PARTITION %s FOR VALUES FROM (%s) TO (%d)", parent, name, from, partition.ToHeight),
+	}
+	for _, statement := range statements {
+		if err := tx.Exec(statement).Error; err != nil {
+			return fmt.Errorf("failed to replace partition: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// removeAddresses deletes the addresses of the messages of the partition that match
+// the condition; message_addresses is not partitioned.
+func removeAddresses(tx *gorm.DB, partition Partition, condition string, args []interface{}) error {
+	if partition.Parent != "messages" {
+		return nil
+	}
+	if err := tx.Exec(fmt.Sprintf("DELETE FROM message_addresses WHERE message_id IN (SELECT id FROM %s WHERE %s)",
+		pq.QuoteIdentifier(partition.Name), condition), args...).Error; err != nil {
+		return fmt.Errorf("failed to delete message addresses: %v", err)
+	}
+
+	return nil
+}
+
+// archiveRows copies the rows of the partition that match the condition to the table
+// of the partition in the archive schema.
+func (m *Manager) archiveRows(tx *gorm.DB, partition Partition, condition string, args []interface{}) error {
+	if err := m.createArchiveSchema(tx); err != nil {
+		return err
+	}
+	archive := pq.QuoteIdentifier(m.cfg.ArchiveSchema) + "." + pq.QuoteIdentifier(partition.Name)
+	if err := tx.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (LIKE %s)",
+		archive, pq.QuoteIdentifier(partition.Parent))).Error; err != nil {
+		return fmt.Errorf("failed to create archive table: %v", err)
+	}
+	if err := tx.Exec(fmt.Sprintf("INSERT INTO %s SELECT * FROM %s WHERE %s",
+		archive, pq.QuoteIdentifier(partition.Name), condition), args...).Error; err != nil {
+		return fmt.Errorf("failed to archive rows: %v", err)
+	}
+
+	return nil
+}
+
+func (m *Manager) archiveExists(tx *gorm.DB, partition Partition) (bool, error) {
+	var exists bool
+	if err := tx.Raw("SELECT to_regclass(?) IS NOT NULL",
+		pq.QuoteIdentifier(m.cfg.ArchiveSchema)+"."+pq.QuoteIdentifier(partition.Name)).Row().Scan(&exists); err != nil {
+		return false, fmt.Errorf("failed to check archive table: %v", err)
+	}
+
+	return exists, nil
+}
+
+func (m *Manager) createArchiveSchema(tx *gorm.DB) error {
+	if err := tx.Exec("CREATE SCHEMA IF NOT EXISTS " + pq.QuoteIdentifier(m.cfg.ArchiveSchema)).Error; err != nil {
+		return fmt.Errorf("failed to create archive schema: %v", err)
+	}
+
+	return nil
+}
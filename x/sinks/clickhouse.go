@@ -0,0 +1,176 @@
+package sinks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	sdk "github.com/cosmos/cosmos-sdk/types"
+	common "github.com/corestario/dwh/x/common"
+	"github.com/prometheus/common/log"
+)
+
+// clickHouseSchema is the schema of the ClickHouse table. Rows are deduplicated by
+// their sorting key, so events that are sent again (e.g., after an insert that timed out
+// but succeeded) are only counted once after merges (or with FINAL). Amounts are 256-bit
+// integers (see sdk.Int), which take up to 77 digits; Decimal(76, 0) is the widest
+// decimal ClickHouse has.
+const clickHouseSchema = `(
+	chain_id LowCardinality(String),
+	type LowCardinality(String),
+	msg_type LowCardinality(String),
+	height Int64,
+	time DateTime('UTC'),
+	tx_hash String,
+	msg_index UInt32,
+	event_index UInt32,
+	denom String,
+	token_id String,
+	sender String,
+	recipient String,
+	amount String,
+	amount_denoms Array(String),
+	amount_values Array(Decimal(76, 0))
+) ENGINE = ReplacingMergeTree
+PARTITION BY toYYYYMM(time)
+ORDER BY (chain_id, height, tx_hash, msg_index, event_index)`
+
+// clickHouseRow is a row of the ClickHouse table. Amounts are also split into parallel
+// arrays of denoms and values, so they can be summed (e.g., with sumMap).
+type clickHouseRow struct {
+	ChainID      string        `json:"chain_id"`
+	Type         string        `json:"type"`
+	MsgType      string        `json:"msg_type"`
+	Height       int64         `json:"height"`
+	Time         string        `json:"time"`
+	TxHash       string        `json:"tx_hash"`
+	MsgIndex     int           `json:"msg_index"`
+	EventIndex   int           `json:"event_index"`
+	Denom        string        `json:"denom"`
+	TokenID      string        `json:"token_id"`
+	Sender       string        `json:"sender"`
+	Recipient    string        `json:"recipient"`
+	Amount       string        `json:"amount"`
+	AmountDenoms []string      `json:"amount_denoms"`
+	AmountValues []json.Number `json:"amount_values"`
+}
+
+func newClickHouseRow(event common.DomainEvent) clickHouseRow {
+	row := clickHouseRow{
+		ChainID:      event.ChainID,
+		Type:         event.Type,
+		MsgType:      event.MsgType,
+		Height:       event.Height,
+		Time:         event.Time.UTC().Format("2006-01-02 15:04:05"),
+		TxHash:       event.TxHash,
+		MsgIndex:     event.MsgIndex,
+		EventIndex:   event.EventIndex,
+		Denom:        event.Denom,
+		TokenID:      event.TokenID,
+		Sender:       event.Sender,
+		Recipient:    event.Recipient,
+		Amount:       event.Amount,
+		AmountDenoms: []string{},
+		AmountValues: []json.Number{},
+	}
+	coins, err := sdk.ParseCoins(event.Amount)
+	if err != nil {
+		log.Errorf("invalid amount of %s event (tx %s): %v", event.Type, event.TxHash, err)
+		return row
+	}
+	for _, coin := range coins {
+		row.AmountDenoms = append(row.AmountDenoms, coin.Denom)
+		row.AmountValues = append(row.AmountValues, json.Number(coin.Amount.String()))
+	}
+
+	return row
+}
+
+// ClickHouse is an exporter (see Relay) that inserts events into a ClickHouse table over
+// the HTTP interface, one insert per batch.
+type ClickHouse struct {
+	cfg     common.ClickHouseCfg
+	client  *http.Client
+	created bool // Whether the table was created.
+}
+
+// NewClickHouse does not connect to ClickHouse, so that the indexer starts while it is
+// down; the table is created by the first export.
+func NewClickHouse(cfg common.ClickHouseCfg) (*ClickHouse, error) {
+	if _, err := url.Parse(cfg.ClickHouseURL); err != nil {
+		return nil, fmt.Errorf("invalid URL: %v", err)
+	}
+
+	return &ClickHouse{cfg: cfg, client: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+// Export inserts the events, creating the table if needed. It fails unless ClickHouse
+// confirms the insert.
+func (c *ClickHouse) Export(events []common.DomainEvent) error {
+	if !c.created {
+		if err := c.exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s %s", c.table(), clickHouseSchema), nil); err != nil {
+			return fmt.Errorf("failed to create table: %v", err)
+		}
+		c.created = true
+	}
+	var body bytes.Buffer
+	for _, event := range events {
+		row, err := json.Marshal(newClickHouseRow(event))
+		if err != nil {
+			return fmt.Errorf("failed to encode %s event: %v", event.Type, err)
+		}
+		body.Write(row)
+		body.WriteByte('\n')
+	}
+
+	return c.exec(fmt.Sprintf("INSERT INTO %s FORMAT JSONEachRow", c.table()), &body)
+}
+
+// Close does nothing: requests are not kept open.
+func (c *ClickHouse) Close() error {
+	return nil
+}
+
+func (c *ClickHouse) table() string {
+	quote := func(name string) string { return "`" + strings.Replace(name, "`", "\\`", -1) + "`" }
+	return quote(c.cfg.ClickHouseDatabase) + "." + quote(c.cfg.ClickHouseTable)
+}
+
+// exec runs the query with body as its data (e.g., the rows to insert). If body is
+// nil, the query itself is sent as the body.
+func (c *ClickHouse) exec(query string, body io.Reader) error {
+	if body == nil {
+		body, query = strings.NewReader(query), ""
+	}
+	u, err := url.Parse(c.cfg.ClickHouseURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %v", err)
+	}
+	if query != "" {
+		u.RawQuery = url.Values{"query": {query}}.Encode()
+	}
+	req, err := http.NewRequest(http.MethodPost, u.String(), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-ClickHouse-User", c.cfg.ClickHouseUser)
+	req.Header.Set("X-ClickHouse-Key", c.cfg.ClickHousePassword)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package sinks
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	common "github.com/corestario/dwh/x/common"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClickHouse(t *testing.T) {
+	var queries, bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		queries, bodies = append(queries, r.URL.Query().Get("query")), append(bodies, string(body))
+		if len(queries) == 2 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	cfg := common.DefaultDwhCommonServiceConfig().ClickHouseCfg
+	cfg.ClickHouseURL = server.URL
+	sink, err := NewClickHouse(cfg)
+	require.NoError(t, err)
+	require.Empty(t, queries)
+
+	blockTime := time.Date(2020, 5, 1, 12, 30, 0, 0, time.UTC)
+	events := []common.DomainEvent{
+		{ChainID: "mpchain", Type: common.DomainEventSale, MsgType: "buy_nft", Height: 7, Time: blockTime,
+			TxHash: "ABC", Denom: "cards", TokenID: "1", Sender: "seller", Recipient: "buyer", Amount: "7gold,100token"},
+		{ChainID: "mpchain", Type: common.DomainEventMint, MsgType: "mint_nft", Height: 8, Time: blockTime,
+			TxHash: "DEF", Denom: "cards", TokenID: "2", EventIndex: 1},
+	}
+	// The table is created by the first export. Its insert fails, so the relay exports
+	// the events again.
+	require.Error(t, sink.Export(events))
+	require.NoError(t, sink.Export(events))
+	require.NoError(t, sink.Close())
+
+	require.Equal(t, 3, len(queries))
+	require.True(t, strings.HasPrefix(bodies[0], "CREATE TABLE IF NOT EXISTS `default`.`domain_events`"))
+	require.Contains(t, bodies[0], "Array(Decimal(76, 0))")
+	require.Equal(t, "INSERT INTO `default`.`domain_events` FORMAT JSONEachRow", queries[2])
+	require.Equal(t, bodies[1], bodies[2])
+
+	lines := strings.Split(strings.TrimSpace(bodies[2]), "\n")
+	require.Equal(t, 2, len(lines))
+	var row map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &row))
+	require.Equal(t, "sale", row["type"])
+	require.Equal(t, "2020-05-01 12:30:00", row["time"])
+	require.Equal(t, []interface{}{"gold", "token"}, row["amount_denoms"])
+	require.Equal(t, []interface{}{7.0, 100.0}, row["amount_values"])
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &row))
+	require.Equal(t, []interface{}{}, row["amount_values"])
+	require.Equal(t, 1.0, row["event_index"])
+}
@@ -0,0 +1,87 @@
+package sinks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Kafka is a broker that produces messages to Kafka through the Confluent REST Proxy
+// (API v2), so the indexer does not need a Kafka client. Messages are produced with
+// their keys, so the messages of a key go to the same partition.
+type Kafka struct {
+	url    string // URL of the REST Proxy.
+	client *http.Client
+}
+
+func NewKafka(restURL string) *Kafka {
+	return &Kafka{url: strings.TrimRight(restURL, "/"), client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+type kafkaRecord struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+type kafkaOffset struct {
+	Partition int     `json:"partition"`
+	Offset    int64   `json:"offset"`
+	ErrorCode *int    `json:"error_code"`
+	Error     *string `json:"error"`
+}
+
+// Publish produces the messages, whose values must be JSON. It fails if any of them
+// was not produced.
+func (k *Kafka) Publish(topic string, messages []Message) error {
+	records := make([]kafkaRecord, len(messages))
+	for i, message := range messages {
+		records[i] = kafkaRecord{Key: message.Key, Value: message.Value}
+	}
+	body, err := json.Marshal(map[string]interface{}{"records": records})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, k.url+"/topics/"+url.PathEscape(topic), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var result struct {
+		Offsets []kafkaOffset `json:"offsets"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	for i, offset := range result.Offsets {
+		if offset.ErrorCode != nil || offset.Error != nil {
+			var msg string
+			if offset.Error != nil {
+				msg = *offset.Error
+			}
+			return fmt.Errorf("failed to produce message %d of %d: %s", i+1, len(records), msg)
+		}
+	}
+
+	return nil
+}
+
+func (k *Kafka) Close() error {
+	return nil
+}
@@ -0,0 +1,125 @@
+package sinks
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// NATS is a broker that publishes messages to a NATS subject over the client protocol
+// of core NATS, so the indexer does not need a NATS client. NATS delivers the messages
+// of a connection in order, so keys are not sent. Publish waits for the server to
+// process the messages (with PING/PONG), so that errors are reported and the batch is
+// published again; the connection is opened again after a failure.
+type NATS struct {
+	addr     string // host:port of the server.
+	user     string
+	password string
+	timeout  time.Duration
+
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func NewNATS(addr, user, password string) *NATS {
+	return &NATS{addr: addr, user: user, password: password, timeout: 30 * time.Second}
+}
+
+// Publish publishes the messages to the subject. It is not safe for concurrent use.
+func (n *NATS) Publish(subject string, messages []Message) error {
+	if n.conn == nil {
+		if err := n.connect(); err != nil {
+			n.Close()
+			return fmt.Errorf("failed to connect to %s: %v", n.addr, err)
+		}
+	}
+	if err := n.publish(subject, messages); err != nil {
+		n.Close()
+		return err
+	}
+
+	return nil
+}
+
+func (n *NATS) connect() error {
+	conn, err := net.DialTimeout("tcp", n.addr, n.timeout)
+	if err != nil {
+		return err
+	}
+	n.conn, n.reader = conn, bufio.NewReader(conn)
+	if err := conn.SetDeadline(time.Now().Add(n.timeout)); err != nil {
+		return err
+	}
+
+	info, err := n.reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(info, "INFO ") {
+		return fmt.Errorf("unexpected greeting %q", strings.TrimSpace(info))
+	}
+	options := map[string]interface{}{"verbose": false, "pedantic": false, "name": "dwh", "lang": "go"}
+	if n.user != "" {
+		options["user"], options["pass"] = n.user, n.password
+	}
+	connect, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", connect); err != nil {
+		return err
+	}
+
+	return n.awaitPong()
+}
+
+func (n *NATS) publish(subject string, messages []Message) error {
+	if err := n.conn.SetDeadline(time.Now().Add(n.timeout)); err != nil {
+		return err
+	}
+	w := bufio.NewWriter(n.conn)
+	for _, message := range messages {
+		fmt.Fprintf(w, "PUB %s %d\r\n", subject, len(message.Value))
+		w.Write(message.Value)
+		w.WriteString("\r\n")
+	}
+	w.WriteString("PING\r\n")
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	return n.awaitPong()
+}
+
+// awaitPong reads from the server until a PONG, answering its PINGs.
+func (n *NATS) awaitPong() error {
+	for {
+		line, err := n.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		switch line = strings.TrimSpace(line); {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := n.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("server error: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+func (n *NATS) Close() error {
+	if n.conn == nil {
+		return nil
+	}
+	err := n.conn.Close()
+	n.conn, n.reader = nil, nil
+
+	return err
+}
@@ -0,0 +1,199 @@
+package sinks
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	common "github.com/corestario/dwh/x/common"
+	"github.com/jinzhu/gorm"
+	"github.com/prometheus/common/log"
+)
+
+// Exporter stores committed domain events in an external storage (see Relay). Export
+// is given events in the order of their IDs and fails unless all of them are stored;
+// events may be exported more than once.
+type Exporter interface {
+	Export(events []common.DomainEvent) error
+	Close() error
+}
+
+// Relay exports the committed domain events of a chain to an exporter, in the order of
+// their IDs. The messages of a chain are committed one at a time, so its events are
+// committed in the order of their IDs. The ID of the last exported event is kept in
+// the domain_event_cursors table and only advanced once the exporter has the events:
+// events are exported at least once, and an exporter that fails holds its relay back
+// until the events are exported. The relay of a chain must run in a single process.
+type Relay struct {
+	db        *gorm.DB // Scoped to the chain (see common.WithChainID).
+	name      string   // Name of the sink in the domain_event_cursors table.
+	exporter  Exporter
+	batchSize int
+	interval  time.Duration
+	cursor    uint
+	loaded    bool // Whether cursor was loaded from the database.
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+func NewRelay(db *gorm.DB, name string, exporter Exporter, batchSize int, interval time.Duration) (*Relay, error) {
+	if batchSize <= 0 || interval <= 0 {
+		return nil, fmt.Errorf("invalid batch size or flush interval")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Relay{
+		db:        db,
+		name:      name,
+		exporter:  exporter,
+		batchSize: batchSize,
+		interval:  interval,
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}, nil
+}
+
+// Relays are the relays of the external sinks of a chain.
+type Relays []*Relay
+
+// NewRelays returns the relays of the external sinks enabled in the config.
+func NewRelays(db *gorm.DB, cfg *common.DwhCommonServiceConfig) (Relays, error) {
+	var relays Relays
+	if cfg.ClickHouseEnabled {
+		clickHouse, err := NewClickHouse(cfg.ClickHouseCfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create ClickHouse sink: %v", err)
+		}
+		relay, err := NewRelay(db, "clickhouse", clickHouse, cfg.ClickHouseBatchSize,
+			time.Duration(cfg.ClickHouseFlushIntervalSeconds)*time.Second)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create ClickHouse relay: %v", err)
+		}
+		relays = append(relays, relay)
+	}
+	broker, err := newBroker(cfg.StreamCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stream broker: %v", err)
+	}
+	if broker != nil {
+		relay, err := NewRelay(db, "stream", NewStream(broker, cfg.StreamCfg), cfg.StreamBatchSize,
+			time.Duration(cfg.StreamFlushIntervalSeconds)*time.Second)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create stream relay: %v", err)
+		}
+		relays = append(relays, relay)
+	}
+
+	return relays, nil
+}
+
+func (r Relays) Start() {
+	for _, relay := range r {
+		relay.Start()
+	}
+}
+
+func (r Relays) Stop() {
+	for _, relay := range r {
+		relay.Stop()
+	}
+}
+
+// Start runs the relay until Stop is called.
+func (r *Relay) Start() {
+	go func() {
+		defer close(r.done)
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.ctx.Done():
+				r.relay()
+				if err := r.exporter.Close(); err != nil {
+					log.Errorf("failed to close %s sink: %v", r.name, err)
+				}
+				return
+			case <-ticker.C:
+				r.relay()
+			}
+		}
+	}()
+}
+
+// Stop stops the relay after exporting the committed events.
+func (r *Relay) Stop() {
+	r.cancel()
+	<-r.done
+}
+
+// relay exports the events after the cursor, in batches. It stops at the first batch
+// that fails, which is exported again at the next interval.
+func (r *Relay) relay() {
+	if !r.loaded {
+		if err := r.load(); err != nil {
+			log.Errorf("failed to load cursor of %s sink: %v", r.name, err)
+			return
+		}
+	}
+	for {
+		var batch []common.DomainEvent
+		if err := r.db.New().Where("id > ?", r.cursor).Order("id").Limit(r.batchSize).Find(&batch).Error; err != nil {
+			log.Errorf("failed to get domain events: %v", err)
+			return
+		}
+		if len(batch) == 0 {
+			return
+		}
+		if err := r.exporter.Export(batch); err != nil {
+			log.Errorf("failed to export domain events #%d-#%d to %s sink: %v", batch[0].ID, batch[len(batch)-1].ID, r.name, err)
+			return
+		}
+		if err := r.save(batch[len(batch)-1].ID); err != nil {
+			// The events will be exported again.
+			log.Errorf("failed to save cursor of %s sink: %v", r.name, err)
+			return
+		}
+		if len(batch) < r.batchSize {
+			return
+		}
+	}
+}
+
+// load reads the cursor. A sink that has no cursor yet (e.g., it was just enabled)
+// starts with the events committed after it.
+func (r *Relay) load() error {
+	var cursor common.DomainEventCursor
+	err := r.db.New().Where("sink = ?", r.name).First(&cursor).Error
+	if err == nil {
+		r.cursor, r.loaded = cursor.EventID, true
+		return nil
+	}
+	if !gorm.IsRecordNotFoundError(err) {
+		return err
+	}
+	var last uint
+	// Raw SQL is not scoped to the chain.
+	if err := r.db.New().Raw("SELECT COALESCE(MAX(id), 0) FROM domain_events WHERE chain_id = ?", common.ChainID(r.db)).
+		Row().Scan(&last); err != nil {
+		return err
+	}
+	if err := r.save(last); err != nil {
+		return err
+	}
+	r.loaded = true
+
+	return nil
+}
+
+func (r *Relay) save(eventID uint) error {
+	if err := r.db.New().Exec(`INSERT INTO domain_event_cursors (chain_id, sink, event_id, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (chain_id, sink) DO UPDATE SET event_id = EXCLUDED.event_id, updated_at = EXCLUDED.updated_at`,
+		common.ChainID(r.db), r.name, eventID, time.Now()).Error; err != nil {
+		return err
+	}
+	r.cursor = eventID
+
+	return nil
+}
@@ -0,0 +1,74 @@
+// Package sinks writes the normalized domain events of handlers (see
+// common.DomainEvent). Handlers write the events of a message in its transaction (see
+// Sink) to the domain_events table of Postgres and to the deliveries of webhooks, so
+// events exist if and only if the message is committed. Relays then export the
+// committed events to external storages (see Relay): ClickHouse, which keeps heavy
+// analytics off the database that Hasura serves, and a stream of typed events in Kafka
+// or NATS for downstream consumers.
+package sinks
+
+import (
+	"fmt"
+	"time"
+
+	common "github.com/corestario/dwh/x/common"
+	"github.com/corestario/dwh/x/webhooks"
+)
+
+// Sink stores domain events. Write is given the transaction of a message and the events
+// of the message, in order; events carry their chain ID.
+type Sink interface {
+	Write(tx common.SQLTx, events []common.DomainEvent) error
+}
+
+// New returns a sink that writes to all sinks enabled in the config. External sinks
+// are fed by relays (see NewRelays).
+func New(cfg *common.DwhCommonServiceConfig) Sink {
+	sinks := []Sink{NewPostgres()}
+	if cfg.WebhooksEnabled {
+		sinks = append(sinks, webhooks.NewSink())
+	}
+
+	return Fanout(sinks...)
+}
+
+type fanout []Sink
+
+// Fanout returns a sink that writes events to all the given sinks, one after another
+// (a transaction can not be used concurrently). Write fails if any of the sinks fails.
+func Fanout(sinks ...Sink) Sink {
+	return fanout(sinks)
+}
+
+func (f fanout) Write(tx common.SQLTx, events []common.DomainEvent) error {
+	for _, sink := range f {
+		if err := sink.Write(tx, events); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type postgres struct{}
+
+// NewPostgres returns a sink that stores events in the domain_events table.
+func NewPostgres() Sink {
+	return postgres{}
+}
+
+func (postgres) Write(tx common.SQLTx, events []common.DomainEvent) error {
+	now := time.Now()
+	for _, event := range events {
+		if _, err := tx.Exec(`INSERT INTO domain_events
+			(created_at, updated_at, chain_id, type, msg_type, height, time, tx_hash, msg_index, event_index,
+			denom, token_id, sender, recipient, amount)
+			VALUES ($1, $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`,
+			now, event.ChainID, event.Type, event.MsgType, event.Height, event.Time, event.TxHash, event.MsgIndex,
+			event.EventIndex, event.Denom, event.TokenID, event.Sender, event.Recipient, event.Amount); err != nil {
+			return fmt.Errorf("failed to store %s event: %v", event.Type, err)
+		}
+	}
+
+	return nil
+}
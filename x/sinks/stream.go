@@ -0,0 +1,87 @@
+package sinks
+
+import (
+	"encoding/json"
+	"fmt"
+
+	common "github.com/corestario/dwh/x/common"
+)
+
+// Broker publishes messages to a topic. Messages with the same key must be delivered in
+// the order they are published.
+type Broker interface {
+	Publish(topic string, messages []Message) error
+	Close() error
+}
+
+// Message is a message published to a broker.
+type Message struct {
+	Key   string
+	Value []byte
+}
+
+// Stream is an exporter (see Relay) that publishes typed, versioned events (see
+// common.StreamEvent) to a broker, keyed by token, so the events of a token are consumed
+// in order.
+type Stream struct {
+	broker Broker
+	topic  string
+}
+
+// NewStream returns a stream that publishes events to the topic of the broker.
+func NewStream(broker Broker, cfg common.StreamCfg) *Stream {
+	return &Stream{broker: broker, topic: cfg.StreamTopic}
+}
+
+// newBroker returns the broker of the config, or nil if the stream is disabled.
+func newBroker(cfg common.StreamCfg) (Broker, error) {
+	switch cfg.StreamBroker {
+	case "":
+		return nil, nil
+	case "kafka":
+		return NewKafka(cfg.StreamKafkaRestURL), nil
+	case "nats":
+		return NewNATS(cfg.StreamNATSAddr, cfg.StreamNATSUser, cfg.StreamNATSPassword), nil
+	}
+
+	return nil, fmt.Errorf("unknown broker %q", cfg.StreamBroker)
+}
+
+// Export publishes the events that have a stream type. It fails unless the broker
+// accepts all of them.
+func (s *Stream) Export(events []common.DomainEvent) error {
+	messages := make([]Message, 0, len(events))
+	for _, event := range events {
+		streamEvent, ok, err := common.NewStreamEvent(event)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		value, err := json.Marshal(streamEvent)
+		if err != nil {
+			return fmt.Errorf("failed to encode %s event: %v", streamEvent.Type, err)
+		}
+		messages = append(messages, Message{Key: streamKey(event), Value: value})
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+
+	return s.broker.Publish(s.topic, messages)
+}
+
+// Close closes the broker.
+func (s *Stream) Close() error {
+	return s.broker.Close()
+}
+
+// streamKey returns the key of the event: the token, or the denom of fungible tokens.
+func streamKey(event common.DomainEvent) string {
+	if event.TokenID == "" {
+		return event.ChainID + "/" + event.Denom
+	}
+
+	return event.ChainID + "/" + event.Denom + "/" + event.TokenID
+}
@@ -0,0 +1,144 @@
+package sinks
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	common "github.com/corestario/dwh/x/common"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamKafka(t *testing.T) {
+	requests := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- r.URL.Path + " " + string(body)
+		if len(requests) == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"offsets":[{"partition":0,"offset":1},{"partition":1,"offset":1},{"partition":0,"offset":2}]}`)
+	}))
+	defer server.Close()
+
+	stream := NewStream(NewKafka(server.URL), common.DefaultDwhCommonServiceConfig().StreamCfg)
+
+	blockTime := time.Date(2020, 5, 1, 12, 30, 0, 0, time.UTC)
+	events := []common.DomainEvent{
+		{ChainID: "mpchain", Type: common.DomainEventBid, MsgType: "make_offer", Height: 7, Time: blockTime,
+			TxHash: "ABC", MsgIndex: 1, Denom: "cards", TokenID: "1", Sender: "buyer", Amount: "7gold"},
+		{ChainID: "mpchain", Type: common.DomainEventSale, MsgType: "accept_offer", Height: 7, Time: blockTime,
+			TxHash: "ABC", MsgIndex: 1, EventIndex: 1, Denom: "cards", TokenID: "1", Sender: "seller", Recipient: "buyer", Amount: "7gold"},
+		{ChainID: "mpchain", Type: common.DomainEventTransfer, MsgType: "transfer_fungible_tokens", Height: 8, Time: blockTime,
+			TxHash: "DEF", Denom: "gold", Sender: "buyer", Recipient: "seller", Amount: "3gold"},
+		{ChainID: "mpchain", Type: "unknown", Height: 8, TxHash: "DEF"},
+	}
+	// The first request fails, so the relay exports the events again.
+	require.Error(t, stream.Export(events))
+	require.NoError(t, stream.Export(events))
+	require.NoError(t, stream.Close())
+
+	require.Equal(t, 2, len(requests))
+	<-requests
+	request := strings.SplitN(<-requests, " ", 2)
+	require.Equal(t, "/topics/dwh.events", request[0])
+
+	var body struct {
+		Records []struct {
+			Key   string
+			Value common.StreamEvent
+		}
+	}
+	require.NoError(t, json.Unmarshal([]byte(request[1]), &body))
+	require.Equal(t, 3, len(body.Records))
+	require.Equal(t, "mpchain/cards/1", body.Records[0].Key)
+	require.Equal(t, "mpchain/cards/1", body.Records[1].Key)
+	require.Equal(t, "mpchain/gold", body.Records[2].Key)
+
+	event := body.Records[1].Value
+	require.Equal(t, "mpchain/ABC/1/1", event.ID)
+	require.Equal(t, common.StreamEventNFTSold, event.Type)
+	require.Equal(t, 1, event.Version)
+	require.Equal(t, int64(7), event.Height)
+	require.Equal(t, "ABC", event.TxHash)
+	require.True(t, blockTime.Equal(event.Time))
+	var sold common.NFTSoldData
+	require.NoError(t, json.Unmarshal(event.Data, &sold))
+	require.Equal(t, common.NFTSoldData{Denom: "cards", TokenID: "1", Seller: "seller", Buyer: "buyer", Price: "7gold"}, sold)
+	require.Equal(t, common.StreamEventOfferMade, body.Records[0].Value.Type)
+	require.Equal(t, common.StreamEventFungibleTransferred, body.Records[2].Value.Type)
+}
+
+func TestNATS(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	published := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveNATS(conn, published)
+		}
+	}()
+
+	broker := NewNATS(listener.Addr().String(), "user", "pass")
+	require.NoError(t, broker.Publish("dwh.events", []Message{{Key: "a", Value: []byte(`{"n":1}`)}, {Key: "a", Value: []byte(`{"n":2}`)}}))
+	require.Equal(t, `CONNECT {"lang":"go","name":"dwh","pass":"pass","pedantic":false,"user":"user","verbose":false}`, <-published)
+	require.Equal(t, `dwh.events {"n":1}`, <-published)
+	require.Equal(t, `dwh.events {"n":2}`, <-published)
+
+	// The server fails the connection, the next batch is published over a new one.
+	require.Error(t, broker.Publish("dwh.events", []Message{{Value: []byte("fail")}}))
+	require.NoError(t, broker.Publish("dwh.events", []Message{{Value: []byte(`{"n":3}`)}}))
+	<-published
+	require.Equal(t, `dwh.events {"n":3}`, <-published)
+	require.NoError(t, broker.Close())
+}
+
+// serveNATS serves the subset of the NATS protocol used by the broker, sending
+// CONNECT options and published messages to the channel. Messages with the "fail"
+// payload are rejected.
+func serveNATS(conn net.Conn, published chan<- string) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	fmt.Fprint(conn, "INFO {\"max_payload\":1048576}\r\n")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "CONNECT":
+			published <- strings.TrimSpace(line)
+		case "PING":
+			fmt.Fprint(conn, "PING\r\nPONG\r\n")
+		case "PONG":
+		case "PUB":
+			size, _ := strconv.Atoi(fields[2])
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, payload); err != nil {
+				return
+			}
+			if string(payload[:size]) == "fail" {
+				fmt.Fprint(conn, "-ERR 'Permissions Violation'\r\n")
+				return
+			}
+			published <- fields[1] + " " + string(payload[:size])
+		}
+	}
+}
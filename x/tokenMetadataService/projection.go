@@ -0,0 +1,137 @@
+package tokenMetadataService
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	dwh_common "github.com/corestario/dwh/x/common"
+	"github.com/jinzhu/gorm"
+)
+
+// erc721Attribute is an attribute as OpenSea-style metadata lists them.
+type erc721Attribute struct {
+	TraitType   json.RawMessage `json:"trait_type"`
+	Value       json.RawMessage `json:"value"`
+	DisplayType json.RawMessage `json:"display_type"`
+}
+
+// projectMetadata returns the Postgres projection of the metadata of a token (see
+// dwh_common.NFTMetadata). Attributes without a value are skipped.
+func projectMetadata(tokenInfo *dwh_common.TaskInfo, metadataBytes []byte, isValid bool, fetchedAt time.Time) (*dwh_common.NFTMetadata, []dwh_common.NFTAttribute, error) {
+	var fields struct {
+		Name        json.RawMessage `json:"name"`
+		Description json.RawMessage `json:"description"`
+		Image       json.RawMessage `json:"image"`
+		ExternalURL json.RawMessage `json:"external_url"`
+		Attributes  json.RawMessage `json:"attributes"`
+	}
+	if err := json.Unmarshal(metadataBytes, &fields); err != nil {
+		return nil, nil, fmt.Errorf("could not unmarshal metadata, error: %+v", err)
+	}
+
+	metadata := &dwh_common.NFTMetadata{
+		Denom:       tokenInfo.Denom,
+		TokenID:     tokenInfo.TokenID,
+		Name:        jsonString(fields.Name),
+		Description: jsonString(fields.Description),
+		Image:       jsonString(fields.Image),
+		ExternalURL: jsonString(fields.ExternalURL),
+		FetchedAt:   fetchedAt,
+		ValidERC721: isValid,
+	}
+
+	// Attributes that are not a list of objects are not projected, as the metadata of
+	// tokens that do not follow the schema may have anything there.
+	var list []json.RawMessage
+	if err := json.Unmarshal(fields.Attributes, &list); err != nil {
+		return metadata, nil, nil
+	}
+	var attributes []dwh_common.NFTAttribute
+	for _, item := range list {
+		var attribute erc721Attribute
+		if err := json.Unmarshal(item, &attribute); err != nil {
+			continue
+		}
+		value := jsonText(attribute.Value)
+		if value == "" {
+			continue
+		}
+		attributes = append(attributes, dwh_common.NFTAttribute{
+			Denom:       tokenInfo.Denom,
+			TokenID:     tokenInfo.TokenID,
+			TraitType:   jsonString(attribute.TraitType),
+			Value:       value,
+			DisplayType: jsonString(attribute.DisplayType),
+		})
+	}
+
+	return metadata, attributes, nil
+}
+
+// jsonString returns the JSON value if it is a string, and an empty string otherwise.
+func jsonString(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return ""
+	}
+	return s
+}
+
+// jsonText returns the JSON value as text: a string as it is, null as an empty string
+// and any other value as compact JSON.
+func jsonText(raw json.RawMessage) string {
+	if len(raw) == 0 || string(raw) == "null" {
+		return ""
+	}
+	if s := jsonString(raw); s != "" || raw[0] == '"' {
+		return s
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, raw); err != nil {
+		return ""
+	}
+	return buf.String()
+}
+
+// saveMetadataProjection replaces the projection of the metadata of a token.
+func saveMetadataProjection(db *gorm.DB, metadata *dwh_common.NFTMetadata, attributes []dwh_common.NFTAttribute) error {
+	tx := db.New().Begin()
+	if err := saveProjection(tx, metadata, attributes); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return fmt.Errorf("could not commit transaction, error: %+v", err)
+	}
+
+	return nil
+}
+
+func saveProjection(tx *gorm.DB, metadata *dwh_common.NFTMetadata, attributes []dwh_common.NFTAttribute) error {
+	// Workers may fetch the metadata of a token concurrently, so the row is upserted by
+	// its key rather than looked up first.
+	if err := tx.Exec(`INSERT INTO nft_metadata
+		(denom, token_id, name, description, image, external_url, fetched_at, valid_erc721)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (denom, token_id) DO UPDATE SET
+			name = EXCLUDED.name, description = EXCLUDED.description, image = EXCLUDED.image,
+			external_url = EXCLUDED.external_url, fetched_at = EXCLUDED.fetched_at,
+			valid_erc721 = EXCLUDED.valid_erc721`,
+		metadata.Denom, metadata.TokenID, metadata.Name, metadata.Description, metadata.Image,
+		metadata.ExternalURL, metadata.FetchedAt, metadata.ValidERC721).Error; err != nil {
+		return fmt.Errorf("could not upsert nft_metadata, error: %+v", err)
+	}
+	if err := tx.Where("denom = ? AND token_id = ?", metadata.Denom, metadata.TokenID).
+		Delete(&dwh_common.NFTAttribute{}).Error; err != nil {
+		return fmt.Errorf("could not delete nft_attributes, error: %+v", err)
+	}
+	for i := range attributes {
+		if err := tx.Create(&attributes[i]).Error; err != nil {
+			return fmt.Errorf("could not insert nft_attributes, error: %+v", err)
+		}
+	}
+
+	return nil
+}
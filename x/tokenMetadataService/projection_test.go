@@ -0,0 +1,57 @@
+package tokenMetadataService
+
+import (
+	"testing"
+	"time"
+
+	dwh_common "github.com/corestario/dwh/x/common"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProjectMetadata(t *testing.T) {
+	info := &dwh_common.TaskInfo{Denom: "cards", TokenID: "7", Owner: "cosmos1owner", URL: "http://tokens/7"}
+	fetchedAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	metadata, attributes, err := projectMetadata(info, []byte(`{
+		"name": "Red dragon",
+		"description": 42,
+		"image": "http://images/7.png",
+		"external_url": "http://cards/7",
+		"attributes": [
+			{"trait_type": "color", "value": "red"},
+			{"trait_type": "level", "value": 5, "display_type": "number"},
+			{"trait_type": "boost", "value": 1.50},
+			{"trait_type": "legendary", "value": true},
+			{"trait_type": "empty", "value": null},
+			{"value": "untyped"},
+			"invalid"
+		]
+	}`), true, fetchedAt)
+	require.NoError(t, err)
+	require.Equal(t, &dwh_common.NFTMetadata{
+		Denom:       "cards",
+		TokenID:     "7",
+		Name:        "Red dragon",
+		Image:       "http://images/7.png",
+		ExternalURL: "http://cards/7",
+		FetchedAt:   fetchedAt,
+		ValidERC721: true,
+	}, metadata)
+	require.Equal(t, []dwh_common.NFTAttribute{
+		{Denom: "cards", TokenID: "7", TraitType: "color", Value: "red"},
+		{Denom: "cards", TokenID: "7", TraitType: "level", Value: "5", DisplayType: "number"},
+		{Denom: "cards", TokenID: "7", TraitType: "boost", Value: "1.50"},
+		{Denom: "cards", TokenID: "7", TraitType: "legendary", Value: "true"},
+		{Denom: "cards", TokenID: "7", Value: "untyped"},
+	}, attributes)
+
+	// Attributes that are not a list are not projected.
+	metadata, attributes, err = projectMetadata(info, []byte(`{"name": "Red dragon", "attributes": {"color": "red"}}`), false, fetchedAt)
+	require.NoError(t, err)
+	require.Equal(t, "Red dragon", metadata.Name)
+	require.False(t, metadata.ValidERC721)
+	require.Empty(t, attributes)
+
+	_, _, err = projectMetadata(info, []byte(`[]`), false, fetchedAt)
+	require.Error(t, err)
+}
@@ -11,6 +11,7 @@ import (
 	"time"
 
 	dwh_common "github.com/corestario/dwh/x/common"
+	"github.com/jinzhu/gorm"
 	"github.com/xeipuuv/gojsonschema"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -26,6 +27,7 @@ type TokenMetadataWorker struct {
 	ctx                context.Context
 	erc721SchemaLoader gojsonschema.JSONLoader
 	imgSender          *dwh_common.RMQSender
+	db                 *gorm.DB
 }
 
 func NewTokenMetadataWorker(configFileName, configPath string) (*TokenMetadataWorker, error) {
@@ -43,6 +45,12 @@ func NewTokenMetadataWorker(configFileName, configPath string) (*TokenMetadataWo
 		return nil, fmt.Errorf("could not create rabbitMQ sender, error: %+v", err)
 	}
 
+	// Metadata is also projected into Postgres (see projectMetadata).
+	db, err := dwh_common.GetDB(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("could not establish database connection, error: %+v", err)
+	}
+
 	mongoClient, err := dwh_common.GetMongoClient(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("could not dial rabbitMQ, error: %+v", err)
@@ -62,6 +70,33 @@ func NewTokenMetadataWorker(configFileName, configPath string) (*TokenMetadataWo
 	}
 	stdLog.Println("created index:", s)
 
+	keys = bson.D{{Key: "dwhData.denom", Value: 1}, {Key: "dwhData.tokenID", Value: 1}}
+	s, err = mongoCollection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: keys}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("could not create MongoDB index, error: %+v", err)
+	}
+	stdLog.Println("created index:", s)
+
+	// The text index of the search API (see api.searchRequest). Metadata is in any
+	// language, so words are not stemmed, and the language of a document is not taken
+	// from its "language" field, which metadata may have with any value.
+	keys = bson.D{{Key: "name", Value: "text"}, {Key: "description", Value: "text"}, {Key: "attributes.value", Value: "text"}}
+	textOpts := options.Index().SetName("metadata_text").SetDefaultLanguage("none").
+		SetLanguageOverride("dwhTextLanguage").
+		SetWeights(bson.M{"name": 10, "attributes.value": 5, "description": 1})
+	s, err = mongoCollection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: keys, Options: textOpts}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("could not create MongoDB index, error: %+v", err)
+	}
+	stdLog.Println("created index:", s)
+
+	keys = bson.D{{Key: "attributes.trait_type", Value: 1}, {Key: "attributes.value", Value: 1}}
+	s, err = mongoCollection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: keys}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("could not create MongoDB index, error: %+v", err)
+	}
+	stdLog.Println("created index:", s)
+
 	return &TokenMetadataWorker{
 		client:             http.Client{Timeout: time.Second * 15},
 		receiver:           receiver,
@@ -70,6 +105,7 @@ func NewTokenMetadataWorker(configFileName, configPath string) (*TokenMetadataWo
 		ctx:                ctx,
 		erc721SchemaLoader: gojsonschema.NewStringLoader(erc721Schema),
 		imgSender:          imgSender,
+		db:                 db,
 		cfg:                cfg,
 	}, nil
 }
@@ -85,6 +121,9 @@ func (tmw *TokenMetadataWorker) Closer() error {
 	if err := tmw.mongoClient.Disconnect(tmw.ctx); err != nil {
 		return fmt.Errorf("could not disconnect MongoDB client, error: %+v", err)
 	}
+	if err := tmw.db.Close(); err != nil {
+		return fmt.Errorf("could not close database connection, error: %+v", err)
+	}
 	return nil
 }
 
@@ -139,12 +178,21 @@ func (tmw *TokenMetadataWorker) processMessage(msg []byte, priority dwh_common.I
 		return fmt.Errorf("could not unmarshal ext json, error: %+v", err)
 	}
 
+	fetchedAt := time.Now().UTC()
 	if err := tmw.upsertTokenMetadata(&rcvd, metadata); err != nil {
 		return fmt.Errorf("could not upsert token metadata, error: %+v", err)
 	}
 
+	projection, attributes, err := projectMetadata(&rcvd, metadataBytes, isValid, fetchedAt)
+	if err != nil {
+		return fmt.Errorf("could not project token metadata, error: %+v", err)
+	}
+	if err := saveMetadataProjection(tmw.db, projection, attributes); err != nil {
+		return fmt.Errorf("could not save token metadata projection, error: %+v", err)
+	}
+
 	if _, ok := metadata["image"]; isValid && ok {
-		if err := tmw.imgSender.Publish(metadata["image"].(string), rcvd.Owner, rcvd.TokenID, priority); err != nil {
+		if err := tmw.imgSender.Publish(metadata["image"].(string), rcvd.Owner, rcvd.Denom, rcvd.TokenID, priority); err != nil {
 			return fmt.Errorf("could not publish img task rabbitMQ, error: %+v", err)
 		}
 	}
@@ -180,7 +228,7 @@ func (tmw *TokenMetadataWorker) upsertTokenMetadata(tokenInfo *dwh_common.TaskIn
 		err         error
 	)
 
-	filter := map[string]interface{}{"dwhData.tokenID": tokenInfo.TokenID}
+	filter := map[string]interface{}{"dwhData.denom": tokenInfo.Denom, "dwhData.tokenID": tokenInfo.TokenID}
 
 	findOpts := []*options.FindOneOptions{{Projection: map[string]interface{}{"dwhData": 0, "_id": 0}}}
 	if err = tmw.mongoCollection.FindOne(tmw.ctx, filter, findOpts...).Decode(&oldMetaData); err != nil && err != mongo.ErrNoDocuments {
@@ -190,7 +238,12 @@ func (tmw *TokenMetadataWorker) upsertTokenMetadata(tokenInfo *dwh_common.TaskIn
 
 	dataForUpsert := make(map[string]interface{})
 	if !reflect.DeepEqual(metadata, oldMetaData) {
-		dwhData := map[string]interface{}{"tokenID": tokenInfo.TokenID, "owner": tokenInfo.Owner, "url": tokenInfo.URL}
+		dwhData := map[string]interface{}{
+			"denom":   tokenInfo.Denom,
+			"tokenID": tokenInfo.TokenID,
+			"owner":   tokenInfo.Owner,
+			"url":     tokenInfo.URL,
+		}
 		dwhData["lastUpdated"] = tNow
 		dwhData["lastChecked"] = tNow
 		metadata["dwhData"] = dwhData
@@ -208,3 +261,15 @@ func (tmw *TokenMetadataWorker) upsertTokenMetadata(tokenInfo *dwh_common.TaskIn
 
 	return nil
 }
+
+// MigrateDenom sets the denom of token metadata documents that were stored before
+// tokens were identified by (denom, token ID).
+func MigrateDenom(ctx context.Context, collection *mongo.Collection, denom, tokenID string) error {
+	filter := bson.M{"dwhData.tokenID": tokenID, "dwhData.denom": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{"dwhData.denom": denom}}
+	if _, err := collection.UpdateMany(ctx, filter, update); err != nil {
+		return fmt.Errorf("could not update many in mongo collection, error: %+v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,289 @@
+package webhooks
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	common "github.com/corestario/dwh/x/common"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/prometheus/common/log"
+)
+
+// Paths of the API.
+const (
+	SubscriptionsPath = "/webhooks/subscriptions"
+	SubscriptionPath  = "/webhooks/subscriptions/{id:[0-9]+}"
+	DeliveriesPath    = "/webhooks/subscriptions/{id:[0-9]+}/deliveries"
+	RetryPath         = "/webhooks/deliveries/{id:[0-9]+}/retry"
+)
+
+// maxDeliveries is the max number of deliveries returned by the API.
+const maxDeliveries = 500
+
+// API is the REST API that manages subscriptions and shows their deliveries. Secrets
+// are only returned when subscriptions are created (or their secrets are changed).
+type API struct {
+	db  *gorm.DB
+	cfg common.WebhooksCfg
+}
+
+func NewAPI(db *gorm.DB, cfg common.WebhooksCfg) *API {
+	return &API{db: db, cfg: cfg}
+}
+
+// Register adds the routes of the API to the router.
+func (a *API) Register(router *mux.Router) {
+	routes := router.NewRoute().Subrouter()
+	routes.Use(a.authenticate)
+	routes.HandleFunc(SubscriptionsPath, a.createSubscription).Methods(http.MethodPost)
+	routes.HandleFunc(SubscriptionsPath, a.listSubscriptions).Methods(http.MethodGet)
+	routes.HandleFunc(SubscriptionPath, a.getSubscription).Methods(http.MethodGet)
+	routes.HandleFunc(SubscriptionPath, a.updateSubscription).Methods(http.MethodPut)
+	routes.HandleFunc(SubscriptionPath, a.deleteSubscription).Methods(http.MethodDelete)
+	routes.HandleFunc(DeliveriesPath, a.listDeliveries).Methods(http.MethodGet)
+	routes.HandleFunc(RetryPath, a.retryDelivery).Methods(http.MethodPost)
+}
+
+func (a *API) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.cfg.WebhooksAPIKey != "" && subtle.ConstantTimeCompare(
+			[]byte(r.Header.Get("Authorization")), []byte("Bearer "+a.cfg.WebhooksAPIKey)) != 1 {
+			writeError(w, http.StatusUnauthorized, "invalid API key")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// subscriptionRequest is the body of requests that create or update subscriptions.
+// Active defaults to true; a secret is generated if none is given on creation.
+type subscriptionRequest struct {
+	ChainID    string   `json:"chain_id"`
+	URL        string   `json:"url"`
+	Secret     string   `json:"secret"`
+	Address    string   `json:"address"`
+	Denom      string   `json:"denom"`
+	TokenID    string   `json:"token_id"`
+	EventTypes []string `json:"event_types"`
+	Active     *bool    `json:"active"`
+}
+
+// apply validates the request and sets the fields of the subscription.
+func (req *subscriptionRequest) apply(subscription *common.WebhookSubscription) error {
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url %q", req.URL)
+	}
+	for _, eventType := range req.EventTypes {
+		if _, ok := common.StreamEventVersions[eventType]; !ok {
+			return fmt.Errorf("unknown event type %q", eventType)
+		}
+	}
+	subscription.ChainID, subscription.URL, subscription.Address, subscription.Denom, subscription.TokenID =
+		req.ChainID, req.URL, req.Address, req.Denom, req.TokenID
+	subscription.EventTypes = pq.StringArray(req.EventTypes)
+	if subscription.EventTypes == nil {
+		subscription.EventTypes = pq.StringArray{}
+	}
+	if req.Active != nil {
+		subscription.Active = *req.Active
+	}
+	if req.Secret != "" {
+		subscription.Secret = req.Secret
+	}
+
+	return nil
+}
+
+func (a *API) createSubscription(w http.ResponseWriter, r *http.Request) {
+	var req subscriptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid body")
+		return
+	}
+	subscription := &common.WebhookSubscription{Active: true}
+	if err := req.apply(subscription); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if subscription.Secret == "" {
+		secret, err := newSecret()
+		if err != nil {
+			log.Errorf("failed to generate webhook secret: %v", err)
+			writeError(w, http.StatusInternalServerError, "failed to generate secret")
+			return
+		}
+		subscription.Secret = secret
+	}
+	if err := a.db.New().Create(subscription).Error; err != nil {
+		log.Errorf("failed to create webhook subscription: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to create subscription")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, subscription)
+}
+
+func (a *API) listSubscriptions(w http.ResponseWriter, r *http.Request) {
+	subscriptions := []common.WebhookSubscription{}
+	if err := a.db.New().Order("id").Find(&subscriptions).Error; err != nil {
+		log.Errorf("failed to get webhook subscriptions: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to get subscriptions")
+		return
+	}
+	for i := range subscriptions {
+		subscriptions[i].Secret = ""
+	}
+
+	writeJSON(w, http.StatusOK, subscriptions)
+}
+
+func (a *API) getSubscription(w http.ResponseWriter, r *http.Request) {
+	subscription, ok := a.findSubscription(w, r)
+	if !ok {
+		return
+	}
+	subscription.Secret = ""
+
+	writeJSON(w, http.StatusOK, subscription)
+}
+
+func (a *API) updateSubscription(w http.ResponseWriter, r *http.Request) {
+	subscription, ok := a.findSubscription(w, r)
+	if !ok {
+		return
+	}
+	var req subscriptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid body")
+		return
+	}
+	if err := req.apply(subscription); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := a.db.New().Save(subscription).Error; err != nil {
+		log.Errorf("failed to update webhook subscription #%d: %v", subscription.ID, err)
+		writeError(w, http.StatusInternalServerError, "failed to update subscription")
+		return
+	}
+	if req.Secret == "" {
+		subscription.Secret = ""
+	}
+
+	writeJSON(w, http.StatusOK, subscription)
+}
+
+// deleteSubscription deletes the subscription along with its deliveries.
+func (a *API) deleteSubscription(w http.ResponseWriter, r *http.Request) {
+	subscription, ok := a.findSubscription(w, r)
+	if !ok {
+		return
+	}
+	if err := a.db.New().Delete(subscription).Error; err != nil {
+		log.Errorf("failed to delete webhook subscription #%d: %v", subscription.ID, err)
+		writeError(w, http.StatusInternalServerError, "failed to delete subscription")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listDeliveries returns the latest deliveries of the subscription, optionally with the
+// given status ("status" parameter), up to "limit" (100 by default).
+func (a *API) listDeliveries(w http.ResponseWriter, r *http.Request) {
+	subscription, ok := a.findSubscription(w, r)
+	if !ok {
+		return
+	}
+	limit := 100
+	if value := r.FormValue("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 || limit > maxDeliveries {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("limit must be from 1 to %d", maxDeliveries))
+			return
+		}
+	}
+	query := a.db.New().Where("subscription_id = ?", subscription.ID)
+	if status := r.FormValue("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	deliveries := []common.WebhookDelivery{}
+	if err := query.Order("id DESC").Limit(limit).Find(&deliveries).Error; err != nil {
+		log.Errorf("failed to get deliveries of webhook subscription #%d: %v", subscription.ID, err)
+		writeError(w, http.StatusInternalServerError, "failed to get deliveries")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, deliveries)
+}
+
+// retryDelivery schedules a delivery (e.g., a failed one) to be attempted again now.
+func (a *API) retryDelivery(w http.ResponseWriter, r *http.Request) {
+	var delivery common.WebhookDelivery
+	err := a.db.New().Where("id = ?", mux.Vars(r)["id"]).First(&delivery).Error
+	if gorm.IsRecordNotFoundError(err) {
+		writeError(w, http.StatusNotFound, "delivery not found")
+		return
+	}
+	if err == nil {
+		err = a.db.New().Model(&delivery).UpdateColumns(map[string]interface{}{
+			"status":          common.WebhookDeliveryPending,
+			"next_attempt_at": time.Now(),
+		}).Error
+	}
+	if err != nil {
+		log.Errorf("failed to retry webhook delivery #%s: %v", mux.Vars(r)["id"], err)
+		writeError(w, http.StatusInternalServerError, "failed to retry delivery")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, delivery)
+}
+
+// findSubscription returns the subscription of the request, or writes an error.
+func (a *API) findSubscription(w http.ResponseWriter, r *http.Request) (*common.WebhookSubscription, bool) {
+	var subscription common.WebhookSubscription
+	err := a.db.New().Where("id = ?", mux.Vars(r)["id"]).First(&subscription).Error
+	if gorm.IsRecordNotFoundError(err) {
+		writeError(w, http.StatusNotFound, "subscription not found")
+		return nil, false
+	}
+	if err != nil {
+		log.Errorf("failed to get webhook subscription #%s: %v", mux.Vars(r)["id"], err)
+		writeError(w, http.StatusInternalServerError, "failed to get subscription")
+		return nil, false
+	}
+
+	return &subscription, true
+}
+
+func newSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(secret), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Errorf("failed to write response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,202 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	common "github.com/corestario/dwh/x/common"
+	"github.com/jinzhu/gorm"
+	"github.com/prometheus/common/log"
+)
+
+// Dispatcher posts pending deliveries to the URLs of their subscriptions. The
+// deliveries of a subscription are posted in order, one at a time, while subscriptions
+// are served in parallel; a delivery that fails holds back the next deliveries of its
+// subscription until the next dispatch. It must run in a single process.
+type Dispatcher struct {
+	db     *gorm.DB
+	cfg    common.WebhooksCfg
+	client *http.Client
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func NewDispatcher(db *gorm.DB, cfg common.WebhooksCfg) *Dispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Dispatcher{
+		db:     db,
+		cfg:    cfg,
+		client: &http.Client{Timeout: time.Duration(cfg.WebhooksTimeoutSeconds) * time.Second},
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+}
+
+// Start runs the dispatcher until Stop is called.
+func (d *Dispatcher) Start() {
+	go func() {
+		defer close(d.done)
+		ticker := time.NewTicker(time.Duration(d.cfg.WebhooksDispatchIntervalSeconds) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.ctx.Done():
+				return
+			case <-ticker.C:
+				d.dispatch()
+			}
+		}
+	}()
+}
+
+// Stop stops the dispatcher once the current deliveries are done.
+func (d *Dispatcher) Stop() {
+	d.cancel()
+	<-d.done
+}
+
+// dispatch posts the pending deliveries that are due, in batches. Deliveries that follow
+// a pending delivery that is not due yet (i.e., that failed and is backing off) are
+// held back; the due ones that precede a delivery are in its batch, since batches are
+// ordered.
+func (d *Dispatcher) dispatch() {
+	for d.ctx.Err() == nil {
+		var batch []common.WebhookDelivery
+		now := time.Now()
+		if err := d.db.New().Select("webhook_deliveries.*").
+			Joins("JOIN webhook_subscriptions ON webhook_subscriptions.id = webhook_deliveries.subscription_id").
+			Where("webhook_subscriptions.active AND webhook_deliveries.status = ? AND webhook_deliveries.next_attempt_at <= ?",
+				common.WebhookDeliveryPending, now).
+			Where(`NOT EXISTS (SELECT 1 FROM webhook_deliveries earlier
+				WHERE earlier.subscription_id = webhook_deliveries.subscription_id AND earlier.id < webhook_deliveries.id
+				AND earlier.status = ? AND earlier.next_attempt_at > ?)`,
+				common.WebhookDeliveryPending, now).
+			Order("webhook_deliveries.id").Limit(d.cfg.WebhooksBatchSize).Find(&batch).Error; err != nil {
+			log.Errorf("failed to get pending webhook deliveries: %v", err)
+			return
+		}
+		if len(batch) == 0 {
+			return
+		}
+
+		var (
+			ids     []uint
+			pending = map[uint][]common.WebhookDelivery{}
+		)
+		for _, delivery := range batch {
+			if _, ok := pending[delivery.SubscriptionID]; !ok {
+				ids = append(ids, delivery.SubscriptionID)
+			}
+			pending[delivery.SubscriptionID] = append(pending[delivery.SubscriptionID], delivery)
+		}
+		var subscriptions []common.WebhookSubscription
+		if err := d.db.New().Where("id IN (?)", ids).Find(&subscriptions).Error; err != nil {
+			log.Errorf("failed to get webhook subscriptions: %v", err)
+			return
+		}
+
+		var wg sync.WaitGroup
+		for _, subscription := range subscriptions {
+			wg.Add(1)
+			go func(subscription common.WebhookSubscription) {
+				defer wg.Done()
+				for _, delivery := range pending[subscription.ID] {
+					if !d.deliver(subscription, delivery) {
+						return
+					}
+				}
+			}(subscription)
+		}
+		wg.Wait()
+
+		if len(batch) < d.cfg.WebhooksBatchSize {
+			return
+		}
+	}
+}
+
+// deliver makes an attempt to post the delivery and records its result. It reports
+// whether the delivery succeeded.
+func (d *Dispatcher) deliver(subscription common.WebhookSubscription, delivery common.WebhookDelivery) bool {
+	statusCode, err := d.post(subscription, delivery)
+	now := time.Now()
+	update := map[string]interface{}{
+		"attempts":         delivery.Attempts + 1,
+		"last_status_code": statusCode,
+		"last_error":       "",
+	}
+	switch {
+	case err == nil:
+		update["status"], update["delivered_at"] = common.WebhookDeliveryDelivered, now
+	case delivery.Attempts+1 >= d.cfg.WebhooksMaxAttempts:
+		update["status"], update["last_error"] = common.WebhookDeliveryFailed, err.Error()
+	default:
+		maxBackoff := time.Duration(d.cfg.WebhooksMaxBackoffSeconds) * time.Second
+		update["next_attempt_at"] = now.Add(backoff(delivery.Attempts+1, maxBackoff))
+		update["last_error"] = err.Error()
+	}
+	if err != nil {
+		log.Errorf("failed to deliver %s to webhook subscription #%d (attempt %d): %v",
+			delivery.EventID, subscription.ID, delivery.Attempts+1, err)
+	}
+	if err := d.db.New().Model(&delivery).UpdateColumns(update).Error; err != nil {
+		log.Errorf("failed to update webhook delivery #%d: %v", delivery.ID, err)
+		return false
+	}
+
+	return err == nil
+}
+
+// post posts the payload of the delivery and returns the status code of the response.
+// Responses other than 2xx are errors.
+func (d *Dispatcher) post(subscription common.WebhookSubscription, delivery common.WebhookDelivery) (int, error) {
+	body := []byte(delivery.Payload)
+	timestamp := time.Now().Unix()
+	req, err := http.NewRequest(http.MethodPost, subscription.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "dwh-webhooks")
+	req.Header.Set(HeaderEvent, delivery.EventType)
+	req.Header.Set(HeaderDelivery, strconv.FormatUint(uint64(delivery.ID), 10))
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, signaturePrefix+Sign(subscription.Secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return resp.StatusCode, nil
+}
+
+// backoff returns the delay before the next attempt after the given number of attempts:
+// ten seconds, doubled with every attempt, up to max.
+func backoff(attempts int, max time.Duration) time.Duration {
+	delay := 10 * time.Second
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		return max
+	}
+
+	return delay
+}
@@ -0,0 +1,67 @@
+package webhooks
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	common "github.com/corestario/dwh/x/common"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPost(t *testing.T) {
+	const secret = "s3cret"
+	var status = http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := Verify(secret, r.Header.Get(HeaderSignature), r.Header.Get(HeaderTimestamp), body, time.Minute); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		require.Equal(t, common.StreamEventNFTSold, r.Header.Get(HeaderEvent))
+		require.Equal(t, "42", r.Header.Get(HeaderDelivery))
+		require.Equal(t, `{"id":"mpchain/ABC/0/1"}`, string(body))
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	d := NewDispatcher(nil, common.DefaultDwhCommonServiceConfig().WebhooksCfg)
+	subscription := common.WebhookSubscription{ID: 1, URL: server.URL, Secret: secret}
+	delivery := common.WebhookDelivery{ID: 42, EventType: common.StreamEventNFTSold, Payload: `{"id":"mpchain/ABC/0/1"}`}
+
+	code, err := d.post(subscription, delivery)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, code)
+
+	status = http.StatusInternalServerError
+	code, err = d.post(subscription, delivery)
+	require.Error(t, err)
+	require.Equal(t, http.StatusInternalServerError, code)
+
+	subscription.Secret = "other"
+	code, err = d.post(subscription, delivery)
+	require.Error(t, err)
+	require.Equal(t, http.StatusUnauthorized, code)
+}
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"type":"BidPlaced"}`)
+	now := time.Now().Unix()
+	signature := signaturePrefix + Sign("secret", now, body)
+	require.NoError(t, Verify("secret", signature, strconv.FormatInt(now, 10), body, time.Minute))
+	require.Error(t, Verify("secret", signature, strconv.FormatInt(now, 10), []byte(`{}`), time.Minute))
+	require.Error(t, Verify("secret", signature, strconv.FormatInt(now+1, 10), body, time.Minute))
+	require.Error(t, Verify("secret", Sign("secret", now, body), strconv.FormatInt(now, 10), body, time.Minute))
+
+	old := now - 3600
+	require.Error(t, Verify("secret", signaturePrefix+Sign("secret", old, body), strconv.FormatInt(old, 10), body, time.Minute))
+}
+
+func TestBackoff(t *testing.T) {
+	require.Equal(t, 10*time.Second, backoff(1, time.Hour))
+	require.Equal(t, 80*time.Second, backoff(4, time.Hour))
+	require.Equal(t, time.Hour, backoff(20, time.Hour))
+}
@@ -0,0 +1,58 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers of deliveries.
+const (
+	HeaderEvent     = "X-DWH-Event"     // Type of the event.
+	HeaderDelivery  = "X-DWH-Delivery"  // ID of the delivery, the same for all its attempts.
+	HeaderTimestamp = "X-DWH-Timestamp" // Unix time of the attempt.
+	HeaderSignature = "X-DWH-Signature" // "sha256=" followed by the signature (see Sign).
+)
+
+const signaturePrefix = "sha256="
+
+// Sign returns the signature of a delivery: the hex-encoded HMAC-SHA256, keyed with the
+// secret of the subscription, of the timestamp, a dot and the body. The timestamp lets
+// receivers reject replayed deliveries.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature and timestamp headers of a delivery with the given body.
+// Deliveries that were signed more than tolerance ago (or ahead) are rejected.
+func Verify(secret, signatureHeader, timestampHeader string, body []byte, tolerance time.Duration) error {
+	timestamp, err := strconv.ParseInt(timestampHeader, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %q", timestampHeader)
+	}
+	if age := time.Since(time.Unix(timestamp, 0)); age > tolerance || age < -tolerance {
+		return fmt.Errorf("timestamp is out of tolerance")
+	}
+	if !strings.HasPrefix(signatureHeader, signaturePrefix) {
+		return fmt.Errorf("invalid signature %q", signatureHeader)
+	}
+	signature, err := hex.DecodeString(strings.TrimPrefix(signatureHeader, signaturePrefix))
+	if err != nil {
+		return fmt.Errorf("invalid signature %q", signatureHeader)
+	}
+	expected, _ := hex.DecodeString(Sign(secret, timestamp, body))
+	if !hmac.Equal(signature, expected) {
+		return fmt.Errorf("signature mismatch")
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+// Package webhooks notifies partners of marketplace activity. Subscriptions (see
+// common.WebhookSubscription) are managed through a REST API; the indexer queues a
+// delivery for every stream event (see common.StreamEvent) that matches a subscription,
+// in the transaction of its message (see Sink), and a dispatcher posts the deliveries,
+// signed with the secret of the subscription, retrying them with exponential backoff.
+package webhooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	common "github.com/corestario/dwh/x/common"
+)
+
+// Sink is a sink of domain events (see package sinks) that queues deliveries of the
+// events that match subscriptions in the transaction of their message, so deliveries
+// are queued if and only if the message is committed. Events that were already queued
+// for a subscription (e.g., when a message is indexed again) are not queued again.
+type Sink struct{}
+
+func NewSink() *Sink {
+	return &Sink{}
+}
+
+func (s *Sink) Write(tx common.SQLTx, events []common.DomainEvent) error {
+	for _, event := range events {
+		streamEvent, ok, err := common.NewStreamEvent(event)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		subscriptions, err := s.match(tx, event, streamEvent.Type)
+		if err != nil {
+			return err
+		}
+		if len(subscriptions) == 0 {
+			continue
+		}
+		payload, err := json.Marshal(streamEvent)
+		if err != nil {
+			return fmt.Errorf("failed to encode %s event: %v", streamEvent.Type, err)
+		}
+		now := time.Now()
+		for _, id := range subscriptions {
+			if _, err := tx.Exec(`INSERT INTO webhook_deliveries
+				(created_at, chain_id, subscription_id, event_id, event_type, payload, status, attempts, next_attempt_at)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, 0, $1)
+				ON CONFLICT (subscription_id, event_id) DO NOTHING`,
+				now, event.ChainID, id, streamEvent.ID, streamEvent.Type, string(payload),
+				common.WebhookDeliveryPending); err != nil {
+				return fmt.Errorf("failed to queue delivery of %s to subscription #%d: %v", streamEvent.ID, id, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// match returns the IDs of the active subscriptions that match the event.
+func (s *Sink) match(tx common.SQLTx, event common.DomainEvent, eventType string) ([]uint, error) {
+	rows, err := tx.Query(`SELECT id FROM webhook_subscriptions
+		WHERE active
+		AND (chain_id = '' OR chain_id = $6)
+		AND (address = '' OR address IN ($1, $2))
+		AND (denom = '' OR denom = $3)
+		AND (token_id = '' OR token_id = $4)
+		AND (COALESCE(cardinality(event_types), 0) = 0 OR $5 = ANY(event_types))`,
+		event.Sender, event.Recipient, event.Denom, event.TokenID, eventType, event.ChainID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to match subscriptions: %v", err)
+	}
+	defer rows.Close()
+
+	var ids []uint
+	for rows.Next() {
+		var id uint
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to match subscriptions: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to match subscriptions: %v", err)
+	}
+
+	return ids, nil
+}